@@ -13,9 +13,11 @@ import (
 	"strings"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/scttfrdmn/aws-remote-access-patterns/examples/aws-cli-helper/internal/cache"
 	"github.com/scttfrdmn/aws-remote-access-patterns/examples/aws-cli-helper/internal/config"
 	"github.com/scttfrdmn/aws-remote-access-patterns/examples/aws-cli-helper/internal/providers"
+	"github.com/scttfrdmn/aws-remote-access-patterns/pkg/awsauth"
 )
 
 // Version information
@@ -24,15 +26,6 @@ const (
 	AppName = "aws-cli-helper"
 )
 
-// AWSCredentialResponse represents the JSON response expected by AWS CLI
-type AWSCredentialResponse struct {
-	Version         int    `json:"Version"`
-	AccessKeyID     string `json:"AccessKeyId"`
-	SecretAccessKey string `json:"SecretAccessKey"`
-	SessionToken    string `json:"SessionToken,omitempty"`
-	Expiration      string `json:"Expiration,omitempty"`
-}
-
 // EnvVarExport represents environment variable export format
 type EnvVarExport struct {
 	AccessKeyID     string
@@ -237,13 +230,13 @@ func (h *CliHelper) outputCredentials(creds *cache.Credentials, exportFormat boo
 	}
 
 	// AWS CLI JSON format
-	response := AWSCredentialResponse{
-		Version:         1,
+	response := awsauth.NewProcessCredentials(aws.Credentials{
 		AccessKeyID:     creds.AccessKeyID,
 		SecretAccessKey: creds.SecretAccessKey,
 		SessionToken:    creds.SessionToken,
-		Expiration:      creds.ExpiresAt.Format(time.RFC3339),
-	}
+		CanExpire:       !creds.ExpiresAt.IsZero(),
+		Expires:         creds.ExpiresAt,
+	})
 
 	encoder := json.NewEncoder(os.Stdout)
 	return encoder.Encode(response)
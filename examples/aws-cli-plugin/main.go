@@ -10,20 +10,11 @@ import (
 	"os"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/scttfrdmn/aws-remote-access-patterns/examples/aws-cli-plugin/internal/auth"
 	"github.com/scttfrdmn/aws-remote-access-patterns/examples/aws-cli-plugin/internal/config"
+	"github.com/scttfrdmn/aws-remote-access-patterns/pkg/awsauth"
 )
 
-// AWSCredentialResponse represents the credential response format expected by AWS CLI
-type AWSCredentialResponse struct {
-	Version         int    `json:"Version"`
-	AccessKeyID     string `json:"AccessKeyId"`
-	SecretAccessKey string `json:"SecretAccessKey"`
-	SessionToken    string `json:"SessionToken,omitempty"`
-	Expiration      string `json:"Expiration,omitempty"`
-}
-
 // PluginMetadata provides information about the plugin
 type PluginMetadata struct {
 	Name        string `json:"name"`
@@ -55,7 +46,9 @@ func main() {
 
 	switch command {
 	case "get-credentials":
-		handleGetCredentials()
+		if err := handleGetCredentials(); err != nil {
+			os.Exit(outputError(err))
+		}
 	case "info":
 		handleInfo()
 	case "setup":
@@ -76,7 +69,8 @@ func main() {
 }
 
 // handleGetCredentials implements the AWS credential provider interface
-func handleGetCredentials() {
+// Errors are returned to main so deferred cleanup runs before the process exits
+func handleGetCredentials() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
@@ -86,59 +80,49 @@ func handleGetCredentials() {
 	cfg, err := config.Load()
 	if err != nil {
 		logger.Error("Failed to load configuration", slog.String("error", err.Error()))
-		outputError("Failed to load configuration: " + err.Error())
-		return
+		return notConfigured("Failed to load configuration: " + err.Error())
 	}
 
 	// Create authentication manager
 	authMgr, err := auth.NewManager(cfg)
 	if err != nil {
 		logger.Error("Failed to create auth manager", slog.String("error", err.Error()))
-		outputError("Failed to create authentication manager: " + err.Error())
-		return
+		return notConfigured("Failed to create authentication manager: " + err.Error())
 	}
 
 	// Get AWS credentials
 	awsConfig, err := authMgr.GetAWSConfig(ctx)
 	if err != nil {
 		logger.Error("Failed to get AWS config", slog.String("error", err.Error()))
-		outputError("Failed to get AWS credentials: " + err.Error())
-		return
+		return fmt.Errorf("failed to get AWS credentials: %w", err)
 	}
 
 	// Retrieve credentials from the config
 	creds, err := awsConfig.Credentials.Retrieve(ctx)
 	if err != nil {
 		logger.Error("Failed to retrieve credentials", slog.String("error", err.Error()))
-		outputError("Failed to retrieve credentials: " + err.Error())
-		return
+		return fmt.Errorf("failed to retrieve credentials: %w", err)
 	}
 
 	// Format response for AWS CLI
-	response := AWSCredentialResponse{
-		Version:         1,
-		AccessKeyID:     creds.AccessKeyID,
-		SecretAccessKey: creds.SecretAccessKey,
-		SessionToken:    creds.SessionToken,
-	}
-
-	// Add expiration if available
-	if !creds.Expires.IsZero() {
-		response.Expiration = creds.Expires.Format(time.RFC3339)
-	}
+	response := awsauth.NewProcessCredentials(creds)
 
 	// Output JSON response
 	encoder := json.NewEncoder(os.Stdout)
 	if err := encoder.Encode(response); err != nil {
 		logger.Error("Failed to encode response", slog.String("error", err.Error()))
-		outputError("Failed to encode credential response: " + err.Error())
-		return
+		return &awsauth.ProcessError{
+			Code:     "InternalError",
+			Message:  "Failed to encode credential response: " + err.Error(),
+			ExitCode: awsauth.ExitCredentialsInternalError,
+		}
 	}
 
 	logger.Info("Credentials provided successfully",
 		slog.String("access_key", creds.AccessKeyID[:10]+"..."),
 		slog.Bool("has_session_token", creds.SessionToken != ""),
 		slog.Time("expires", creds.Expires))
+	return nil
 }
 
 // handleInfo provides information about the plugin
@@ -399,14 +383,29 @@ func runInteractiveSetup(cfg *config.Config) error {
 	return nil
 }
 
-// outputError outputs an error in the format expected by AWS CLI
-func outputError(message string) {
-	errorResponse := map[string]interface{}{
-		"error": message,
+// notConfigured reports a plugin configuration problem; the user has to run setup
+func notConfigured(message string) error {
+	return &awsauth.ProcessError{
+		Code:     "NotConfigured",
+		Message:  message,
+		ExitCode: awsauth.ExitCredentialsNotConfigured,
 	}
-	
-	encoder := json.NewEncoder(os.Stdout)
+}
+
+// outputError writes a structured error to stderr and returns the exit code
+// awsauth assigns to it. Nothing but credentials may ever reach stdout in
+// credential_process mode
+func outputError(err error) int {
+	pe := awsauth.AsProcessError(err, PluginName)
+	if pe.Tool == "" {
+		pe.Tool = PluginName
+	}
+
+	errorResponse := map[string]interface{}{"error": pe}
+
+	encoder := json.NewEncoder(os.Stderr)
 	encoder.Encode(errorResponse)
+	return pe.ExitCode
 }
 
 // getLogLevel returns the appropriate log level based on environment
@@ -4,6 +4,7 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"log/slog"
@@ -38,7 +39,7 @@ type Customer struct {
 	RoleARN      string    `json:"role_arn,omitempty"`
 	ExternalID   string    `json:"external_id,omitempty"`
 	SetupURL     string    `json:"setup_url,omitempty"`
-	Status       string    `json:"status"` // pending, setup_required, active, error
+	Status       string    `json:"status"` // Account status; see IntegrationStatus for the AWS integration
 	CreatedAt    time.Time `json:"created_at"`
 	UpdatedAt    time.Time `json:"updated_at"`
 }
@@ -230,6 +231,7 @@ func (h *Handler) CompleteSetup(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		RoleARN      string `json:"role_arn"`
 		ExternalID   string `json:"external_id"`
+		SetupToken   string `json:"setup_token"`
 		AWSAccountID string `json:"aws_account_id"`
 	}
 
@@ -249,6 +251,7 @@ func (h *Handler) CompleteSetup(w http.ResponseWriter, r *http.Request) {
 		CustomerID: customerID,
 		RoleARN:    req.RoleARN,
 		ExternalID: req.ExternalID,
+		SetupToken: req.SetupToken,
 	}
 
 	if err := h.crossAccountClient.CompleteSetup(context.Background(), setupReq); err != nil {
@@ -383,18 +386,26 @@ func (h *Handler) IntegrationStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	customer, exists := h.customers[customerID]
-	if !exists {
+	// The library tracks the integration lifecycle
+	integration, err := h.crossAccountClient.GetIntegration(r.Context(), customerID)
+	if errors.Is(err, crossaccount.ErrIntegrationNotFound) {
 		http.Error(w, "Integration not found", http.StatusNotFound)
 		return
 	}
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"customer_id": customerID,
-		"status":      customer.Status,
-		"created_at":  customer.CreatedAt,
-		"updated_at":  customer.UpdatedAt,
+		"customer_id":       customerID,
+		"status":            integration.Status,
+		"status_reason":     integration.StatusReason,
+		"status_changed_at": integration.StatusChangedAt,
+		"history":           integration.History,
+		"created_at":        integration.CreatedAt,
+		"updated_at":        integration.UpdatedAt,
 	})
 }
 
@@ -29,6 +29,10 @@ func main() {
 
 	r := gin.Default()
 
+	// What the customer's role can do, for their security team to review
+	// before they launch the stack. Add ?format=markdown or ?format=json
+	r.GET("/aws/permissions", gin.WrapH(client.PermissionReviewHandler()))
+
 	// Customer onboarding - generates a single click setup link
 	r.POST("/customers/:id/aws-setup", func(c *gin.Context) {
 		customerID := c.Param("id")
@@ -46,7 +50,7 @@ func main() {
 			"setup_link": setupResp.LaunchURL,
 			"external_id": setupResp.ExternalID, // They'll need this from CloudFormation outputs
 			"next_steps": []string{
-				"1. Send the setup_link to your customer",
+				"1. Send the setup_link to your customer, with /aws/permissions for their security review",
 				"2. Customer clicks link and follows the CloudFormation wizard",  
 				"3. Customer copies Role ARN and External ID from stack outputs",
 				"4. Customer calls your /complete-setup endpoint with those values",
@@ -62,6 +66,7 @@ func main() {
 		var req struct {
 			RoleARN    string `json:"role_arn"`
 			ExternalID string `json:"external_id"`
+			SetupToken string `json:"setup_token"` // From the setup link response
 		}
 		
 		if err := c.ShouldBindJSON(&req); err != nil {
@@ -74,6 +79,7 @@ func main() {
 			CustomerID: customerID,
 			RoleARN:    req.RoleARN,
 			ExternalID: req.ExternalID,
+			SetupToken: req.SetupToken,
 		})
 		if err != nil {
 			c.JSON(400, gin.H{"error": fmt.Sprintf("Setup verification failed: %v", err)})
@@ -144,8 +150,17 @@ func main() {
 			return
 		}
 
+		if instructions.Automated {
+			c.JSON(200, gin.H{
+				"message": "🔒 Setup permissions removed - only ongoing permissions remain",
+				"stack_name": instructions.StackName,
+			})
+			return
+		}
+
 		c.JSON(200, gin.H{
 			"message": "🔒 Ready to remove setup permissions for enhanced security",
+			"automation_error": instructions.AutomationError,
 			"instructions": instructions.Instructions,
 			"automation_script": instructions.AutomationScript,
 			"why_important": "Setup permissions are broader than needed for daily operations. Removing them follows security best practices.",
@@ -187,6 +202,7 @@ func main() {
 	fmt.Println("🚀 Starting DataAnalyzer service...")
 	fmt.Println("📖 Try these endpoints to see the secure cross-account approach:")
 	fmt.Println("   POST /customers/acme/aws-setup")
+	fmt.Println("   GET  /aws/permissions")
 	fmt.Println("   GET  /compare-approaches")
 	fmt.Println("   👉 Visit http://localhost:8080/compare-approaches to see why this is better than access keys")
 	
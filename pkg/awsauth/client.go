@@ -2,14 +2,21 @@ package awsauth
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/sts"
+
+	"github.com/scttfrdmn/aws-remote-access-patterns/pkg/telemetry"
 )
 
+// ErrNoCredentials is returned when no valid AWS credentials could be found
+// and interactive setup was not attempted
+var ErrNoCredentials = errors.New("no valid AWS credentials found")
+
 // Client provides AWS authentication for external tools
 // Handles the complexity of credential discovery and setup
 type Client struct {
@@ -17,6 +24,7 @@ type Client struct {
 	profileName string
 	credCache   *CredentialCache
 	setupUI     *SetupUI
+	telemetry   telemetry.Recorder
 }
 
 // New creates a new AWS auth client for external tools
@@ -40,6 +48,9 @@ func New(cfg *Config, opts ...Option) (*Client, error) {
 	for _, opt := range opts {
 		opt(c)
 	}
+	if c.telemetry == nil {
+		c.telemetry = telemetry.Nop()
+	}
 
 	return c, nil
 }
@@ -57,18 +68,18 @@ func WithCredentialCache(cache *CredentialCache) Option {
 	return func(c *Client) { c.credCache = cache }
 }
 
+// WithTelemetry records credential cache hits and SSO device flow outcomes
+// with recorder. See the telemetry package for adapters
+func WithTelemetry(recorder telemetry.Recorder) Option {
+	return func(c *Client) { c.telemetry = recorder }
+}
+
 // GetAWSConfig returns AWS config, handling all authentication complexity
 // This is the main entry point - it tries cached credentials first,
 // then existing AWS profiles, then guides user through setup if needed
 func (c *Client) GetAWSConfig(ctx context.Context) (aws.Config, error) {
-	// Try cached credentials first
-	if creds := c.credCache.Get(c.profileName); creds != nil && creds.IsValid() {
-		return creds.AWSConfig, nil
-	}
-
-	// Try existing AWS configuration
-	if cfg, err := c.tryExistingCredentials(ctx); err == nil {
-		c.cacheCredentials(cfg)
+	// Try cached credentials and existing AWS configuration first
+	if cfg, err := c.loadConfig(ctx); err == nil {
 		return cfg, nil
 	}
 
@@ -83,6 +94,25 @@ func (c *Client) GetAWSConfig(ctx context.Context) (aws.Config, error) {
 	return c.runSetup(ctx)
 }
 
+// loadConfig returns AWS config from the cache or existing AWS configuration
+// It never starts interactive setup, so non-interactive entry points such as
+// the credential server can use it safely
+func (c *Client) loadConfig(ctx context.Context) (aws.Config, error) {
+	if creds := c.credCache.Get(c.profileName); creds != nil && creds.IsValid() {
+		c.telemetry.Count(ctx, telemetry.CredentialCacheHits, 1, telemetry.String("result", "hit"))
+		return creds.AWSConfig, nil
+	}
+	c.telemetry.Count(ctx, telemetry.CredentialCacheHits, 1, telemetry.String("result", "miss"))
+
+	cfg, err := c.tryExistingCredentials(ctx)
+	if err != nil {
+		return aws.Config{}, err
+	}
+
+	c.cacheCredentials(cfg)
+	return cfg, nil
+}
+
 // tryExistingCredentials attempts to use existing AWS credentials
 func (c *Client) tryExistingCredentials(ctx context.Context) (aws.Config, error) {
 	// Try tool-specific profile
@@ -106,7 +136,7 @@ func (c *Client) tryExistingCredentials(ctx context.Context) (aws.Config, error)
 		}
 	}
 
-	return aws.Config{}, fmt.Errorf("no valid AWS credentials found")
+	return aws.Config{}, ErrNoCredentials
 }
 
 // loadProfile loads a specific AWS profile
@@ -0,0 +1,478 @@
+// Package cobracmd provides a ready-made cobra command tree for awsauth-based tools
+// Tools get a consistent authentication UX from a single call:
+//
+//	root.AddCommand(cobracmd.New(client))
+//	root.AddCommand(cobracmd.NewCredentialsCommand(client))
+package cobracmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/spf13/cobra"
+
+	"github.com/scttfrdmn/aws-remote-access-patterns/pkg/awsauth"
+)
+
+// Output formats supported by every command
+const (
+	OutputTable = "table"
+	OutputJSON  = "json"
+)
+
+// ExitError carries a child process exit code out of the exec command
+// Callers should exit with Code so scripts see the child's status
+type ExitError struct {
+	Code int
+}
+
+// Error implements the error interface
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("command exited with status %d", e.Code)
+}
+
+// ExitCode returns the process exit code for an error returned by Execute
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.Code
+	}
+	return 1
+}
+
+// options holds command tree customizations
+type options struct {
+	use   string
+	short string
+}
+
+// Option customizes the command tree
+type Option func(*options)
+
+// WithUse sets the name of the parent command (default "auth")
+func WithUse(use string) Option {
+	return func(o *options) { o.use = use }
+}
+
+// WithShort sets the parent command's short description
+func WithShort(short string) Option {
+	return func(o *options) { o.short = short }
+}
+
+// New returns an auth command with login, logout, status, whoami,
+// test-permissions, doctor, export and exec subcommands wired to client
+func New(client *awsauth.Client, opts ...Option) *cobra.Command {
+	o := &options{
+		use:   "auth",
+		short: fmt.Sprintf("Manage AWS authentication for %s", client.ToolName()),
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	cmd := &cobra.Command{
+		Use:   o.use,
+		Short: o.short,
+	}
+	cmd.PersistentFlags().StringP("output", "o", OutputTable, "Output format (table, json)")
+
+	cmd.AddCommand(newLoginCommand(client))
+	cmd.AddCommand(newLogoutCommand(client))
+	cmd.AddCommand(newStatusCommand(client))
+	cmd.AddCommand(newWhoamiCommand(client))
+	cmd.AddCommand(newTestPermissionsCommand(client))
+	cmd.AddCommand(newDoctorCommand(client))
+	cmd.AddCommand(newExportCommand(client))
+	cmd.AddCommand(newExecCommand(client))
+
+	return cmd
+}
+
+// NewCredentialsCommand returns the top-level `credentials` command used as a
+// credential_process, matching awsauth.Client.RegisterCredentialProcess
+func NewCredentialsCommand(client *awsauth.Client) *cobra.Command {
+	return &cobra.Command{
+		Use:    "credentials",
+		Short:  "Print credentials for use as an AWS credential_process",
+		Hidden: true,
+		Args:   cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if code := client.RunCredentialProcess(cmd.Context()); code != awsauth.ExitCredentialsOK {
+				return &ExitError{Code: code}
+			}
+			return nil
+		},
+		SilenceErrors: true,
+		SilenceUsage:  true,
+	}
+}
+
+// newLoginCommand creates the login command
+func newLoginCommand(client *awsauth.Client) *cobra.Command {
+	var force bool
+
+	cmd := &cobra.Command{
+		Use:   "login",
+		Short: "Set up AWS authentication",
+		Long: fmt.Sprintf(`Set up AWS authentication for %s.
+
+Existing valid credentials are reused unless --force is given.`, client.ToolName()),
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			if !force {
+				if status := client.Status(ctx); status.Authenticated {
+					return writeStatus(cmd, status)
+				}
+			}
+
+			if err := client.RunSetup(ctx); err != nil {
+				return fmt.Errorf("login failed: %w", err)
+			}
+
+			return writeStatus(cmd, client.Status(ctx))
+		},
+	}
+
+	cmd.Flags().BoolVar(&force, "force", false, "Run setup even if credentials are already valid")
+	return cmd
+}
+
+// newLogoutCommand creates the logout command
+func newLogoutCommand(client *awsauth.Client) *cobra.Command {
+	var removeProfile bool
+
+	cmd := &cobra.Command{
+		Use:   "logout",
+		Short: "Clear cached credentials",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := client.Logout(removeProfile); err != nil {
+				return err
+			}
+
+			result := map[string]interface{}{
+				"profile":         client.ProfileName(),
+				"cache_cleared":   true,
+				"profile_removed": removeProfile,
+			}
+			return writeOutput(cmd, result, func(w io.Writer) {
+				fmt.Fprintf(w, "Logged out of %s\n", client.ToolName())
+				if removeProfile {
+					fmt.Fprintf(w, "Removed AWS profile %s\n", client.ProfileName())
+				}
+			})
+		},
+	}
+
+	cmd.Flags().BoolVar(&removeProfile, "remove-profile", false, "Also remove the tool's AWS profile")
+	return cmd
+}
+
+// newStatusCommand creates the status command
+func newStatusCommand(client *awsauth.Client) *cobra.Command {
+	return &cobra.Command{
+		Use:   "status",
+		Short: "Show authentication status",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return writeStatus(cmd, client.Status(cmd.Context()))
+		},
+	}
+}
+
+// newWhoamiCommand creates the whoami command
+func newWhoamiCommand(client *awsauth.Client) *cobra.Command {
+	return &cobra.Command{
+		Use:   "whoami",
+		Short: "Show the current AWS identity",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			identity, err := client.Identity(cmd.Context())
+			if err != nil {
+				return err
+			}
+
+			return writeOutput(cmd, identity, func(w io.Writer) {
+				tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+				fmt.Fprintf(tw, "Account\t%s\n", identity.Account)
+				fmt.Fprintf(tw, "ARN\t%s\n", identity.ARN)
+				fmt.Fprintf(tw, "User ID\t%s\n", identity.UserID)
+				tw.Flush()
+			})
+		},
+	}
+}
+
+// newTestPermissionsCommand creates the test-permissions command
+func newTestPermissionsCommand(client *awsauth.Client) *cobra.Command {
+	return &cobra.Command{
+		Use:   "test-permissions",
+		Short: "Check the tool's required AWS permissions",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			checks, err := client.CheckPermissions(cmd.Context())
+			if err != nil {
+				return err
+			}
+
+			if err := writeOutput(cmd, checks, func(w io.Writer) {
+				tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+				fmt.Fprintln(tw, "ACTION\tDECISION\tDETAIL")
+				for _, check := range checks {
+					fmt.Fprintf(tw, "%s\t%s\t%s\n", check.Action, check.Decision, check.Detail)
+				}
+				tw.Flush()
+			}); err != nil {
+				return err
+			}
+
+			for _, check := range checks {
+				if check.Decision == awsauth.DecisionDenied {
+					return fmt.Errorf("required permission %s is denied", check.Action)
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// newDoctorCommand creates the doctor command
+func newDoctorCommand(client *awsauth.Client) *cobra.Command {
+	var opts awsauth.DoctorOptions
+
+	cmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "Diagnose AWS configuration problems",
+		Long: `Check the environment, AWS config files, profiles, SSO sessions, clock
+skew and required permissions for common problems.
+
+Use --fix to apply safe automatic fixes such as tightening file permissions.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			report := client.Doctor(cmd.Context(), opts)
+
+			if err := writeOutput(cmd, report, func(w io.Writer) {
+				if len(report.Findings) == 0 {
+					fmt.Fprintf(w, "No problems found (%s)\n", strings.Join(report.Checks, ", "))
+					return
+				}
+				tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+				fmt.Fprintln(tw, "SEVERITY\tCHECK\tMESSAGE\tFIX")
+				for _, f := range report.Findings {
+					fix := f.Remediation
+					if f.Fixed {
+						fix = "fixed"
+					}
+					fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", f.Severity, f.Check, f.Message, fix)
+				}
+				tw.Flush()
+			}); err != nil {
+				return err
+			}
+
+			if !report.Healthy() {
+				return fmt.Errorf("doctor found problems")
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&opts.Fix, "fix", false, "Apply safe automatic fixes")
+	cmd.Flags().BoolVar(&opts.Offline, "offline", false, "Skip checks that call AWS")
+	return cmd
+}
+
+// newExportCommand creates the export command
+func newExportCommand(client *awsauth.Client) *cobra.Command {
+	var format string
+
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Print credentials as environment variables",
+		Long: `Print the current credentials for use in a shell.
+
+Formats:
+  env         export statements for sh/bash/zsh (default)
+  powershell  $env: assignments for PowerShell
+  process     credential_process JSON`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			creds, err := client.Credentials(cmd.Context())
+			if err != nil {
+				return err
+			}
+
+			w := cmd.OutOrStdout()
+			switch format {
+			case "env":
+				for _, kv := range credentialEnv(creds, client.Region()) {
+					fmt.Fprintf(w, "export %s\n", kv)
+				}
+			case "powershell":
+				for _, kv := range credentialEnv(creds, client.Region()) {
+					name, value, _ := strings.Cut(kv, "=")
+					fmt.Fprintf(w, "$env:%s=\"%s\"\n", name, value)
+				}
+			case "process":
+				return json.NewEncoder(w).Encode(awsauth.NewProcessCredentials(creds))
+			default:
+				return fmt.Errorf("unknown export format: %s", format)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&format, "format", "env", "Export format (env, powershell, process)")
+	return cmd
+}
+
+// newExecCommand creates the exec command
+func newExecCommand(client *awsauth.Client) *cobra.Command {
+	var staticEnv bool
+
+	cmd := &cobra.Command{
+		Use:   "exec -- command [args...]",
+		Short: "Run a command with AWS credentials",
+		Long: `Run a command with AWS credentials.
+
+By default the command gets credentials from a local credential server, so
+long-running processes keep working after the current session expires. Use
+--static-env to inject a fixed set of credentials instead.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			env := scrubCredentialEnv(os.Environ())
+
+			if staticEnv {
+				creds, err := client.Credentials(ctx)
+				if err != nil {
+					return err
+				}
+				env = append(env, credentialEnv(creds, client.Region())...)
+			} else {
+				// Fail early rather than letting the child discover missing credentials
+				if _, err := client.Credentials(ctx); err != nil {
+					return err
+				}
+
+				server, err := client.StartCredentialServer(ctx)
+				if err != nil {
+					return err
+				}
+				defer server.Close()
+
+				env = append(env, server.Environ()...)
+				env = append(env, "AWS_REGION="+client.Region(), "AWS_DEFAULT_REGION="+client.Region())
+				// SDKs use a default profile's credentials before the container
+				// endpoint, so hide the shared config files
+				env = append(env, "AWS_CONFIG_FILE="+os.DevNull, "AWS_SHARED_CREDENTIALS_FILE="+os.DevNull)
+			}
+
+			child := exec.CommandContext(ctx, args[0], args[1:]...)
+			child.Env = env
+			child.Stdin = cmd.InOrStdin()
+			child.Stdout = cmd.OutOrStdout()
+			child.Stderr = cmd.ErrOrStderr()
+
+			if err := child.Run(); err != nil {
+				var exitErr *exec.ExitError
+				if errors.As(err, &exitErr) {
+					return &ExitError{Code: exitErr.ExitCode()}
+				}
+				return fmt.Errorf("failed to run %s: %w", args[0], err)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&staticEnv, "static-env", false, "Inject static credentials instead of starting a credential server")
+	return cmd
+}
+
+// writeStatus writes a status in the selected output format
+func writeStatus(cmd *cobra.Command, status *awsauth.Status) error {
+	return writeOutput(cmd, status, func(w io.Writer) {
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(tw, "Tool\t%s\n", status.Tool)
+		fmt.Fprintf(tw, "Profile\t%s\n", status.Profile)
+		fmt.Fprintf(tw, "Region\t%s\n", status.Region)
+		fmt.Fprintf(tw, "Authenticated\t%t\n", status.Authenticated)
+		if status.Source != "" {
+			fmt.Fprintf(tw, "Source\t%s\n", status.Source)
+		}
+		if status.Expires != nil {
+			fmt.Fprintf(tw, "Expires\t%s (in %s)\n", status.Expires.Format(time.RFC3339), time.Until(*status.Expires).Round(time.Second))
+		}
+		if status.Identity != nil {
+			fmt.Fprintf(tw, "Account\t%s\n", status.Identity.Account)
+			fmt.Fprintf(tw, "ARN\t%s\n", status.Identity.ARN)
+		}
+		if status.Error != "" {
+			fmt.Fprintf(tw, "Error\t%s\n", status.Error)
+		}
+		tw.Flush()
+	})
+}
+
+// writeOutput writes v as JSON or calls table to render it for humans
+func writeOutput(cmd *cobra.Command, v interface{}, table func(io.Writer)) error {
+	format, _ := cmd.Flags().GetString("output")
+
+	switch format {
+	case OutputJSON:
+		encoder := json.NewEncoder(cmd.OutOrStdout())
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	case OutputTable, "":
+		table(cmd.OutOrStdout())
+		return nil
+	default:
+		return fmt.Errorf("unknown output format: %s", format)
+	}
+}
+
+// credentialEnv returns the environment variables for static credentials
+func credentialEnv(creds aws.Credentials, region string) []string {
+	env := []string{
+		"AWS_ACCESS_KEY_ID=" + creds.AccessKeyID,
+		"AWS_SECRET_ACCESS_KEY=" + creds.SecretAccessKey,
+	}
+	if creds.SessionToken != "" {
+		env = append(env, "AWS_SESSION_TOKEN="+creds.SessionToken)
+	}
+	if region != "" {
+		env = append(env, "AWS_REGION="+region, "AWS_DEFAULT_REGION="+region)
+	}
+	return env
+}
+
+// scrubCredentialEnv removes inherited credential settings that would take
+// precedence over the credentials injected for the child
+func scrubCredentialEnv(environ []string) []string {
+	scrubbed := make([]string, 0, len(environ))
+	for _, kv := range environ {
+		name, _, _ := strings.Cut(kv, "=")
+		switch name {
+		case "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_PROFILE", "AWS_DEFAULT_PROFILE",
+			"AWS_CONFIG_FILE", "AWS_SHARED_CREDENTIALS_FILE",
+			awsauth.EnvContainerCredentialsFullURI, awsauth.EnvContainerAuthorizationToken,
+			"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI":
+			continue
+		}
+		scrubbed = append(scrubbed, kv)
+	}
+	return scrubbed
+}
@@ -3,6 +3,7 @@ package awsauth
 import (
 	"context"
 	"errors"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -128,7 +129,9 @@ func (c *CachedCredentials) IsValid() bool {
 }
 
 // CredentialCache manages cached AWS credentials
+// It is safe for concurrent use
 type CredentialCache struct {
+	mu    sync.RWMutex
 	cache map[string]*CachedCredentials
 }
 
@@ -141,6 +144,9 @@ func NewCredentialCache() *CredentialCache {
 
 // Get retrieves cached credentials if they're still valid
 func (c *CredentialCache) Get(key string) *CachedCredentials {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
 	if creds, ok := c.cache[key]; ok && creds.IsValid() {
 		return creds
 	}
@@ -149,11 +155,17 @@ func (c *CredentialCache) Get(key string) *CachedCredentials {
 
 // Set stores credentials in the cache
 func (c *CredentialCache) Set(key string, creds *CachedCredentials) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	c.cache[key] = creds
 }
 
 // Clear removes cached credentials
 func (c *CredentialCache) Clear(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	delete(c.cache, key)
 }
 
@@ -0,0 +1,221 @@
+package awsauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+const (
+	// DefaultFederationEndpoint is the AWS sign-in federation endpoint
+	DefaultFederationEndpoint = "https://signin.aws.amazon.com/federation"
+	// DefaultConsoleDestination is where users land after signing in
+	DefaultConsoleDestination = "https://console.aws.amazon.com/"
+
+	// allowAllFederationPolicy scopes a federation token to the IAM user's own permissions
+	allowAllFederationPolicy = `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Action":"*","Resource":"*"}]}`
+)
+
+// ErrLongLivedCredentials is returned when a console link is requested for
+// long-lived IAM user keys without opting in to a federation token exchange
+var ErrLongLivedCredentials = errors.New("console sign-in requires temporary credentials; long-lived IAM user keys must be exchanged with GetFederationToken first")
+
+// FederationTokenAPI is the subset of the STS client used to exchange long-lived keys
+type FederationTokenAPI interface {
+	GetFederationToken(ctx context.Context, params *sts.GetFederationTokenInput, optFns ...func(*sts.Options)) (*sts.GetFederationTokenOutput, error)
+}
+
+// ConsoleOptions customizes a console sign-in link
+type ConsoleOptions struct {
+	// Destination is the console URL users land on (defaults to the console home)
+	Destination string
+	// Issuer is shown to users when their console session expires
+	Issuer string
+	// SessionDuration is the console session length (15 minutes to 12 hours, default 1 hour)
+	SessionDuration time.Duration
+
+	// UseFederationToken allows long-lived IAM user keys by first calling
+	// sts:GetFederationToken. Without it those keys are refused
+	UseFederationToken bool
+	// FederationName names the federated user (defaults to "console")
+	FederationName string
+	// FederationPolicy scopes down the federated session (defaults to the user's own permissions)
+	FederationPolicy string
+
+	// FederationEndpoint overrides the sign-in federation endpoint, e.g. for tests
+	FederationEndpoint string
+	// HTTPClient is used to call the federation endpoint
+	HTTPClient *http.Client
+	// STSClient is used for GetFederationToken (defaults to one built from the AWS config)
+	STSClient FederationTokenAPI
+}
+
+// ConsoleSignInURL returns a console login URL for the client's current session
+func (c *Client) ConsoleSignInURL(ctx context.Context, opts ConsoleOptions) (string, error) {
+	cfg, err := c.loadConfig(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if opts.Issuer == "" {
+		opts.Issuer = c.config.ToolName
+	}
+
+	return ConsoleSignInURL(ctx, cfg, opts)
+}
+
+// ConsoleSignInURL returns a console login URL for the credentials behind cfg
+// It works with any session, including the config returned by
+// crossaccount.Client.AssumeRole, so users can "open the console as the role"
+func ConsoleSignInURL(ctx context.Context, cfg aws.Config, opts ConsoleOptions) (string, error) {
+	if cfg.Credentials == nil {
+		return "", fmt.Errorf("AWS config has no credentials provider")
+	}
+
+	opts.setDefaults(cfg.Region)
+	if opts.SessionDuration < 15*time.Minute || opts.SessionDuration > 12*time.Hour {
+		return "", fmt.Errorf("session duration must be between 15 minutes and 12 hours")
+	}
+
+	creds, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve credentials: %w", err)
+	}
+
+	// The federation endpoint rejects SessionDuration for federation token
+	// sessions - their length is fixed when the token is issued
+	includeDuration := true
+	if creds.SessionToken == "" {
+		if !opts.UseFederationToken {
+			return "", ErrLongLivedCredentials
+		}
+
+		creds, err = exchangeForFederationToken(ctx, cfg, opts)
+		if err != nil {
+			return "", err
+		}
+		includeDuration = false
+	}
+
+	signinToken, err := requestSigninToken(ctx, creds, opts, includeDuration)
+	if err != nil {
+		return "", err
+	}
+
+	params := url.Values{}
+	params.Set("Action", "login")
+	params.Set("Issuer", opts.Issuer)
+	params.Set("Destination", opts.Destination)
+	params.Set("SigninToken", signinToken)
+
+	return opts.FederationEndpoint + "?" + params.Encode(), nil
+}
+
+// setDefaults fills in unset options
+func (o *ConsoleOptions) setDefaults(region string) {
+	if o.FederationEndpoint == "" {
+		o.FederationEndpoint = DefaultFederationEndpoint
+	}
+	if o.Destination == "" {
+		o.Destination = DefaultConsoleDestination
+		if region != "" {
+			o.Destination = fmt.Sprintf("https://console.aws.amazon.com/console/home?region=%s", region)
+		}
+	}
+	if o.Issuer == "" {
+		o.Issuer = "aws-remote-access-patterns"
+	}
+	if o.SessionDuration == 0 {
+		o.SessionDuration = time.Hour
+	}
+	if o.FederationName == "" {
+		o.FederationName = "console"
+	}
+	if o.FederationPolicy == "" {
+		o.FederationPolicy = allowAllFederationPolicy
+	}
+	if o.HTTPClient == nil {
+		o.HTTPClient = &http.Client{Timeout: 30 * time.Second}
+	}
+}
+
+// exchangeForFederationToken trades long-lived IAM user keys for a federation token
+func exchangeForFederationToken(ctx context.Context, cfg aws.Config, opts ConsoleOptions) (aws.Credentials, error) {
+	stsClient := opts.STSClient
+	if stsClient == nil {
+		stsClient = sts.NewFromConfig(cfg)
+	}
+
+	result, err := stsClient.GetFederationToken(ctx, &sts.GetFederationTokenInput{
+		Name:            aws.String(opts.FederationName),
+		Policy:          aws.String(opts.FederationPolicy),
+		DurationSeconds: aws.Int32(int32(opts.SessionDuration.Seconds())),
+	})
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("failed to get federation token: %w", err)
+	}
+	if result.Credentials == nil {
+		return aws.Credentials{}, fmt.Errorf("federation token response contained no credentials")
+	}
+
+	return aws.Credentials{
+		AccessKeyID:     aws.ToString(result.Credentials.AccessKeyId),
+		SecretAccessKey: aws.ToString(result.Credentials.SecretAccessKey),
+		SessionToken:    aws.ToString(result.Credentials.SessionToken),
+		CanExpire:       result.Credentials.Expiration != nil,
+		Expires:         aws.ToTime(result.Credentials.Expiration),
+	}, nil
+}
+
+// requestSigninToken calls the federation endpoint's getSigninToken action
+func requestSigninToken(ctx context.Context, creds aws.Credentials, opts ConsoleOptions, includeDuration bool) (string, error) {
+	session, err := json.Marshal(map[string]string{
+		"sessionId":    creds.AccessKeyID,
+		"sessionKey":   creds.SecretAccessKey,
+		"sessionToken": creds.SessionToken,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode session: %w", err)
+	}
+
+	params := url.Values{}
+	params.Set("Action", "getSigninToken")
+	params.Set("Session", string(session))
+	if includeDuration {
+		params.Set("SessionDuration", fmt.Sprintf("%d", int(opts.SessionDuration.Seconds())))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, opts.FederationEndpoint+"?"+params.Encode(), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to build federation request: %w", err)
+	}
+
+	resp, err := opts.HTTPClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("federation request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("federation endpoint returned status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		SigninToken string `json:"SigninToken"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to decode federation response: %w", err)
+	}
+	if result.SigninToken == "" {
+		return "", fmt.Errorf("federation endpoint returned no sign-in token")
+	}
+
+	return result.SigninToken, nil
+}
@@ -0,0 +1,153 @@
+package awsauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/aws-sdk-go-v2/service/sts/types"
+)
+
+// mockFederationSTS provides a mock GetFederationToken implementation
+type mockFederationSTS struct {
+	called bool
+	input  *sts.GetFederationTokenInput
+}
+
+func (m *mockFederationSTS) GetFederationToken(ctx context.Context, params *sts.GetFederationTokenInput, optFns ...func(*sts.Options)) (*sts.GetFederationTokenOutput, error) {
+	m.called = true
+	m.input = params
+	return &sts.GetFederationTokenOutput{
+		Credentials: &types.Credentials{
+			AccessKeyId:     aws.String("ASIAFEDERATED"),
+			SecretAccessKey: aws.String("federated-secret"),
+			SessionToken:    aws.String("federated-token"),
+			Expiration:      aws.Time(time.Now().Add(time.Hour)),
+		},
+	}, nil
+}
+
+// newFederationStandIn returns a local stand-in for the sign-in federation endpoint
+func newFederationStandIn(t *testing.T, lastQuery *url.Values) *httptest.Server {
+	t.Helper()
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		*lastQuery = q
+
+		if q.Get("Action") != "getSigninToken" {
+			http.Error(w, "unexpected action", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"SigninToken": "test-signin-token"})
+	}))
+}
+
+func TestConsoleSignInURL_TemporaryCredentials(t *testing.T) {
+	var query url.Values
+	server := newFederationStandIn(t, &query)
+	defer server.Close()
+
+	cfg := aws.Config{
+		Region:      "eu-west-1",
+		Credentials: credentials.NewStaticCredentialsProvider("ASIATEMP", "temp-secret", "temp-token"),
+	}
+
+	loginURL, err := ConsoleSignInURL(context.Background(), cfg, ConsoleOptions{
+		Destination:        "https://console.aws.amazon.com/s3/home",
+		Issuer:             "test-tool",
+		SessionDuration:    2 * time.Hour,
+		FederationEndpoint: server.URL,
+	})
+	if err != nil {
+		t.Fatalf("ConsoleSignInURL() error = %v", err)
+	}
+
+	var session map[string]string
+	if err := json.Unmarshal([]byte(query.Get("Session")), &session); err != nil {
+		t.Fatalf("Session parameter is not JSON: %v", err)
+	}
+	if session["sessionId"] != "ASIATEMP" || session["sessionToken"] != "temp-token" {
+		t.Errorf("unexpected session sent to federation endpoint: %v", session)
+	}
+	if query.Get("SessionDuration") != "7200" {
+		t.Errorf("SessionDuration = %s, want 7200", query.Get("SessionDuration"))
+	}
+
+	parsed, err := url.Parse(loginURL)
+	if err != nil {
+		t.Fatalf("login URL is invalid: %v", err)
+	}
+	if !strings.HasPrefix(loginURL, server.URL) {
+		t.Errorf("login URL should use the configured endpoint, got %s", loginURL)
+	}
+	if got := parsed.Query().Get("SigninToken"); got != "test-signin-token" {
+		t.Errorf("SigninToken = %s, want test-signin-token", got)
+	}
+	if got := parsed.Query().Get("Destination"); got != "https://console.aws.amazon.com/s3/home" {
+		t.Errorf("Destination = %s", got)
+	}
+}
+
+func TestConsoleSignInURL_LongLivedKeys(t *testing.T) {
+	var query url.Values
+	server := newFederationStandIn(t, &query)
+	defer server.Close()
+
+	cfg := aws.Config{
+		Credentials: credentials.NewStaticCredentialsProvider("AKIALONGLIVED", "long-lived-secret", ""),
+	}
+
+	t.Run("refused without federation token", func(t *testing.T) {
+		_, err := ConsoleSignInURL(context.Background(), cfg, ConsoleOptions{
+			FederationEndpoint: server.URL,
+		})
+		if !errors.Is(err, ErrLongLivedCredentials) {
+			t.Errorf("ConsoleSignInURL() error = %v, want ErrLongLivedCredentials", err)
+		}
+	})
+
+	t.Run("exchanged with federation token", func(t *testing.T) {
+		mockSTS := &mockFederationSTS{}
+		_, err := ConsoleSignInURL(context.Background(), cfg, ConsoleOptions{
+			UseFederationToken: true,
+			FederationEndpoint: server.URL,
+			STSClient:          mockSTS,
+		})
+		if err != nil {
+			t.Fatalf("ConsoleSignInURL() error = %v", err)
+		}
+
+		if !mockSTS.called {
+			t.Fatal("GetFederationToken should be called for long-lived keys")
+		}
+		if strings.Contains(query.Get("Session"), "AKIALONGLIVED") {
+			t.Error("long-lived keys must never be sent to the federation endpoint")
+		}
+		if query.Get("SessionDuration") != "" {
+			t.Error("SessionDuration must not be sent for federation token sessions")
+		}
+	})
+}
+
+func TestConsoleSignInURL_InvalidDuration(t *testing.T) {
+	cfg := aws.Config{
+		Credentials: credentials.NewStaticCredentialsProvider("ASIATEMP", "temp-secret", "temp-token"),
+	}
+
+	_, err := ConsoleSignInURL(context.Background(), cfg, ConsoleOptions{
+		SessionDuration: 13 * time.Hour,
+	})
+	if err == nil {
+		t.Error("ConsoleSignInURL() should reject sessions longer than 12 hours")
+	}
+}
@@ -0,0 +1,242 @@
+package awsauth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// Exit codes returned by RunCredentialProcess
+// AWS CLI and SDKs treat any non-zero exit as failure; distinct codes let
+// wrapper scripts tell "needs setup" apart from transient failures
+const (
+	ExitCredentialsOK            = 0
+	ExitCredentialsInternalError = 1
+	ExitCredentialsNotConfigured = 2
+	ExitCredentialsUnavailable   = 3
+	ExitCredentialsRecursion     = 4
+)
+
+// envCredentialProcessActive guards against a profile whose credential_process
+// points back at the same tool, which would otherwise recurse forever
+const envCredentialProcessActive = "AWSAUTH_CREDENTIAL_PROCESS_ACTIVE"
+
+// ProcessCredentials is the Version 1 JSON document expected from a credential_process
+type ProcessCredentials struct {
+	Version         int    `json:"Version"`
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	SessionToken    string `json:"SessionToken,omitempty"`
+	Expiration      string `json:"Expiration,omitempty"`
+}
+
+// NewProcessCredentials converts SDK credentials to the credential_process format
+func NewProcessCredentials(creds aws.Credentials) ProcessCredentials {
+	pc := ProcessCredentials{
+		Version:         1,
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.SessionToken,
+	}
+	if creds.CanExpire && !creds.Expires.IsZero() {
+		pc.Expiration = creds.Expires.UTC().Format(time.RFC3339)
+	}
+	return pc
+}
+
+// ProcessError is the structured error written to stderr by RunCredentialProcess
+type ProcessError struct {
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+	Tool     string `json:"tool,omitempty"`
+	ExitCode int    `json:"-"`
+}
+
+// Error implements the error interface
+func (e *ProcessError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// ProcessCredentials resolves credentials without interactive setup and
+// returns them in the credential_process format. Failures are *ProcessError
+func (c *Client) ProcessCredentials(ctx context.Context) (*ProcessCredentials, error) {
+	cfg, err := c.loadConfig(ctx)
+	if err != nil {
+		if errors.Is(err, ErrNoCredentials) {
+			return nil, c.processError("NotConfigured",
+				fmt.Sprintf("no AWS credentials configured; run '%s' setup first", c.config.ToolName),
+				ExitCredentialsNotConfigured)
+		}
+		return nil, c.processError("CredentialsUnavailable", err.Error(), ExitCredentialsUnavailable)
+	}
+	if cfg.Credentials == nil {
+		return nil, c.processError("CredentialsUnavailable", "AWS config has no credentials provider", ExitCredentialsUnavailable)
+	}
+
+	creds, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, c.processError("CredentialsUnavailable", err.Error(), ExitCredentialsUnavailable)
+	}
+
+	pc := NewProcessCredentials(creds)
+	return &pc, nil
+}
+
+// WriteProcessCredentials writes credentials to stdout or a structured error to
+// stderr and returns the process exit code. stdout receives exactly one JSON
+// document on success and nothing at all on failure
+func (c *Client) WriteProcessCredentials(ctx context.Context, stdout, stderr io.Writer) int {
+	pc, err := c.ProcessCredentials(ctx)
+	if err != nil {
+		return writeProcessError(stderr, c.asProcessError(err))
+	}
+
+	// Encode fully before writing so stdout never sees a partial document
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(pc); err != nil {
+		return writeProcessError(stderr, c.processError("InternalError", err.Error(), ExitCredentialsInternalError))
+	}
+	if _, err := stdout.Write(buf.Bytes()); err != nil {
+		return writeProcessError(stderr, c.processError("InternalError", err.Error(), ExitCredentialsInternalError))
+	}
+
+	return ExitCredentialsOK
+}
+
+// RunCredentialProcess implements a `<tool> credentials` command for use as a
+// credential_process. While credentials are resolved, os.Stdout is redirected
+// to stderr so stray output from SDKs or setup code can't corrupt the JSON
+//
+//	os.Exit(client.RunCredentialProcess(ctx))
+func (c *Client) RunCredentialProcess(ctx context.Context) int {
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+	defer func() { os.Stdout = stdout }()
+
+	if os.Getenv(envCredentialProcessActive) != "" {
+		return writeProcessError(os.Stderr, c.processError("RecursiveInvocation",
+			"credential_process invoked itself; the tool's own profile must not use credential_process",
+			ExitCredentialsRecursion))
+	}
+	os.Setenv(envCredentialProcessActive, "1")
+	defer os.Unsetenv(envCredentialProcessActive)
+
+	return c.WriteProcessCredentials(ctx, stdout, os.Stderr)
+}
+
+// RegisterCredentialProcess configures an AWS profile whose credential_process
+// runs `<this executable> credentials`, so the AWS CLI and SDKs can use the tool
+// for authentication. profileName defaults to the tool name and must differ
+// from the profile the tool itself authenticates with
+func (c *Client) RegisterCredentialProcess(profileName string) error {
+	if profileName == "" {
+		profileName = c.config.ToolName
+	}
+	if profileName == c.profileName {
+		return fmt.Errorf("profile %s is used by %s itself and cannot use credential_process", profileName, c.config.ToolName)
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate executable: %w", err)
+	}
+
+	cm := NewCredentialManager(profileName, c.config.DefaultRegion)
+	return cm.RegisterCredentialProcess(quoteCommandArg(executable) + " credentials")
+}
+
+// processError builds a ProcessError for this client
+func (c *Client) processError(code, message string, exitCode int) *ProcessError {
+	return &ProcessError{Code: code, Message: message, Tool: c.config.ToolName, ExitCode: exitCode}
+}
+
+// asProcessError converts any error to a ProcessError for this client
+func (c *Client) asProcessError(err error) *ProcessError {
+	return AsProcessError(err, c.config.ToolName)
+}
+
+// AsProcessError maps an error to the ProcessError and exit code a
+// credential_process should report. Tools that resolve credentials
+// themselves use it to exit the same way RunCredentialProcess does:
+// ErrNoCredentials means the tool needs setup, and any other error means
+// credentials are currently unavailable
+func AsProcessError(err error, tool string) *ProcessError {
+	var pe *ProcessError
+	switch {
+	case errors.As(err, &pe):
+		return pe
+	case errors.Is(err, ErrNoCredentials):
+		return &ProcessError{Code: "NotConfigured", Message: err.Error(), Tool: tool, ExitCode: ExitCredentialsNotConfigured}
+	default:
+		return &ProcessError{Code: "CredentialsUnavailable", Message: err.Error(), Tool: tool, ExitCode: ExitCredentialsUnavailable}
+	}
+}
+
+// writeProcessError writes a structured error and returns its exit code
+func writeProcessError(w io.Writer, pe *ProcessError) int {
+	json.NewEncoder(w).Encode(struct {
+		Error *ProcessError `json:"error"`
+	}{Error: pe})
+	return pe.ExitCode
+}
+
+// RegisterCredentialProcess writes a credential_process entry for the profile
+// to ~/.aws/config, replacing any existing section for the profile
+func (cm *CredentialManager) RegisterCredentialProcess(command string) error {
+	if command == "" {
+		return fmt.Errorf("credential_process command is required")
+	}
+
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return fmt.Errorf("failed to get home directory: %w", err)
+	}
+
+	awsDir := filepath.Join(homeDir, ".aws")
+	if err := os.MkdirAll(awsDir, 0700); err != nil {
+		return fmt.Errorf("failed to create .aws directory: %w", err)
+	}
+
+	configFile := filepath.Join(awsDir, "config")
+
+	content := ""
+	if data, err := os.ReadFile(configFile); err == nil {
+		content = string(data)
+	}
+
+	// The default profile has no "profile " prefix in the config file
+	header := fmt.Sprintf("[profile %s]", cm.profileName)
+	if cm.profileName == "default" {
+		header = "[default]"
+	}
+	content = strings.TrimRight(cm.removeProfileSection(content, header), "\n")
+
+	section := fmt.Sprintf("\n\n%s\ncredential_process = %s\n", header, command)
+	if cm.region != "" {
+		section += fmt.Sprintf("region = %s\n", cm.region)
+	}
+	content = strings.TrimLeft(content+section, "\n")
+
+	if err := os.WriteFile(configFile, []byte(content), 0600); err != nil {
+		return fmt.Errorf("failed to update config file: %w", err)
+	}
+
+	return nil
+}
+
+// quoteCommandArg quotes a path containing spaces for credential_process
+func quoteCommandArg(arg string) string {
+	if strings.ContainsAny(arg, " \t") {
+		return `"` + arg + `"`
+	}
+	return arg
+}
@@ -0,0 +1,188 @@
+package awsauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// EnvContainerCredentialsFullURI is read by AWS SDKs to locate a container credentials endpoint
+	EnvContainerCredentialsFullURI = "AWS_CONTAINER_CREDENTIALS_FULL_URI"
+	// EnvContainerAuthorizationToken is sent by AWS SDKs in the Authorization header
+	EnvContainerAuthorizationToken = "AWS_CONTAINER_AUTHORIZATION_TOKEN"
+
+	// credentialServerPath is the path credentials are served from
+	credentialServerPath = "/v1/credentials"
+
+	// nonExpiringRefreshInterval is the expiration reported for credentials that
+	// never expire, so child processes still re-fetch them periodically
+	nonExpiringRefreshInterval = 15 * time.Minute
+)
+
+// containerCredentials is the JSON document served by the ECS container credentials endpoint
+type containerCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Token           string `json:"Token,omitempty"`
+	Expiration      string `json:"Expiration"`
+}
+
+// containerCredentialsError is the error document understood by AWS SDKs
+type containerCredentialsError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// CredentialServer serves refreshing credentials to child processes
+// It speaks the ECS container credentials protocol on a loopback address, so any
+// AWS SDK in a child process picks up fresh credentials on its own instead of
+// relying on environment variables that go stale
+type CredentialServer struct {
+	client    *Client
+	authToken string
+	listener  net.Listener
+	server    *http.Server
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// StartCredentialServer starts a credential server on a random loopback port
+// A new random authorization token is generated for every server. The server
+// shuts down when ctx is cancelled or Close is called
+func (c *Client) StartCredentialServer(ctx context.Context) (*CredentialServer, error) {
+	token, err := generateAuthToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate authorization token: %w", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on loopback address: %w", err)
+	}
+
+	s := &CredentialServer{
+		client:    c,
+		authToken: token,
+		listener:  listener,
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(credentialServerPath, s)
+	s.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go s.server.Serve(listener)
+	go func() {
+		<-ctx.Done()
+		s.Close()
+	}()
+
+	return s, nil
+}
+
+// URL returns the full URI child processes should fetch credentials from
+func (s *CredentialServer) URL() string {
+	return fmt.Sprintf("http://%s%s", s.listener.Addr().String(), credentialServerPath)
+}
+
+// AuthToken returns the authorization token required by the server
+func (s *CredentialServer) AuthToken() string {
+	return s.authToken
+}
+
+// Environ returns the environment variables that point an AWS SDK at this server
+// Append them to exec.Cmd.Env when starting a child process. SDKs prefer
+// credentials from environment variables and the shared config's profile
+// over the server, so remove those as well, e.g. by setting AWS_CONFIG_FILE
+// and AWS_SHARED_CREDENTIALS_FILE to os.DevNull
+func (s *CredentialServer) Environ() []string {
+	return []string{
+		fmt.Sprintf("%s=%s", EnvContainerCredentialsFullURI, s.URL()),
+		fmt.Sprintf("%s=%s", EnvContainerAuthorizationToken, s.authToken),
+	}
+}
+
+// Close stops the server immediately
+func (s *CredentialServer) Close() error {
+	s.closeOnce.Do(func() {
+		s.closeErr = s.server.Close()
+		if errors.Is(s.closeErr, http.ErrServerClosed) {
+			s.closeErr = nil
+		}
+	})
+	return s.closeErr
+}
+
+// ServeHTTP implements http.Handler for the container credentials protocol
+func (s *CredentialServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeCredentialError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "only GET is supported")
+		return
+	}
+
+	// Compare in constant time so the token can't be guessed byte by byte
+	provided := r.Header.Get("Authorization")
+	if subtle.ConstantTimeCompare([]byte(provided), []byte(s.authToken)) != 1 {
+		writeCredentialError(w, http.StatusUnauthorized, "Unauthorized", "missing or invalid authorization token")
+		return
+	}
+
+	cfg, err := s.client.loadConfig(r.Context())
+	if err != nil {
+		writeCredentialError(w, http.StatusServiceUnavailable, "CredentialsUnavailable", err.Error())
+		return
+	}
+	if cfg.Credentials == nil {
+		writeCredentialError(w, http.StatusServiceUnavailable, "CredentialsUnavailable", "AWS config has no credentials provider")
+		return
+	}
+
+	creds, err := cfg.Credentials.Retrieve(r.Context())
+	if err != nil {
+		writeCredentialError(w, http.StatusServiceUnavailable, "CredentialsUnavailable", err.Error())
+		return
+	}
+
+	expiration := time.Now().Add(nonExpiringRefreshInterval)
+	if creds.CanExpire {
+		expiration = creds.Expires
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(containerCredentials{
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		Token:           creds.SessionToken,
+		Expiration:      expiration.UTC().Format(time.RFC3339),
+	})
+}
+
+// writeCredentialError writes an error in the format AWS SDKs expect
+func writeCredentialError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(containerCredentialsError{Code: code, Message: message})
+}
+
+// generateAuthToken creates a random per-session authorization token
+func generateAuthToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -34,7 +34,7 @@ func (cm *CredentialManager) SaveProfile(accessKey, secretKey, sessionToken stri
 	}
 
 	awsDir := filepath.Join(homeDir, ".aws")
-	if err := os.MkdirAll(awsDir, 0755); err != nil {
+	if err := os.MkdirAll(awsDir, 0700); err != nil {
 		return fmt.Errorf("failed to create .aws directory: %w", err)
 	}
 
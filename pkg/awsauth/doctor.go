@@ -0,0 +1,506 @@
+package awsauth
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+// Finding severities, from least to most serious
+const (
+	SeverityInfo    = "info"
+	SeverityWarning = "warning"
+	SeverityError   = "error"
+)
+
+// Doctor check names
+const (
+	CheckEnvironment     = "environment"
+	CheckFilePermissions = "file-permissions"
+	CheckProfile         = "profile"
+	CheckSSOCache        = "sso-cache"
+	CheckCredentials     = "credentials"
+	CheckClockSkew       = "clock-skew"
+	CheckPermissions     = "permissions"
+)
+
+// DefaultMaxClockSkew is the skew SigV4 tolerates before rejecting requests
+const DefaultMaxClockSkew = 5 * time.Minute
+
+// DoctorOptions controls which checks Doctor runs
+type DoctorOptions struct {
+	// Offline skips checks that call AWS (credentials, clock skew, permissions)
+	Offline bool
+
+	// Fix applies safe automatic fixes, such as tightening file permissions
+	Fix bool
+
+	// MaxClockSkew is the tolerated difference from STS time (default 5m)
+	MaxClockSkew time.Duration
+
+	// STSEndpoint overrides the endpoint used to measure clock skew
+	STSEndpoint string
+
+	// HTTPClient is used for the clock skew check
+	HTTPClient *http.Client
+}
+
+// Finding is a single problem found by Doctor
+type Finding struct {
+	Check       string `json:"check"`
+	Code        string `json:"code"`
+	Severity    string `json:"severity"`
+	Message     string `json:"message"`
+	Remediation string `json:"remediation,omitempty"`
+	Fixable     bool   `json:"fixable"`
+	Fixed       bool   `json:"fixed,omitempty"`
+
+	fix func() error
+}
+
+// Fix applies the finding's automatic fix
+func (f *Finding) Fix() error {
+	if f.fix == nil {
+		return fmt.Errorf("%s has no automatic fix", f.Code)
+	}
+	if f.Fixed {
+		return nil
+	}
+	if err := f.fix(); err != nil {
+		return fmt.Errorf("failed to fix %s: %w", f.Code, err)
+	}
+	f.Fixed = true
+	return nil
+}
+
+// DoctorReport is the result of a Doctor run
+type DoctorReport struct {
+	Tool      string     `json:"tool"`
+	Profile   string     `json:"profile"`
+	CheckedAt time.Time  `json:"checked_at"`
+	Checks    []string   `json:"checks"`
+	Findings  []*Finding `json:"findings"`
+}
+
+// Healthy reports whether no unfixed error findings remain
+func (r *DoctorReport) Healthy() bool {
+	for _, f := range r.Findings {
+		if f.Severity == SeverityError && !f.Fixed {
+			return false
+		}
+	}
+	return true
+}
+
+// ApplyFixes applies every available automatic fix
+// All fixes are attempted; the first failure is returned
+func (r *DoctorReport) ApplyFixes() error {
+	var firstErr error
+	for _, f := range r.Findings {
+		if !f.Fixable || f.Fixed {
+			continue
+		}
+		if err := f.Fix(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// add records a finding
+func (r *DoctorReport) add(f *Finding) {
+	f.Fixable = f.fix != nil
+	r.Findings = append(r.Findings, f)
+}
+
+// Doctor inspects the local AWS environment and configuration for common
+// problems: conflicting environment variables, loose file permissions,
+// unresolvable profiles, expired SSO sessions, clock skew and missing
+// permissions. It never starts interactive setup
+func (c *Client) Doctor(ctx context.Context, opts DoctorOptions) *DoctorReport {
+	if opts.MaxClockSkew == 0 {
+		opts.MaxClockSkew = DefaultMaxClockSkew
+	}
+
+	report := &DoctorReport{
+		Tool:      c.config.ToolName,
+		Profile:   c.profileName,
+		CheckedAt: time.Now(),
+	}
+
+	report.Checks = append(report.Checks, CheckEnvironment)
+	c.checkEnvironment(report)
+
+	if runtime.GOOS != "windows" {
+		report.Checks = append(report.Checks, CheckFilePermissions)
+		c.checkFilePermissions(report)
+	}
+
+	report.Checks = append(report.Checks, CheckProfile, CheckSSOCache)
+	c.checkProfiles(ctx, report)
+
+	if !opts.Offline {
+		report.Checks = append(report.Checks, CheckClockSkew)
+		c.checkClockSkew(ctx, report, opts)
+
+		report.Checks = append(report.Checks, CheckCredentials)
+		if c.checkCredentials(ctx, report) {
+			report.Checks = append(report.Checks, CheckPermissions)
+			c.checkPermissions(ctx, report)
+		}
+	}
+
+	if opts.Fix {
+		// Failures stay visible as unfixed findings
+		_ = report.ApplyFixes()
+	}
+
+	return report
+}
+
+// checkEnvironment looks for conflicting AWS environment variables
+func (c *Client) checkEnvironment(report *DoctorReport) {
+	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
+	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	sessionToken := os.Getenv("AWS_SESSION_TOKEN")
+	profile := os.Getenv("AWS_PROFILE")
+
+	if (accessKey == "") != (secretKey == "") {
+		report.add(&Finding{
+			Check:       CheckEnvironment,
+			Code:        "env-partial-static-keys",
+			Severity:    SeverityError,
+			Message:     "only one of AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY is set",
+			Remediation: "set both variables or unset both",
+		})
+	}
+
+	if sessionToken != "" && accessKey == "" {
+		report.add(&Finding{
+			Check:       CheckEnvironment,
+			Code:        "env-orphan-session-token",
+			Severity:    SeverityWarning,
+			Message:     "AWS_SESSION_TOKEN is set without AWS_ACCESS_KEY_ID",
+			Remediation: "unset AWS_SESSION_TOKEN",
+		})
+	}
+
+	if profile != "" && accessKey != "" {
+		report.add(&Finding{
+			Check:       CheckEnvironment,
+			Code:        "env-profile-shadowed",
+			Severity:    SeverityWarning,
+			Message:     fmt.Sprintf("AWS_PROFILE=%s is ignored because static keys are set in the environment", profile),
+			Remediation: "unset AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN to use the profile",
+		})
+	}
+
+	region := os.Getenv("AWS_REGION")
+	defaultRegion := os.Getenv("AWS_DEFAULT_REGION")
+	if region != "" && defaultRegion != "" && region != defaultRegion {
+		report.add(&Finding{
+			Check:       CheckEnvironment,
+			Code:        "env-region-conflict",
+			Severity:    SeverityWarning,
+			Message:     fmt.Sprintf("AWS_REGION=%s and AWS_DEFAULT_REGION=%s disagree; the SDK uses AWS_REGION", region, defaultRegion),
+			Remediation: "set both variables to the same region",
+		})
+	}
+}
+
+// checkFilePermissions makes sure credential material isn't readable by others
+func (c *Client) checkFilePermissions(report *DoctorReport) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return
+	}
+	awsDir := filepath.Join(homeDir, ".aws")
+
+	checkPath(report, awsDir, 0700, SeverityWarning)
+	checkPath(report, sharedConfigFile(), 0600, SeverityWarning)
+	checkPath(report, sharedCredentialsFile(), 0600, SeverityError)
+
+	ssoCacheDir := filepath.Join(awsDir, "sso", "cache")
+	checkPath(report, ssoCacheDir, 0700, SeverityWarning)
+	tokens, _ := filepath.Glob(filepath.Join(ssoCacheDir, "*.json"))
+	for _, token := range tokens {
+		checkPath(report, token, 0600, SeverityError)
+	}
+}
+
+// checkPath reports a path that is accessible to group or other users
+func checkPath(report *DoctorReport, path string, want os.FileMode, severity string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+
+	mode := info.Mode().Perm()
+	if mode&0077 == 0 {
+		return
+	}
+
+	report.add(&Finding{
+		Check:       CheckFilePermissions,
+		Code:        "insecure-permissions",
+		Severity:    severity,
+		Message:     fmt.Sprintf("%s has mode %04o and is accessible to other users", path, mode),
+		Remediation: fmt.Sprintf("chmod %o %s", want, path),
+		fix:         func() error { return os.Chmod(path, want) },
+	})
+}
+
+// checkProfiles verifies the tool profile and AWS_PROFILE resolve, and that
+// any SSO session they rely on is still valid
+func (c *Client) checkProfiles(ctx context.Context, report *DoctorReport) {
+	profiles := []string{c.profileName}
+	if envProfile := os.Getenv("AWS_PROFILE"); envProfile != "" && envProfile != c.profileName {
+		profiles = append(profiles, envProfile)
+	}
+
+	for i, profile := range profiles {
+		fromEnv := i > 0 || os.Getenv("AWS_PROFILE") == profile
+
+		shared, err := config.LoadSharedConfigProfile(ctx, profile, func(o *config.LoadSharedConfigOptions) {
+			o.ConfigFiles = []string{sharedConfigFile()}
+			o.CredentialsFiles = []string{sharedCredentialsFile()}
+		})
+
+		var notExist config.SharedConfigProfileNotExistError
+		switch {
+		case errors.As(err, &notExist) && fromEnv:
+			// The SDK refuses to load any configuration in this case
+			report.add(&Finding{
+				Check:       CheckProfile,
+				Code:        "env-profile-not-found",
+				Severity:    SeverityError,
+				Message:     fmt.Sprintf("AWS_PROFILE=%s does not exist in the shared config or credentials files", profile),
+				Remediation: "unset AWS_PROFILE or create the profile",
+			})
+		case errors.As(err, &notExist):
+			report.add(&Finding{
+				Check:       CheckProfile,
+				Code:        "profile-not-configured",
+				Severity:    SeverityInfo,
+				Message:     fmt.Sprintf("profile %s is not configured; the default profile or environment will be used", profile),
+				Remediation: fmt.Sprintf("run %s auth login to set it up", c.config.ToolName),
+			})
+		case err != nil:
+			report.add(&Finding{
+				Check:    CheckProfile,
+				Code:     "profile-invalid",
+				Severity: SeverityError,
+				Message:  fmt.Sprintf("profile %s can't be loaded: %v", profile, err),
+			})
+		default:
+			checkSSOCache(report, profile, shared)
+		}
+	}
+}
+
+// checkSSOCache reports a missing or expired SSO token for an SSO profile
+func checkSSOCache(report *DoctorReport, profile string, shared config.SharedConfig) {
+	cacheKey := shared.SSOStartURL
+	if shared.SSOSession != nil {
+		cacheKey = shared.SSOSession.Name
+	}
+	if cacheKey == "" {
+		return
+	}
+
+	remediation := fmt.Sprintf("run aws sso login --profile %s", profile)
+
+	path, err := ssoTokenPath(cacheKey)
+	if err != nil {
+		return
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		report.add(&Finding{
+			Check:       CheckSSOCache,
+			Code:        "sso-token-missing",
+			Severity:    SeverityError,
+			Message:     fmt.Sprintf("profile %s uses SSO but has no cached SSO token", profile),
+			Remediation: remediation,
+		})
+		return
+	}
+
+	var token struct {
+		AccessToken string    `json:"accessToken"`
+		ExpiresAt   time.Time `json:"expiresAt"`
+	}
+	if err := json.Unmarshal(data, &token); err != nil || token.AccessToken == "" {
+		report.add(&Finding{
+			Check:       CheckSSOCache,
+			Code:        "sso-token-invalid",
+			Severity:    SeverityError,
+			Message:     fmt.Sprintf("cached SSO token %s for profile %s can't be read", path, profile),
+			Remediation: remediation,
+		})
+		return
+	}
+
+	if time.Now().After(token.ExpiresAt) {
+		report.add(&Finding{
+			Check:       CheckSSOCache,
+			Code:        "sso-token-expired",
+			Severity:    SeverityError,
+			Message:     fmt.Sprintf("SSO session for profile %s expired at %s", profile, token.ExpiresAt.Format(time.RFC3339)),
+			Remediation: remediation,
+		})
+	}
+}
+
+// checkClockSkew compares local time with the Date header returned by STS
+func (c *Client) checkClockSkew(ctx context.Context, report *DoctorReport, opts DoctorOptions) {
+	endpoint := opts.STSEndpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://sts.%s.amazonaws.com/", c.config.DefaultRegion)
+	}
+	httpClient := opts.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, endpoint, nil)
+	if err != nil {
+		return
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		report.add(&Finding{
+			Check:    CheckClockSkew,
+			Code:     "clock-skew-unchecked",
+			Severity: SeverityInfo,
+			Message:  fmt.Sprintf("could not reach %s to check clock skew: %v", endpoint, err),
+		})
+		return
+	}
+	resp.Body.Close()
+
+	serverTime, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return
+	}
+
+	skew := time.Since(serverTime)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > opts.MaxClockSkew {
+		report.add(&Finding{
+			Check:       CheckClockSkew,
+			Code:        "clock-skew",
+			Severity:    SeverityError,
+			Message:     fmt.Sprintf("local clock differs from AWS by %s; signed requests will be rejected", skew.Round(time.Second)),
+			Remediation: "synchronize the system clock with NTP",
+		})
+	}
+}
+
+// checkCredentials reports whether credentials resolve and validate
+func (c *Client) checkCredentials(ctx context.Context, report *DoctorReport) bool {
+	status := c.Status(ctx)
+	if !status.Authenticated {
+		report.add(&Finding{
+			Check:       CheckCredentials,
+			Code:        "no-credentials",
+			Severity:    SeverityError,
+			Message:     fmt.Sprintf("no usable AWS credentials: %s", status.Error),
+			Remediation: fmt.Sprintf("run %s auth login", c.config.ToolName),
+		})
+		return false
+	}
+
+	if status.Expires != nil && time.Until(*status.Expires) < 15*time.Minute {
+		report.add(&Finding{
+			Check:    CheckCredentials,
+			Code:     "credentials-expiring",
+			Severity: SeverityInfo,
+			Message:  fmt.Sprintf("credentials expire at %s", status.Expires.Format(time.RFC3339)),
+		})
+	}
+	return true
+}
+
+// checkPermissions reports required actions the caller can't perform
+func (c *Client) checkPermissions(ctx context.Context, report *DoctorReport) {
+	checks, err := c.CheckPermissions(ctx)
+	if err != nil {
+		report.add(&Finding{
+			Check:    CheckPermissions,
+			Code:     "permissions-unchecked",
+			Severity: SeverityInfo,
+			Message:  fmt.Sprintf("could not check permissions: %v", err),
+		})
+		return
+	}
+
+	var unknown []string
+	for _, check := range checks {
+		switch check.Decision {
+		case DecisionDenied:
+			report.add(&Finding{
+				Check:       CheckPermissions,
+				Code:        "permission-denied",
+				Severity:    SeverityError,
+				Message:     fmt.Sprintf("required action %s is denied (%s)", check.Action, check.Detail),
+				Remediation: "grant the action to the tool's IAM principal",
+			})
+		case DecisionUnknown:
+			unknown = append(unknown, check.Action)
+		}
+	}
+
+	if len(unknown) > 0 {
+		report.add(&Finding{
+			Check:    CheckPermissions,
+			Code:     "permissions-unchecked",
+			Severity: SeverityInfo,
+			Message:  fmt.Sprintf("could not simulate %s", strings.Join(unknown, ", ")),
+		})
+	}
+}
+
+// sharedConfigFile returns the shared config path, honoring AWS_CONFIG_FILE
+func sharedConfigFile() string {
+	if path := os.Getenv("AWS_CONFIG_FILE"); path != "" {
+		return path
+	}
+	homeDir, _ := os.UserHomeDir()
+	return filepath.Join(homeDir, ".aws", "config")
+}
+
+// sharedCredentialsFile returns the shared credentials path, honoring
+// AWS_SHARED_CREDENTIALS_FILE
+func sharedCredentialsFile() string {
+	if path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE"); path != "" {
+		return path
+	}
+	homeDir, _ := os.UserHomeDir()
+	return filepath.Join(homeDir, ".aws", "credentials")
+}
+
+// ssoTokenPath returns the SDK's cache file for an SSO session name or start URL
+func ssoTokenPath(key string) (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha1.Sum([]byte(key))
+	return filepath.Join(homeDir, ".aws", "sso", "cache", hex.EncodeToString(sum[:])+".json"), nil
+}
@@ -15,7 +15,7 @@ import (
 func (c *Client) setupSSO(ctx context.Context) error {
 	fmt.Println("\n🔐 Setting up AWS SSO")
 
-	ssoAuth := NewSSOAuthenticator(c.config)
+	ssoAuth := NewSSOAuthenticator(c.config, WithSSOTelemetry(c.telemetry))
 	cfg, err := ssoAuth.Authenticate(ctx)
 	if err != nil {
 		return fmt.Errorf("SSO setup failed: %w", err)
@@ -304,7 +304,7 @@ func (c *Client) saveCredentials(accessKey, secretKey string) error {
 	}
 
 	awsDir := filepath.Join(homeDir, ".aws")
-	if err := os.MkdirAll(awsDir, 0755); err != nil {
+	if err := os.MkdirAll(awsDir, 0700); err != nil {
 		return fmt.Errorf("failed to create .aws directory: %w", err)
 	}
 
@@ -2,6 +2,7 @@ package awsauth
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/url"
 	"os/exec"
@@ -12,13 +13,36 @@ import (
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/sso"
 	"github.com/aws/aws-sdk-go-v2/service/ssooidc"
+
+	"github.com/scttfrdmn/aws-remote-access-patterns/pkg/telemetry"
+)
+
+// errDeviceCodeExpired is returned when the user doesn't approve the device
+// authorization in time
+var errDeviceCodeExpired = errors.New("device code expired")
+
+// SSO device flow outcomes recorded in telemetry
+const (
+	deviceFlowSuccess   = "success"
+	deviceFlowExpired   = "expired"
+	deviceFlowCancelled = "cancelled"
+	deviceFlowError     = "error"
 )
 
 // SSOAuthenticator handles AWS SSO authentication using device flow
 type SSOAuthenticator struct {
-	config   *Config
-	startURL string
-	region   string
+	config    *Config
+	startURL  string
+	region    string
+	telemetry telemetry.Recorder
+}
+
+// SSOOption customizes an SSOAuthenticator
+type SSOOption func(*SSOAuthenticator)
+
+// WithSSOTelemetry records device flow outcomes and spans with recorder
+func WithSSOTelemetry(recorder telemetry.Recorder) SSOOption {
+	return func(s *SSOAuthenticator) { s.telemetry = recorder }
 }
 
 // SSOConfig holds AWS SSO configuration
@@ -30,11 +54,16 @@ type SSOConfig struct {
 }
 
 // NewSSOAuthenticator creates a new SSO authenticator
-func NewSSOAuthenticator(cfg *Config) *SSOAuthenticator {
-	return &SSOAuthenticator{
-		config: cfg,
-		region: cfg.DefaultRegion,
+func NewSSOAuthenticator(cfg *Config, opts ...SSOOption) *SSOAuthenticator {
+	s := &SSOAuthenticator{
+		config:    cfg,
+		region:    cfg.DefaultRegion,
+		telemetry: telemetry.Nop(),
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	return s
 }
 
 // Authenticate performs AWS SSO device flow authentication
@@ -48,7 +77,30 @@ func (s *SSOAuthenticator) Authenticate(ctx context.Context) (aws.Config, error)
 	}
 
 	// Perform device authorization flow
-	return s.performDeviceFlow(ctx, ssoConfig)
+	ctx, span := s.telemetry.StartSpan(ctx, "awsauth.SSODeviceFlow", telemetry.String("tool", s.config.ToolName))
+	start := time.Now()
+	cfg, err := s.performDeviceFlow(ctx, ssoConfig)
+	span.End(err)
+
+	outcome := telemetry.String("outcome", deviceFlowOutcome(err))
+	s.telemetry.Count(ctx, telemetry.SSODeviceFlows, 1, outcome)
+	s.telemetry.Duration(ctx, telemetry.SSODeviceFlowDuration, time.Since(start), outcome)
+	return cfg, err
+}
+
+// deviceFlowOutcome classifies how a device flow ended. Polling retries every
+// CreateToken error, so a denied authorization also ends as expired
+func deviceFlowOutcome(err error) string {
+	switch {
+	case err == nil:
+		return deviceFlowSuccess
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		return deviceFlowCancelled
+	case errors.Is(err, errDeviceCodeExpired):
+		return deviceFlowExpired
+	default:
+		return deviceFlowError
+	}
 }
 
 // getSSOConfig gets SSO configuration from user or existing setup
@@ -174,7 +226,7 @@ func (s *SSOAuthenticator) pollForToken(ctx context.Context, oidcClient *ssooidc
 		}
 	}
 
-	return aws.Config{}, fmt.Errorf("authentication timed out")
+	return aws.Config{}, fmt.Errorf("authentication timed out: %w", errDeviceCodeExpired)
 }
 
 // shouldContinuePolling determines if we should continue polling for the token
@@ -0,0 +1,29 @@
+package awsauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestDeviceFlowOutcome(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"success", nil, deviceFlowSuccess},
+		{"timed out", fmt.Errorf("authentication timed out: %w", errDeviceCodeExpired), deviceFlowExpired},
+		{"cancelled", context.Canceled, deviceFlowCancelled},
+		{"other", errors.New("network unreachable"), deviceFlowError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := deviceFlowOutcome(tt.err); got != tt.want {
+				t.Errorf("deviceFlowOutcome() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
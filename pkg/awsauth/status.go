@@ -0,0 +1,236 @@
+package awsauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	iamtypes "github.com/aws/aws-sdk-go-v2/service/iam/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
+)
+
+// Permission check decisions
+const (
+	DecisionAllowed = "allowed"
+	DecisionDenied  = "denied"
+	DecisionUnknown = "unknown"
+)
+
+// Identity describes the AWS principal behind the client's credentials
+type Identity struct {
+	Account string `json:"account"`
+	ARN     string `json:"arn"`
+	UserID  string `json:"user_id"`
+}
+
+// Status summarizes the client's authentication state
+type Status struct {
+	Tool          string     `json:"tool"`
+	Profile       string     `json:"profile"`
+	Region        string     `json:"region"`
+	Authenticated bool       `json:"authenticated"`
+	Source        string     `json:"source,omitempty"`
+	Expires       *time.Time `json:"expires,omitempty"`
+	Identity      *Identity  `json:"identity,omitempty"`
+	Error         string     `json:"error,omitempty"`
+}
+
+// PermissionCheck is the simulated outcome for one required action
+type PermissionCheck struct {
+	Action   string `json:"action"`
+	Decision string `json:"decision"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+// ToolName returns the configured tool name
+func (c *Client) ToolName() string {
+	return c.config.ToolName
+}
+
+// ProfileName returns the AWS profile the client authenticates with
+func (c *Client) ProfileName() string {
+	return c.profileName
+}
+
+// Region returns the client's default region
+func (c *Client) Region() string {
+	return c.config.DefaultRegion
+}
+
+// Credentials returns the current credentials without starting interactive setup
+func (c *Client) Credentials(ctx context.Context) (aws.Credentials, error) {
+	cfg, err := c.loadConfig(ctx)
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+	if cfg.Credentials == nil {
+		return aws.Credentials{}, fmt.Errorf("AWS config has no credentials provider")
+	}
+	return cfg.Credentials.Retrieve(ctx)
+}
+
+// Identity calls sts:GetCallerIdentity with the current credentials
+func (c *Client) Identity(ctx context.Context) (*Identity, error) {
+	cfg, err := c.loadConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := sts.NewFromConfig(cfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get caller identity: %w", err)
+	}
+
+	return &Identity{
+		Account: aws.ToString(result.Account),
+		ARN:     aws.ToString(result.Arn),
+		UserID:  aws.ToString(result.UserId),
+	}, nil
+}
+
+// Status reports whether the client can currently authenticate and as whom
+// Failures are reported in the returned Status rather than as an error
+func (c *Client) Status(ctx context.Context) *Status {
+	status := &Status{
+		Tool:    c.config.ToolName,
+		Profile: c.profileName,
+		Region:  c.config.DefaultRegion,
+	}
+
+	creds, err := c.Credentials(ctx)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.Source = creds.Source
+	if creds.CanExpire {
+		expires := creds.Expires
+		status.Expires = &expires
+	}
+
+	identity, err := c.Identity(ctx)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+
+	status.Authenticated = true
+	status.Identity = identity
+	return status
+}
+
+// CheckPermissions simulates the configured RequiredActions against the
+// caller's IAM policies. Actions are reported as unknown when the caller may
+// not call iam:SimulatePrincipalPolicy
+func (c *Client) CheckPermissions(ctx context.Context) ([]PermissionCheck, error) {
+	identity, err := c.Identity(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := c.loadConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return simulateActions(ctx, iam.NewFromConfig(cfg), identity.ARN, c.config.RequiredActions)
+}
+
+// Logout clears cached credentials and optionally removes the tool's profile
+func (c *Client) Logout(removeProfile bool) error {
+	c.credCache.Clear(c.profileName)
+
+	if removeProfile {
+		cm := NewCredentialManager(c.profileName, c.config.DefaultRegion)
+		if err := cm.DeleteProfile(); err != nil {
+			return fmt.Errorf("failed to remove profile %s: %w", c.profileName, err)
+		}
+	}
+
+	return nil
+}
+
+// simulationAPI is the subset of the IAM client used for policy simulation
+type simulationAPI interface {
+	SimulatePrincipalPolicy(ctx context.Context, params *iam.SimulatePrincipalPolicyInput, optFns ...func(*iam.Options)) (*iam.SimulatePrincipalPolicyOutput, error)
+}
+
+// simulateActions evaluates actions for a principal with iam:SimulatePrincipalPolicy
+func simulateActions(ctx context.Context, client simulationAPI, callerARN string, actions []string) ([]PermissionCheck, error) {
+	checks := make([]PermissionCheck, 0, len(actions))
+	if len(actions) == 0 {
+		return checks, nil
+	}
+
+	principal, err := principalARNForSimulation(callerARN)
+	if err != nil {
+		for _, action := range actions {
+			checks = append(checks, PermissionCheck{Action: action, Decision: DecisionUnknown, Detail: err.Error()})
+		}
+		return checks, nil
+	}
+
+	result, err := client.SimulatePrincipalPolicy(ctx, &iam.SimulatePrincipalPolicyInput{
+		PolicySourceArn: aws.String(principal),
+		ActionNames:     actions,
+	})
+	if err != nil {
+		detail := err.Error()
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "AccessDenied" {
+			detail = "caller may not call iam:SimulatePrincipalPolicy"
+		}
+		for _, action := range actions {
+			checks = append(checks, PermissionCheck{Action: action, Decision: DecisionUnknown, Detail: detail})
+		}
+		return checks, nil
+	}
+
+	decisions := make(map[string]iamtypes.PolicyEvaluationDecisionType)
+	for _, r := range result.EvaluationResults {
+		decisions[aws.ToString(r.EvalActionName)] = r.EvalDecision
+	}
+
+	for _, action := range actions {
+		check := PermissionCheck{Action: action, Decision: DecisionUnknown}
+		switch decision := decisions[action]; decision {
+		case iamtypes.PolicyEvaluationDecisionTypeAllowed:
+			check.Decision = DecisionAllowed
+		case iamtypes.PolicyEvaluationDecisionTypeExplicitDeny, iamtypes.PolicyEvaluationDecisionTypeImplicitDeny:
+			check.Decision = DecisionDenied
+			check.Detail = string(decision)
+		}
+		checks = append(checks, check)
+	}
+
+	return checks, nil
+}
+
+// principalARNForSimulation converts a caller ARN to one IAM can simulate
+// Assumed-role session ARNs map back to the role; role paths are not part of
+// the session ARN, so roles with a path can't be simulated this way
+func principalARNForSimulation(callerARN string) (string, error) {
+	parts := strings.SplitN(callerARN, ":", 6)
+	if len(parts) != 6 {
+		return "", fmt.Errorf("unrecognized caller ARN: %s", callerARN)
+	}
+
+	partition, service, account, resource := parts[1], parts[2], parts[4], parts[5]
+	switch {
+	case service == "iam":
+		return callerARN, nil
+	case service == "sts" && strings.HasPrefix(resource, "assumed-role/"):
+		segments := strings.Split(resource, "/")
+		if len(segments) < 3 {
+			return "", fmt.Errorf("unrecognized assumed-role ARN: %s", callerARN)
+		}
+		return fmt.Sprintf("arn:%s:iam::%s:role/%s", partition, account, segments[1]), nil
+	default:
+		return "", fmt.Errorf("principal %s can't be simulated", callerARN)
+	}
+}
@@ -0,0 +1,119 @@
+package awsauth
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	iamtypes "github.com/aws/aws-sdk-go-v2/service/iam/types"
+	"github.com/aws/smithy-go"
+)
+
+// mockSimulationClient provides a mock SimulatePrincipalPolicy implementation
+type mockSimulationClient struct {
+	decisions map[string]iamtypes.PolicyEvaluationDecisionType
+	err       error
+	source    string
+}
+
+func (m *mockSimulationClient) SimulatePrincipalPolicy(ctx context.Context, params *iam.SimulatePrincipalPolicyInput, optFns ...func(*iam.Options)) (*iam.SimulatePrincipalPolicyOutput, error) {
+	m.source = aws.ToString(params.PolicySourceArn)
+	if m.err != nil {
+		return nil, m.err
+	}
+
+	var results []iamtypes.EvaluationResult
+	for _, action := range params.ActionNames {
+		results = append(results, iamtypes.EvaluationResult{
+			EvalActionName: aws.String(action),
+			EvalDecision:   m.decisions[action],
+		})
+	}
+	return &iam.SimulatePrincipalPolicyOutput{EvaluationResults: results}, nil
+}
+
+func TestPrincipalARNForSimulation(t *testing.T) {
+	tests := []struct {
+		name    string
+		arn     string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "iam user",
+			arn:  "arn:aws:iam::123456789012:user/test-user",
+			want: "arn:aws:iam::123456789012:user/test-user",
+		},
+		{
+			name: "assumed role",
+			arn:  "arn:aws:sts::123456789012:assumed-role/Developer/session",
+			want: "arn:aws:iam::123456789012:role/Developer",
+		},
+		{
+			name: "other partition",
+			arn:  "arn:aws-us-gov:sts::123456789012:assumed-role/Developer/session",
+			want: "arn:aws-us-gov:iam::123456789012:role/Developer",
+		},
+		{
+			name:    "federated user",
+			arn:     "arn:aws:sts::123456789012:federated-user/bob",
+			wantErr: true,
+		},
+		{
+			name:    "not an ARN",
+			arn:     "bogus",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := principalARNForSimulation(tt.arn)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("principalARNForSimulation() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("principalARNForSimulation() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSimulateActions(t *testing.T) {
+	ctx := context.Background()
+	actions := []string{"s3:ListBucket", "ec2:RunInstances"}
+
+	t.Run("decisions", func(t *testing.T) {
+		mock := &mockSimulationClient{decisions: map[string]iamtypes.PolicyEvaluationDecisionType{
+			"s3:ListBucket":    iamtypes.PolicyEvaluationDecisionTypeAllowed,
+			"ec2:RunInstances": iamtypes.PolicyEvaluationDecisionTypeImplicitDeny,
+		}}
+
+		checks, err := simulateActions(ctx, mock, "arn:aws:sts::123456789012:assumed-role/Developer/s", actions)
+		if err != nil {
+			t.Fatalf("simulateActions() error = %v", err)
+		}
+		if mock.source != "arn:aws:iam::123456789012:role/Developer" {
+			t.Errorf("simulated principal = %s", mock.source)
+		}
+		if checks[0].Decision != DecisionAllowed || checks[1].Decision != DecisionDenied {
+			t.Errorf("unexpected decisions: %+v", checks)
+		}
+	})
+
+	t.Run("simulation not permitted", func(t *testing.T) {
+		mock := &mockSimulationClient{err: fmt.Errorf("wrapped: %w", &smithy.GenericAPIError{Code: "AccessDenied"})}
+
+		checks, err := simulateActions(ctx, mock, "arn:aws:iam::123456789012:user/test-user", actions)
+		if err != nil {
+			t.Fatalf("simulateActions() error = %v", err)
+		}
+		for _, check := range checks {
+			if check.Decision != DecisionUnknown {
+				t.Errorf("%s decision = %s, want unknown", check.Action, check.Decision)
+			}
+		}
+	})
+}
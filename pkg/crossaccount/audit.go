@@ -0,0 +1,314 @@
+package crossaccount
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditAction is what an audit event records
+type AuditAction string
+
+// Audited actions
+const (
+	AuditAssumeRole             AuditAction = "assume_role"   // AssumeRole or AssumeRoleWithOptions was called
+	AuditIssueSession           AuditAction = "issue_session" // sts:AssumeRole was called on a customer role
+	AuditCompleteSetup          AuditAction = "complete_setup"
+	AuditRemoveSetupPermissions AuditAction = "remove_setup_permissions"
+	AuditSaveIntegration        AuditAction = "save_integration"
+	AuditStoreSession           AuditAction = "store_session"
+	AuditDeleteSession          AuditAction = "delete_session"
+)
+
+// AuditOutcome is whether an audited action succeeded
+type AuditOutcome string
+
+// Audit outcomes
+const (
+	AuditSuccess AuditOutcome = "success"
+	AuditFailure AuditOutcome = "failure"
+)
+
+// AuditEvent is one structured audit record
+type AuditEvent struct {
+	Time        time.Time         `json:"time"`
+	Action      AuditAction       `json:"action"`
+	CustomerID  string            `json:"customer_id"`
+	Caller      string            `json:"caller,omitempty"`  // From ContextWithAuditInfo, or the session's source identity
+	Purpose     string            `json:"purpose,omitempty"` // From ContextWithAuditInfo, or the client's own reason
+	RoleARN     string            `json:"role_arn,omitempty"`
+	SessionName string            `json:"session_name,omitempty"`
+	Outcome     AuditOutcome      `json:"outcome"`
+	Error       string            `json:"error,omitempty"`
+	RequestID   string            `json:"request_id,omitempty"` // AWS request ID, when the action made one call
+	Details     map[string]string `json:"details,omitempty"`
+}
+
+// AuditSink receives audit events. Record is called synchronously, from
+// concurrent goroutines, before the audited call returns
+type AuditSink interface {
+	Record(ctx context.Context, event AuditEvent) error
+}
+
+// WithAuditSink sends an audit event for every customer role assumption,
+// setup completion, setup permission removal and storage change to sink.
+// Failures to record are logged; they don't fail the audited call
+func WithAuditSink(sink AuditSink) Option {
+	return func(c *Client) { c.auditSink = sink }
+}
+
+// auditInfoKey is the context key for ContextWithAuditInfo
+type auditInfoKey struct{}
+
+// auditInfo is who is acting and why
+type auditInfo struct {
+	caller, purpose string
+}
+
+// ContextWithAuditInfo returns a context whose audit events name caller,
+// e.g. an internal user or job, and purpose, e.g. a ticket or job name
+func ContextWithAuditInfo(ctx context.Context, caller, purpose string) context.Context {
+	return context.WithValue(ctx, auditInfoKey{}, auditInfo{caller: caller, purpose: purpose})
+}
+
+// audit completes event from ctx and sends it to the audit sink, if any.
+// Caller and purpose from ctx take precedence over the client's defaults
+func (c *Client) audit(ctx context.Context, event AuditEvent, err error) {
+	if c.auditSink == nil {
+		return
+	}
+
+	event.Time = c.now()
+	if info, ok := ctx.Value(auditInfoKey{}).(auditInfo); ok {
+		if info.caller != "" {
+			event.Caller = info.caller
+		}
+		if info.purpose != "" {
+			event.Purpose = info.purpose
+		}
+	}
+	event.Outcome = AuditSuccess
+	if err != nil {
+		event.Outcome = AuditFailure
+		event.Error = err.Error()
+		if event.RequestID == "" {
+			event.RequestID = requestIDFromError(err)
+		}
+	}
+
+	// Audit records outlive the request, so cancellation must not drop them
+	if rerr := c.auditSink.Record(context.WithoutCancel(ctx), event); rerr != nil {
+		c.logger.ErrorContext(ctx, "failed to record audit event", "action", event.Action, "customer_id", event.CustomerID, "error", rerr)
+	}
+}
+
+// requestIDFromError returns the AWS request ID of a failed call, if any
+func requestIDFromError(err error) string {
+	var withID interface{ ServiceRequestID() string }
+	if errors.As(err, &withID) {
+		return withID.ServiceRequestID()
+	}
+	return ""
+}
+
+// ErrAuditChainBroken is returned when an audit log's hash chain doesn't
+// verify, meaning entries were changed, removed or reordered
+var ErrAuditChainBroken = errors.New("audit log hash chain broken")
+
+// ErrAuditLogIncomplete is returned, along with ErrAuditChainBroken, when an
+// audit log ends part way through an entry, as a crash while writing leaves
+// it. RepairAuditLog removes the incomplete entry
+var ErrAuditLogIncomplete = errors.New("audit log ends with an incomplete entry")
+
+// auditEntry is one line of a FileAuditSink log. Hash covers the sequence
+// number, the previous entry's hash and the event exactly as written
+type auditEntry struct {
+	Seq      uint64          `json:"seq"`
+	PrevHash string          `json:"prev_hash"`
+	Event    json.RawMessage `json:"event"`
+	Hash     string          `json:"hash"`
+}
+
+// auditHash chains an entry to the one before it
+func auditHash(seq uint64, prevHash string, event []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\n%s\n", seq, prevHash)
+	h.Write(event)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// FileAuditSink appends audit events to a JSON lines file. Each entry
+// includes the hash of the one before it, so VerifyAuditLog detects edits,
+// deletions and reordering that leave the rest of the log in place. The
+// chain isn't keyed: anyone who can write the file can also rewrite it with
+// fresh hashes or cut entries off its end. Both are only detected by
+// comparing with a LastHash kept somewhere the log's writers can't change
+type FileAuditSink struct {
+	mu       sync.Mutex
+	file     *os.File
+	seq      uint64
+	lastHash string
+}
+
+// NewFileAuditSink opens or creates the audit log at path. An existing log
+// is verified first, and new entries continue its chain. A log that ends
+// with an incomplete entry is refused with ErrAuditLogIncomplete until
+// RepairAuditLog removes it
+func NewFileAuditSink(path string) (*FileAuditSink, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	verification, err := VerifyAuditLog(file)
+	if err != nil {
+		file.Close()
+		if errors.Is(err, ErrAuditLogIncomplete) {
+			return nil, fmt.Errorf("existing audit log %s: %w (RepairAuditLog removes the incomplete entry)", path, err)
+		}
+		return nil, fmt.Errorf("existing audit log %s: %w", path, err)
+	}
+
+	return &FileAuditSink{
+		file:     file,
+		seq:      uint64(verification.Entries),
+		lastHash: verification.LastHash,
+	}, nil
+}
+
+// Record appends event to the log and syncs it to disk
+func (s *FileAuditSink) Record(ctx context.Context, event AuditEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit event: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return errors.New("audit log is closed")
+	}
+
+	entry := auditEntry{Seq: s.seq + 1, PrevHash: s.lastHash, Event: data}
+	entry.Hash = auditHash(entry.Seq, entry.PrevHash, entry.Event)
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit entry: %w", err)
+	}
+
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync audit log: %w", err)
+	}
+
+	s.seq, s.lastHash = entry.Seq, entry.Hash
+	return nil
+}
+
+// LastHash returns the hash of the newest entry. Keeping it outside the log
+// lets VerifyAuditLog results be checked for rewrites and truncation
+func (s *FileAuditSink) LastHash() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastHash
+}
+
+// Close closes the log file
+func (s *FileAuditSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// AuditVerification summarizes a verified audit log
+type AuditVerification struct {
+	Entries  int    `json:"entries"`
+	LastHash string `json:"last_hash,omitempty"`
+}
+
+// VerifyAuditLog checks the hash chain of a FileAuditSink log. Errors wrap
+// ErrAuditChainBroken and name the first line that doesn't verify
+func VerifyAuditLog(r io.Reader) (*AuditVerification, error) {
+	verification := &AuditVerification{}
+
+	reader := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(data) == 0 {
+			return verification, nil
+		}
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("failed to read audit log: %w", err)
+		}
+		if err == io.EOF {
+			return nil, fmt.Errorf("%w: %w at line %d", ErrAuditChainBroken, ErrAuditLogIncomplete, line)
+		}
+
+		var entry auditEntry
+		if err := json.Unmarshal(bytes.TrimSpace(data), &entry); err != nil {
+			return nil, fmt.Errorf("%w: line %d is not an audit entry: %v", ErrAuditChainBroken, line, err)
+		}
+		if entry.Seq != uint64(verification.Entries)+1 {
+			return nil, fmt.Errorf("%w: line %d has sequence %d, want %d", ErrAuditChainBroken, line, entry.Seq, verification.Entries+1)
+		}
+		if entry.PrevHash != verification.LastHash {
+			return nil, fmt.Errorf("%w: line %d doesn't follow the previous entry", ErrAuditChainBroken, line)
+		}
+		if auditHash(entry.Seq, entry.PrevHash, entry.Event) != entry.Hash {
+			return nil, fmt.Errorf("%w: line %d was modified", ErrAuditChainBroken, line)
+		}
+
+		verification.Entries++
+		verification.LastHash = entry.Hash
+	}
+}
+
+// VerifyAuditFile is VerifyAuditLog for the log at path
+func VerifyAuditFile(path string) (*AuditVerification, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer file.Close()
+	return VerifyAuditLog(file)
+}
+
+// RepairAuditLog removes an incomplete entry from the end of the log at path
+// and returns the bytes it removed, or nil if every entry was complete. It
+// refuses to change a log whose complete entries don't verify
+func RepairAuditLog(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+
+	complete := data[:bytes.LastIndexByte(data, '\n')+1]
+	if _, err := VerifyAuditLog(bytes.NewReader(complete)); err != nil {
+		return nil, err
+	}
+	if len(complete) == len(data) {
+		return nil, nil
+	}
+	if err := os.Truncate(path, int64(len(complete))); err != nil {
+		return nil, fmt.Errorf("failed to truncate audit log: %w", err)
+	}
+	return data[len(complete):], nil
+}
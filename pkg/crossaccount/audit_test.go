@@ -0,0 +1,234 @@
+package crossaccount
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingAuditSink keeps audit events in memory
+type recordingAuditSink struct {
+	mu     sync.Mutex
+	events []AuditEvent
+}
+
+func (s *recordingAuditSink) Record(ctx context.Context, event AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+	return nil
+}
+
+// find returns the recorded events with action
+func (s *recordingAuditSink) find(action AuditAction) []AuditEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []AuditEvent
+	for _, e := range s.events {
+		if e.Action == action {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func TestAuditEvents(t *testing.T) {
+	ctx := context.Background()
+	sink := &recordingAuditSink{}
+	client := newIntegratedTestClient(t, SimpleConfig("test-service", "123456789012", "test-bucket"),
+		withClientOptions(WithAuditSink(sink))).client
+
+	if e := sink.find(AuditCompleteSetup); len(e) != 1 || e[0].Outcome != AuditSuccess || e[0].RoleARN != testSetupRoleARN {
+		t.Errorf("complete_setup events = %+v", e)
+	}
+	issued := sink.find(AuditIssueSession)
+	if len(issued) != 1 || issued[0].Purpose != "setup validation" || issued[0].SessionName != "test-service-validation" {
+		t.Errorf("validation session should be audited: %+v", issued)
+	}
+	saves := sink.find(AuditSaveIntegration)
+	if len(saves) != 2 || saves[1].Details["status"] != string(IntegrationActive) {
+		t.Errorf("save_integration events = %+v", saves)
+	}
+
+	jobCtx := ContextWithAuditInfo(ctx, "billing-worker", "JIRA-42")
+	if _, err := client.AssumeRoleWithOptions(jobCtx, "customer-123", AssumeRoleOptions{SourceIdentity: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	assumed := sink.find(AuditAssumeRole)
+	if len(assumed) != 1 || assumed[0].Caller != "billing-worker" || assumed[0].Purpose != "JIRA-42" || assumed[0].Details["scoped"] != "true" {
+		t.Errorf("assume_role events = %+v", assumed)
+	}
+	issued = sink.find(AuditIssueSession)
+	if len(issued) != 2 || issued[1].Caller != "billing-worker" || !strings.HasPrefix(issued[1].SessionName, "test-service-customer-123-") {
+		t.Errorf("issued session should name the caller: %+v", issued)
+	}
+
+	if _, err := client.AssumeRole(ctx, "customer-123"); err != nil {
+		t.Fatal(err)
+	}
+	if e := sink.find(AuditStoreSession); len(e) != 1 || e[0].SessionName == "" {
+		t.Errorf("only unscoped sessions are stored: %+v", e)
+	}
+
+	if _, err := client.AssumeRole(ctx, "unknown"); err == nil {
+		t.Fatal("AssumeRole() should fail for unknown customers")
+	}
+	assumed = sink.find(AuditAssumeRole)
+	if last := assumed[len(assumed)-1]; last.Outcome != AuditFailure || last.Error == "" || last.CustomerID != "unknown" {
+		t.Errorf("failed assume_role = %+v", last)
+	}
+}
+
+func TestFileAuditSink(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	sink, err := NewFileAuditSink(path)
+	if err != nil {
+		t.Fatalf("NewFileAuditSink() error = %v", err)
+	}
+	for _, id := range []string{"customer-1", "customer-2"} {
+		if err := sink.Record(ctx, AuditEvent{Time: time.Now(), Action: AuditAssumeRole, CustomerID: id, Outcome: AuditSuccess}); err != nil {
+			t.Fatalf("Record() error = %v", err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopening continues the chain
+	sink, err = NewFileAuditSink(path)
+	if err != nil {
+		t.Fatalf("NewFileAuditSink() on existing log error = %v", err)
+	}
+	defer sink.Close()
+	if err := sink.Record(ctx, AuditEvent{Action: AuditCompleteSetup, CustomerID: "customer-3", Outcome: AuditFailure, Details: map[string]string{"b": "2", "a": "1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	verification, err := VerifyAuditFile(path)
+	if err != nil {
+		t.Fatalf("VerifyAuditFile() error = %v", err)
+	}
+	if verification.Entries != 3 || verification.LastHash != sink.LastHash() {
+		t.Errorf("verification = %+v, want 3 entries ending in %s", verification, sink.LastHash())
+	}
+}
+
+func TestVerifyAuditLog_Tampering(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := NewFileAuditSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"customer-1", "customer-2", "customer-3"} {
+		if err := sink.Record(ctx, AuditEvent{Action: AuditAssumeRole, CustomerID: id, Outcome: AuditSuccess}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sink.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want 3", len(lines))
+	}
+	join := func(l ...[]byte) []byte { return bytes.Join(l, nil) }
+
+	tests := []struct {
+		name string
+		log  []byte
+	}{
+		{"edited", bytes.Replace(data, []byte("customer-2"), []byte("customer-9"), 1)},
+		{"outcome changed", bytes.Replace(data, []byte(`"success"`), []byte(`"failure"`), 1)},
+		{"deleted", join(lines[0], lines[2])},
+		{"reordered", join(lines[1], lines[0], lines[2])},
+		{"partial line", data[:len(data)-10]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := VerifyAuditLog(bytes.NewReader(tt.log)); !errors.Is(err, ErrAuditChainBroken) {
+				t.Errorf("VerifyAuditLog() error = %v, want ErrAuditChainBroken", err)
+			}
+		})
+	}
+
+	if err := os.WriteFile(path, tests[0].log, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileAuditSink(path); !errors.Is(err, ErrAuditChainBroken) {
+		t.Errorf("NewFileAuditSink() should refuse a tampered log, error = %v", err)
+	}
+}
+
+func TestRepairAuditLog(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := NewFileAuditSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"customer-1", "customer-2"} {
+		if err := sink.Record(ctx, AuditEvent{Action: AuditAssumeRole, CustomerID: id, Outcome: AuditSuccess}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sink.Close()
+
+	if removed, err := RepairAuditLog(path); err != nil || removed != nil {
+		t.Fatalf("RepairAuditLog() on a complete log = %q, %v", removed, err)
+	}
+
+	// A crash part way through writing the third entry
+	torn := []byte(`{"seq":3,"prev_hash":"`)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(torn)
+	file.Close()
+
+	if _, err := NewFileAuditSink(path); !errors.Is(err, ErrAuditLogIncomplete) || !strings.Contains(err.Error(), "RepairAuditLog") {
+		t.Fatalf("NewFileAuditSink() error = %v, want ErrAuditLogIncomplete", err)
+	}
+	removed, err := RepairAuditLog(path)
+	if err != nil || !bytes.Equal(removed, torn) {
+		t.Fatalf("RepairAuditLog() = %q, %v, want %q", removed, err, torn)
+	}
+
+	sink, err = NewFileAuditSink(path)
+	if err != nil {
+		t.Fatalf("NewFileAuditSink() after repair error = %v", err)
+	}
+	defer sink.Close()
+	if err := sink.Record(ctx, AuditEvent{Action: AuditAssumeRole, CustomerID: "customer-3", Outcome: AuditSuccess}); err != nil {
+		t.Fatal(err)
+	}
+	if verification, err := VerifyAuditFile(path); err != nil || verification.Entries != 3 {
+		t.Errorf("VerifyAuditFile() = %+v, %v, want 3 entries", verification, err)
+	}
+
+	// Broken chains aren't repaired
+	data, _ := os.ReadFile(path)
+	tampered := append(bytes.Replace(data, []byte("customer-1"), []byte("customer-9"), 1), torn...)
+	if err := os.WriteFile(path, tampered, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RepairAuditLog(path); !errors.Is(err, ErrAuditChainBroken) || errors.Is(err, ErrAuditLogIncomplete) {
+		t.Errorf("RepairAuditLog() on a tampered log error = %v, want ErrAuditChainBroken", err)
+	}
+	if after, _ := os.ReadFile(path); !bytes.Equal(after, tampered) {
+		t.Error("RepairAuditLog() changed a tampered log")
+	}
+}
@@ -6,24 +6,129 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"io"
+	"log/slog"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/organizations"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/sts"
+
+	"github.com/scttfrdmn/aws-remote-access-patterns/pkg/telemetry"
 )
 
 // Client provides simple cross-account AWS integration
 // This handles all the complexity so your customers just click one link
 type Client struct {
-	config  *Config
-	storage CredentialStorage
+	config       *Config
+	storage      CredentialStorage  // Cached customer sessions
+	integrations IntegrationStorage // Durable customer records
+
+	stsClient STSAPI
+	now       func() time.Time
+	logger    *slog.Logger
+
+	awsConfigMu sync.Mutex
+	awsConfig   *aws.Config // Service identity, loaded on first use unless provided
+
+	integrationMu sync.Mutex // Serializes integration record updates
+	setupKey      []byte     // Signs setup tokens
+
+	sessionMu sync.Mutex
+	sessions  map[string]aws.Credentials // Assumed-role sessions by customer ID
+	inflight  map[string]*sessionCall
+	clears    map[string]uint64 // clearSession calls by customer ID
+
+	newCloudFormation func(aws.Config) CloudFormationAPI // Clients for customer accounts
+	newIAM            func(aws.Config) IAMAPI
+	newSTS            func(aws.Config) STSAPI
+	newOrganizations  func(aws.Config) OrganizationsAPI
+	newStackSets      func(aws.Config) StackSetAPI
+	stackPollDelay    time.Duration                       // Minimum delay between stack status checks
+
+	auditSink AuditSink // Receives audit events, if set
+	telemetry telemetry.Recorder
+
+	s3Client          *s3.Client
+	templateMu        sync.Mutex
+	publishedTemplate map[string]bool // Template object keys uploaded by this client
+}
+
+// STSAPI is the subset of the STS client used to access customer accounts
+type STSAPI interface {
+	AssumeRole(ctx context.Context, params *sts.AssumeRoleInput, optFns ...func(*sts.Options)) (*sts.AssumeRoleOutput, error)
+	GetCallerIdentity(ctx context.Context, params *sts.GetCallerIdentityInput, optFns ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error)
+}
+
+// Option allows customization of the client
+type Option func(*Client)
+
+// WithStorage sets where customer sessions are cached. If storage also
+// implements IntegrationStorage, as MemoryStorage and FileStorage do, it
+// holds customer integrations too. The default is in-memory storage, which
+// is lost on restart
+func WithStorage(storage CredentialStorage) Option {
+	return func(c *Client) { c.storage = storage }
+}
+
+// WithIntegrationStorage sets where customer integration records are
+// persisted, overriding the storage given to WithStorage
+func WithIntegrationStorage(storage IntegrationStorage) Option {
+	return func(c *Client) { c.integrations = storage }
+}
+
+// WithSTSClient sets the STS client used to assume customer roles
+// By default one is created from the base AWS config
+func WithSTSClient(client STSAPI) Option {
+	return func(c *Client) { c.stsClient = client }
+}
+
+// WithBaseAWSConfig sets your service's own AWS config, used to call STS and
+// S3 and as the base of configs returned by AssumeRole. By default it is
+// loaded with config.LoadDefaultConfig on first use
+func WithBaseAWSConfig(cfg aws.Config) Option {
+	return func(c *Client) { c.awsConfig = &cfg }
+}
+
+// WithClock sets the time source, mainly for tests
+func WithClock(now func() time.Time) Option {
+	return func(c *Client) { c.now = now }
+}
+
+// WithLogger sets the logger for integration events
+// Logging is disabled by default
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *Client) { c.logger = logger }
+}
+
+// WithS3Client sets the S3 client used to publish CloudFormation templates
+// By default one is created from the base AWS config on first use
+func WithS3Client(client *s3.Client) Option {
+	return func(c *Client) { c.s3Client = client }
+}
+
+// WithCloudFormationClientFactory sets how CloudFormation clients for customer
+// accounts are created from their assumed-role config
+func WithCloudFormationClientFactory(factory func(cfg aws.Config) CloudFormationAPI) Option {
+	return func(c *Client) { c.newCloudFormation = factory }
+}
+
+// WithSTSClientFactory sets how STS clients using customer credentials are
+// created
+func WithSTSClientFactory(factory func(cfg aws.Config) STSAPI) Option {
+	return func(c *Client) { c.newSTS = factory }
 }
 
 // New creates a new cross-account client with sane defaults
 // Only requires your service name and account ID to get started
-func New(cfg *Config) (*Client, error) {
+func New(cfg *Config, opts ...Option) (*Client, error) {
 	if cfg == nil {
 		return nil, fmt.Errorf("config is required")
 	}
@@ -43,174 +148,431 @@ func New(cfg *Config) (*Client, error) {
 		return nil, fmt.Errorf("invalid config: %w", err)
 	}
 
-	return &Client{
-		config:  cfg,
-		storage: NewMemoryStorage(), // Simple in-memory storage by default
-	}, nil
+	c := &Client{
+		config:            cfg,
+		now:               time.Now,
+		logger:            slog.New(slog.NewTextHandler(io.Discard, nil)),
+		sessions:          make(map[string]aws.Credentials),
+		inflight:          make(map[string]*sessionCall),
+		clears:            make(map[string]uint64),
+		publishedTemplate: make(map[string]bool),
+		newCloudFormation: func(cfg aws.Config) CloudFormationAPI { return cloudformation.NewFromConfig(cfg) },
+		newIAM:            func(cfg aws.Config) IAMAPI { return iam.NewFromConfig(cfg) },
+		newSTS:            func(cfg aws.Config) STSAPI { return sts.NewFromConfig(cfg) },
+		newOrganizations:  func(cfg aws.Config) OrganizationsAPI { return organizations.NewFromConfig(cfg) },
+		newStackSets:      func(cfg aws.Config) StackSetAPI { return cloudformation.NewFromConfig(cfg) },
+		stackPollDelay:    defaultStackPollDelay,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	// Simple in-memory storage by default
+	if c.storage == nil {
+		c.storage = NewMemoryStorage()
+	}
+	if c.integrations == nil {
+		integrations, ok := c.storage.(IntegrationStorage)
+		if !ok {
+			return nil, fmt.Errorf("storage %T does not implement IntegrationStorage; use WithIntegrationStorage", c.storage)
+		}
+		c.integrations = integrations
+	}
+	if c.telemetry == nil {
+		c.telemetry = telemetry.Nop()
+	} else {
+		c.storage = &instrumentedCredentialStorage{CredentialStorage: c.storage, recorder: c.telemetry}
+		c.integrations = &instrumentedIntegrationStorage{IntegrationStorage: c.integrations, recorder: c.telemetry}
+	}
+
+	if c.setupKey == nil {
+		c.setupKey = make([]byte, minSetupSigningKeyLength)
+		if _, err := rand.Read(c.setupKey); err != nil {
+			return nil, fmt.Errorf("failed to generate setup signing key: %w", err)
+		}
+		c.logger.Warn("no setup signing key configured; setup links won't survive a restart")
+	} else if len(c.setupKey) < minSetupSigningKeyLength {
+		return nil, fmt.Errorf("setup signing key must be at least %d bytes", minSetupSigningKeyLength)
+	}
+
+	return c, nil
 }
 
 // GenerateSetupLink creates a one-click setup link for your customer
 // This is the main entry point - customer clicks this link and follows the wizard
 func (c *Client) GenerateSetupLink(customerID, customerName string) (*SetupResponse, error) {
-	if customerID == "" {
-		return nil, fmt.Errorf("customer ID is required")
+	return c.GenerateSetupLinkWithContext(context.Background(), customerID, customerName)
+}
+
+// GenerateSetupLinkWithContext is GenerateSetupLink with a context for the
+// template upload to S3
+func (c *Client) GenerateSetupLinkWithContext(ctx context.Context, customerID, customerName string) (*SetupResponse, error) {
+	return c.GenerateSetupLinkWithOptions(ctx, customerID, customerName, SetupLinkOptions{})
+}
+
+// GenerateSetupLinkWithOptions issues a setup link whose session can only be
+// completed as opts allow. Each link replaces the customer's previous session
+func (c *Client) GenerateSetupLinkWithOptions(ctx context.Context, customerID, customerName string, opts SetupLinkOptions) (*SetupResponse, error) {
+	if err := validateSetupRequest(customerID, customerName, opts); err != nil {
+		return nil, err
 	}
-	if customerName == "" {
-		return nil, fmt.Errorf("customer name is required")
+
+	// Publish the template rendered from this service's permissions
+	templateURL, templateVersion, err := c.uploadTemplate(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to publish CloudFormation template: %w", err)
 	}
 
-	// Generate a unique, secure external ID for this customer
-	externalID := c.generateSecureExternalID(customerID)
+	stackName := c.stackName(customerID)
+	roleName := c.customerRoleName(customerID)
+
+	integration, token, err := c.startSetup(ctx, customerID, customerName, opts, func(i *CustomerIntegration) {
+		i.Deployment = DeploymentCloudFormation
+		i.StackName = stackName
+		i.StackRegion = c.config.DefaultRegion
+		i.TemplateVersion = templateVersion
+	})
+	if err != nil {
+		return nil, err
+	}
+	var expiresAt time.Time
+	if token != "" {
+		expiresAt = integration.SetupSession.ExpiresAt
+	}
 
 	// Create CloudFormation launch URL with all parameters pre-filled
-	templateURL := fmt.Sprintf("https://%s.s3.amazonaws.com/cross-account-role.yaml", c.config.TemplateS3Bucket)
-	
 	params := url.Values{}
 	params.Set("templateURL", templateURL)
-	params.Set("stackName", fmt.Sprintf("%s-Integration-%s", c.config.ServiceName, customerName))
-	params.Set("param_ExternalId", externalID)
+	params.Set("stackName", stackName)
+	params.Set("param_ExternalId", integration.ExternalID)
 	params.Set("param_ServiceAccountId", c.config.ServiceAccountID)
-	params.Set("param_RoleName", fmt.Sprintf("%s-CrossAccount-%s", c.config.ServiceName, customerID))
+	params.Set("param_RoleName", roleName)
 	params.Set("param_SetupPhase", "true") // Include setup permissions initially
+	if token != "" && c.config.SetupCallbackTopicARN != "" {
+		params.Set("param_SetupToken", token) // Completes setup from the stack
+	}
 
 	launchURL := fmt.Sprintf("https://console.aws.amazon.com/cloudformation/home?region=%s#/stacks/quickcreate?%s", 
 		c.config.DefaultRegion, params.Encode())
 
 	return &SetupResponse{
-		LaunchURL:      launchURL,
-		ExternalID:     externalID,
-		CustomerID:     customerID,
-		StackName:      params.Get("stackName"),
-		SetupComplete:  false,
+		LaunchURL:           launchURL,
+		ExternalID:          integration.ExternalID,
+		CustomerID:          customerID,
+		StackName:           integration.StackName,
+		SetupComplete:       integration.Status.Operational(),
+		SetupToken:          token,
+		ExpiresAt:           expiresAt,
+		PermissionReviewURL: c.config.PermissionReviewURL,
 	}, nil
 }
 
-// CompleteSetup verifies the customer's role and stores credentials
+// validateSetupRequest checks the arguments of a setup link request
+func validateSetupRequest(customerID, customerName string, opts SetupLinkOptions) error {
+	if customerID == "" {
+		return fmt.Errorf("customer ID is required")
+	}
+	if customerName == "" {
+		return fmt.Errorf("customer name is required")
+	}
+	if opts.CustomerAccountID != "" && !isAccountID(opts.CustomerAccountID) {
+		return fmt.Errorf("customer account ID must be a 12-digit AWS account ID")
+	}
+	return nil
+}
+
+// customerRoleName is the name of the role a customer creates for us
+func (c *Client) customerRoleName(customerID string) string {
+	return fmt.Sprintf("%s-CrossAccount-%s", c.config.ServiceName, customerID)
+}
+
+// startSetup records the customer's pending integration with a new external
+// ID and setup session, letting deploy fill in how the role gets deployed.
+// Established integrations keep their record and external ID and get no
+// setup token
+func (c *Client) startSetup(ctx context.Context, customerID, customerName string, opts SetupLinkOptions, deploy func(*CustomerIntegration)) (*CustomerIntegration, string, error) {
+	integration, err := c.updateIntegration(ctx, customerID, true, func(i *CustomerIntegration) error {
+		if i.Status.Operational() {
+			return nil
+		}
+
+		// Generate a unique, secure external ID for this customer
+		i.ExternalID = c.generateSecureExternalID(customerID)
+		i.CustomerName = customerName
+		i.RoleName = c.customerRoleName(customerID)
+		i.StackName = ""
+		i.StackRegion = ""
+		i.Organization = nil
+		i.SetupPhase = true
+		i.DeployedPermissions = copyPermissions(c.config.OngoingPermissions)
+		deploy(i)
+
+		session, err := c.newSetupSession(i.ExternalID, i.StackName, i.RoleName, opts)
+		if err != nil {
+			return err
+		}
+		i.SetupSession = session
+
+		return i.transition(IntegrationLinkGenerated, "setup link generated", c.now())
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to record integration: %w", err)
+	}
+
+	// Established integrations get no new session to complete
+	if integration.Status.Operational() {
+		return integration, "", nil
+	}
+	token, err := c.signSetupToken(customerID, integration.SetupSession)
+	if err != nil {
+		return nil, "", err
+	}
+	c.logger.InfoContext(ctx, "setup link generated", "customer_id", customerID, "deployment", integration.Deployment, "setup_session", integration.SetupSession.ID, "expires", integration.SetupSession.ExpiresAt)
+	c.funnel(ctx, funnelLinkGenerated)
+	return integration, token, nil
+}
+
+// CompleteSetup verifies the customer's role and records the integration
 // Call this after the customer has created the CloudFormation stack
 func (c *Client) CompleteSetup(ctx context.Context, req *SetupCompleteRequest) error {
 	if req == nil {
 		return fmt.Errorf("setup request is required")
 	}
-	if req.CustomerID == "" || req.RoleARN == "" || req.ExternalID == "" {
-		return fmt.Errorf("customer ID, role ARN, and external ID are all required")
+
+	ctx, span := c.telemetry.StartSpan(ctx, "crossaccount.CompleteSetup", telemetry.String("customer_id", req.CustomerID))
+	err := c.completeSetup(ctx, req)
+	span.End(err)
+
+	if err != nil {
+		c.funnel(ctx, funnelSetupRejected)
+	} else {
+		c.funnel(ctx, funnelSetupCompleted)
+	}
+	c.audit(ctx, AuditEvent{Action: AuditCompleteSetup, CustomerID: req.CustomerID, RoleARN: req.RoleARN}, err)
+	return err
+}
+
+// completeSetup is CompleteSetup without auditing
+func (c *Client) completeSetup(ctx context.Context, req *SetupCompleteRequest) error {
+	if req.CustomerID == "" || req.RoleARN == "" || req.ExternalID == "" || req.SetupToken == "" {
+		return fmt.Errorf("customer ID, role ARN, external ID, and setup token are all required")
+	}
+
+	// Only the setup link's own session can complete setup
+	claims, err := c.parseSetupToken(req.SetupToken)
+	if err != nil {
+		return err
+	}
+	if claims.CustomerID != req.CustomerID {
+		return fmt.Errorf("%w: issued for a different customer", ErrInvalidSetupToken)
+	}
+	pending, err := c.integrations.GetIntegration(ctx, req.CustomerID)
+	if err != nil {
+		return fmt.Errorf("customer not found: %w", err)
+	}
+	if err := c.checkSetupSession(pending.SetupSession, claims, req); err != nil {
+		c.logger.WarnContext(ctx, "setup completion rejected", "customer_id", req.CustomerID, "role_arn", req.RoleARN, "error", err)
+		return err
 	}
 
 	// Test that we can actually assume the role
-	if err := c.validateRoleAccess(ctx, req.RoleARN, req.ExternalID); err != nil {
+	creds, err := c.validateRoleAccess(ctx, req.CustomerID, "setup validation", req.RoleARN, req.ExternalID)
+	if err != nil {
 		return fmt.Errorf("role validation failed: %w", err)
 	}
 
-	// Store the credentials securely
-	creds := &StoredCredentials{
-		RoleARN:     req.RoleARN,
-		ExternalID:  req.ExternalID,
-		SessionName: fmt.Sprintf("%s-%s", c.config.ServiceName, req.CustomerID),
-		CreatedAt:   time.Now(),
-		LastUsed:    time.Now(),
-		Expiration:  time.Now().Add(24 * time.Hour), // Set expiration
+	// Refuse roles that anyone but us, with this external ID, could assume
+	cfg, err := c.credentialsConfig(ctx, creds)
+	if err != nil {
+		return err
+	}
+	trust := c.checkTrustPolicy(ctx, cfg, req.RoleARN, req.ExternalID)
+	if !trust.Trusted() {
+		err := &TrustPolicyError{Report: trust}
+		c.logger.WarnContext(ctx, "setup completion rejected", "customer_id", req.CustomerID, "role_arn", req.RoleARN, "error", err)
+		return err
 	}
 
-	if err := c.storage.Store(ctx, req.CustomerID, creds); err != nil {
-		return fmt.Errorf("failed to store credentials: %w", err)
+	// Record the verified role, keeping details from the setup link
+	integration, err := c.updateIntegration(ctx, req.CustomerID, false, func(i *CustomerIntegration) error {
+		// Another request may have used or replaced the session meanwhile
+		if err := c.checkSetupSession(i.SetupSession, claims, req); err != nil {
+			return err
+		}
+
+		now := c.now()
+		if err := i.transition(IntegrationRoleVerified, "role assumed with external ID", now); err != nil {
+			return err
+		}
+		i.RoleARN = req.RoleARN
+		i.ExternalID = req.ExternalID
+		i.StackName = i.SetupSession.StackName
+		i.RoleName = i.SetupSession.RoleName
+		i.SetupSession.UsedAt = now
+		i.TrustPolicy = trust
+
+		if i.SetupPhase && len(c.config.SetupPermissions) > 0 {
+			return i.transition(IntegrationSetupActive, "setup permissions attached", now)
+		}
+		i.SetupPhase = false
+		return i.transition(IntegrationActive, "no setup permissions attached", now)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record integration: %w", err)
 	}
+	c.clearSession(ctx, req.CustomerID)
 
+	c.logger.InfoContext(ctx, "customer setup completed", "customer_id", req.CustomerID, "role_arn", req.RoleARN, "status", integration.Status)
 	return nil
 }
 
 // AssumeRole gets temporary credentials for a customer's AWS account
 // This is what you use in your application code to access customer resources
+// The returned config refreshes its credentials before they expire, so it
+// keeps working in jobs that run longer than SessionDuration. Sessions are
+// cached per customer and shared between configs
 func (c *Client) AssumeRole(ctx context.Context, customerID string) (aws.Config, error) {
-	if customerID == "" {
-		return aws.Config{}, fmt.Errorf("customer ID is required")
+	return c.assumeRole(ctx, customerID, nil)
+}
+
+// AssumeRoleWithOptions is AssumeRole with session tags, a source identity
+// and session policies. Session policies can only narrow what the role
+// allows, e.g. to one bucket for a single job. Tags and the source identity
+// show up in the customer's CloudTrail. Sessions with the same options are
+// cached and shared
+func (c *Client) AssumeRoleWithOptions(ctx context.Context, customerID string, opts AssumeRoleOptions) (aws.Config, error) {
+	if err := opts.validate(); err != nil {
+		return aws.Config{}, fmt.Errorf("invalid assume role options: %w", err)
 	}
 
-	// Get stored credentials
-	creds, err := c.storage.Retrieve(ctx, customerID)
-	if err != nil {
-		return aws.Config{}, fmt.Errorf("customer not found: %w", err)
+	// Later changes to the caller's maps and slices must not change the session
+	scoped := AssumeRoleOptions{
+		SessionTags:       make(map[string]string, len(opts.SessionTags)),
+		TransitiveTagKeys: append([]string(nil), opts.TransitiveTagKeys...),
+		SourceIdentity:    opts.SourceIdentity,
+		Policy:            append([]Permission(nil), opts.Policy...),
+		PolicyARNs:        append([]string(nil), opts.PolicyARNs...),
+	}
+	for key, value := range opts.SessionTags {
+		scoped.SessionTags[key] = value
+	}
+	return c.assumeRole(ctx, customerID, &scoped)
+}
+
+// assumeRole returns a config with refreshing credentials for the customer,
+// scoped by options if set
+func (c *Client) assumeRole(ctx context.Context, customerID string, options *AssumeRoleOptions) (aws.Config, error) {
+	if customerID == "" {
+		return aws.Config{}, fmt.Errorf("customer ID is required")
 	}
 
 	// Load our service's AWS config
-	cfg, err := config.LoadDefaultConfig(ctx)
+	cfg, err := c.baseAWSConfig(ctx)
 	if err != nil {
-		return aws.Config{}, fmt.Errorf("failed to load AWS config: %w", err)
+		return aws.Config{}, err
 	}
 
-	stsClient := sts.NewFromConfig(cfg)
-
-	// Assume the customer's role
-	sessionName := fmt.Sprintf("%s-%s-%d", c.config.ServiceName, customerID, time.Now().Unix())
-	result, err := stsClient.AssumeRole(ctx, &sts.AssumeRoleInput{
-		RoleArn:         aws.String(creds.RoleARN),
-		RoleSessionName: aws.String(sessionName),
-		ExternalId:      aws.String(creds.ExternalID),
-		DurationSeconds: aws.Int32(int32(c.config.SessionDuration.Seconds())),
-	})
+	// Fail now rather than on the first API call if the role can't be assumed
+	ctx, span := c.telemetry.StartSpan(ctx, "crossaccount.AssumeRole", telemetry.String("customer_id", customerID))
+	_, err = c.customerCredentials(ctx, customerID, options)
+	span.End(err)
+	event := AuditEvent{Action: AuditAssumeRole, CustomerID: customerID}
+	if options != nil {
+		event.Caller = options.SourceIdentity
+		event.Details = map[string]string{"scoped": "true"}
+	}
+	c.audit(ctx, event, err)
 	if err != nil {
-		return aws.Config{}, fmt.Errorf("failed to assume role: %w", err)
+		return aws.Config{}, err
 	}
 
-	// Create new AWS config with the temporary credentials
-	return config.LoadDefaultConfig(ctx,
-		config.WithCredentialsProvider(&staticCredentialsProvider{
-			accessKey:    aws.ToString(result.Credentials.AccessKeyId),
-			secretKey:    aws.ToString(result.Credentials.SecretAccessKey),
-			sessionToken: aws.ToString(result.Credentials.SessionToken),
-		}),
-		config.WithRegion(c.config.DefaultRegion),
+	// Create new AWS config with refreshing customer credentials
+	customerCfg := cfg.Copy()
+	customerCfg.Region = c.config.DefaultRegion
+	customerCfg.Credentials = aws.NewCredentialsCache(
+		&customerCredentialsProvider{client: c, customerID: customerID, options: options},
+		func(o *aws.CredentialsCacheOptions) { o.ExpiryWindow = sessionRefreshWindow },
 	)
+	return customerCfg, nil
 }
 
 // RemoveSetupPermissions removes temporary setup permissions from customer role
 // Call this after initial setup is complete to improve security
 func (c *Client) RemoveSetupPermissions(customerID string) (*CleanupInstructions, error) {
-	if customerID == "" {
-		return nil, fmt.Errorf("customer ID is required")
-	}
+	return c.RemoveSetupPermissionsWithContext(context.Background(), customerID)
+}
 
-	creds, err := c.storage.Retrieve(context.Background(), customerID)
-	if err != nil {
-		return nil, fmt.Errorf("customer not found: %w", err)
-	}
-
-	// Update credentials to mark setup phase as complete
-	creds.LastUsed = time.Now()
-	if err := c.storage.Store(context.Background(), customerID, creds); err != nil {
-		return nil, fmt.Errorf("failed to update credentials: %w", err)
-	}
-
-	// Return instructions for customer
-	return &CleanupInstructions{
-		CustomerID:    customerID,
-		Instructions: []string{
-			"1. Go to AWS CloudFormation console",
-			"2. Find your stack: " + fmt.Sprintf("%s-Integration-*", c.config.ServiceName),
-			"3. Click 'Update'",
-			"4. Change 'SetupPhase' parameter from 'true' to 'false'",
-			"5. Click 'Update stack'",
-		},
-		AutomationScript: c.generateCleanupScript(customerID),
-	}, nil
+// GetIntegration returns the integration record for a customer
+func (c *Client) GetIntegration(ctx context.Context, customerID string) (*CustomerIntegration, error) {
+	return c.integrations.GetIntegration(ctx, customerID)
+}
+
+// ListIntegrations returns all customer integration records
+func (c *Client) ListIntegrations(ctx context.Context) ([]*CustomerIntegration, error) {
+	return c.integrations.ListIntegrations(ctx)
 }
 
-// validateRoleAccess tests that we can assume the customer's role
-func (c *Client) validateRoleAccess(ctx context.Context, roleARN, externalID string) error {
-	cfg, err := config.LoadDefaultConfig(ctx)
+// validateRoleAccess tests that we can assume the customer's role and
+// returns the validation session's credentials
+func (c *Client) validateRoleAccess(ctx context.Context, customerID, purpose, roleARN, externalID string) (aws.Credentials, error) {
+	stsClient, err := c.sts(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to load AWS config: %w", err)
+		return aws.Credentials{}, err
 	}
 
-	stsClient := sts.NewFromConfig(cfg)
-
 	// Try to assume the role
-	_, err = stsClient.AssumeRole(ctx, &sts.AssumeRoleInput{
+	result, err := c.stsAssumeRole(ctx, stsClient, customerID, purpose, &sts.AssumeRoleInput{
 		RoleArn:         aws.String(roleARN),
 		RoleSessionName: aws.String(fmt.Sprintf("%s-validation", c.config.ServiceName)),
 		ExternalId:      aws.String(externalID),
 		DurationSeconds: aws.Int32(900), // 15 minutes for validation
 	})
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+	if result.Credentials == nil {
+		return aws.Credentials{}, fmt.Errorf("assume role returned no credentials")
+	}
 
-	return err
+	return aws.Credentials{
+		AccessKeyID:     aws.ToString(result.Credentials.AccessKeyId),
+		SecretAccessKey: aws.ToString(result.Credentials.SecretAccessKey),
+		SessionToken:    aws.ToString(result.Credentials.SessionToken),
+		Source:          "crossaccount:validation",
+	}, nil
+}
+
+// baseAWSConfig returns the service's own AWS config, loading the default
+// config on first use
+func (c *Client) baseAWSConfig(ctx context.Context) (aws.Config, error) {
+	c.awsConfigMu.Lock()
+	defer c.awsConfigMu.Unlock()
+
+	if c.awsConfig != nil {
+		return *c.awsConfig, nil
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(c.config.DefaultRegion))
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	c.awsConfig = &cfg
+	return cfg, nil
+}
+
+// sts returns the configured STS client or one built from the base config
+func (c *Client) sts(ctx context.Context) (STSAPI, error) {
+	if c.stsClient != nil {
+		return c.stsClient, nil
+	}
+
+	cfg, err := c.baseAWSConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return sts.NewFromConfig(cfg), nil
 }
 
 // generateSecureExternalID creates a cryptographically secure external ID
@@ -260,30 +622,60 @@ func GenerateExternalID(customerID string) string {
 	return fmt.Sprintf("%s-%s", customerHash, hexString)
 }
 
+// stackName returns the CloudFormation stack name for a customer's integration
+// Stack names only allow letters, digits and hyphens, and must start with a letter
+func (c *Client) stackName(customerID string) string {
+	name := []byte(fmt.Sprintf("%s-Integration-%s", c.config.ServiceName, customerID))
+	for i, ch := range name {
+		if !(ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch == '-') {
+			name[i] = '-'
+		}
+	}
+	if len(name) > 128 {
+		name = name[:128]
+	}
+	return string(name)
+}
+
 // generateCleanupScript creates an AWS CLI script for removing setup permissions
-func (c *Client) generateCleanupScript(customerID string) string {
-	stackName := fmt.Sprintf("%s-Integration-%s", c.config.ServiceName, customerID)
+// from a stack with the given parameters
+func (c *Client) generateCleanupScript(stackName, region string, parameterKeys []string) string {
 	return fmt.Sprintf(`#!/bin/bash
 # Remove setup permissions from %s integration
 aws cloudformation update-stack \
+  --region "%s" \
   --stack-name "%s" \
   --use-previous-template \
-  --parameters ParameterKey=SetupPhase,ParameterValue=false \
-  --capabilities CAPABILITY_IAM
+  --parameters %s \
+  --capabilities CAPABILITY_NAMED_IAM
 
-echo "Setup permissions removed. Integration is now secure for ongoing operations."`, 
-		c.config.ServiceName, stackName)
+aws cloudformation wait stack-update-complete --region "%s" --stack-name "%s"
+
+echo "Setup permissions removed. Integration is now secure for ongoing operations."`,
+		c.config.ServiceName, region, stackName, stackUpdateParameters(parameterKeys, map[string]string{"SetupPhase": "false"}),
+		region, stackName)
 }
 
-// staticCredentialsProvider implements aws.CredentialsProvider for temporary credentials
-type staticCredentialsProvider struct {
-	accessKey, secretKey, sessionToken string
+// templateParameterKeys returns the parameters of the template this client
+// currently generates
+func (c *Client) templateParameterKeys() []string {
+	keys := []string{"SetupPhase", "ExternalId", "ServiceAccountId", "RoleName"}
+	if c.config.SetupCallbackTopicARN != "" {
+		keys = append(keys, "SetupToken")
+	}
+	return keys
 }
 
-func (s *staticCredentialsProvider) Retrieve(ctx context.Context) (aws.Credentials, error) {
-	return aws.Credentials{
-		AccessKeyID:     s.accessKey,
-		SecretAccessKey: s.secretKey,
-		SessionToken:    s.sessionToken,
-	}, nil
-}
\ No newline at end of file
+// stackUpdateParameters renders the --parameters of an update-stack command
+// that changes the given parameters and keeps the rest of keys
+func stackUpdateParameters(keys []string, values map[string]string) string {
+	params := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if value, ok := values[key]; ok {
+			params = append(params, fmt.Sprintf("ParameterKey=%s,ParameterValue=%s", key, value))
+			continue
+		}
+		params = append(params, fmt.Sprintf("ParameterKey=%s,UsePreviousValue=true", key))
+	}
+	return strings.Join(params, " \\\n    ")
+}
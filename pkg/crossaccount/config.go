@@ -2,6 +2,8 @@ package crossaccount
 
 import (
 	"errors"
+	"net/url"
+	"strings"
 	"time"
 )
 
@@ -14,10 +16,33 @@ type Config struct {
 	
 	// Required: Where to host CloudFormation templates
 	TemplateS3Bucket string `json:"template_s3_bucket" yaml:"template_s3_bucket"`
+
+	// Optional: How templates are published to the bucket
+	TemplateS3Region      string        `json:"template_s3_region,omitempty" yaml:"template_s3_region,omitempty"`             // Defaults to DefaultRegion
+	TemplateKeyPrefix     string        `json:"template_key_prefix,omitempty" yaml:"template_key_prefix,omitempty"`           // Defaults to "templates/"
+	TemplateBucketOwner   string        `json:"template_bucket_owner,omitempty" yaml:"template_bucket_owner,omitempty"`       // Expected bucket owner account ID
+	PresignTemplateURLs   bool          `json:"presign_template_urls,omitempty" yaml:"presign_template_urls,omitempty"`       // For private template buckets
+	TemplateURLExpiration time.Duration `json:"template_url_expiration,omitempty" yaml:"template_url_expiration,omitempty"` // Presigned URL lifetime, defaults to 24h
 	
 	// Optional: Will use sensible defaults if not specified
-	DefaultRegion     string        `json:"default_region" yaml:"default_region"`
-	SessionDuration   time.Duration `json:"session_duration" yaml:"session_duration"`
+	DefaultRegion         string        `json:"default_region" yaml:"default_region"`
+	SessionDuration       time.Duration `json:"session_duration" yaml:"session_duration"`
+	SetupLinkExpiration   time.Duration `json:"setup_link_expiration,omitempty" yaml:"setup_link_expiration,omitempty"`     // How long a setup session can be completed, defaults to 72h
+	ExternalIDGracePeriod time.Duration `json:"external_id_grace_period,omitempty" yaml:"external_id_grace_period,omitempty"` // How long the old external ID works during a rotation, defaults to 7 days
+
+	// Optional: SNS topic in DefaultRegion that customer stacks notify when
+	// the role is ready, so setup completes without copying the role ARN.
+	// Subscribe a SetupCallbackHandler to it
+	SetupCallbackTopicARN string `json:"setup_callback_topic_arn,omitempty" yaml:"setup_callback_topic_arn,omitempty"`
+
+	// Optional: Where customers who use Terraform get the module from
+	// GenerateTerraformModule, e.g. a git URL or registry address. Defaults
+	// to a local directory, ./<service_name>-cross-account-role
+	TerraformModuleSource string `json:"terraform_module_source,omitempty" yaml:"terraform_module_source,omitempty"`
+
+	// Optional: Where you serve PermissionReviewHandler, so customers' security
+	// teams can review the role before launching it. Returned with setup links
+	PermissionReviewURL string `json:"permission_review_url,omitempty" yaml:"permission_review_url,omitempty"`
 	
 	// Optional: Define specific permissions your service needs
 	OngoingPermissions []Permission `json:"ongoing_permissions" yaml:"ongoing_permissions"`
@@ -46,6 +71,12 @@ type Permission struct {
 	Actions   []string               `json:"actions" yaml:"actions"`
 	Resources []string               `json:"resources" yaml:"resources"`
 	Condition map[string]interface{} `json:"condition,omitempty" yaml:"condition,omitempty"`
+
+	// Optional: Explain the statement to customers in the permission review.
+	// They aren't part of the policy
+	Description   string `json:"description,omitempty" yaml:"description,omitempty"`     // What the statement allows
+	Justification string `json:"justification,omitempty" yaml:"justification,omitempty"` // Why your service needs it
+	UsedWhen      string `json:"used_when,omitempty" yaml:"used_when,omitempty"`         // Which features or jobs use it
 }
 
 // Validate ensures the config has minimum required fields
@@ -71,6 +102,64 @@ func (c *Config) Validate() error {
 		c.SessionDuration = time.Hour // 1 hour is reasonable for most use cases
 	}
 
+	if c.TemplateS3Region == "" {
+		c.TemplateS3Region = c.DefaultRegion
+	}
+
+	if c.TemplateKeyPrefix == "" {
+		c.TemplateKeyPrefix = "templates/"
+	}
+
+	if c.TemplateURLExpiration == 0 {
+		c.TemplateURLExpiration = 24 * time.Hour
+	}
+
+	if c.TemplateURLExpiration > 7*24*time.Hour {
+		return errors.New("template_url_expiration can't exceed 7 days")
+	}
+
+	if c.SetupLinkExpiration == 0 {
+		c.SetupLinkExpiration = 72 * time.Hour
+	}
+
+	if c.SetupLinkExpiration < 0 {
+		return errors.New("setup_link_expiration can't be negative")
+	}
+
+	if c.ExternalIDGracePeriod == 0 {
+		c.ExternalIDGracePeriod = 7 * 24 * time.Hour
+	}
+
+	if c.ExternalIDGracePeriod < 0 {
+		return errors.New("external_id_grace_period can't be negative")
+	}
+
+	if c.TerraformModuleSource == "" {
+		c.TerraformModuleSource = "./" + c.ServiceName + "-cross-account-role"
+	}
+
+	if c.SetupCallbackTopicARN != "" {
+		parts := strings.Split(c.SetupCallbackTopicARN, ":")
+		if len(parts) != 6 || parts[0] != "arn" || parts[2] != "sns" {
+			return errors.New("setup_callback_topic_arn must be an SNS topic ARN")
+		}
+		// CloudFormation only notifies topics in the stack's region
+		if parts[3] != c.DefaultRegion {
+			return errors.New("setup_callback_topic_arn must be in default_region")
+		}
+	}
+
+	if c.PermissionReviewURL != "" {
+		u, err := url.Parse(c.PermissionReviewURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return errors.New("permission_review_url must be an absolute HTTP(S) URL")
+		}
+	}
+
+	if c.TemplateBucketOwner != "" && len(c.TemplateBucketOwner) != 12 {
+		return errors.New("template_bucket_owner must be a 12-digit AWS account ID")
+	}
+
 	// Validate AWS account ID format
 	if len(c.ServiceAccountID) != 12 {
 		return errors.New("service_account_id must be a 12-digit AWS account ID")
@@ -86,16 +175,59 @@ type SetupResponse struct {
 	CustomerID    string `json:"customer_id"`    // Your customer identifier  
 	StackName     string `json:"stack_name"`     // CloudFormation stack name
 	SetupComplete bool   `json:"setup_complete"` // Whether setup is finished
+
+	// Signed token for this setup session; pass it back in SetupCompleteRequest
+	// Empty when setup is already complete
+	SetupToken string    `json:"setup_token,omitempty"`
+	ExpiresAt  time.Time `json:"expires_at"` // When the setup session stops being accepted
+
+	// Config.PermissionReviewURL, for the customer to review before launching
+	PermissionReviewURL string `json:"permission_review_url,omitempty"`
+}
+
+// SetupLinkOptions narrows who can complete a setup session
+type SetupLinkOptions struct {
+	// CustomerAccountID, if set, is the only AWS account whose role can
+	// complete the session
+	CustomerAccountID string `json:"customer_account_id,omitempty"`
+}
+
+// AssumeRoleOptions scopes down and labels the sessions AssumeRoleWithOptions
+// creates. They all appear in the customer's CloudTrail
+type AssumeRoleOptions struct {
+	// SessionTags are passed as STS session tags, e.g. {"Job": "nightly-report"}
+	SessionTags map[string]string `json:"session_tags,omitempty"`
+
+	// TransitiveTagKeys are the session tags kept through role chaining
+	// Each must be a key of SessionTags
+	TransitiveTagKeys []string `json:"transitive_tag_keys,omitempty"`
+
+	// SourceIdentity names the user or job behind the session. It stays on
+	// the session and any roles it assumes
+	SourceIdentity string `json:"source_identity,omitempty"`
+
+	// Policy is an inline session policy. The session gets only the
+	// permissions both it and the role allow
+	Policy []Permission `json:"policy,omitempty"`
+
+	// PolicyARNs are managed policies that further limit the session, e.g.
+	// arn:aws:iam::aws:policy/ReadOnlyAccess. Up to 10
+	PolicyARNs []string `json:"policy_arns,omitempty"`
 }
 
 // SetupCompleteRequest is sent after customer creates the CloudFormation stack
 type SetupCompleteRequest struct {
 	CustomerID string `json:"customer_id"`
-	RoleARN    string `json:"role_arn"`    // From CloudFormation outputs
-	ExternalID string `json:"external_id"` // From CloudFormation outputs
+	RoleARN    string `json:"role_arn"`             // From CloudFormation outputs
+	ExternalID string `json:"external_id"`          // From CloudFormation outputs
+	SetupToken string `json:"setup_token"`          // From SetupResponse
+	StackName  string `json:"stack_name,omitempty"` // If set, must be the stack the setup link created
 }
 
 // CustomerCredentials stores what we need to access customer's AWS account
+//
+// Deprecated: Use CustomerIntegration, which the client persists through
+// IntegrationStorage
 type CustomerCredentials struct {
 	CustomerID string    `json:"customer_id"`
 	RoleARN    string    `json:"role_arn"`
@@ -105,10 +237,14 @@ type CustomerCredentials struct {
 }
 
 // CleanupInstructions helps customers remove setup permissions
+// When Automated is true the permissions are already gone and no steps remain
 type CleanupInstructions struct {
 	CustomerID       string   `json:"customer_id"`
-	Instructions     []string `json:"instructions"`      // Human-readable steps
-	AutomationScript string   `json:"automation_script"` // AWS CLI script
+	StackName        string   `json:"stack_name"`
+	Automated        bool     `json:"automated"`                   // Removed by the service without customer action
+	AutomationError  string   `json:"automation_error,omitempty"`  // Why the manual steps are needed
+	Instructions     []string `json:"instructions,omitempty"`      // Human-readable steps
+	AutomationScript string   `json:"automation_script,omitempty"` // AWS CLI script
 }
 
 // Common permission templates that most services need
@@ -0,0 +1,464 @@
+package crossaccount
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+)
+
+// Policy drift kinds
+const (
+	DriftMissing  = "missing"  // In the config but not on the role
+	DriftExtra    = "extra"    // On the role but not in the config
+	DriftModified = "modified" // On the role, but different from the config
+)
+
+// Policies a drift finding refers to. Other attached policies are named by ARN
+const (
+	DriftPolicyOngoing = "ongoing"
+	DriftPolicySetup   = "setup"
+)
+
+// setupPhaseTag is the role tag the templates set from the SetupPhase parameter
+const setupPhaseTag = "SetupPhase"
+
+// PolicyStatement is a normalized IAM policy statement. Actions are lower
+// case, and lists and condition values are sorted
+type PolicyStatement struct {
+	Sid          string                         `json:"sid,omitempty"`
+	Effect       string                         `json:"effect"`
+	Actions      []string                       `json:"actions,omitempty"`
+	NotActions   []string                       `json:"not_actions,omitempty"`
+	Resources    []string                       `json:"resources,omitempty"`
+	NotResources []string                       `json:"not_resources,omitempty"`
+	Condition    map[string]map[string][]string `json:"condition,omitempty"`
+}
+
+// DriftFinding is one statement that differs between the config and a
+// customer's role
+type DriftFinding struct {
+	Kind      string           `json:"kind"`
+	Policy    string           `json:"policy"`              // DriftPolicyOngoing, DriftPolicySetup or a policy ARN
+	Statement string           `json:"statement,omitempty"` // Sid, or actions when unnamed
+	Expected  *PolicyStatement `json:"expected,omitempty"`
+	Actual    *PolicyStatement `json:"actual,omitempty"`
+	Message   string           `json:"message"`
+}
+
+// DriftReport compares a customer's role with the policies the current
+// config would deploy
+type DriftReport struct {
+	CustomerID string         `json:"customer_id"`
+	RoleARN    string         `json:"role_arn"`
+	CheckedAt  time.Time      `json:"checked_at"`
+	SetupPhase bool           `json:"setup_phase"`
+	Findings   []DriftFinding `json:"findings,omitempty"`
+	Warnings   []string       `json:"warnings,omitempty"` // Parts of the role that couldn't be checked
+}
+
+// Drifted reports whether the role differs from the config
+func (r *DriftReport) Drifted() bool {
+	return len(r.Findings) > 0
+}
+
+// DetectDrift compares the managed policies attached to a customer's role
+// with the policies Config.OngoingPermissions and Config.SetupPermissions
+// would generate today. Setup permissions are expected while the role's
+// SetupPhase tag is true. Statements are matched by Sid, or by effect and
+// actions when unnamed. The report is recorded on the integration
+func (c *Client) DetectDrift(ctx context.Context, customerID string) (*DriftReport, error) {
+	integration, err := c.integrations.GetIntegration(ctx, customerID)
+	if err != nil {
+		return nil, fmt.Errorf("customer not found: %w", err)
+	}
+	if integration.Deployment == DeploymentOrganization {
+		return nil, fmt.Errorf("customer %s is an organization; check its member accounts instead", customerID)
+	}
+	_, roleName, err := parseRoleARN(integration.RoleARN)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := c.AssumeRole(ctx, customerID)
+	if err != nil {
+		return nil, err
+	}
+	iamClient := c.newIAM(cfg)
+
+	report := &DriftReport{CustomerID: customerID, RoleARN: integration.RoleARN, CheckedAt: c.now()}
+
+	role, err := iamClient.GetRole(ctx, &iam.GetRoleInput{RoleName: aws.String(roleName)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read role: %w", err)
+	}
+	report.SetupPhase = integration.SetupPhase
+	tagged := false
+	if role.Role != nil {
+		for _, tag := range role.Role.Tags {
+			if aws.ToString(tag.Key) == setupPhaseTag {
+				report.SetupPhase, tagged = aws.ToString(tag.Value) == "true", true
+			}
+		}
+	}
+	if !tagged {
+		report.Warnings = append(report.Warnings, "role has no SetupPhase tag; using the recorded setup phase")
+	}
+
+	attached, err := listAttachedPolicies(ctx, iamClient, roleName)
+	if err != nil {
+		return nil, err
+	}
+
+	var ongoing, setup []PolicyStatement
+	unreadable := make(map[string]bool)
+	for _, policy := range attached {
+		statements, err := readManagedPolicy(ctx, iamClient, policy.arn)
+		kind := classifyAttachedPolicy(policy.name, roleName)
+
+		if err != nil {
+			if kind == "" {
+				report.Findings = append(report.Findings, DriftFinding{
+					Kind:    DriftExtra,
+					Policy:  policy.arn,
+					Message: fmt.Sprintf("policy %s is attached but can't be read: %v", policy.name, err),
+				})
+			} else {
+				report.Warnings = append(report.Warnings, fmt.Sprintf("%s policy %s can't be read: %v", kind, policy.name, err))
+				unreadable[kind] = true
+			}
+			continue
+		}
+
+		switch kind {
+		case DriftPolicyOngoing:
+			ongoing = append(ongoing, statements...)
+		case DriftPolicySetup:
+			setup = append(setup, statements...)
+		default:
+			report.Findings = append(report.Findings, diffStatements(policy.arn, nil, statements)...)
+		}
+	}
+
+	// Unreadable policies can't be compared
+	if !unreadable[DriftPolicyOngoing] {
+		report.Findings = append(report.Findings, diffStatements(DriftPolicyOngoing, normalizePermissions(c.config.OngoingPermissions), ongoing)...)
+	}
+	if !unreadable[DriftPolicySetup] {
+		var expectedSetup []PolicyStatement
+		if report.SetupPhase {
+			expectedSetup = normalizePermissions(c.config.SetupPermissions)
+		}
+		report.Findings = append(report.Findings, diffStatements(DriftPolicySetup, expectedSetup, setup)...)
+	}
+
+	if _, err := c.updateIntegration(ctx, customerID, false, func(i *CustomerIntegration) error {
+		i.PolicyDrift = report
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to record drift report: %w", err)
+	}
+
+	if report.Drifted() {
+		c.logger.WarnContext(ctx, "customer role policies drifted", "customer_id", customerID, "findings", len(report.Findings))
+	}
+	return report, nil
+}
+
+// DetectAllDrift runs DetectDrift for every operational customer. Customers
+// that can't be checked are skipped and their errors joined
+func (c *Client) DetectAllDrift(ctx context.Context) ([]*DriftReport, error) {
+	integrations, err := c.ListIntegrationsByStatus(ctx,
+		IntegrationRoleVerified, IntegrationSetupActive, IntegrationSetupRemoved, IntegrationActive, IntegrationDegraded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list integrations: %w", err)
+	}
+
+	var reports []*DriftReport
+	var errs []error
+	for _, integration := range integrations {
+		if integration.Deployment == DeploymentOrganization {
+			continue // The management role has no permissions to compare
+		}
+		report, err := c.DetectDrift(ctx, integration.CustomerID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("customer %s: %w", integration.CustomerID, err))
+			continue
+		}
+		reports = append(reports, report)
+	}
+	return reports, errors.Join(errs...)
+}
+
+// attachedPolicy is a managed policy attached to a role
+type attachedPolicy struct {
+	name, arn string
+}
+
+// listAttachedPolicies lists the managed policies attached to a role
+func listAttachedPolicies(ctx context.Context, iamClient IAMAPI, roleName string) ([]attachedPolicy, error) {
+	var policies []attachedPolicy
+	paginator := iam.NewListAttachedRolePoliciesPaginator(iamClient, &iam.ListAttachedRolePoliciesInput{RoleName: aws.String(roleName)})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list attached policies: %w", err)
+		}
+		for _, p := range page.AttachedPolicies {
+			policies = append(policies, attachedPolicy{name: aws.ToString(p.PolicyName), arn: aws.ToString(p.PolicyArn)})
+		}
+	}
+	return policies, nil
+}
+
+// classifyAttachedPolicy identifies the policies the templates create. The
+// generated template names the ongoing policy <stack>-OngoingPolicy-<id>,
+// templates/cross-account-role.yaml and the Terraform module name it
+// <role>-OngoingOperations
+func classifyAttachedPolicy(policyName, roleName string) string {
+	switch {
+	case strings.EqualFold(policyName, roleName+"-setup"):
+		return DriftPolicySetup
+	case strings.Contains(policyName, "-OngoingPolicy-"), policyName == roleName+"-OngoingOperations":
+		return DriftPolicyOngoing
+	}
+	return ""
+}
+
+// readManagedPolicy returns the statements of a managed policy's default version
+func readManagedPolicy(ctx context.Context, iamClient IAMAPI, policyARN string) ([]PolicyStatement, error) {
+	policy, err := iamClient.GetPolicy(ctx, &iam.GetPolicyInput{PolicyArn: aws.String(policyARN)})
+	if err != nil {
+		return nil, err
+	}
+	if policy.Policy == nil || policy.Policy.DefaultVersionId == nil {
+		return nil, errors.New("policy has no default version")
+	}
+
+	version, err := iamClient.GetPolicyVersion(ctx, &iam.GetPolicyVersionInput{
+		PolicyArn: aws.String(policyARN),
+		VersionId: policy.Policy.DefaultVersionId,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if version.PolicyVersion == nil || version.PolicyVersion.Document == nil {
+		return nil, errors.New("policy version has no document")
+	}
+
+	// IAM returns policy documents URL-encoded
+	document, err := url.QueryUnescape(aws.ToString(version.PolicyVersion.Document))
+	if err != nil {
+		return nil, err
+	}
+	return parsePolicyStatements(document)
+}
+
+// parsePolicyStatements parses and normalizes a policy document's statements
+func parsePolicyStatements(document string) ([]PolicyStatement, error) {
+	var policy struct {
+		Statement json.RawMessage `json:"Statement"`
+	}
+	if err := json.Unmarshal([]byte(document), &policy); err != nil {
+		return nil, fmt.Errorf("invalid policy document: %w", err)
+	}
+
+	type rawStatement struct {
+		Sid         string                                `json:"Sid"`
+		Effect      string                                `json:"Effect"`
+		Action      json.RawMessage                       `json:"Action"`
+		NotAction   json.RawMessage                       `json:"NotAction"`
+		Resource    json.RawMessage                       `json:"Resource"`
+		NotResource json.RawMessage                       `json:"NotResource"`
+		Condition   map[string]map[string]json.RawMessage `json:"Condition"`
+	}
+
+	// Statement may be a single object or a list
+	var raw []rawStatement
+	if err := json.Unmarshal(policy.Statement, &raw); err != nil {
+		var single rawStatement
+		if err := json.Unmarshal(policy.Statement, &single); err != nil {
+			return nil, fmt.Errorf("invalid policy statement: %w", err)
+		}
+		raw = []rawStatement{single}
+	}
+
+	statements := make([]PolicyStatement, 0, len(raw))
+	for _, s := range raw {
+		statements = append(statements, normalizeStatement(PolicyStatement{
+			Sid:          s.Sid,
+			Effect:       s.Effect,
+			Actions:      stringOrList(s.Action),
+			NotActions:   stringOrList(s.NotAction),
+			Resources:    stringOrList(s.Resource),
+			NotResources: stringOrList(s.NotResource),
+			Condition:    normalizeCondition(s.Condition),
+		}))
+	}
+	return statements, nil
+}
+
+// normalizePermissions returns the statements policyDocumentJSON generates
+// for permissions
+func normalizePermissions(permissions []Permission) []PolicyStatement {
+	statements := make([]PolicyStatement, 0, len(permissions))
+	for _, p := range permissions {
+		effect := p.Effect
+		if effect == "" {
+			effect = "Allow"
+		}
+		resources := p.Resources
+		if len(resources) == 0 {
+			resources = []string{"*"}
+		}
+
+		var condition map[string]map[string]json.RawMessage
+		if len(p.Condition) > 0 {
+			data, _ := json.Marshal(p.Condition)
+			json.Unmarshal(data, &condition)
+		}
+
+		statements = append(statements, normalizeStatement(PolicyStatement{
+			Sid:       p.Sid,
+			Effect:    effect,
+			Actions:   append([]string(nil), p.Actions...),
+			Resources: append([]string(nil), resources...),
+			Condition: normalizeCondition(condition),
+		}))
+	}
+	return statements
+}
+
+// normalizeStatement sorts lists and lower-cases actions, which IAM treats
+// case-insensitively
+func normalizeStatement(s PolicyStatement) PolicyStatement {
+	for _, list := range []*[]string{&s.Actions, &s.NotActions} {
+		for i, a := range *list {
+			(*list)[i] = strings.ToLower(a)
+		}
+	}
+	for _, list := range [][]string{s.Actions, s.NotActions, s.Resources, s.NotResources} {
+		sort.Strings(list)
+	}
+	for _, list := range []*[]string{&s.Actions, &s.NotActions, &s.Resources, &s.NotResources} {
+		if len(*list) == 0 {
+			*list = nil
+		}
+	}
+	return s
+}
+
+// normalizeCondition lower-cases condition keys, which IAM treats
+// case-insensitively, and sorts their values
+func normalizeCondition(condition map[string]map[string]json.RawMessage) map[string]map[string][]string {
+	if len(condition) == 0 {
+		return nil
+	}
+	out := make(map[string]map[string][]string, len(condition))
+	for op, keys := range condition {
+		out[op] = make(map[string][]string, len(keys))
+		for key, raw := range keys {
+			values := stringOrList(raw)
+			if values == nil {
+				// Numbers and booleans
+				values = []string{strings.Trim(string(raw), `"`)}
+			}
+			sort.Strings(values)
+			out[op][strings.ToLower(key)] = values
+		}
+	}
+	return out
+}
+
+// statementKey is how statements are matched: by Sid, or by effect and
+// actions when unnamed
+func statementKey(s PolicyStatement) string {
+	if s.Sid != "" {
+		return s.Sid
+	}
+	return s.Effect + " " + strings.Join(s.Actions, ",") + strings.Join(s.NotActions, ",")
+}
+
+// diffStatements compares the statements a policy should have with the ones
+// it has
+func diffStatements(policy string, expected, actual []PolicyStatement) []DriftFinding {
+	var findings []DriftFinding
+	used := make([]bool, len(actual))
+
+	for i := range expected {
+		want := expected[i]
+		key := statementKey(want)
+		match := -1
+		for j := range actual {
+			if !used[j] && statementKey(actual[j]) == key {
+				match = j
+				break
+			}
+		}
+
+		if match < 0 {
+			findings = append(findings, DriftFinding{
+				Kind:      DriftMissing,
+				Policy:    policy,
+				Statement: key,
+				Expected:  &want,
+				Message:   fmt.Sprintf("%s policy is missing statement %s", policy, key),
+			})
+			continue
+		}
+
+		used[match] = true
+		got := actual[match]
+		if differences := statementDifferences(want, got); len(differences) > 0 {
+			findings = append(findings, DriftFinding{
+				Kind:      DriftModified,
+				Policy:    policy,
+				Statement: key,
+				Expected:  &want,
+				Actual:    &got,
+				Message:   fmt.Sprintf("%s policy statement %s has different %s", policy, key, strings.Join(differences, ", ")),
+			})
+		}
+	}
+
+	for j := range actual {
+		if used[j] {
+			continue
+		}
+		got := actual[j]
+		findings = append(findings, DriftFinding{
+			Kind:      DriftExtra,
+			Policy:    policy,
+			Statement: statementKey(got),
+			Actual:    &got,
+			Message:   fmt.Sprintf("%s policy has unexpected statement %s", policy, statementKey(got)),
+		})
+	}
+	return findings
+}
+
+// statementDifferences names the parts of two matched statements that differ
+func statementDifferences(want, got PolicyStatement) []string {
+	var differences []string
+	if want.Effect != got.Effect {
+		differences = append(differences, "effect")
+	}
+	if !reflect.DeepEqual(want.Actions, got.Actions) || !reflect.DeepEqual(want.NotActions, got.NotActions) {
+		differences = append(differences, "actions")
+	}
+	if !reflect.DeepEqual(want.Resources, got.Resources) || !reflect.DeepEqual(want.NotResources, got.NotResources) {
+		differences = append(differences, "resources")
+	}
+	if !reflect.DeepEqual(want.Condition, got.Condition) {
+		differences = append(differences, "condition")
+	}
+	return differences
+}
@@ -0,0 +1,171 @@
+package crossaccount
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	iamtypes "github.com/aws/aws-sdk-go-v2/service/iam/types"
+)
+
+// driftTestConfig has ongoing and setup permissions for drift to show up in
+func driftTestConfig() *Config {
+	cfg := SimpleConfig("test-service", "123456789012", "test-bucket")
+	cfg.OngoingPermissions = []Permission{
+		{Sid: "ReadEC2", Actions: []string{"ec2:DescribeInstances", "ec2:DescribeVolumes"}},
+		{
+			Actions:   []string{"s3:GetObject"},
+			Resources: []string{"arn:aws:s3:::data-*/*"},
+			Condition: map[string]interface{}{"StringEquals": map[string]interface{}{"s3:ExistingObjectTag/Owner": "test-service"}},
+		},
+	}
+	cfg.SetupPermissions = []Permission{{Sid: "CreateBuckets", Actions: []string{"s3:CreateBucket"}}}
+	return cfg
+}
+
+// driftKinds summarizes findings as policy/kind/statement
+func driftKinds(report *DriftReport) []string {
+	var kinds []string
+	for _, f := range report.Findings {
+		kinds = append(kinds, f.Policy+"/"+f.Kind+"/"+f.Statement)
+	}
+	return kinds
+}
+
+func TestDetectDrift(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(m *fakeIAM)
+		want   []string
+	}{
+		{name: "matches config", modify: func(m *fakeIAM) {}},
+		{
+			name: "equivalent formatting",
+			modify: func(m *fakeIAM) {
+				m.managedPolicies[testOngoingPolicyARN] = `{"Version":"2012-10-17","Statement":[
+					{"Effect":"Allow","Action":"s3:getobject","Resource":"arn:aws:s3:::data-*/*","Condition":{"StringEquals":{"S3:ExistingObjectTag/Owner":["test-service"]}}},
+					{"Sid":"ReadEC2","Effect":"Allow","Action":["ec2:DescribeVolumes","ec2:DescribeInstances"],"Resource":"*"}]}`
+			},
+		},
+		{
+			name: "hand edited",
+			modify: func(m *fakeIAM) {
+				m.managedPolicies[testOngoingPolicyARN] = `{"Version":"2012-10-17","Statement":[
+					{"Sid":"ReadEC2","Effect":"Allow","Action":["ec2:DescribeInstances","ec2:DescribeVolumes"],"Resource":"arn:aws:ec2:*:*:instance/*"},
+					{"Sid":"Extra","Effect":"Allow","Action":"iam:*","Resource":"*"}]}`
+			},
+			want: []string{
+				"ongoing/modified/ReadEC2",
+				"ongoing/missing/Allow s3:getobject",
+				"ongoing/extra/Extra",
+			},
+		},
+		{
+			name: "setup phase over",
+			modify: func(m *fakeIAM) {
+				m.roleTags = []iamtypes.Tag{{Key: aws.String("SetupPhase"), Value: aws.String("false")}}
+			},
+			want: []string{"setup/extra/CreateBuckets"},
+		},
+		{
+			name: "policies missing",
+			modify: func(m *fakeIAM) {
+				m.managedPolicies = map[string]string{}
+			},
+			want: []string{
+				"ongoing/missing/ReadEC2",
+				"ongoing/missing/Allow s3:getobject",
+				"setup/missing/CreateBuckets",
+			},
+		},
+		{
+			name: "other policies attached",
+			modify: func(m *fakeIAM) {
+				m.managedPolicies["arn:aws:iam::aws:policy/ReadOnlyAccess"] = `{"Version":"2012-10-17","Statement":{"Effect":"Allow","Action":"*:Describe*","Resource":"*"}}`
+				m.managedPolicies["arn:aws:iam::999999999999:policy/admin"] = ""
+			},
+			want: []string{
+				"arn:aws:iam::999999999999:policy/admin/extra/",
+				"arn:aws:iam::aws:policy/ReadOnlyAccess/extra/Allow *:describe*",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			ti := newIntegratedTestClient(t, driftTestConfig(), withDeployedPolicies())
+			client := ti.client
+			ti.iam.mu.Lock()
+			tt.modify(ti.iam)
+			ti.iam.mu.Unlock()
+
+			report, err := client.DetectDrift(ctx, "customer-123")
+			if err != nil {
+				t.Fatalf("DetectDrift() error = %v", err)
+			}
+			if got := strings.Join(driftKinds(report), "; "); got != strings.Join(tt.want, "; ") {
+				t.Errorf("findings = %s\nwant %s", got, strings.Join(tt.want, "; "))
+			}
+			if report.Drifted() != (len(tt.want) > 0) {
+				t.Errorf("Drifted() = %v", report.Drifted())
+			}
+
+			integration, _ := client.GetIntegration(ctx, "customer-123")
+			if integration.PolicyDrift == nil || len(integration.PolicyDrift.Findings) != len(tt.want) {
+				t.Errorf("report should be recorded on the integration: %+v", integration.PolicyDrift)
+			}
+		})
+	}
+}
+
+func TestDetectDrift_OlderStacks(t *testing.T) {
+	ctx := context.Background()
+	ti := newIntegratedTestClient(t, driftTestConfig(), withDeployedPolicies())
+	client := ti.client
+
+	// No SetupPhase tag, and the ongoing policy can't be read
+	ti.iam.mu.Lock()
+	ti.iam.roleTags = nil
+	ti.iam.managedPolicies[testOngoingPolicyARN] = ""
+	ti.iam.mu.Unlock()
+
+	report, err := client.DetectDrift(ctx, "customer-123")
+	if err != nil {
+		t.Fatalf("DetectDrift() error = %v", err)
+	}
+	if report.Drifted() || len(report.Warnings) != 2 || !report.SetupPhase {
+		t.Errorf("unexpected report: %+v", report)
+	}
+}
+
+func TestDetectAllDrift(t *testing.T) {
+	ctx := context.Background()
+	client := newIntegratedTestClient(t, driftTestConfig(), withDeployedPolicies()).client
+	if _, err := client.GenerateSetupLinkWithContext(ctx, "customer-456", "Not Set Up"); err != nil {
+		t.Fatal(err)
+	}
+
+	reports, err := client.DetectAllDrift(ctx)
+	if err != nil {
+		t.Fatalf("DetectAllDrift() error = %v", err)
+	}
+	if len(reports) != 1 || reports[0].CustomerID != "customer-123" {
+		t.Errorf("only integrated customers should be checked: %+v", reports)
+	}
+}
+
+func TestGenerateCloudFormationTemplate_DriftPermissions(t *testing.T) {
+	client := newIntegratedTestClient(t, driftTestConfig(), withDeployedPolicies()).client
+
+	body, err := client.GenerateCloudFormationTemplate()
+	if err != nil {
+		t.Fatalf("GenerateCloudFormationTemplate() error = %v", err)
+	}
+	for _, want := range []string{"Key: SetupPhase", "iam:ListAttachedRolePolicies", "iam:GetPolicyVersion", "- !Ref OngoingPolicy"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("template is missing %q", want)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package crossaccount
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// ErrIntegrationNotFound is returned when no integration exists for a customer
+var ErrIntegrationNotFound = errors.New("customer integration not found")
+
+// CustomerIntegration is the durable record of a customer's cross-account
+// relationship. Unlike cached sessions it never expires
+type CustomerIntegration struct {
+	CustomerID          string              `json:"customer_id"`
+	CustomerName        string              `json:"customer_name,omitempty"`
+	RoleARN             string              `json:"role_arn,omitempty"`
+	ExternalID          string              `json:"external_id"`
+	RoleName            string              `json:"role_name,omitempty"`
+	StackName           string              `json:"stack_name,omitempty"`
+	StackRegion         string              `json:"stack_region,omitempty"`
+	Deployment          DeploymentMethod    `json:"deployment,omitempty"`           // How the customer deployed their role; empty means CloudFormation
+	SetupPhase          bool                `json:"setup_phase"`                    // True while setup permissions are attached
+	TemplateVersion     string              `json:"template_version,omitempty"`     // Hash of the template the customer launched
+	DeployedPermissions []Permission        `json:"deployed_permissions"`           // Ongoing permissions of that template, nil if not recorded
+	SetupSession        *SetupSession       `json:"setup_session,omitempty"`        // Latest setup link issued
+	TrustPolicy         *TrustPolicyReport  `json:"trust_policy,omitempty"`         // Latest trust policy check
+	ExternalIDRotation  *ExternalIDRotation `json:"external_id_rotation,omitempty"` // Latest external ID rotation
+	Health              *HealthCheck        `json:"health,omitempty"`               // Latest Monitor check
+	PolicyDrift         *DriftReport        `json:"policy_drift,omitempty"`         // Latest drift check
+	Upgrade             *TemplateUpgrade    `json:"upgrade,omitempty"`              // Latest template upgrade offered
+	Organization        *OrganizationSetup  `json:"organization,omitempty"`         // StackSet deployment, for organization management accounts
+	ParentCustomerID    string              `json:"parent_customer_id,omitempty"`   // Organization integration that registered this account
+	AccountID           string              `json:"account_id,omitempty"`           // Member account, for accounts registered from an organization
+	CreatedAt           time.Time           `json:"created_at"`
+	UpdatedAt           time.Time           `json:"updated_at"`
+
+	Status          IntegrationStatus `json:"status"`
+	StatusReason    string            `json:"status_reason,omitempty"`
+	StatusChangedAt time.Time         `json:"status_changed_at"`
+	History         []StatusChange    `json:"history,omitempty"` // Oldest first, bounded
+}
+
+// DeploymentMethod is how a customer deploys their role
+type DeploymentMethod string
+
+const (
+	DeploymentCloudFormation DeploymentMethod = "cloudformation" // Stack launched from a setup link
+	DeploymentTerraform      DeploymentMethod = "terraform"      // Module from GenerateTerraformModule
+	DeploymentOrganization   DeploymentMethod = "organization"   // Management account stack from GenerateOrgSetupLink
+	DeploymentStackSet       DeploymentMethod = "stackset"       // Member account role deployed by the organization's StackSet
+)
+
+// terraform reports whether the customer manages their role with Terraform
+func (i *CustomerIntegration) terraform() bool {
+	return i.Deployment == DeploymentTerraform
+}
+
+// organization reports whether the integration belongs to an organization,
+// as its management account or as a member account
+func (i *CustomerIntegration) organization() bool {
+	return i.Deployment == DeploymentOrganization || i.Deployment == DeploymentStackSet
+}
+
+// clone returns a deep copy of the record, so MemoryStorage never shares the
+// nested sessions, reports and history with callers. It round-trips through
+// JSON to copy exactly what FileStorage would persist
+func (i *CustomerIntegration) clone() (*CustomerIntegration, error) {
+	data, err := json.Marshal(i)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy integration: %w", err)
+	}
+
+	var record CustomerIntegration
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("failed to copy integration: %w", err)
+	}
+	return &record, nil
+}
+
+// IntegrationStorage persists customer integration records
+type IntegrationStorage interface {
+	// SaveIntegration creates or replaces the record for integration.CustomerID
+	SaveIntegration(ctx context.Context, integration *CustomerIntegration) error
+
+	// GetIntegration returns ErrIntegrationNotFound if the customer is unknown
+	GetIntegration(ctx context.Context, customerID string) (*CustomerIntegration, error)
+
+	// DeleteIntegration removes a customer's record
+	DeleteIntegration(ctx context.Context, customerID string) error
+
+	// ListIntegrations returns all records ordered by customer ID
+	ListIntegrations(ctx context.Context) ([]*CustomerIntegration, error)
+}
+
+// SaveIntegration stores an integration record in memory
+func (ms *MemoryStorage) SaveIntegration(ctx context.Context, integration *CustomerIntegration) error {
+	if err := validateCredentialKey(integration.CustomerID); err != nil {
+		return fmt.Errorf("invalid customer ID: %w", err)
+	}
+
+	record, err := integration.clone()
+	if err != nil {
+		return err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.integrations[integration.CustomerID] = record
+	return nil
+}
+
+// GetIntegration returns a copy of an integration record
+func (ms *MemoryStorage) GetIntegration(ctx context.Context, customerID string) (*CustomerIntegration, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	record, ok := ms.integrations[customerID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrIntegrationNotFound, customerID)
+	}
+
+	return record.clone()
+}
+
+// DeleteIntegration removes an integration record from memory
+func (ms *MemoryStorage) DeleteIntegration(ctx context.Context, customerID string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	delete(ms.integrations, customerID)
+	return nil
+}
+
+// ListIntegrations returns copies of all integration records
+func (ms *MemoryStorage) ListIntegrations(ctx context.Context) ([]*CustomerIntegration, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	result := make([]*CustomerIntegration, 0, len(ms.integrations))
+	for _, record := range ms.integrations {
+		r, err := record.clone()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+
+	sortIntegrations(result)
+	return result, nil
+}
+
+// SaveIntegration writes an encrypted integration record
+func (fs *FileStorage) SaveIntegration(ctx context.Context, integration *CustomerIntegration) error {
+	if err := validateCredentialKey(integration.CustomerID); err != nil {
+		return fmt.Errorf("invalid customer ID: %w", err)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.writeIntegration(integration)
+}
+
+// GetIntegration reads and decrypts an integration record
+func (fs *FileStorage) GetIntegration(ctx context.Context, customerID string) (*CustomerIntegration, error) {
+	if err := validateCredentialKey(customerID); err != nil {
+		return nil, fmt.Errorf("invalid customer ID: %w", err)
+	}
+
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	return fs.readIntegration(customerID)
+}
+
+// DeleteIntegration removes an integration record file
+func (fs *FileStorage) DeleteIntegration(ctx context.Context, customerID string) error {
+	if err := validateCredentialKey(customerID); err != nil {
+		return fmt.Errorf("invalid customer ID: %w", err)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := os.Remove(fs.integrationPath(customerID)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete integration file: %w", err)
+	}
+	return nil
+}
+
+// ListIntegrations reads all integration records
+func (fs *FileStorage) ListIntegrations(ctx context.Context) ([]*CustomerIntegration, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	entries, err := os.ReadDir(fs.integrationDir())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read integration directory: %w", err)
+	}
+
+	var result []*CustomerIntegration
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || filepath.Ext(name) != integrationExtension {
+			continue
+		}
+
+		record, err := fs.readIntegration(name[:len(name)-len(integrationExtension)])
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, record)
+	}
+
+	sortIntegrations(result)
+	return result, nil
+}
+
+// MigrateLegacyRecords converts customer records written by earlier versions,
+// which kept the role ARN and external ID in a StoredCredentials entry that
+// expired after 24 hours, into CustomerIntegration records. Migrated entries
+// are removed from the session cache. NewFileStorage runs this automatically
+func (fs *FileStorage) MigrateLegacyRecords(ctx context.Context) (int, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	entries, err := os.ReadDir(fs.baseDir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read storage directory: %w", err)
+	}
+
+	migrated := 0
+	for _, entry := range entries {
+		if entry.IsDir() || !hasCredentialExtension(entry.Name()) {
+			continue
+		}
+		key := removeCredentialExtension(entry.Name())
+		path := filepath.Join(fs.baseDir, entry.Name())
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return migrated, fmt.Errorf("failed to read credentials file %s: %w", entry.Name(), err)
+		}
+		decrypted, err := fs.encryptor.DecryptString(string(data))
+		if err != nil {
+			return migrated, fmt.Errorf("failed to decrypt credentials file %s: %w", entry.Name(), err)
+		}
+
+		var legacy StoredCredentials
+		if err := json.Unmarshal([]byte(decrypted), &legacy); err != nil {
+			return migrated, fmt.Errorf("failed to unmarshal credentials file %s: %w", entry.Name(), err)
+		}
+
+		// Entries holding session keys are already cached sessions
+		if legacy.RoleARN == "" || legacy.AccessKeyID != "" {
+			continue
+		}
+
+		if _, err := fs.readIntegration(key); errors.Is(err, ErrIntegrationNotFound) {
+			// Earlier versions never tracked whether setup permissions were
+			// removed, so assume they are still attached
+			now := time.Now()
+			reason := "migrated from legacy credentials record"
+			if err := fs.writeIntegration(&CustomerIntegration{
+				CustomerID:      key,
+				RoleARN:         legacy.RoleARN,
+				ExternalID:      legacy.ExternalID,
+				SetupPhase:      true,
+				CreatedAt:       legacy.CreatedAt,
+				UpdatedAt:       now,
+				Status:          IntegrationSetupActive,
+				StatusReason:    reason,
+				StatusChangedAt: now,
+				History:         []StatusChange{{To: IntegrationSetupActive, Reason: reason, At: now}},
+			}); err != nil {
+				return migrated, err
+			}
+		} else if err != nil {
+			return migrated, err
+		}
+
+		if err := os.Remove(path); err != nil {
+			return migrated, fmt.Errorf("failed to remove migrated credentials file %s: %w", entry.Name(), err)
+		}
+		migrated++
+	}
+
+	return migrated, nil
+}
+
+// integrationExtension is the file extension of integration records
+const integrationExtension = ".integration"
+
+// integrationDir returns the directory holding integration records
+func (fs *FileStorage) integrationDir() string {
+	return filepath.Join(fs.baseDir, "integrations")
+}
+
+// integrationPath returns the file path for a customer's integration record
+func (fs *FileStorage) integrationPath(customerID string) string {
+	return filepath.Join(fs.integrationDir(), sanitizeFilename(customerID)+integrationExtension)
+}
+
+// writeIntegration encrypts and writes a record; callers hold fs.mu
+func (fs *FileStorage) writeIntegration(integration *CustomerIntegration) error {
+	data, err := json.Marshal(integration)
+	if err != nil {
+		return fmt.Errorf("failed to marshal integration: %w", err)
+	}
+
+	encrypted, err := fs.encryptor.EncryptString(string(data))
+	if err != nil {
+		return fmt.Errorf("failed to encrypt integration: %w", err)
+	}
+
+	if err := os.WriteFile(fs.integrationPath(integration.CustomerID), []byte(encrypted), 0600); err != nil {
+		return fmt.Errorf("failed to write integration file: %w", err)
+	}
+	return nil
+}
+
+// readIntegration reads and decrypts a record; callers hold fs.mu
+func (fs *FileStorage) readIntegration(customerID string) (*CustomerIntegration, error) {
+	data, err := os.ReadFile(fs.integrationPath(customerID))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrIntegrationNotFound, customerID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read integration file: %w", err)
+	}
+
+	decrypted, err := fs.encryptor.DecryptString(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt integration: %w", err)
+	}
+
+	var record CustomerIntegration
+	if err := json.Unmarshal([]byte(decrypted), &record); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal integration: %w", err)
+	}
+	return &record, nil
+}
+
+// sortIntegrations orders records by customer ID
+func sortIntegrations(records []*CustomerIntegration) {
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].CustomerID < records[j].CustomerID
+	})
+}
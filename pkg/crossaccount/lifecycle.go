@@ -0,0 +1,185 @@
+package crossaccount
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// IntegrationStatus is a stage in a customer integration's lifecycle
+type IntegrationStatus string
+
+// Integration statuses
+const (
+	IntegrationLinkGenerated IntegrationStatus = "link_generated" // Setup link issued, role not yet verified
+	IntegrationRoleVerified  IntegrationStatus = "role_verified"  // Role assumed with the customer's external ID
+	IntegrationSetupActive   IntegrationStatus = "setup_active"   // Setup permissions attached to the role
+	IntegrationSetupRemoved  IntegrationStatus = "setup_removed"  // Setup permissions detached, not yet confirmed working
+	IntegrationActive        IntegrationStatus = "active"         // Running on ongoing permissions
+	IntegrationDegraded      IntegrationStatus = "degraded"       // Role reachable but failing checks or calls
+	IntegrationRevoked       IntegrationStatus = "revoked"        // Customer removed the role or its trust
+	IntegrationOffboarded    IntegrationStatus = "offboarded"     // Integration ended by the service
+)
+
+// ErrInvalidTransition is returned when a status change isn't allowed from
+// the integration's current status
+var ErrInvalidTransition = errors.New("invalid integration status transition")
+
+// maxStatusHistory bounds the history kept on each integration record
+const maxStatusHistory = 100
+
+// integrationTransitions lists the statuses reachable from each status.
+// The empty status is a record that doesn't exist yet
+var integrationTransitions = map[IntegrationStatus][]IntegrationStatus{
+	"":                       {IntegrationLinkGenerated, IntegrationRoleVerified},
+	IntegrationLinkGenerated: {IntegrationLinkGenerated, IntegrationRoleVerified, IntegrationOffboarded},
+	IntegrationRoleVerified:  {IntegrationSetupActive, IntegrationActive, IntegrationDegraded, IntegrationRevoked, IntegrationOffboarded},
+	IntegrationSetupActive:   {IntegrationRoleVerified, IntegrationSetupRemoved, IntegrationDegraded, IntegrationRevoked, IntegrationOffboarded},
+	IntegrationSetupRemoved:  {IntegrationRoleVerified, IntegrationActive, IntegrationDegraded, IntegrationRevoked, IntegrationOffboarded},
+	IntegrationActive:        {IntegrationRoleVerified, IntegrationSetupActive, IntegrationDegraded, IntegrationRevoked, IntegrationOffboarded},
+	IntegrationDegraded:      {IntegrationRoleVerified, IntegrationActive, IntegrationRevoked, IntegrationOffboarded},
+	IntegrationRevoked:       {IntegrationLinkGenerated, IntegrationRoleVerified, IntegrationOffboarded},
+	IntegrationOffboarded:    {IntegrationLinkGenerated},
+}
+
+// CanTransitionTo reports whether an integration may move from s to next
+func (s IntegrationStatus) CanTransitionTo(next IntegrationStatus) bool {
+	for _, allowed := range integrationTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// Operational reports whether the customer's role has been verified and
+// access hasn't been withdrawn, i.e. whether AssumeRole is allowed
+func (s IntegrationStatus) Operational() bool {
+	switch s {
+	case IntegrationRoleVerified, IntegrationSetupActive, IntegrationSetupRemoved, IntegrationActive, IntegrationDegraded:
+		return true
+	}
+	return false
+}
+
+// StatusChange is one entry in an integration's status history
+type StatusChange struct {
+	From   IntegrationStatus `json:"from,omitempty"`
+	To     IntegrationStatus `json:"to"`
+	Reason string            `json:"reason,omitempty"`
+	At     time.Time         `json:"at"`
+}
+
+// transition moves the integration to next and records the change
+func (i *CustomerIntegration) transition(next IntegrationStatus, reason string, at time.Time) error {
+	if !i.Status.CanTransitionTo(next) {
+		return fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, i.Status, next)
+	}
+
+	i.History = append(i.History, StatusChange{From: i.Status, To: next, Reason: reason, At: at})
+	if len(i.History) > maxStatusHistory {
+		i.History = i.History[len(i.History)-maxStatusHistory:]
+	}
+
+	i.Status = next
+	i.StatusReason = reason
+	i.StatusChangedAt = at
+	i.UpdatedAt = at
+
+	switch next {
+	case IntegrationSetupActive:
+		i.SetupPhase = true
+	case IntegrationSetupRemoved:
+		i.SetupPhase = false
+	}
+	return nil
+}
+
+// updateIntegration applies fn to a customer's record and saves it. Updates
+// are serialized so concurrent transitions can't overwrite each other. With
+// create, a missing record is passed to fn as a new, status-less record
+func (c *Client) updateIntegration(ctx context.Context, customerID string, create bool, fn func(*CustomerIntegration) error) (*CustomerIntegration, error) {
+	c.integrationMu.Lock()
+	defer c.integrationMu.Unlock()
+
+	integration, err := c.integrations.GetIntegration(ctx, customerID)
+	if errors.Is(err, ErrIntegrationNotFound) && create {
+		now := c.now()
+		integration = &CustomerIntegration{
+			CustomerID: customerID,
+			SetupPhase: true,
+			CreatedAt:  now,
+			UpdatedAt:  now,
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := fn(integration); err != nil {
+		return nil, err
+	}
+
+	err = c.integrations.SaveIntegration(ctx, integration)
+	c.audit(ctx, AuditEvent{
+		Action:     AuditSaveIntegration,
+		CustomerID: customerID,
+		RoleARN:    integration.RoleARN,
+		Details:    map[string]string{"status": string(integration.Status)},
+	}, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save integration: %w", err)
+	}
+	return integration, nil
+}
+
+// TransitionIntegration moves a customer's integration to a new status,
+// recording the reason in its history. Moving to revoked or offboarded also
+// drops any cached session for the customer
+func (c *Client) TransitionIntegration(ctx context.Context, customerID string, next IntegrationStatus, reason string) (*CustomerIntegration, error) {
+	if customerID == "" {
+		return nil, fmt.Errorf("customer ID is required")
+	}
+
+	integration, err := c.updateIntegration(ctx, customerID, false, func(i *CustomerIntegration) error {
+		return i.transition(next, reason, c.now())
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !next.Operational() {
+		c.clearSession(ctx, customerID)
+	}
+
+	c.logger.InfoContext(ctx, "integration status changed", "customer_id", customerID, "status", next, "reason", reason)
+	return integration, nil
+}
+
+// ListIntegrationsByStatus returns the integrations in any of the given statuses
+func (c *Client) ListIntegrationsByStatus(ctx context.Context, statuses ...IntegrationStatus) ([]*CustomerIntegration, error) {
+	all, err := c.integrations.ListIntegrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*CustomerIntegration
+	for _, integration := range all {
+		for _, status := range statuses {
+			if integration.Status == status {
+				result = append(result, integration)
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+// IntegrationHistory returns a customer's status changes, oldest first
+func (c *Client) IntegrationHistory(ctx context.Context, customerID string) ([]StatusChange, error) {
+	integration, err := c.integrations.GetIntegration(ctx, customerID)
+	if err != nil {
+		return nil, err
+	}
+	return integration.History, nil
+}
@@ -0,0 +1,131 @@
+package crossaccount
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestIntegrationStatus_CanTransitionTo(t *testing.T) {
+	tests := []struct {
+		from, to IntegrationStatus
+		want     bool
+	}{
+		{"", IntegrationLinkGenerated, true},
+		{"", IntegrationActive, false},
+		{IntegrationLinkGenerated, IntegrationRoleVerified, true},
+		{IntegrationLinkGenerated, IntegrationActive, false},
+		{IntegrationRoleVerified, IntegrationSetupActive, true},
+		{IntegrationSetupActive, IntegrationSetupRemoved, true},
+		{IntegrationSetupActive, IntegrationActive, false},
+		{IntegrationSetupRemoved, IntegrationActive, true},
+		{IntegrationActive, IntegrationDegraded, true},
+		{IntegrationDegraded, IntegrationActive, true},
+		{IntegrationRevoked, IntegrationActive, false},
+		{IntegrationRevoked, IntegrationRoleVerified, true},
+		{IntegrationOffboarded, IntegrationActive, false},
+		{IntegrationOffboarded, IntegrationLinkGenerated, true},
+	}
+
+	for _, tt := range tests {
+		if got := tt.from.CanTransitionTo(tt.to); got != tt.want {
+			t.Errorf("%q -> %q = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestClient_TransitionIntegration(t *testing.T) {
+	ctx := context.Background()
+	cfg := QuickConfig("data-platform", "test-service", "123456789012", "test-bucket")
+	s3Server := newFakeS3(t)
+
+	client, err := New(cfg, WithS3Client(s3Server.client()), withMockSTS(&mockSTSClient{}))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	resp, err := client.GenerateSetupLinkWithContext(ctx, "customer-123", "Test Customer")
+	if err != nil {
+		t.Fatalf("GenerateSetupLink() error = %v", err)
+	}
+	if err := client.CompleteSetup(ctx, &SetupCompleteRequest{
+		CustomerID: "customer-123",
+		RoleARN:    "arn:aws:iam::999999999999:role/test-service/test-service-CrossAccount-customer-123",
+		ExternalID: resp.ExternalID,
+		SetupToken: resp.SetupToken,
+	}); err != nil {
+		t.Fatalf("CompleteSetup() error = %v", err)
+	}
+
+	integration, err := client.GetIntegration(ctx, "customer-123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if integration.Status != IntegrationSetupActive || !integration.SetupPhase {
+		t.Fatalf("setup permissions should be active after setup: %+v", integration)
+	}
+
+	// Links for established integrations report setup as complete
+	again, err := client.GenerateSetupLinkWithContext(ctx, "customer-123", "Test Customer")
+	if err != nil {
+		t.Fatalf("GenerateSetupLink() error = %v", err)
+	}
+	if !again.SetupComplete || again.ExternalID != resp.ExternalID {
+		t.Errorf("unexpected setup response for established integration: %+v", again)
+	}
+
+	if _, err := client.TransitionIntegration(ctx, "customer-123", IntegrationActive, "skip"); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("setup_active -> active error = %v, want ErrInvalidTransition", err)
+	}
+
+	integration, err = client.TransitionIntegration(ctx, "customer-123", IntegrationSetupRemoved, "stack updated")
+	if err != nil {
+		t.Fatalf("TransitionIntegration() error = %v", err)
+	}
+	if integration.SetupPhase || integration.StatusReason != "stack updated" {
+		t.Errorf("unexpected integration after removing setup permissions: %+v", integration)
+	}
+
+	for _, next := range []IntegrationStatus{IntegrationActive, IntegrationDegraded, IntegrationActive} {
+		if _, err := client.TransitionIntegration(ctx, "customer-123", next, "test"); err != nil {
+			t.Fatalf("TransitionIntegration(%s) error = %v", next, err)
+		}
+	}
+
+	active, err := client.ListIntegrationsByStatus(ctx, IntegrationActive, IntegrationDegraded)
+	if err != nil || len(active) != 1 {
+		t.Errorf("ListIntegrationsByStatus() = %v, %v", active, err)
+	}
+
+	if _, err := client.TransitionIntegration(ctx, "customer-123", IntegrationRevoked, "role deleted"); err != nil {
+		t.Fatalf("TransitionIntegration() error = %v", err)
+	}
+	if _, err := client.AssumeRole(ctx, "customer-123"); err == nil {
+		t.Error("AssumeRole() should fail for a revoked integration")
+	}
+
+	history, err := client.IntegrationHistory(ctx, "customer-123")
+	if err != nil {
+		t.Fatalf("IntegrationHistory() error = %v", err)
+	}
+	want := []IntegrationStatus{
+		IntegrationLinkGenerated, IntegrationRoleVerified, IntegrationSetupActive, IntegrationSetupRemoved,
+		IntegrationActive, IntegrationDegraded, IntegrationActive, IntegrationRevoked,
+	}
+	if len(history) != len(want) {
+		t.Fatalf("history = %+v, want %d entries", history, len(want))
+	}
+	for i, change := range history {
+		if change.To != want[i] || (i > 0 && change.From != want[i-1]) || change.At.IsZero() {
+			t.Errorf("history[%d] = %+v, want transition to %s", i, change, want[i])
+		}
+	}
+}
+
+func TestClient_TransitionIntegration_Unknown(t *testing.T) {
+	client, _ := newTestClient(t, SimpleConfig("test-service", "123456789012", "test-bucket"))
+
+	if _, err := client.TransitionIntegration(context.Background(), "customer-123", IntegrationActive, ""); !errors.Is(err, ErrIntegrationNotFound) {
+		t.Errorf("TransitionIntegration() error = %v, want ErrIntegrationNotFound", err)
+	}
+}
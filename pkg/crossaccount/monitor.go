@@ -0,0 +1,468 @@
+package crossaccount
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
+)
+
+const (
+	defaultMonitorInterval    = 15 * time.Minute
+	defaultMonitorConcurrency = 10
+
+	// defaultRevokeThreshold is how many consecutive access denied checks
+	// move an integration to revoked
+	defaultRevokeThreshold = 3
+
+	// healthReasonPrefix marks status changes made by the monitor, so it only
+	// clears degradations it caused
+	healthReasonPrefix = "health check: "
+)
+
+// HealthFailure classifies why a customer health check failed
+type HealthFailure string
+
+// Health check failure classes
+const (
+	// The role was deleted or its trust policy no longer accepts the service
+	// or the external ID; STS doesn't say which
+	FailureAccessDenied HealthFailure = "access_denied"
+	FailureSCPDenied    HealthFailure = "scp_denied"   // An organization SCP blocks the role
+	FailureThrottled    HealthFailure = "throttled"    // Transient; the integration isn't changed
+	FailureInvalidRole  HealthFailure = "invalid_role" // The stored role ARN or external ID is malformed
+	FailureUnknown      HealthFailure = "unknown"
+)
+
+// HealthCheck is the latest health check result, kept on the integration
+type HealthCheck struct {
+	CheckedAt           time.Time     `json:"checked_at"`
+	Healthy             bool          `json:"healthy"`
+	Failure             HealthFailure `json:"failure,omitempty"`
+	Message             string        `json:"message,omitempty"`
+	ConsecutiveFailures int           `json:"consecutive_failures,omitempty"`
+}
+
+// HealthEvent is emitted for every customer a Monitor checks
+type HealthEvent struct {
+	CustomerID     string
+	Healthy        bool
+	Failure        HealthFailure
+	Err            error
+	Latency        time.Duration
+	CheckedAt      time.Time
+	PreviousStatus IntegrationStatus
+	Status         IntegrationStatus // Differs from PreviousStatus when the check changed it
+}
+
+// HealthObserver receives health events, e.g. to export metrics or alert.
+// It's called from the monitor's workers and must be safe for concurrent use
+type HealthObserver func(ctx context.Context, event HealthEvent)
+
+// MonitorStats are cumulative counters for a Monitor
+type MonitorStats struct {
+	Runs     int
+	Checks   int
+	Healthy  int
+	Failures map[HealthFailure]int
+	LastRun  time.Time
+}
+
+// MonitorOption customizes a Monitor
+type MonitorOption func(*Monitor)
+
+// WithMonitorInterval sets how often all customers are checked (default: 15m)
+func WithMonitorInterval(interval time.Duration) MonitorOption {
+	return func(m *Monitor) { m.interval = interval }
+}
+
+// WithMonitorConcurrency bounds how many customers are checked at once
+// (default: 10)
+func WithMonitorConcurrency(n int) MonitorOption {
+	return func(m *Monitor) { m.concurrency = n }
+}
+
+// WithRevokeThreshold sets how many consecutive access denied checks move
+// an integration to revoked (default: 3). Earlier ones degrade it
+func WithRevokeThreshold(n int) MonitorOption {
+	return func(m *Monitor) { m.revokeThreshold = n }
+}
+
+// WithHealthObserver adds an observer for health events
+func WithHealthObserver(observer HealthObserver) MonitorOption {
+	return func(m *Monitor) { m.observers = append(m.observers, observer) }
+}
+
+// Monitor periodically checks that every operational customer's role can
+// still be assumed. Each check assumes the role with a short session and
+// calls sts:GetCallerIdentity, bypassing the session cache. Failures are
+// classified, recorded on the integration as its HealthCheck and reflected
+// in its status:
+//   - access denied degrades the integration, and revokes it after
+//     WithRevokeThreshold consecutive failures
+//   - SCP denies, invalid roles and unknown errors degrade it
+//   - throttling leaves it unchanged
+//
+// A later healthy check restores integrations the monitor degraded. The
+// monitor can't tell a deleted role from one whose trust policy no longer
+// accepts the external ID: STS denies both the same way, so both are
+// FailureAccessDenied. Checks interrupted by Stop or ctx are not recorded
+type Monitor struct {
+	client          *Client
+	interval        time.Duration
+	concurrency     int
+	revokeThreshold int
+	observers       []HealthObserver
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+	stats  MonitorStats
+}
+
+// NewMonitor creates a health monitor for the client's customers
+func (c *Client) NewMonitor(opts ...MonitorOption) *Monitor {
+	m := &Monitor{
+		client:          c,
+		interval:        defaultMonitorInterval,
+		concurrency:     defaultMonitorConcurrency,
+		revokeThreshold: defaultRevokeThreshold,
+		stats:           MonitorStats{Failures: make(map[HealthFailure]int)},
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.concurrency < 1 {
+		m.concurrency = 1
+	}
+	if m.revokeThreshold < 1 {
+		m.revokeThreshold = 1
+	}
+	return m
+}
+
+// Start checks all customers now and then every interval, until ctx is
+// cancelled or Stop is called
+func (m *Monitor) Start(ctx context.Context) error {
+	if m.interval <= 0 {
+		return fmt.Errorf("monitor interval must be positive")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.done != nil {
+		select {
+		case <-m.done:
+			// Stopped by its context
+			m.cancel()
+		default:
+			return fmt.Errorf("monitor is already running")
+		}
+	}
+
+	ctx, m.cancel = context.WithCancel(ctx)
+	m.done = make(chan struct{})
+	go m.run(ctx, m.done)
+	return nil
+}
+
+// Stop stops the monitor and waits for in-flight checks to finish
+func (m *Monitor) Stop() {
+	m.mu.Lock()
+	cancel, done := m.cancel, m.done
+	m.cancel, m.done = nil, nil
+	m.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+// run checks all customers every interval until ctx is cancelled
+func (m *Monitor) run(ctx context.Context, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		if _, err := m.CheckAll(ctx); err != nil && ctx.Err() == nil {
+			m.client.logger.WarnContext(ctx, "health check run failed", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stats returns a snapshot of the monitor's counters
+func (m *Monitor) Stats() MonitorStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := m.stats
+	stats.Failures = make(map[HealthFailure]int, len(m.stats.Failures))
+	for k, v := range m.stats.Failures {
+		stats.Failures[k] = v
+	}
+	return stats
+}
+
+// CheckAll checks every operational customer once, at most concurrency at a
+// time, and returns their events
+func (m *Monitor) CheckAll(ctx context.Context) ([]HealthEvent, error) {
+	integrations, err := m.client.ListIntegrationsByStatus(ctx,
+		IntegrationRoleVerified, IntegrationSetupActive, IntegrationSetupRemoved, IntegrationActive, IntegrationDegraded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list integrations: %w", err)
+	}
+
+	events := make([]HealthEvent, len(integrations))
+	sem := make(chan struct{}, m.concurrency)
+	var wg sync.WaitGroup
+	for i, integration := range integrations {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return nil, ctx.Err()
+		}
+
+		wg.Add(1)
+		go func(i int, integration *CustomerIntegration) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			events[i], _ = m.check(ctx, integration)
+		}(i, integration)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		// Interrupted checks weren't recorded
+		return nil, err
+	}
+
+	m.mu.Lock()
+	m.stats.Runs++
+	m.stats.LastRun = m.client.now()
+	m.mu.Unlock()
+	return events, nil
+}
+
+// Check checks one customer and records the result
+func (m *Monitor) Check(ctx context.Context, customerID string) (HealthEvent, error) {
+	integration, err := m.client.integrations.GetIntegration(ctx, customerID)
+	if err != nil {
+		return HealthEvent{}, fmt.Errorf("customer not found: %w", err)
+	}
+	if !integration.Status.Operational() || integration.RoleARN == "" {
+		return HealthEvent{}, fmt.Errorf("customer %s integration is %s", customerID, integration.Status)
+	}
+	return m.check(ctx, integration)
+}
+
+// check probes the customer's role, records the result and notifies
+// observers. A probe cut short by ctx says nothing about the role, so it is
+// dropped and ctx's error returned
+func (m *Monitor) check(ctx context.Context, integration *CustomerIntegration) (HealthEvent, error) {
+	c := m.client
+	start := c.now()
+	err := m.probe(ctx, integration)
+	if err != nil && (ctx.Err() != nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) {
+		c.logger.DebugContext(ctx, "health check interrupted", "customer_id", integration.CustomerID, "error", err)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return HealthEvent{}, ctxErr
+		}
+		return HealthEvent{}, err
+	}
+
+	event := HealthEvent{
+		CustomerID:     integration.CustomerID,
+		Healthy:        err == nil,
+		Err:            err,
+		Latency:        c.now().Sub(start),
+		CheckedAt:      start,
+		PreviousStatus: integration.Status,
+		Status:         integration.Status,
+	}
+	if err != nil {
+		event.Failure = classifyHealthFailure(err)
+	}
+
+	if updated, err := m.record(ctx, &event); err != nil {
+		c.logger.WarnContext(ctx, "failed to record health check", "customer_id", event.CustomerID, "error", err)
+	} else {
+		event.PreviousStatus, event.Status = updated.PreviousStatus, updated.Status
+	}
+	if !event.Status.Operational() {
+		c.clearSession(ctx, event.CustomerID)
+	}
+
+	m.mu.Lock()
+	m.stats.Checks++
+	if event.Healthy {
+		m.stats.Healthy++
+	} else {
+		m.stats.Failures[event.Failure]++
+	}
+	m.mu.Unlock()
+
+	if event.Healthy {
+		c.logger.DebugContext(ctx, "customer healthy", "customer_id", event.CustomerID, "latency", event.Latency)
+	} else {
+		c.logger.WarnContext(ctx, "customer health check failed", "customer_id", event.CustomerID, "failure", event.Failure, "status", event.Status, "error", event.Err)
+	}
+	for _, observer := range m.observers {
+		observer(ctx, event)
+	}
+	return event, nil
+}
+
+// probe assumes the customer's role with a short session and calls
+// sts:GetCallerIdentity with it. During an external ID rotation the new ID
+// counts too
+func (m *Monitor) probe(ctx context.Context, integration *CustomerIntegration) error {
+	err := m.probeWith(ctx, integration.CustomerID, integration.RoleARN, integration.ExternalID)
+	if rotation := integration.ExternalIDRotation; err != nil && rotation != nil && rotation.Status == RotationPending &&
+		classifyHealthFailure(err) == FailureAccessDenied {
+		if m.probeWith(ctx, integration.CustomerID, integration.RoleARN, rotation.NewExternalID) == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// probeWith runs one probe with the given external ID
+func (m *Monitor) probeWith(ctx context.Context, customerID, roleARN, externalID string) error {
+	c := m.client
+	stsClient, err := c.sts(ctx)
+	if err != nil {
+		return err
+	}
+
+	result, err := c.stsAssumeRole(ctx, stsClient, customerID, "health check", &sts.AssumeRoleInput{
+		RoleArn:         aws.String(roleARN),
+		RoleSessionName: aws.String(fmt.Sprintf("%s-health", c.config.ServiceName)),
+		ExternalId:      aws.String(externalID),
+		DurationSeconds: aws.Int32(900), // The shortest session STS allows
+	})
+	if err != nil {
+		return fmt.Errorf("failed to assume role: %w", err)
+	}
+	if result.Credentials == nil {
+		return fmt.Errorf("assume role returned no credentials")
+	}
+
+	cfg, err := c.credentialsConfig(ctx, aws.Credentials{
+		AccessKeyID:     aws.ToString(result.Credentials.AccessKeyId),
+		SecretAccessKey: aws.ToString(result.Credentials.SecretAccessKey),
+		SessionToken:    aws.ToString(result.Credentials.SessionToken),
+		Source:          "crossaccount:health",
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := c.newSTS(cfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{}); err != nil {
+		return fmt.Errorf("failed to get caller identity: %w", err)
+	}
+	return nil
+}
+
+// record saves the check on the integration and applies its status change
+func (m *Monitor) record(ctx context.Context, event *HealthEvent) (*HealthEvent, error) {
+	c := m.client
+	updated := *event
+
+	_, err := c.updateIntegration(ctx, event.CustomerID, false, func(i *CustomerIntegration) error {
+		updated.PreviousStatus, updated.Status = i.Status, i.Status
+		if !i.Status.Operational() {
+			// Changed while the check ran
+			return nil
+		}
+
+		check := &HealthCheck{CheckedAt: event.CheckedAt, Healthy: event.Healthy, Failure: event.Failure}
+		if event.Err != nil {
+			check.Message = event.Err.Error()
+			check.ConsecutiveFailures = 1
+			if prev := i.Health; prev != nil && !prev.Healthy && prev.Failure == event.Failure {
+				check.ConsecutiveFailures = prev.ConsecutiveFailures + 1
+			}
+		}
+		i.Health = check
+
+		next, reason := m.nextStatus(i, check)
+		if next == "" || next == i.Status {
+			return nil
+		}
+		if err := i.transition(next, reason, c.now()); err != nil {
+			return err
+		}
+		updated.Status = next
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if updated.Status != updated.PreviousStatus {
+		c.logger.InfoContext(ctx, "integration status changed", "customer_id", event.CustomerID, "status", updated.Status, "reason", "health check")
+	}
+	return &updated, nil
+}
+
+// nextStatus returns the status a check moves the integration to, or ""
+func (m *Monitor) nextStatus(i *CustomerIntegration, check *HealthCheck) (IntegrationStatus, string) {
+	if check.Healthy {
+		if i.Status != IntegrationDegraded || !strings.HasPrefix(i.StatusReason, healthReasonPrefix) {
+			return "", ""
+		}
+		// Return to the status the monitor degraded
+		prev := IntegrationRoleVerified
+		if n := len(i.History); n > 0 && i.Status.CanTransitionTo(i.History[n-1].From) {
+			prev = i.History[n-1].From
+		}
+		return prev, healthReasonPrefix + "role reachable again"
+	}
+
+	reason := healthReasonPrefix + string(check.Failure) + ": " + check.Message
+	switch check.Failure {
+	case FailureThrottled:
+		return "", ""
+	case FailureAccessDenied:
+		if check.ConsecutiveFailures >= m.revokeThreshold {
+			return IntegrationRevoked, reason
+		}
+	}
+	if i.Status == IntegrationDegraded {
+		return "", ""
+	}
+	return IntegrationDegraded, reason
+}
+
+// classifyHealthFailure maps an AWS error to a failure class
+func classifyHealthFailure(err error) HealthFailure {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return FailureUnknown
+	}
+
+	switch code := apiErr.ErrorCode(); code {
+	case "Throttling", "ThrottlingException", "RequestLimitExceeded", "TooManyRequestsException", "RequestThrottled":
+		return FailureThrottled
+	case "AccessDenied", "AccessDeniedException":
+		if strings.Contains(strings.ToLower(apiErr.ErrorMessage()), "service control policy") {
+			return FailureSCPDenied
+		}
+		return FailureAccessDenied
+	case "ValidationError", "MalformedPolicyDocument":
+		return FailureInvalidRole
+	}
+	return FailureUnknown
+}
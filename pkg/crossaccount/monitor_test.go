@@ -0,0 +1,270 @@
+package crossaccount
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
+)
+
+func TestClassifyHealthFailure(t *testing.T) {
+	tests := []struct {
+		err  error
+		want HealthFailure
+	}{
+		{&smithy.GenericAPIError{Code: "AccessDenied", Message: "User: arn:aws:iam::123456789012:root is not authorized to perform: sts:AssumeRole"}, FailureAccessDenied},
+		{&smithy.GenericAPIError{Code: "AccessDenied", Message: "... with an explicit deny in a service control policy"}, FailureSCPDenied},
+		{&smithy.GenericAPIError{Code: "Throttling", Message: "Rate exceeded"}, FailureThrottled},
+		{&smithy.GenericAPIError{Code: "ValidationError", Message: "1 validation error detected"}, FailureInvalidRole},
+		{&smithy.GenericAPIError{Code: "InternalFailure"}, FailureUnknown},
+		{errors.New("connection reset"), FailureUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.want), func(t *testing.T) {
+			if got := classifyHealthFailure(fmt.Errorf("failed to assume role: %w", tt.err)); got != tt.want {
+				t.Errorf("classifyHealthFailure(%v) = %s, want %s", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+// newMonitorTestClient returns a client with active integrations for
+// customers whose roles fail with the given errors (nil for healthy)
+func newMonitorTestClient(t *testing.T, roles map[string]error) (*Client, *sync.Map) {
+	t.Helper()
+	ctx := context.Background()
+
+	var failures sync.Map
+	mock := &mockSTSClient{}
+	mock.assumeRoleFunc = func(ctx context.Context, params *sts.AssumeRoleInput, optFns ...func(*sts.Options)) (*sts.AssumeRoleOutput, error) {
+		if err, ok := failures.Load(aws.ToString(params.RoleArn)); ok && err != nil {
+			return nil, err.(error)
+		}
+		return (&mockSTSClient{}).AssumeRole(ctx, params, optFns...)
+	}
+	client, _ := newTestClient(t, SimpleConfig("test-service", "123456789012", "test-bucket"), withMockSTS(mock))
+
+	for customerID, err := range roles {
+		roleARN := "arn:aws:iam::999999999999:role/" + customerID
+		failures.Store(roleARN, err)
+		now := time.Now()
+		if err := client.integrations.SaveIntegration(ctx, &CustomerIntegration{
+			CustomerID: customerID,
+			RoleARN:    roleARN,
+			ExternalID: "ext-" + customerID,
+			Status:     IntegrationActive,
+			History:    []StatusChange{{From: IntegrationRoleVerified, To: IntegrationActive, At: now}},
+			CreatedAt:  now,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return client, &failures
+}
+
+func TestMonitor_CheckAll(t *testing.T) {
+	ctx := context.Background()
+	denied := &smithy.GenericAPIError{Code: "AccessDenied", Message: "not authorized to perform: sts:AssumeRole"}
+	client, _ := newMonitorTestClient(t, map[string]error{
+		"healthy":   nil,
+		"deleted":   denied,
+		"scp":       &smithy.GenericAPIError{Code: "AccessDenied", Message: "explicit deny in a service control policy"},
+		"throttled": &smithy.GenericAPIError{Code: "Throttling", Message: "Rate exceeded"},
+	})
+	if _, err := client.TransitionIntegration(ctx, "scp", IntegrationOffboarded, "left"); err != nil {
+		t.Fatal(err)
+	}
+
+	var observed int32
+	monitor := client.NewMonitor(
+		WithMonitorConcurrency(2),
+		WithHealthObserver(func(ctx context.Context, event HealthEvent) { atomic.AddInt32(&observed, 1) }),
+	)
+	events, err := monitor.CheckAll(ctx)
+	if err != nil {
+		t.Fatalf("CheckAll() error = %v", err)
+	}
+
+	// Offboarded customers aren't checked
+	if len(events) != 3 || observed != 3 {
+		t.Fatalf("got %d events, %d observed, want 3", len(events), observed)
+	}
+	byCustomer := make(map[string]HealthEvent)
+	for _, e := range events {
+		byCustomer[e.CustomerID] = e
+	}
+
+	if e := byCustomer["healthy"]; !e.Healthy || e.Status != IntegrationActive {
+		t.Errorf("healthy event = %+v", e)
+	}
+	if e := byCustomer["deleted"]; e.Healthy || e.Failure != FailureAccessDenied || e.PreviousStatus != IntegrationActive || e.Status != IntegrationDegraded {
+		t.Errorf("deleted event = %+v", e)
+	}
+	if e := byCustomer["throttled"]; e.Failure != FailureThrottled || e.Status != IntegrationActive {
+		t.Errorf("throttling should not change the status: %+v", e)
+	}
+
+	integration, _ := client.GetIntegration(ctx, "deleted")
+	if integration.Health == nil || integration.Health.Healthy || integration.Health.ConsecutiveFailures != 1 ||
+		!strings.HasPrefix(integration.StatusReason, healthReasonPrefix) {
+		t.Errorf("failed check should be recorded: %+v", integration)
+	}
+
+	stats := monitor.Stats()
+	if stats.Runs != 1 || stats.Checks != 3 || stats.Healthy != 1 || stats.Failures[FailureAccessDenied] != 1 || stats.Failures[FailureThrottled] != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestMonitor_RevokesAndRecovers(t *testing.T) {
+	ctx := context.Background()
+	denied := &smithy.GenericAPIError{Code: "AccessDenied", Message: "not authorized to perform: sts:AssumeRole"}
+	client, failures := newMonitorTestClient(t, map[string]error{"flaky": denied, "gone": denied})
+	monitor := client.NewMonitor(WithRevokeThreshold(2))
+
+	if _, err := monitor.CheckAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The customer fixes their role before the threshold
+	failures.Store("arn:aws:iam::999999999999:role/flaky", nil)
+	event, err := monitor.Check(ctx, "flaky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !event.Healthy || event.PreviousStatus != IntegrationDegraded || event.Status != IntegrationActive {
+		t.Errorf("recovered customer should be active again: %+v", event)
+	}
+
+	event, err = monitor.Check(ctx, "gone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Status != IntegrationRevoked {
+		t.Errorf("second access denied check should revoke, got %s", event.Status)
+	}
+	if _, err := client.AssumeRole(ctx, "gone"); err == nil {
+		t.Error("AssumeRole() should refuse revoked customers")
+	}
+	if _, err := monitor.Check(ctx, "gone"); err == nil {
+		t.Error("Check() should skip revoked customers")
+	}
+}
+
+func TestMonitor_KeepsOtherDegradations(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newMonitorTestClient(t, map[string]error{"customer-123": nil})
+	if _, err := client.TransitionIntegration(ctx, "customer-123", IntegrationDegraded, "trust policy too broad"); err != nil {
+		t.Fatal(err)
+	}
+
+	event, err := client.NewMonitor().Check(ctx, "customer-123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !event.Healthy || event.Status != IntegrationDegraded {
+		t.Errorf("monitor should only clear its own degradations: %+v", event)
+	}
+}
+
+func TestMonitor_StartStop(t *testing.T) {
+	client, _ := newMonitorTestClient(t, map[string]error{"customer-123": nil})
+
+	checks := make(chan HealthEvent, 10)
+	monitor := client.NewMonitor(
+		WithMonitorInterval(10*time.Millisecond),
+		WithHealthObserver(func(ctx context.Context, event HealthEvent) {
+			select {
+			case checks <- event:
+			default:
+			}
+		}),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := monitor.Start(ctx); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	if err := monitor.Start(ctx); err == nil {
+		t.Error("Start() should fail while running")
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-checks:
+		case <-time.After(5 * time.Second):
+			t.Fatal("monitor did not check periodically")
+		}
+	}
+	monitor.Stop()
+	runs := monitor.Stats().Runs
+
+	time.Sleep(30 * time.Millisecond)
+	if monitor.Stats().Runs != runs {
+		t.Error("monitor kept running after Stop()")
+	}
+
+	// Cancelling the context stops it too
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	if err := monitor.Start(ctx2); err != nil {
+		t.Fatalf("Start() after Stop() error = %v", err)
+	}
+	cancel2()
+	time.Sleep(30 * time.Millisecond)
+	if err := monitor.Start(context.Background()); err != nil {
+		t.Errorf("Start() after cancellation error = %v", err)
+	}
+	monitor.Stop()
+}
+
+func TestMonitor_StopDuringCheck(t *testing.T) {
+	started := make(chan struct{})
+	var once sync.Once
+	mock := &mockSTSClient{}
+	mock.assumeRoleFunc = func(ctx context.Context, params *sts.AssumeRoleInput, optFns ...func(*sts.Options)) (*sts.AssumeRoleOutput, error) {
+		// Hang like a slow STS endpoint until the monitor is stopped
+		once.Do(func() { close(started) })
+		<-ctx.Done()
+		return nil, fmt.Errorf("operation error STS: AssumeRole: %w", ctx.Err())
+	}
+	client, _ := newTestClient(t, SimpleConfig("test-service", "123456789012", "test-bucket"), withMockSTS(mock))
+	now := time.Now()
+	if err := client.integrations.SaveIntegration(context.Background(), &CustomerIntegration{
+		CustomerID: "customer-123",
+		RoleARN:    "arn:aws:iam::999999999999:role/customer-123",
+		ExternalID: "ext-customer-123",
+		Status:     IntegrationActive,
+		CreatedAt:  now,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var observed int32
+	monitor := client.NewMonitor(WithHealthObserver(func(ctx context.Context, event HealthEvent) { atomic.AddInt32(&observed, 1) }))
+	if err := monitor.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("monitor did not start checking")
+	}
+	monitor.Stop()
+
+	integration, _ := client.GetIntegration(context.Background(), "customer-123")
+	if integration.Status != IntegrationActive || integration.Health != nil {
+		t.Errorf("interrupted check should not be recorded: %+v", integration)
+	}
+	if stats := monitor.Stats(); stats.Checks != 0 || stats.Runs != 0 || len(stats.Failures) != 0 || observed != 0 {
+		t.Errorf("interrupted check should not be counted: %+v, %d observed", stats, observed)
+	}
+}
@@ -0,0 +1,615 @@
+package crossaccount
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	cftypes "github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+	"github.com/aws/aws-sdk-go-v2/service/organizations"
+	orgtypes "github.com/aws/aws-sdk-go-v2/service/organizations/types"
+)
+
+// OrganizationsAPI is the subset of the Organizations client used to list a
+// customer's member accounts
+type OrganizationsAPI interface {
+	ListAccounts(ctx context.Context, params *organizations.ListAccountsInput, optFns ...func(*organizations.Options)) (*organizations.ListAccountsOutput, error)
+}
+
+// StackSetAPI is the subset of the CloudFormation client used to follow the
+// StackSet that deploys the role to member accounts
+type StackSetAPI interface {
+	ListStackInstances(ctx context.Context, params *cloudformation.ListStackInstancesInput, optFns ...func(*cloudformation.Options)) (*cloudformation.ListStackInstancesOutput, error)
+}
+
+// WithOrganizationsClientFactory sets how Organizations clients for
+// management accounts are created
+func WithOrganizationsClientFactory(factory func(cfg aws.Config) OrganizationsAPI) Option {
+	return func(c *Client) { c.newOrganizations = factory }
+}
+
+// WithStackSetClientFactory sets how CloudFormation clients that read a
+// management account's StackSet are created
+func WithStackSetClientFactory(factory func(cfg aws.Config) StackSetAPI) Option {
+	return func(c *Client) { c.newStackSets = factory }
+}
+
+// OrgExternalIDMode is how member accounts' external IDs are derived
+type OrgExternalIDMode string
+
+const (
+	OrgExternalIDShared     OrgExternalIDMode = "shared"      // Every member role trusts the organization's external ID
+	OrgExternalIDPerAccount OrgExternalIDMode = "per-account" // Each member role trusts "<external ID>-<account ID>"
+)
+
+// organizationTargetPattern matches an organization root or OU ID
+var organizationTargetPattern = regexp.MustCompile(`^(r-[0-9a-z]{4,32}|ou-[0-9a-z]{4,32}-[a-z0-9]{8,32})$`)
+
+// OrgSetupOptions describes where an organization deploys the role
+type OrgSetupOptions struct {
+	// OrganizationalUnitIDs are the OUs, or the root, whose accounts get the
+	// role. Accounts that join them later get it automatically
+	OrganizationalUnitIDs []string `json:"organizational_unit_ids"`
+
+	// ExternalIDMode defaults to OrgExternalIDShared
+	ExternalIDMode OrgExternalIDMode `json:"external_id_mode,omitempty"`
+
+	// ManagementAccountID, if set, is the only account whose management role
+	// can complete the session
+	ManagementAccountID string `json:"management_account_id,omitempty"`
+}
+
+// validate checks the options and fills in defaults
+func (o *OrgSetupOptions) validate() error {
+	if len(o.OrganizationalUnitIDs) == 0 {
+		return fmt.Errorf("at least one organizational unit ID is required")
+	}
+	for _, id := range o.OrganizationalUnitIDs {
+		if !organizationTargetPattern.MatchString(id) {
+			return fmt.Errorf("invalid organizational unit ID: %q", id)
+		}
+	}
+
+	switch o.ExternalIDMode {
+	case "":
+		o.ExternalIDMode = OrgExternalIDShared
+	case OrgExternalIDShared, OrgExternalIDPerAccount:
+	default:
+		return fmt.Errorf("unknown external ID mode: %q", o.ExternalIDMode)
+	}
+	return nil
+}
+
+// OrganizationSetup is how an organization deploys the role to its member
+// accounts, recorded on the management account's integration
+type OrganizationSetup struct {
+	StackSetName          string            `json:"stackset_name"`
+	MemberRoleName        string            `json:"member_role_name"`
+	OrganizationalUnitIDs []string          `json:"organizational_unit_ids"`
+	ExternalIDMode        OrgExternalIDMode `json:"external_id_mode"`
+	MemberTemplateVersion string            `json:"member_template_version"` // Hash of the template the StackSet deploys
+	LastDiscoveredAt      time.Time         `json:"last_discovered_at,omitempty"`
+}
+
+// Member account discovery outcomes
+const (
+	OrgAccountRegistered = "registered" // Role verified and integration created or restored
+	OrgAccountUnchanged  = "unchanged"  // Already registered
+	OrgAccountPending    = "pending"    // The StackSet hasn't deployed the role yet
+	OrgAccountFailed     = "failed"     // Deployment failed or the role couldn't be verified
+	OrgAccountRemoved    = "removed"    // No longer deployed; integration revoked
+	OrgAccountSkipped    = "skipped"    // Integration offboarded by the service
+)
+
+// OrgAccount is one member account found by DiscoverOrgAccounts
+type OrgAccount struct {
+	AccountID  string `json:"account_id"`
+	Name       string `json:"name,omitempty"`
+	CustomerID string `json:"customer_id"` // Of the account's own integration
+	Status     string `json:"status"`
+	Detail     string `json:"detail,omitempty"`
+}
+
+// OrgDiscovery is the result of DiscoverOrgAccounts
+type OrgDiscovery struct {
+	CustomerID   string       `json:"customer_id"`
+	DiscoveredAt time.Time    `json:"discovered_at"`
+	Accounts     []OrgAccount `json:"accounts"`
+}
+
+// OrgAccountCustomerID is the customer ID under which an organization's
+// member account is registered
+func OrgAccountCustomerID(parentCustomerID, accountID string) string {
+	return parentCustomerID + "-" + accountID
+}
+
+// GenerateOrgSetupLink is GenerateSetupLinkWithOptions for customers who run
+// AWS Organizations. The link launches a stack in the management account
+// that creates a management role for discovery and a service-managed
+// StackSet deploying the cross-account role to the accounts in
+// opts.OrganizationalUnitIDs. Trusted access for StackSets must be enabled in
+// the organization; the management account itself doesn't get the role.
+// Complete setup with the stack's ManagementRoleArn output, then call
+// DiscoverOrgAccounts to register the member accounts
+func (c *Client) GenerateOrgSetupLink(ctx context.Context, customerID, customerName string, opts OrgSetupOptions) (*SetupResponse, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	linkOpts := SetupLinkOptions{CustomerAccountID: opts.ManagementAccountID}
+	if err := validateSetupRequest(customerID, customerName, linkOpts); err != nil {
+		return nil, err
+	}
+
+	memberBody, memberVersion, err := c.currentOrgMemberTemplate()
+	if err != nil {
+		return nil, err
+	}
+	memberURL, err := c.publishTemplate(ctx, "org-member-role", memberBody, memberVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to publish CloudFormation template: %w", err)
+	}
+	managementBody, managementVersion, err := c.currentOrgManagementTemplate()
+	if err != nil {
+		return nil, err
+	}
+	templateURL, err := c.publishTemplate(ctx, "org-management", managementBody, managementVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to publish CloudFormation template: %w", err)
+	}
+
+	stackName := c.stackName(customerID)
+	organization := &OrganizationSetup{
+		StackSetName:          c.stackName(customerID + "-members"),
+		MemberRoleName:        c.customerRoleName(customerID),
+		OrganizationalUnitIDs: append([]string(nil), opts.OrganizationalUnitIDs...),
+		ExternalIDMode:        opts.ExternalIDMode,
+		MemberTemplateVersion: memberVersion,
+	}
+
+	integration, token, err := c.startSetup(ctx, customerID, customerName, linkOpts, func(i *CustomerIntegration) {
+		i.Deployment = DeploymentOrganization
+		i.RoleName = fmt.Sprintf("%s-OrgManagement-%s", c.config.ServiceName, customerID)
+		i.StackName = stackName
+		i.StackRegion = c.config.DefaultRegion
+		i.SetupPhase = false // Setup permissions are never deployed to an organization
+		i.TemplateVersion = managementVersion
+		i.Organization = organization
+	})
+	if err != nil {
+		return nil, err
+	}
+	var expiresAt time.Time
+	if token != "" {
+		expiresAt = integration.SetupSession.ExpiresAt
+	}
+
+	// Established organizations keep the StackSet they deployed
+	if integration.Organization != nil {
+		organization = integration.Organization
+	}
+
+	params := url.Values{}
+	params.Set("templateURL", templateURL)
+	params.Set("stackName", stackName)
+	params.Set("param_ExternalId", integration.ExternalID)
+	params.Set("param_ServiceAccountId", c.config.ServiceAccountID)
+	params.Set("param_ManagementRoleName", integration.RoleName)
+	params.Set("param_MemberRoleName", organization.MemberRoleName)
+	params.Set("param_OrganizationalUnitIds", strings.Join(organization.OrganizationalUnitIDs, ","))
+	params.Set("param_ExternalIdMode", string(organization.ExternalIDMode))
+	params.Set("param_StackSetName", organization.StackSetName)
+	params.Set("param_MemberTemplateURL", memberURL)
+
+	launchURL := fmt.Sprintf("https://console.aws.amazon.com/cloudformation/home?region=%s#/stacks/quickcreate?%s",
+		c.config.DefaultRegion, params.Encode())
+
+	return &SetupResponse{
+		LaunchURL:           launchURL,
+		ExternalID:          integration.ExternalID,
+		CustomerID:          customerID,
+		StackName:           integration.StackName,
+		SetupComplete:       integration.Status.Operational(),
+		SetupToken:          token,
+		ExpiresAt:           expiresAt,
+		PermissionReviewURL: c.config.PermissionReviewURL,
+	}, nil
+}
+
+// DiscoverOrgAccounts lists the organization's accounts and the StackSet's
+// instances through the management role and registers every active account
+// the role was deployed to as an integration of its own, with customer ID
+// OrgAccountCustomerID. Roles are verified with the account's external ID and
+// trust policy check before they're registered. Accounts the StackSet no
+// longer covers are revoked. Run it after setup and whenever accounts may
+// have joined or left
+func (c *Client) DiscoverOrgAccounts(ctx context.Context, customerID string) (*OrgDiscovery, error) {
+	parent, err := c.integrations.GetIntegration(ctx, customerID)
+	if err != nil {
+		return nil, fmt.Errorf("customer not found: %w", err)
+	}
+	if parent.Deployment != DeploymentOrganization || parent.Organization == nil {
+		return nil, fmt.Errorf("customer %s isn't an organization", customerID)
+	}
+	if !parent.Status.Operational() {
+		return nil, fmt.Errorf("customer %s integration is %s", customerID, parent.Status)
+	}
+	partition := strings.SplitN(parent.RoleARN, ":", 3)[1]
+
+	cfg, err := c.AssumeRole(ctx, customerID)
+	if err != nil {
+		return nil, err
+	}
+	accounts, err := listOrgAccounts(ctx, c.newOrganizations(cfg))
+	if err != nil {
+		return nil, err
+	}
+	cfg.Region = parent.StackRegion
+	instances, err := listStackInstances(ctx, c.newStackSets(cfg), parent.Organization.StackSetName)
+	if err != nil {
+		return nil, err
+	}
+
+	all, err := c.integrations.ListIntegrations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list integrations: %w", err)
+	}
+	children := make(map[string]*CustomerIntegration)
+	for _, i := range all {
+		if i.ParentCustomerID == customerID {
+			children[i.AccountID] = i
+		}
+	}
+
+	discovery := &OrgDiscovery{CustomerID: customerID, DiscoveredAt: c.now()}
+	deployed := make(map[string]bool)
+	for _, instance := range instances {
+		accountID := aws.ToString(instance.Account)
+		account, ok := accounts[accountID]
+		if !ok || account.Status != orgtypes.AccountStatusActive {
+			continue
+		}
+		deployed[accountID] = true
+
+		result := OrgAccount{AccountID: accountID, Name: aws.ToString(account.Name), CustomerID: OrgAccountCustomerID(customerID, accountID)}
+		var detailed cftypes.StackInstanceDetailedStatus
+		if instance.StackInstanceStatus != nil {
+			detailed = instance.StackInstanceStatus.DetailedStatus
+		}
+		child := children[accountID]
+
+		switch {
+		case child != nil && child.Status == IntegrationOffboarded:
+			result.Status, result.Detail = OrgAccountSkipped, "integration offboarded"
+		case child != nil && child.Status.Operational():
+			result.Status = OrgAccountUnchanged
+		case detailed == cftypes.StackInstanceDetailedStatusSucceeded:
+			if err := c.registerOrgAccount(ctx, parent, partition, accountID); err != nil {
+				result.Status, result.Detail = OrgAccountFailed, err.Error()
+			} else {
+				result.Status = OrgAccountRegistered
+			}
+		case detailed == cftypes.StackInstanceDetailedStatusPending || detailed == cftypes.StackInstanceDetailedStatusRunning:
+			result.Status = OrgAccountPending
+		default:
+			result.Status = OrgAccountFailed
+			result.Detail = fmt.Sprintf("stack instance is %s", detailed)
+			if instance.StatusReason != nil {
+				result.Detail += ": " + aws.ToString(instance.StatusReason)
+			}
+		}
+		discovery.Accounts = append(discovery.Accounts, result)
+	}
+
+	for accountID, child := range children {
+		if deployed[accountID] || !child.Status.Operational() {
+			continue
+		}
+		result := OrgAccount{AccountID: accountID, CustomerID: child.CustomerID, Status: OrgAccountRemoved}
+		if _, err := c.TransitionIntegration(ctx, child.CustomerID, IntegrationRevoked, "account no longer in the organization's StackSet"); err != nil {
+			result.Status, result.Detail = OrgAccountFailed, err.Error()
+		}
+		discovery.Accounts = append(discovery.Accounts, result)
+	}
+	sort.Slice(discovery.Accounts, func(a, b int) bool {
+		return discovery.Accounts[a].AccountID < discovery.Accounts[b].AccountID
+	})
+
+	if _, err := c.updateIntegration(ctx, customerID, false, func(i *CustomerIntegration) error {
+		if i.Organization != nil {
+			i.Organization.LastDiscoveredAt = discovery.DiscoveredAt
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to record discovery: %w", err)
+	}
+
+	c.logger.InfoContext(ctx, "organization accounts discovered", "customer_id", customerID, "accounts", len(discovery.Accounts))
+	return discovery, nil
+}
+
+// registerOrgAccount verifies a member account's role and records it as an
+// active integration under the organization
+func (c *Client) registerOrgAccount(ctx context.Context, parent *CustomerIntegration, partition, accountID string) error {
+	org := parent.Organization
+	childID := OrgAccountCustomerID(parent.CustomerID, accountID)
+	roleARN := fmt.Sprintf("arn:%s:iam::%s:role/%s/%s", partition, accountID, c.config.ServiceName, org.MemberRoleName)
+	externalID := orgMemberExternalID(parent.ExternalID, org.ExternalIDMode, accountID)
+
+	creds, err := c.validateRoleAccess(ctx, childID, "organization discovery", roleARN, externalID)
+	if err != nil {
+		return fmt.Errorf("role validation failed: %w", err)
+	}
+	cfg, err := c.credentialsConfig(ctx, creds)
+	if err != nil {
+		return err
+	}
+	trust := c.checkTrustPolicy(ctx, cfg, roleARN, externalID)
+	if !trust.Trusted() {
+		return &TrustPolicyError{Report: trust}
+	}
+
+	_, err = c.updateIntegration(ctx, childID, true, func(i *CustomerIntegration) error {
+		now := c.now()
+		if err := i.transition(IntegrationRoleVerified, "role deployed by the organization's StackSet", now); err != nil {
+			return err
+		}
+		i.CustomerName = parent.CustomerName
+		i.ParentCustomerID = parent.CustomerID
+		i.AccountID = accountID
+		i.Deployment = DeploymentStackSet
+		i.RoleARN = roleARN
+		i.RoleName = org.MemberRoleName
+		i.ExternalID = externalID
+		i.StackName = org.StackSetName
+		i.StackRegion = parent.StackRegion
+		i.SetupPhase = false
+		i.TemplateVersion = org.MemberTemplateVersion
+		i.DeployedPermissions = copyPermissions(parent.DeployedPermissions)
+		i.TrustPolicy = trust
+		return i.transition(IntegrationActive, "no setup permissions attached", now)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record integration: %w", err)
+	}
+	c.clearSession(ctx, childID)
+
+	c.logger.InfoContext(ctx, "organization account registered", "customer_id", childID, "parent_customer_id", parent.CustomerID, "role_arn", roleARN)
+	return nil
+}
+
+// orgMemberExternalID is the external ID a member account's role trusts,
+// matching the member template's ExternalIdMode
+func orgMemberExternalID(externalID string, mode OrgExternalIDMode, accountID string) string {
+	if mode == OrgExternalIDPerAccount {
+		return externalID + "-" + accountID
+	}
+	return externalID
+}
+
+// listOrgAccounts returns the organization's accounts by ID
+func listOrgAccounts(ctx context.Context, client OrganizationsAPI) (map[string]orgtypes.Account, error) {
+	accounts := make(map[string]orgtypes.Account)
+	input := &organizations.ListAccountsInput{}
+	for {
+		out, err := client.ListAccounts(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list organization accounts: %w", err)
+		}
+		for _, account := range out.Accounts {
+			accounts[aws.ToString(account.Id)] = account
+		}
+		if out.NextToken == nil {
+			return accounts, nil
+		}
+		input.NextToken = out.NextToken
+	}
+}
+
+// listStackInstances returns the StackSet's stack instances
+func listStackInstances(ctx context.Context, client StackSetAPI, stackSetName string) ([]cftypes.StackInstanceSummary, error) {
+	var instances []cftypes.StackInstanceSummary
+	input := &cloudformation.ListStackInstancesInput{StackSetName: aws.String(stackSetName)}
+	for {
+		out, err := client.ListStackInstances(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list stack instances of %s: %w", stackSetName, err)
+		}
+		instances = append(instances, out.Summaries...)
+		if out.NextToken == nil {
+			return instances, nil
+		}
+		input.NextToken = out.NextToken
+	}
+}
+
+// currentOrgMemberTemplate renders the role template the StackSet deploys to
+// member accounts and returns it with its version
+func (c *Client) currentOrgMemberTemplate() (string, string, error) {
+	body, err := c.renderCrossAccountTemplate(c.config.ServiceName, c.config.ServiceAccountID, c.config.OngoingPermissions, true)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate template: %w", err)
+	}
+
+	return body, contentVersion(body), nil
+}
+
+// currentOrgManagementTemplate renders the management account template and
+// returns it with its version. The member template is passed to it by URL,
+// so its version doesn't depend on the service's permissions
+func (c *Client) currentOrgManagementTemplate() (string, string, error) {
+	tmpl, err := template.New("org-management").Parse(orgManagementTemplate)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse template: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, map[string]interface{}{
+		"ServiceName":            c.config.ServiceName,
+		"ServiceAccountID":       c.config.ServiceAccountID,
+		"SessionDurationSeconds": c.maxSessionSeconds(),
+	}); err != nil {
+		return "", "", fmt.Errorf("failed to execute template: %w", err)
+	}
+
+	body := buf.String()
+	return body, contentVersion(body), nil
+}
+
+// orgManagementTemplate is launched in the organization's management account
+const orgManagementTemplate = `AWSTemplateFormatVersion: '2010-09-09'
+Description: 'Organization access for {{.ServiceName}} - deploys its cross-account role to member accounts'
+
+Parameters:
+  ExternalId:
+    Type: String
+    Description: 'Unique identifier for additional security'
+    MinLength: 8
+    MaxLength: 1211
+    AllowedPattern: '[\w+=,.@:/-]+'
+    NoEcho: true
+
+  ServiceAccountId:
+    Type: String
+    Description: 'AWS Account ID for {{.ServiceName}}'
+    Default: '{{.ServiceAccountID}}'
+    AllowedPattern: '[0-9]{12}'
+
+  ManagementRoleName:
+    Type: String
+    Description: 'Role {{.ServiceName}} assumes in this account to find member accounts'
+    Default: '{{.ServiceName}}-OrgManagement'
+    AllowedPattern: '[\w+=,.@-]{1,64}'
+
+  MemberRoleName:
+    Type: String
+    Description: 'Role created in each member account'
+    Default: '{{.ServiceName}}-CrossAccountRole'
+    AllowedPattern: '[\w+=,.@-]{1,64}'
+
+  OrganizationalUnitIds:
+    Type: CommaDelimitedList
+    Description: 'Organization root or OU IDs whose accounts get the role'
+
+  ExternalIdMode:
+    Type: String
+    Description: 'shared: every account trusts ExternalId; per-account: each account trusts ExternalId-<account ID>'
+    Default: 'shared'
+    AllowedValues:
+      - 'shared'
+      - 'per-account'
+
+  StackSetName:
+    Type: String
+    Description: 'Name of the StackSet that deploys the member role'
+    Default: '{{.ServiceName}}-CrossAccountRole'
+    AllowedPattern: '[a-zA-Z][a-zA-Z0-9-]{0,127}'
+
+  MemberTemplateURL:
+    Type: String
+    Description: 'Template the StackSet deploys to each member account'
+
+Resources:
+  # Lets {{.ServiceName}} list member accounts and see where the role was
+  # deployed. It grants no access to the accounts themselves
+  ManagementRole:
+    Type: AWS::IAM::Role
+    Properties:
+      RoleName: !Ref ManagementRoleName
+      Path: '/{{.ServiceName}}/'
+      MaxSessionDuration: {{.SessionDurationSeconds}}
+      AssumeRolePolicyDocument:
+        Version: '2012-10-17'
+        Statement:
+          - Effect: Allow
+            Principal:
+              AWS: !Sub 'arn:${AWS::Partition}:iam::${ServiceAccountId}:root'
+            Action:
+              - 'sts:AssumeRole'
+              - 'sts:TagSession'
+              - 'sts:SetSourceIdentity'
+            Condition:
+              StringEquals:
+                'sts:ExternalId': !Ref ExternalId
+      Policies:
+        - PolicyName: organization-discovery
+          PolicyDocument:
+            Version: '2012-10-17'
+            Statement:
+              - Sid: ListAccounts
+                Effect: Allow
+                Action:
+                  - 'organizations:DescribeOrganization'
+                  - 'organizations:ListAccounts'
+                Resource: '*'
+              - Sid: ReadStackSet
+                Effect: Allow
+                Action:
+                  - 'cloudformation:DescribeStackSet'
+                  - 'cloudformation:ListStackInstances'
+                Resource: !Sub 'arn:${AWS::Partition}:cloudformation:${AWS::Region}:${AWS::AccountId}:stackset/${StackSetName}:*'
+              - Sid: ReadOwnRole
+                Effect: Allow
+                Action:
+                  - 'iam:GetRole'
+                Resource: !Sub 'arn:${AWS::Partition}:iam::${AWS::AccountId}:role/{{.ServiceName}}/${ManagementRoleName}'
+      Tags:
+        - Key: ManagedBy
+          Value: '{{.ServiceName}}'
+
+  # Creates the role in every active account of the target OUs, including
+  # accounts that join later. Requires trusted access for StackSets
+  MemberRoleStackSet:
+    Type: AWS::CloudFormation::StackSet
+    Properties:
+      StackSetName: !Ref StackSetName
+      Description: 'Cross-account role for {{.ServiceName}}'
+      PermissionModel: SERVICE_MANAGED
+      AutoDeployment:
+        Enabled: true
+        RetainStacksOnAccountRemoval: false
+      ManagedExecution:
+        Active: true
+      Capabilities:
+        - CAPABILITY_NAMED_IAM
+      TemplateURL: !Ref MemberTemplateURL
+      Parameters:
+        - ParameterKey: ExternalId
+          ParameterValue: !Ref ExternalId
+        - ParameterKey: ExternalIdMode
+          ParameterValue: !Ref ExternalIdMode
+        - ParameterKey: ServiceAccountId
+          ParameterValue: !Ref ServiceAccountId
+        - ParameterKey: RoleName
+          ParameterValue: !Ref MemberRoleName
+        - ParameterKey: SetupPhase
+          ParameterValue: 'false'
+      # One account failing doesn't hold up the others
+      OperationPreferences:
+        FailureTolerancePercentage: 100
+        MaxConcurrentPercentage: 100
+      StackInstancesGroup:
+        - DeploymentTargets:
+            OrganizationalUnitIds: !Ref OrganizationalUnitIds
+          Regions:
+            - !Ref AWS::Region
+
+Outputs:
+  ManagementRoleArn:
+    Description: 'ARN of the management role - send it to {{.ServiceName}} to complete setup'
+    Value: !GetAtt ManagementRole.Arn
+
+  StackSetName:
+    Description: 'StackSet that deploys the member role'
+    Value: !Ref StackSetName
+
+  ExternalIdMode:
+    Description: 'How member accounts derive their external ID'
+    Value: !Ref ExternalIdMode`
@@ -0,0 +1,262 @@
+package crossaccount
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	cftypes "github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+	"github.com/aws/aws-sdk-go-v2/service/organizations"
+	orgtypes "github.com/aws/aws-sdk-go-v2/service/organizations/types"
+)
+
+const testManagementRoleARN = "arn:aws:iam::999999999999:role/test-service/test-service-OrgManagement-org-1"
+
+// fakeOrganization serves one account per ListAccounts page and the
+// StackSet's instances
+type fakeOrganization struct {
+	accounts     []orgtypes.Account
+	instances    []cftypes.StackInstanceSummary
+	stackSetName string
+}
+
+func (f *fakeOrganization) ListAccounts(ctx context.Context, params *organizations.ListAccountsInput, optFns ...func(*organizations.Options)) (*organizations.ListAccountsOutput, error) {
+	i := 0
+	if params.NextToken != nil {
+		for i < len(f.accounts) && aws.ToString(f.accounts[i].Id) != aws.ToString(params.NextToken) {
+			i++
+		}
+	}
+	out := &organizations.ListAccountsOutput{}
+	if i < len(f.accounts) {
+		out.Accounts = f.accounts[i : i+1]
+	}
+	if i+1 < len(f.accounts) {
+		out.NextToken = f.accounts[i+1].Id
+	}
+	return out, nil
+}
+
+func (f *fakeOrganization) ListStackInstances(ctx context.Context, params *cloudformation.ListStackInstancesInput, optFns ...func(*cloudformation.Options)) (*cloudformation.ListStackInstancesOutput, error) {
+	f.stackSetName = aws.ToString(params.StackSetName)
+	return &cloudformation.ListStackInstancesOutput{Summaries: f.instances}, nil
+}
+
+func orgAccount(id string, status orgtypes.AccountStatus) orgtypes.Account {
+	return orgtypes.Account{Id: aws.String(id), Name: aws.String("account " + id), Status: status}
+}
+
+func stackInstance(account string, status cftypes.StackInstanceDetailedStatus) cftypes.StackInstanceSummary {
+	return cftypes.StackInstanceSummary{
+		Account:             aws.String(account),
+		Region:              aws.String("us-east-1"),
+		StackInstanceStatus: &cftypes.StackInstanceComprehensiveStatus{DetailedStatus: status},
+	}
+}
+
+func TestGenerateOrgSetupLink(t *testing.T) {
+	ctx := context.Background()
+	cfg := SimpleConfig("test-service", "123456789012", "test-bucket")
+	cfg.SetupCallbackTopicARN = testCallbackTopicARN
+	client, s3Server := newTestClient(t, cfg, withMockSTS(&mockSTSClient{}))
+
+	for _, opts := range []OrgSetupOptions{
+		{},
+		{OrganizationalUnitIDs: []string{"ou-bad"}},
+		{OrganizationalUnitIDs: []string{"r-ab12"}, ExternalIDMode: "random"},
+		{OrganizationalUnitIDs: []string{"r-ab12"}, ManagementAccountID: "123"},
+	} {
+		if _, err := client.GenerateOrgSetupLink(ctx, "org-1", "Acme Corp", opts); err == nil {
+			t.Errorf("GenerateOrgSetupLink(%+v) should fail", opts)
+		}
+	}
+
+	setup, err := client.GenerateOrgSetupLink(ctx, "org-1", "Acme Corp", OrgSetupOptions{
+		OrganizationalUnitIDs: []string{"r-ab12", "ou-ab12-cdef3456"},
+	})
+	if err != nil {
+		t.Fatalf("GenerateOrgSetupLink() error = %v", err)
+	}
+	if s3Server.puts != 2 {
+		t.Errorf("expected the member and management templates to be published, got %d uploads", s3Server.puts)
+	}
+
+	params, err := urlFragmentQuery(setup.LaunchURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{
+		"stackName":                   "test-service-Integration-org-1",
+		"param_ManagementRoleName":    "test-service-OrgManagement-org-1",
+		"param_MemberRoleName":        "test-service-CrossAccount-org-1",
+		"param_OrganizationalUnitIds": "r-ab12,ou-ab12-cdef3456",
+		"param_ExternalIdMode":        "shared",
+		"param_StackSetName":          "test-service-Integration-org-1-members",
+		"param_ExternalId":            setup.ExternalID,
+	} {
+		if got := params.Get(key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+	if !strings.Contains(params.Get("templateURL"), "org-management") || !strings.Contains(params.Get("param_MemberTemplateURL"), "org-member-role") {
+		t.Errorf("launch URL templates = %s, %s", params.Get("templateURL"), params.Get("param_MemberTemplateURL"))
+	}
+	if params.Has("param_SetupToken") {
+		t.Error("organization setup can't complete through the setup callback")
+	}
+
+	integration, err := client.GetIntegration(ctx, "org-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if integration.Deployment != DeploymentOrganization || integration.SetupPhase || integration.Organization == nil || integration.Organization.MemberTemplateVersion == "" {
+		t.Errorf("integration = %+v", integration)
+	}
+
+	member, _, err := client.currentOrgMemberTemplate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(member, `!If [PerAccountExternalId, !Sub '${ExternalId}-${AWS::AccountId}', !Ref ExternalId]`) || strings.Contains(member, "SetupCallback") {
+		t.Error("member template should derive per-account external IDs and have no setup callback")
+	}
+	role, err := client.GenerateCloudFormationTemplate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(role, "ExternalIdMode") {
+		t.Error("single-account template shouldn't have an external ID mode")
+	}
+}
+
+func TestDiscoverOrgAccounts(t *testing.T) {
+	ctx := context.Background()
+	org := &fakeOrganization{
+		accounts: []orgtypes.Account{
+			orgAccount("111111111111", orgtypes.AccountStatusActive),
+			orgAccount("222222222222", orgtypes.AccountStatusActive),
+			orgAccount("333333333333", orgtypes.AccountStatusSuspended),
+			orgAccount("444444444444", orgtypes.AccountStatusActive),
+		},
+		instances: []cftypes.StackInstanceSummary{
+			stackInstance("111111111111", cftypes.StackInstanceDetailedStatusSucceeded),
+			stackInstance("222222222222", cftypes.StackInstanceDetailedStatusRunning),
+			stackInstance("333333333333", cftypes.StackInstanceDetailedStatusSucceeded),
+			stackInstance("444444444444", cftypes.StackInstanceDetailedStatusFailed),
+		},
+	}
+	cfg := SimpleConfig("test-service", "123456789012", "test-bucket")
+	cfg.OngoingPermissions = []Permission{{Sid: "ReadEC2", Actions: []string{"ec2:DescribeInstances"}}}
+	cfg.SetupPermissions = []Permission{{Sid: "CreateBuckets", Actions: []string{"s3:CreateBucket"}}}
+	ti := newIntegratedTestClient(t, cfg,
+		withOrgSetup("org-1", testManagementRoleARN, OrgSetupOptions{
+			OrganizationalUnitIDs: []string{"ou-ab12-cdef3456"},
+			ExternalIDMode:        OrgExternalIDPerAccount,
+		}),
+		withClientOptions(
+			WithOrganizationsClientFactory(func(aws.Config) OrganizationsAPI { return org }),
+			WithStackSetClientFactory(func(aws.Config) StackSetAPI { return org }),
+		))
+	client, mock, setup := ti.client, ti.sts, ti.setup
+
+	discovery, err := client.DiscoverOrgAccounts(ctx, "org-1")
+	if err != nil {
+		t.Fatalf("DiscoverOrgAccounts() error = %v", err)
+	}
+	if org.stackSetName != "test-service-Integration-org-1-members" {
+		t.Errorf("listed stack instances of %q", org.stackSetName)
+	}
+	statuses := make(map[string]string)
+	for _, account := range discovery.Accounts {
+		statuses[account.AccountID] = account.Status
+	}
+	want := map[string]string{
+		"111111111111": OrgAccountRegistered,
+		"222222222222": OrgAccountPending,
+		"444444444444": OrgAccountFailed,
+	}
+	if len(statuses) != len(want) {
+		t.Errorf("discovered %v, want %v", statuses, want)
+	}
+	for id, status := range want {
+		if statuses[id] != status {
+			t.Errorf("account %s is %s, want %s", id, statuses[id], status)
+		}
+	}
+
+	child, err := client.GetIntegration(ctx, OrgAccountCustomerID("org-1", "111111111111"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if child.Status != IntegrationActive || child.Deployment != DeploymentStackSet || child.ParentCustomerID != "org-1" || child.AccountID != "111111111111" ||
+		child.RoleARN != "arn:aws:iam::111111111111:role/test-service/test-service-CrossAccount-org-1" ||
+		child.ExternalID != setup.ExternalID+"-111111111111" || child.SetupPhase {
+		t.Errorf("child = %+v", child)
+	}
+	last := mock.assumeRoleCalls[len(mock.assumeRoleCalls)-1]
+	if aws.ToString(last.ExternalId) != child.ExternalID {
+		t.Errorf("member role assumed with external ID %s", aws.ToString(last.ExternalId))
+	}
+	if _, err := client.AssumeRole(ctx, child.CustomerID); err != nil {
+		t.Errorf("AssumeRole() on a member account error = %v", err)
+	}
+
+	// Organization deployments have no setup permissions or rotation of their own
+	if _, err := client.RemoveSetupPermissionsWithContext(ctx, child.CustomerID); err == nil {
+		t.Error("RemoveSetupPermissions() should fail for a member account")
+	}
+	if _, err := client.RotateExternalID(ctx, child.CustomerID, "test"); err == nil {
+		t.Error("RotateExternalID() should fail for a member account")
+	}
+	if _, err := client.DetectDrift(ctx, "org-1"); err == nil {
+		t.Error("DetectDrift() should fail for the management account")
+	}
+
+	// Member accounts are compared with the member template
+	plan, err := client.PlanUpgrades(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.UpToDate) != 1 || plan.UpToDate[0] != child.CustomerID || len(plan.Customers) != 0 {
+		t.Errorf("plan = %+v", plan)
+	}
+	client.config.OngoingPermissions = append(client.config.OngoingPermissions, Permission{Sid: "ReadS3", Actions: []string{"s3:GetObject"}})
+	upgrade, err := client.OfferUpgrade(ctx, child.CustomerID)
+	if err != nil {
+		t.Fatalf("OfferUpgrade() error = %v", err)
+	}
+	if upgrade.Deployment != DeploymentStackSet || upgrade.StackName != "test-service-Integration-org-1" || !strings.Contains(upgrade.CLICommand, "ParameterKey=MemberTemplateURL,ParameterValue="+upgrade.TemplateURL) {
+		t.Errorf("upgrade = %+v", upgrade)
+	}
+
+	// Accounts that leave the StackSet are revoked
+	org.instances = []cftypes.StackInstanceSummary{stackInstance("222222222222", cftypes.StackInstanceDetailedStatusSucceeded)}
+	discovery, err = client.DiscoverOrgAccounts(ctx, "org-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(discovery.Accounts) != 2 || discovery.Accounts[0].Status != OrgAccountRemoved || discovery.Accounts[1].Status != OrgAccountRegistered {
+		t.Errorf("discovery = %+v", discovery.Accounts)
+	}
+	child, err = client.GetIntegration(ctx, child.CustomerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if child.Status != IntegrationRevoked {
+		t.Errorf("removed account is %s", child.Status)
+	}
+
+	parent, err := client.GetIntegration(ctx, "org-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parent.Organization.LastDiscoveredAt.Equal(discovery.DiscoveredAt) {
+		t.Errorf("last discovered at %v, want %v", parent.Organization.LastDiscoveredAt, discovery.DiscoveredAt)
+	}
+
+	if _, err := client.DiscoverOrgAccounts(ctx, child.CustomerID); err == nil {
+		t.Error("DiscoverOrgAccounts() should fail for a member account")
+	}
+}
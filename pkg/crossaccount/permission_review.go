@@ -0,0 +1,466 @@
+package crossaccount
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// AccessLevel classifies an action the way IAM policy summaries do
+type AccessLevel string
+
+const (
+	AccessList                  AccessLevel = "List"
+	AccessRead                  AccessLevel = "Read"
+	AccessWrite                 AccessLevel = "Write"
+	AccessPermissionsManagement AccessLevel = "Permissions management"
+	AccessTagging               AccessLevel = "Tagging"
+	AccessAll                   AccessLevel = "All" // Every action of a service, or of every service
+)
+
+// accessLevelOrder is the order access levels are listed in
+var accessLevelOrder = []AccessLevel{AccessList, AccessRead, AccessWrite, AccessPermissionsManagement, AccessTagging, AccessAll}
+
+// permissionsKeywords mark write actions that change who can access a resource
+var permissionsKeywords = []string{"policy", "permission", "acl", "grant", "revoke"}
+
+// PermissionReview explains every statement the customer's role grants, for
+// their security team to review before launching the stack
+type PermissionReview struct {
+	ServiceName       string    `json:"service_name"`
+	ServiceAccountID  string    `json:"service_account_id"` // The only account the role trusts
+	TemplateVersion   string    `json:"template_version"`   // Version of the template the review describes
+	MaxSessionSeconds int       `json:"max_session_seconds"`
+	GeneratedAt       time.Time `json:"generated_at"`
+
+	Ongoing      []ReviewedStatement `json:"ongoing"`                 // Config.OngoingPermissions
+	Setup        []ReviewedStatement `json:"setup,omitempty"`         // Config.SetupPermissions
+	Management   []ReviewedStatement `json:"management"`              // What the template adds so the service can check its own stack
+	SetupRemoval string              `json:"setup_removal,omitempty"` // When setup permissions are removed
+}
+
+// ReviewedStatement is one policy statement with its explanation
+type ReviewedStatement struct {
+	Sid           string                 `json:"sid,omitempty"`
+	Effect        string                 `json:"effect"`
+	Description   string                 `json:"description"`
+	Justification string                 `json:"justification,omitempty"`
+	UsedWhen      string                 `json:"used_when"`
+	Actions       []ReviewedAction       `json:"actions"`
+	AccessLevels  []AccessLevel          `json:"access_levels"` // Of all the actions, in a fixed order
+	Resources     []string               `json:"resources"`
+	Condition     map[string]interface{} `json:"condition,omitempty"`
+}
+
+// ReviewedAction is an action and its access level
+type ReviewedAction struct {
+	Action      string      `json:"action"`
+	AccessLevel AccessLevel `json:"access_level"`
+}
+
+// PermissionReview describes the role GenerateCloudFormationTemplate creates.
+// Statements without a Description or UsedWhen get a generated one
+func (c *Client) PermissionReview() (*PermissionReview, error) {
+	_, version, err := c.currentTemplate()
+	if err != nil {
+		return nil, err
+	}
+
+	review := &PermissionReview{
+		ServiceName:       c.config.ServiceName,
+		ServiceAccountID:  c.config.ServiceAccountID,
+		TemplateVersion:   version,
+		MaxSessionSeconds: c.maxSessionSeconds(),
+		GeneratedAt:       c.now(),
+	}
+	for _, p := range c.config.OngoingPermissions {
+		review.Ongoing = append(review.Ongoing, reviewStatement(p, "Whenever "+c.config.ServiceName+" works in your account"))
+	}
+	for _, p := range c.config.SetupPermissions {
+		review.Setup = append(review.Setup, reviewStatement(p, "Only during setup"))
+	}
+	for _, p := range c.managementPermissions() {
+		review.Management = append(review.Management, reviewStatement(p, ""))
+	}
+	if len(review.Setup) > 0 {
+		review.SetupRemoval = fmt.Sprintf("Setup permissions are attached only while the stack's SetupPhase parameter "+
+			"(setup_phase in Terraform) is true. Once setup is complete, %s updates your stack with SetupPhase=false, "+
+			"which deletes the setup policy and the permissions used to remove it. You can remove them yourself at any "+
+			"time the same way", c.config.ServiceName)
+	}
+	return review, nil
+}
+
+// managementPermissions are the statements the role template adds besides
+// the configured ones, described with the template's resources
+func (c *Client) managementPermissions() []Permission {
+	stack := "This stack"
+	role := "The cross-account role"
+	setupPolicy := "The role's setup policy"
+	policies := []string{setupPolicy, "AWS managed policies"}
+	if len(c.config.OngoingPermissions) > 0 {
+		policies = append([]string{"The role's ongoing policy"}, policies...)
+	}
+
+	permissions := []Permission{
+		{
+			Sid:         "StackStatus",
+			Actions:     []string{"cloudformation:DescribeStacks", "cloudformation:DescribeStackResources"},
+			Resources:   []string{stack},
+			Description: "Read the status of this stack",
+			UsedWhen:    "While setup permissions are removed and during drift checks",
+		},
+		{
+			Sid:         "RoleStatus",
+			Actions:     []string{"iam:GetRole", "iam:ListAttachedRolePolicies"},
+			Resources:   []string{role},
+			Description: "Check that the trust policy hasn't been widened and list the attached policies",
+			UsedWhen:    "During drift checks",
+		},
+		{
+			Sid:         "PolicyStatus",
+			Actions:     []string{"iam:GetPolicy", "iam:GetPolicyVersion"},
+			Resources:   policies,
+			Description: "Compare the attached policies with the ones " + c.config.ServiceName + " expects",
+			UsedWhen:    "During drift checks",
+		},
+	}
+	if len(c.config.SetupPermissions) > 0 {
+		permissions = append(permissions,
+			Permission{
+				Sid:         "UpdateOwnStack",
+				Actions:     []string{"cloudformation:UpdateStack"},
+				Resources:   []string{stack},
+				Description: "Update this stack with SetupPhase=false",
+				UsedWhen:    "Once, to remove the setup permissions. Removed with them",
+			},
+			Permission{
+				Sid:         "DeleteSetupPolicy",
+				Actions:     []string{"iam:GetPolicy", "iam:ListPolicyVersions", "iam:ListEntitiesForPolicy", "iam:DeletePolicyVersion", "iam:DeletePolicy"},
+				Resources:   []string{setupPolicy},
+				Description: "Let CloudFormation delete the setup policy during that update",
+				UsedWhen:    "Once, to remove the setup permissions. Removed with them",
+			},
+			Permission{
+				Sid:         "DetachSetupPolicy",
+				Actions:     []string{"iam:DetachRolePolicy", "iam:GetRolePolicy", "iam:DeleteRolePolicy"},
+				Resources:   []string{role},
+				Description: "Let CloudFormation detach the setup policies from the role during that update",
+				UsedWhen:    "Once, to remove the setup permissions. Removed with them",
+			},
+			Permission{
+				Sid:         "TagRole",
+				Actions:     []string{"iam:TagRole", "iam:UntagRole"},
+				Resources:   []string{role},
+				Description: "Let CloudFormation update the role's SetupPhase tag during that update",
+				UsedWhen:    "Once, to remove the setup permissions. Removed with them",
+			},
+		)
+	}
+	return permissions
+}
+
+// reviewStatement explains a permission, filling in what it doesn't say
+func reviewStatement(p Permission, usedWhen string) ReviewedStatement {
+	s := ReviewedStatement{
+		Sid:           p.Sid,
+		Effect:        p.Effect,
+		Description:   p.Description,
+		Justification: p.Justification,
+		UsedWhen:      p.UsedWhen,
+		Resources:     p.Resources,
+		Condition:     p.Condition,
+	}
+	if s.Effect == "" {
+		s.Effect = "Allow"
+	}
+	if len(s.Resources) == 0 {
+		s.Resources = []string{"*"}
+	}
+	if s.UsedWhen == "" {
+		s.UsedWhen = usedWhen
+	}
+
+	levels := make(map[AccessLevel]bool)
+	services := make(map[string]bool)
+	for _, action := range p.Actions {
+		level := accessLevel(action)
+		s.Actions = append(s.Actions, ReviewedAction{Action: action, AccessLevel: level})
+		levels[level] = true
+		if service, _, ok := strings.Cut(action, ":"); ok {
+			services[strings.ToLower(service)] = true
+		}
+	}
+	for _, level := range accessLevelOrder {
+		if levels[level] {
+			s.AccessLevels = append(s.AccessLevels, level)
+		}
+	}
+
+	if s.Description == "" {
+		s.Description = describeAccess(s.Effect, s.AccessLevels, services)
+	}
+	return s
+}
+
+// describeAccess summarizes a statement, e.g. "List and Write access to ec2"
+func describeAccess(effect string, levels []AccessLevel, services map[string]bool) string {
+	names := make([]string, 0, len(levels))
+	for _, level := range levels {
+		names = append(names, string(level))
+	}
+	serviceNames := make([]string, 0, len(services))
+	for service := range services {
+		serviceNames = append(serviceNames, service)
+	}
+	sort.Strings(serviceNames)
+
+	description := joinWords(names) + " access"
+	if len(serviceNames) > 0 {
+		description += " to " + joinWords(serviceNames)
+	}
+	if effect == "Deny" {
+		description = "Denies " + strings.ToLower(description[:1]) + description[1:]
+	}
+	return description
+}
+
+// joinWords joins a list as "a, b and c"
+func joinWords(words []string) string {
+	if len(words) < 2 {
+		return strings.Join(words, "")
+	}
+	return strings.Join(words[:len(words)-1], ", ") + " and " + words[len(words)-1]
+}
+
+// accessLevel classifies an action from its name. Names with wildcards are
+// classified by the part before the first wildcard, so the result is an
+// approximation of IAM's own classification
+func accessLevel(action string) AccessLevel {
+	service, name, ok := strings.Cut(action, ":")
+	if !ok || service == "*" {
+		return AccessAll
+	}
+	literal, _, _ := strings.Cut(name, "*")
+	literal, _, _ = strings.Cut(literal, "?")
+	literal = strings.ToLower(literal)
+
+	switch {
+	case literal == "":
+		return AccessAll
+	case strings.HasPrefix(literal, "list") || strings.HasPrefix(literal, "describe"):
+		return AccessList
+	case readOnlyAction(literal):
+		return AccessRead
+	case strings.HasPrefix(literal, "tag") || strings.HasPrefix(literal, "untag") || literal == "createtags" || literal == "deletetags":
+		return AccessTagging
+	case strings.EqualFold(service, "iam"):
+		return AccessPermissionsManagement
+	}
+	for _, keyword := range permissionsKeywords {
+		if strings.Contains(literal, keyword) {
+			return AccessPermissionsManagement
+		}
+	}
+	return AccessWrite
+}
+
+// JSON renders the review as indented JSON
+func (r *PermissionReview) JSON() ([]byte, error) {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode permission review: %w", err)
+	}
+	return data, nil
+}
+
+// Markdown renders the review as a Markdown document
+func (r *PermissionReview) Markdown() (string, error) {
+	tmpl, err := template.New("review").Funcs(reviewFuncs).Parse(markdownReviewTemplate)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse review template: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, r); err != nil {
+		return "", fmt.Errorf("failed to render permission review: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// HTML renders the review as a standalone HTML page
+func (r *PermissionReview) HTML() (string, error) {
+	tmpl, err := htmltemplate.New("review").Funcs(htmltemplate.FuncMap(reviewFuncs)).Parse(htmlReviewTemplate)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse review template: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, r); err != nil {
+		return "", fmt.Errorf("failed to render permission review: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// PermissionReviewHandler serves the permission review as HTML, or as
+// Markdown or JSON with ?format=markdown or ?format=json. Serve it at
+// Config.PermissionReviewURL so setup links point customers to it
+func (c *Client) PermissionReviewHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		review, err := c.PermissionReview()
+		if err != nil {
+			http.Error(w, "failed to generate permission review", http.StatusInternalServerError)
+			return
+		}
+
+		var body []byte
+		var contentType string
+		switch format := r.URL.Query().Get("format"); format {
+		case "", "html":
+			var page string
+			page, err = review.HTML()
+			body, contentType = []byte(page), "text/html; charset=utf-8"
+		case "markdown", "md":
+			var doc string
+			doc, err = review.Markdown()
+			body, contentType = []byte(doc), "text/markdown; charset=utf-8"
+		case "json":
+			body, err = review.JSON()
+			contentType = "application/json"
+		default:
+			http.Error(w, fmt.Sprintf("unknown format %q", format), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "failed to render permission review", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		w.Write(body)
+	})
+}
+
+// reviewFuncs are shared by the Markdown and HTML templates
+var reviewFuncs = template.FuncMap{
+	"hours": func(seconds int) string {
+		if seconds == 3600 {
+			return "1 hour"
+		}
+		return strings.TrimSuffix(fmt.Sprintf("%.1f", float64(seconds)/3600), ".0") + " hours"
+	},
+	"levels": func(levels []AccessLevel) string {
+		names := make([]string, 0, len(levels))
+		for _, level := range levels {
+			names = append(names, string(level))
+		}
+		return strings.Join(names, ", ")
+	},
+	"conditionJSON": func(condition map[string]interface{}) (string, error) {
+		data, err := json.MarshalIndent(condition, "", "  ")
+		return string(data), err
+	},
+	"date": func(t time.Time) string {
+		return t.UTC().Format("2006-01-02 15:04 UTC")
+	},
+}
+
+const markdownReviewTemplate = `# {{.ServiceName}} permission review
+
+{{.ServiceName}} asks for an IAM role in your account. Only AWS account {{.ServiceAccountID}} can assume it, and only with the external ID from your setup link. Sessions last at most {{hours .MaxSessionSeconds}}.
+
+Template version {{.TemplateVersion}}, generated {{date .GeneratedAt}}.
+{{define "statements"}}{{range .}}
+### {{if .Sid}}{{.Sid}}{{else}}Statement{{end}}
+
+{{.Description}}
+{{if .Justification}}
+**Why it's needed:** {{.Justification}}
+{{end}}
+**Used:** {{.UsedWhen}}
+
+**Effect:** {{.Effect}} · **Access levels:** {{levels .AccessLevels}}
+
+| Action | Access level |
+| --- | --- |
+{{range .Actions}}| ` + "`{{.Action}}`" + ` | {{.AccessLevel}} |
+{{end}}
+**Resources:**
+{{range .Resources}}
+- ` + "`{{.}}`" + `{{end}}
+{{if .Condition}}
+**Condition:**
+
+` + "```json\n{{conditionJSON .Condition}}\n```" + `
+{{end}}{{end}}{{end}}
+## Ongoing permissions
+{{if .Ongoing}}{{template "statements" .Ongoing}}{{else}}
+None.
+{{end}}
+## Setup permissions
+{{if .Setup}}
+{{.SetupRemoval}}.
+{{template "statements" .Setup}}{{else}}
+None.
+{{end}}
+## Stack management permissions
+
+The template also lets {{.ServiceName}} check the role it manages. These statements are scoped to this stack's own resources.
+{{template "statements" .Management}}`
+
+const htmlReviewTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.ServiceName}} permission review</title>
+<style>
+body { font-family: sans-serif; max-width: 60em; margin: 2em auto; padding: 0 1em; line-height: 1.5; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.25em 0.75em; text-align: left; }
+section.statement { border-top: 1px solid #eee; margin-top: 1.5em; }
+</style>
+</head>
+<body>
+<h1>{{.ServiceName}} permission review</h1>
+<p>{{.ServiceName}} asks for an IAM role in your account. Only AWS account {{.ServiceAccountID}} can assume it, and only with the external ID from your setup link. Sessions last at most {{hours .MaxSessionSeconds}}.</p>
+<p>Template version {{.TemplateVersion}}, generated {{date .GeneratedAt}}.</p>
+{{define "statements"}}{{range .}}
+<section class="statement">
+<h3>{{if .Sid}}{{.Sid}}{{else}}Statement{{end}}</h3>
+<p>{{.Description}}</p>
+{{if .Justification}}<p><strong>Why it's needed:</strong> {{.Justification}}</p>
+{{end}}<p><strong>Used:</strong> {{.UsedWhen}}</p>
+<p><strong>Effect:</strong> {{.Effect}} · <strong>Access levels:</strong> {{levels .AccessLevels}}</p>
+<table>
+<tr><th>Action</th><th>Access level</th></tr>
+{{range .Actions}}<tr><td><code>{{.Action}}</code></td><td>{{.AccessLevel}}</td></tr>
+{{end}}</table>
+<p><strong>Resources:</strong></p>
+<ul>
+{{range .Resources}}<li><code>{{.}}</code></li>
+{{end}}</ul>
+{{if .Condition}}<p><strong>Condition:</strong></p>
+<pre>{{conditionJSON .Condition}}</pre>
+{{end}}</section>
+{{end}}{{end}}
+<h2>Ongoing permissions</h2>
+{{if .Ongoing}}{{template "statements" .Ongoing}}{{else}}<p>None.</p>{{end}}
+<h2>Setup permissions</h2>
+{{if .Setup}}<p>{{.SetupRemoval}}.</p>
+{{template "statements" .Setup}}{{else}}<p>None.</p>{{end}}
+<h2>Stack management permissions</h2>
+<p>The template also lets {{.ServiceName}} check the role it manages. These statements are scoped to this stack's own resources.</p>
+{{template "statements" .Management}}
+</body>
+</html>
+`
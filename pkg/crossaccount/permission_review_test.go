@@ -0,0 +1,142 @@
+package crossaccount
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAccessLevel(t *testing.T) {
+	tests := map[string]AccessLevel{
+		"ec2:DescribeInstances":   AccessList,
+		"s3:ListBucket":           AccessList,
+		"s3:GetObject":            AccessRead,
+		"cloudwatch:get*":         AccessRead,
+		"s3:PutObject":            AccessWrite,
+		"ec2:RunInstances":        AccessWrite,
+		"s3:PutBucketPolicy":      AccessPermissionsManagement,
+		"kms:CreateGrant":         AccessPermissionsManagement,
+		"iam:PassRole":            AccessPermissionsManagement,
+		"ec2:CreateTags":          AccessTagging,
+		"lambda:TagResource":      AccessTagging,
+		"ec2:*":                   AccessAll,
+		"*":                       AccessAll,
+		"logs:DescribeLogGroups*": AccessList,
+	}
+	for action, want := range tests {
+		if got := accessLevel(action); got != want {
+			t.Errorf("accessLevel(%q) = %q, want %q", action, got, want)
+		}
+	}
+}
+
+func TestPermissionReview(t *testing.T) {
+	cfg := QuickConfig("data-platform", "test-service", "123456789012", "test-bucket")
+	cfg.OngoingPermissions[0].Justification = "Reads the <datasets> you connect"
+	cfg.OngoingPermissions[0].UsedWhen = "Nightly imports"
+	client, _ := newTestClient(t, cfg)
+
+	review, err := client.PermissionReview()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, version, _ := client.currentTemplate()
+	if review.TemplateVersion != version || review.MaxSessionSeconds != 3600 {
+		t.Errorf("review = %+v", review)
+	}
+	if len(review.Ongoing) != 2 || len(review.Setup) != 1 || len(review.Management) != 7 || review.SetupRemoval == "" {
+		t.Fatalf("review has %d ongoing, %d setup and %d management statements", len(review.Ongoing), len(review.Setup), len(review.Management))
+	}
+
+	data := review.Ongoing[0]
+	if data.UsedWhen != "Nightly imports" || data.Description != "List, Read and Write access to s3" {
+		t.Errorf("statement = %+v", data)
+	}
+	if got := data.AccessLevels; len(got) != 3 || got[0] != AccessList || got[2] != AccessWrite {
+		t.Errorf("access levels = %v", got)
+	}
+	setup := review.Setup[0]
+	if setup.UsedWhen != "Only during setup" || setup.Description != "Write and Permissions management access to s3" {
+		t.Errorf("setup statement = %+v", setup)
+	}
+
+	markdown, err := review.Markdown()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"# test-service permission review", "### S3DataAccess", "**Why it's needed:** Reads the <datasets>", "| `s3:PutBucketPolicy` | Permissions management |", "SetupPhase=false", "### UpdateOwnStack"} {
+		if !strings.Contains(markdown, want) {
+			t.Errorf("Markdown is missing %q:\n%s", want, markdown)
+		}
+	}
+
+	page, err := review.HTML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(page, "Reads the &lt;datasets&gt; you connect") || !strings.Contains(page, "<code>arn:aws:s3:::customer-data-*</code>") {
+		t.Errorf("HTML page:\n%s", page)
+	}
+
+	encoded, err := review.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded PermissionReview
+	if err := json.Unmarshal(encoded, &decoded); err != nil || decoded.Ongoing[0].Justification != cfg.OngoingPermissions[0].Justification {
+		t.Errorf("JSON round trip = %+v, %v", decoded, err)
+	}
+
+	// Without setup permissions there is nothing to remove
+	client, _ = newTestClient(t, QuickConfig("monitoring-platform", "test-service", "123456789012", "test-bucket"))
+	review, err = client.PermissionReview()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(review.Setup) != 0 || len(review.Management) != 3 || review.SetupRemoval != "" {
+		t.Errorf("review = %+v", review)
+	}
+}
+
+func TestPermissionReviewHandler(t *testing.T) {
+	cfg := QuickConfig("compute-platform", "test-service", "123456789012", "test-bucket")
+	cfg.PermissionReviewURL = "https://example.com/aws/permissions"
+	client, _ := newTestClient(t, cfg)
+	handler := client.PermissionReviewHandler()
+
+	tests := []struct {
+		method      string
+		target      string
+		status      int
+		contentType string
+	}{
+		{http.MethodGet, "/aws/permissions", http.StatusOK, "text/html; charset=utf-8"},
+		{http.MethodGet, "/aws/permissions?format=markdown", http.StatusOK, "text/markdown; charset=utf-8"},
+		{http.MethodGet, "/aws/permissions?format=json", http.StatusOK, "application/json"},
+		{http.MethodGet, "/aws/permissions?format=pdf", http.StatusBadRequest, ""},
+		{http.MethodPost, "/aws/permissions", http.StatusMethodNotAllowed, ""},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.target, nil))
+		if rec.Code != tt.status {
+			t.Errorf("%s %s status = %d, want %d", tt.method, tt.target, rec.Code, tt.status)
+			continue
+		}
+		if tt.contentType != "" && rec.Header().Get("Content-Type") != tt.contentType {
+			t.Errorf("%s %s content type = %q", tt.method, tt.target, rec.Header().Get("Content-Type"))
+		}
+	}
+
+	// Setup links point customers at the review
+	resp, err := client.GenerateSetupLinkWithContext(context.Background(), "customer-1", "Customer One")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.PermissionReviewURL != cfg.PermissionReviewURL {
+		t.Errorf("PermissionReviewURL = %q", resp.PermissionReviewURL)
+	}
+}
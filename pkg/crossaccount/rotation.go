@@ -0,0 +1,344 @@
+package crossaccount
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// RotationStatus is the state of an external ID rotation
+type RotationStatus string
+
+// External ID rotation statuses
+const (
+	RotationPending   RotationStatus = "pending"   // Waiting for the customer to update their stack
+	RotationCompleted RotationStatus = "completed" // New ID verified and the old one retired
+	RotationExpired   RotationStatus = "expired"   // Grace period ended before the new ID worked
+)
+
+// ErrNoPendingRotation is returned when a customer has no rotation to complete
+var ErrNoPendingRotation = errors.New("no pending external ID rotation")
+
+// ErrPreviousExternalIDAccepted is returned when a rotation can't complete
+// because the customer's role still accepts the old external ID
+var ErrPreviousExternalIDAccepted = errors.New("role still accepts the previous external ID")
+
+// ExternalIDRotation records a customer's latest external ID rotation
+type ExternalIDRotation struct {
+	Status             RotationStatus `json:"status"`
+	NewExternalID      string         `json:"new_external_id"`
+	PreviousExternalID string         `json:"previous_external_id"`
+	Reason             string         `json:"reason,omitempty"`
+	StartedAt          time.Time      `json:"started_at"`
+	GraceUntil         time.Time      `json:"grace_until"` // Both IDs are tried until then
+	CompletedAt        time.Time      `json:"completed_at,omitempty"`
+	Steps              []RotationStep `json:"steps"`
+}
+
+// RotationStep is one recorded step of a rotation
+type RotationStep struct {
+	Step   string    `json:"step"`
+	At     time.Time `json:"at"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// RotationInstructions tells the customer how to switch their role to the
+// new external ID
+type RotationInstructions struct {
+	CustomerID       string    `json:"customer_id"`
+	StackName        string    `json:"stack_name"`
+	NewExternalID    string    `json:"new_external_id"`
+	GraceUntil       time.Time `json:"grace_until"`
+	ConsoleURL       string    `json:"console_url"`
+	Instructions     []string  `json:"instructions"`
+	AutomationScript string    `json:"automation_script"`
+}
+
+// step records a rotation step
+func (r *ExternalIDRotation) step(name, detail string, at time.Time) {
+	r.Steps = append(r.Steps, RotationStep{Step: name, At: at, Detail: detail})
+}
+
+// RotateExternalID starts replacing a customer's external ID, for example
+// because it may have leaked. The customer updates their stack with the new
+// ID using the returned instructions. The role can't change its own trust
+// policy, so this can't be automated. Until Config.ExternalIDGracePeriod
+// passes, sessions try the new ID and fall back to the old one; once the new
+// ID works and the role no longer accepts the old one, the rotation
+// completes and the old ID is retired. Starting a rotation replaces any
+// pending one
+func (c *Client) RotateExternalID(ctx context.Context, customerID, reason string) (*RotationInstructions, error) {
+	if customerID == "" {
+		return nil, fmt.Errorf("customer ID is required")
+	}
+
+	integration, err := c.updateIntegration(ctx, customerID, false, func(i *CustomerIntegration) error {
+		if !i.Status.Operational() || i.RoleARN == "" {
+			return fmt.Errorf("customer %s integration is %s", customerID, i.Status)
+		}
+		if i.organization() {
+			// Member roles get their external ID from the StackSet
+			return fmt.Errorf("customer %s external ID is shared with its organization; generate a new organization setup link instead", customerID)
+		}
+
+		now := c.now()
+		rotation := &ExternalIDRotation{
+			Status:             RotationPending,
+			NewExternalID:      c.generateSecureExternalID(customerID),
+			PreviousExternalID: i.ExternalID,
+			Reason:             reason,
+			StartedAt:          now,
+			GraceUntil:         now.Add(c.config.ExternalIDGracePeriod),
+		}
+		if prev := i.ExternalIDRotation; prev != nil && prev.Status == RotationPending {
+			rotation.step("replaced", fmt.Sprintf("rotation started %s was abandoned", prev.StartedAt.Format(time.RFC3339)), now)
+		}
+		rotation.step("started", reason, now)
+		i.ExternalIDRotation = rotation
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rotation := integration.ExternalIDRotation
+	stackName, region := integration.StackName, integration.StackRegion
+	if stackName == "" {
+		stackName = c.stackName(customerID)
+	}
+	if region == "" {
+		region = c.config.DefaultRegion
+	}
+
+	c.logger.InfoContext(ctx, "external ID rotation started", "customer_id", customerID, "grace_until", rotation.GraceUntil, "reason", reason)
+
+	if integration.terraform() {
+		return &RotationInstructions{
+			CustomerID:    customerID,
+			NewExternalID: rotation.NewExternalID,
+			GraceUntil:    rotation.GraceUntil,
+			Instructions: []string{
+				fmt.Sprintf("1. In the %s module block of your Terraform configuration, set external_id = %q", c.terraformModuleName(), rotation.NewExternalID),
+				"2. Run terraform apply",
+				"3. Finish before " + rotation.GraceUntil.Format(time.RFC1123),
+			},
+		}, nil
+	}
+
+	return &RotationInstructions{
+		CustomerID:    customerID,
+		StackName:     stackName,
+		NewExternalID: rotation.NewExternalID,
+		GraceUntil:    rotation.GraceUntil,
+		ConsoleURL: fmt.Sprintf("https://console.aws.amazon.com/cloudformation/home?region=%s#/stacks/stackinfo?stackId=%s",
+			region, stackName),
+		Instructions: []string{
+			"1. Go to AWS CloudFormation console in " + region,
+			"2. Find your stack: " + stackName,
+			"3. Click 'Update' and choose 'Use existing template'",
+			"4. Change the 'ExternalId' parameter to: " + rotation.NewExternalID,
+			"5. Keep the other parameters and click 'Update stack'",
+			"6. Finish before " + rotation.GraceUntil.Format(time.RFC1123),
+		},
+		AutomationScript: c.generateRotationScript(stackName, region, rotation.NewExternalID,
+			c.stackParameterKeys(ctx, customerID, stackName, region)),
+	}, nil
+}
+
+// CompleteExternalIDRotation verifies that the customer's role accepts the
+// new external ID, that its trust policy accepts no other ID and that
+// assuming it with the old ID fails, then retires the old one. It fails while
+// the stack hasn't been updated, and marks the rotation expired once the
+// grace period is over. A role that still accepts the old ID fails with a
+// TrustPolicyError or ErrPreviousExternalIDAccepted and the rotation stays
+// pending
+func (c *Client) CompleteExternalIDRotation(ctx context.Context, customerID string) (*ExternalIDRotation, error) {
+	integration, err := c.integrations.GetIntegration(ctx, customerID)
+	if err != nil {
+		return nil, fmt.Errorf("customer not found: %w", err)
+	}
+	rotation := integration.ExternalIDRotation
+	if rotation == nil || rotation.Status != RotationPending {
+		return nil, ErrNoPendingRotation
+	}
+
+	creds, err := c.validateRoleAccess(ctx, customerID, "external ID rotation", integration.RoleARN, rotation.NewExternalID)
+	if err != nil {
+		c.expireRotation(ctx, customerID, rotation.NewExternalID)
+		return nil, fmt.Errorf("role does not accept the new external ID yet: %w", err)
+	}
+
+	trust, err := c.verifyRotation(ctx, integration, creds)
+	if err != nil {
+		c.recordRotationCheck(ctx, customerID, rotation.NewExternalID, trust, err)
+		return nil, err
+	}
+
+	integration, err = c.finishRotation(ctx, customerID, rotation.NewExternalID, "new external ID verified", trust)
+	if err != nil {
+		return nil, err
+	}
+	return integration.ExternalIDRotation, nil
+}
+
+// verifyRotation checks, with credentials assumed with the rotation's new
+// external ID, that the role's trust policy accepts only that ID and that
+// the role refuses the previous one
+func (c *Client) verifyRotation(ctx context.Context, integration *CustomerIntegration, creds aws.Credentials) (*TrustPolicyReport, error) {
+	rotation := integration.ExternalIDRotation
+
+	cfg, err := c.credentialsConfig(ctx, creds)
+	if err != nil {
+		return nil, err
+	}
+	trust := c.checkTrustPolicy(ctx, cfg, integration.RoleARN, rotation.NewExternalID)
+	if !trust.Trusted() {
+		return trust, &TrustPolicyError{Report: trust}
+	}
+
+	// The trust policy may be unreadable, so also try the old ID
+	_, err = c.validateRoleAccess(ctx, integration.CustomerID, "external ID rotation check", integration.RoleARN, rotation.PreviousExternalID)
+	switch {
+	case err == nil:
+		return trust, ErrPreviousExternalIDAccepted
+	case classifyHealthFailure(err) != FailureAccessDenied:
+		return trust, fmt.Errorf("could not confirm the previous external ID is refused: %w", err)
+	}
+	return trust, nil
+}
+
+// recordRotationCheck records a failed rotation verification on a pending
+// rotation, with the trust policy report when there is one
+func (c *Client) recordRotationCheck(ctx context.Context, customerID, newExternalID string, trust *TrustPolicyReport, checkErr error) {
+	_, err := c.updateIntegration(ctx, customerID, false, func(i *CustomerIntegration) error {
+		rotation := i.ExternalIDRotation
+		if rotation == nil || rotation.Status != RotationPending || rotation.NewExternalID != newExternalID {
+			return nil
+		}
+		// Session refreshes retry the check, so record each problem once
+		if n := len(rotation.Steps); n > 0 && rotation.Steps[n-1].Step == "verification-failed" && rotation.Steps[n-1].Detail == checkErr.Error() {
+			return nil
+		}
+		rotation.step("verification-failed", checkErr.Error(), c.now())
+		if trust != nil {
+			i.TrustPolicy = trust
+		}
+		return nil
+	})
+	if err != nil {
+		c.logger.WarnContext(ctx, "failed to record rotation check", "customer_id", customerID, "error", err)
+	}
+	c.logger.WarnContext(ctx, "external ID rotation not verified", "customer_id", customerID, "error", checkErr)
+}
+
+// finishRotation switches the integration to the new external ID and
+// retires the old one
+func (c *Client) finishRotation(ctx context.Context, customerID, newExternalID, detail string, trust *TrustPolicyReport) (*CustomerIntegration, error) {
+	integration, err := c.updateIntegration(ctx, customerID, false, func(i *CustomerIntegration) error {
+		rotation := i.ExternalIDRotation
+		if rotation == nil || rotation.Status != RotationPending || rotation.NewExternalID != newExternalID {
+			return ErrNoPendingRotation
+		}
+
+		now := c.now()
+		rotation.step("verified", detail, now)
+		i.ExternalID = rotation.NewExternalID
+		rotation.Status = RotationCompleted
+		rotation.CompletedAt = now
+		rotation.step("retired", "previous external ID is no longer used", now)
+		if trust != nil {
+			i.TrustPolicy = trust
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to record rotation: %w", err)
+	}
+
+	// Sessions assumed with the old ID are dropped
+	c.clearSession(ctx, customerID)
+	c.logger.InfoContext(ctx, "external ID rotation completed", "customer_id", customerID)
+	return integration, nil
+}
+
+// expireRotation marks a pending rotation expired once its grace period is
+// over and flags the integration, since a possibly leaked ID is still in use
+func (c *Client) expireRotation(ctx context.Context, customerID, newExternalID string) {
+	var expired bool
+	_, err := c.updateIntegration(ctx, customerID, false, func(i *CustomerIntegration) error {
+		rotation := i.ExternalIDRotation
+		now := c.now()
+		if rotation == nil || rotation.Status != RotationPending || rotation.NewExternalID != newExternalID || now.Before(rotation.GraceUntil) {
+			return nil
+		}
+
+		rotation.Status = RotationExpired
+		rotation.step("expired", "stack was not updated with the new external ID in time", now)
+		expired = true
+		if i.Status.CanTransitionTo(IntegrationDegraded) {
+			return i.transition(IntegrationDegraded, "external ID rotation not completed before the grace period ended", now)
+		}
+		return nil
+	})
+	if err != nil {
+		c.logger.WarnContext(ctx, "failed to record expired rotation", "customer_id", customerID, "error", err)
+		return
+	}
+	if expired {
+		c.logger.WarnContext(ctx, "external ID rotation expired", "customer_id", customerID)
+	}
+}
+
+// assumeDuringRotation tries the pending rotation's new external ID and
+// completes the rotation if it works. ok is false when the caller should
+// use the current ID
+func (c *Client) assumeDuringRotation(ctx context.Context, integration *CustomerIntegration, options *AssumeRoleOptions) (creds aws.Credentials, sessionName string, ok bool) {
+	rotation := integration.ExternalIDRotation
+	if rotation == nil || rotation.Status != RotationPending {
+		return aws.Credentials{}, "", false
+	}
+	if !c.now().Before(rotation.GraceUntil) {
+		c.expireRotation(ctx, integration.CustomerID, rotation.NewExternalID)
+		return aws.Credentials{}, "", false
+	}
+
+	candidate := *integration
+	candidate.ExternalID = rotation.NewExternalID
+	creds, sessionName, err := c.assumeCustomerRole(ctx, &candidate, options)
+	if err != nil {
+		// The customer hasn't updated their stack yet
+		return aws.Credentials{}, "", false
+	}
+
+	// The session works either way; the rotation only completes once the
+	// old ID is refused
+	if trust, err := c.verifyRotation(ctx, integration, creds); err != nil {
+		c.recordRotationCheck(ctx, integration.CustomerID, rotation.NewExternalID, trust, err)
+	} else if _, err := c.finishRotation(ctx, integration.CustomerID, rotation.NewExternalID, "new external ID accepted during session refresh", trust); err != nil {
+		c.logger.WarnContext(ctx, "failed to complete external ID rotation", "customer_id", integration.CustomerID, "error", err)
+	}
+	integration.ExternalID = rotation.NewExternalID
+	return creds, sessionName, true
+}
+
+// generateRotationScript creates the AWS CLI commands that switch a stack
+// with the given parameters to a new external ID
+func (c *Client) generateRotationScript(stackName, region, externalID string, parameterKeys []string) string {
+	return fmt.Sprintf(`#!/bin/bash
+# Rotate the external ID %s uses to access your account
+aws cloudformation update-stack \
+  --region "%s" \
+  --stack-name "%s" \
+  --use-previous-template \
+  --parameters %s \
+  --capabilities CAPABILITY_NAMED_IAM
+
+aws cloudformation wait stack-update-complete --region "%s" --stack-name "%s"
+
+echo "External ID updated."`,
+		c.config.ServiceName, region, stackName, stackUpdateParameters(parameterKeys, map[string]string{"ExternalId": externalID}),
+		region, stackName)
+}
@@ -0,0 +1,381 @@
+package crossaccount
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	ststypes "github.com/aws/aws-sdk-go-v2/service/sts/types"
+
+	"github.com/scttfrdmn/aws-remote-access-patterns/pkg/telemetry"
+)
+
+// sessionRefreshWindow is how long before expiry a cached session is renewed
+// Matches the 5 minute buffer StoredCredentials.IsValid uses
+const sessionRefreshWindow = 5 * time.Minute
+
+// sessionRefreshAttempts bounds how often a refresh restarts because the
+// customer's session was cleared while it ran
+const sessionRefreshAttempts = 2
+
+// errSessionCleared is returned when the customer's session keeps being
+// cleared while it's refreshed
+var errSessionCleared = errors.New("session was cleared while it was being refreshed")
+
+// sessionCall is an in-flight AssumeRole shared by concurrent callers
+type sessionCall struct {
+	done       chan struct{}
+	generation uint64 // The customer's clears count when the call started
+	creds      aws.Credentials
+	err        error
+}
+
+// customerCredentialsProvider is an aws.CredentialsProvider for one customer
+// Every Retrieve goes through the client's session cache
+type customerCredentialsProvider struct {
+	client     *Client
+	customerID string
+	options    *AssumeRoleOptions // nil for the role's full permissions
+}
+
+// Retrieve returns the customer's cached session, renewing it near expiry
+func (p *customerCredentialsProvider) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	return p.client.customerCredentials(ctx, p.customerID, p.options)
+}
+
+// customerCredentials returns a cached session for the customer or assumes
+// their role. Concurrent refreshes of the same session share one STS call
+func (c *Client) customerCredentials(ctx context.Context, customerID string, options *AssumeRoleOptions) (aws.Credentials, error) {
+	key := sessionKey(customerID, options)
+
+	c.sessionMu.Lock()
+	if creds, ok := c.sessions[key]; ok && c.now().Before(creds.Expires.Add(-sessionRefreshWindow)) {
+		c.sessionMu.Unlock()
+		c.telemetry.Count(ctx, telemetry.SessionCacheRequests, 1, telemetry.String("result", "hit"))
+		return creds, nil
+	}
+	c.telemetry.Count(ctx, telemetry.SessionCacheRequests, 1, telemetry.String("result", "miss"))
+
+	call, ok := c.inflight[key]
+	if !ok {
+		call = &sessionCall{done: make(chan struct{}), generation: c.clears[customerID]}
+		c.inflight[key] = call
+
+		// The refresh is shared, so one caller giving up must not fail the others
+		go c.refreshSession(context.WithoutCancel(ctx), key, customerID, options, call)
+	}
+	c.sessionMu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.creds, call.err
+	case <-ctx.Done():
+		return aws.Credentials{}, ctx.Err()
+	}
+}
+
+// refreshSession loads a cached session from storage or assumes the
+// customer's role, and publishes the result to call. If the customer's
+// session is cleared meanwhile, e.g. because they were revoked, the result
+// may predate that, so it's dropped and the refresh tried again
+func (c *Client) refreshSession(ctx context.Context, key, customerID string, options *AssumeRoleOptions, call *sessionCall) {
+	generation := call.generation
+	for attempt := 1; ; attempt++ {
+		call.creds, call.err = c.loadOrAssumeSession(ctx, customerID, options)
+
+		c.sessionMu.Lock()
+		current := c.clears[customerID]
+		if current == generation || call.err != nil || attempt == sessionRefreshAttempts {
+			if c.inflight[key] == call {
+				delete(c.inflight, key)
+			}
+			if current != generation {
+				call.creds, call.err = aws.Credentials{}, fmt.Errorf("customer %s: %w", customerID, errSessionCleared)
+			} else if call.err == nil {
+				c.sessions[key] = call.creds
+			}
+			c.sessionMu.Unlock()
+			break
+		}
+		c.sessionMu.Unlock()
+		generation = current
+
+		if options == nil {
+			// loadOrAssumeSession may have stored it after the clear
+			err := c.storage.Delete(ctx, customerID)
+			c.audit(ctx, AuditEvent{Action: AuditDeleteSession, CustomerID: customerID}, err)
+			if err != nil {
+				c.logger.WarnContext(ctx, "failed to delete cached session", "customer_id", customerID, "error", err)
+			}
+		}
+	}
+
+	close(call.done)
+}
+
+// loadOrAssumeSession returns a still-valid session from the session store,
+// or assumes the customer's role and stores the new session. Scoped sessions
+// are only cached in memory
+func (c *Client) loadOrAssumeSession(ctx context.Context, customerID string, options *AssumeRoleOptions) (aws.Credentials, error) {
+	integration, err := c.integrations.GetIntegration(ctx, customerID)
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("customer not found: %w", err)
+	}
+	if !integration.Status.Operational() || integration.RoleARN == "" {
+		return aws.Credentials{}, fmt.Errorf("customer %s integration is %s", customerID, integration.Status)
+	}
+
+	// Sessions survive restarts when the session store is persistent
+	if stored, err := c.storage.Retrieve(ctx, customerID); err == nil && options == nil &&
+		stored.AccessKeyID != "" && stored.RoleARN == integration.RoleARN &&
+		c.now().Before(stored.Expiration.Add(-sessionRefreshWindow)) {
+		c.telemetry.Count(ctx, telemetry.SessionRefreshes, 1, telemetry.String("source", "storage"), telemetry.String("outcome", telemetry.OutcomeSuccess))
+		return aws.Credentials{
+			AccessKeyID:     stored.AccessKeyID,
+			SecretAccessKey: stored.SecretAccessKey,
+			SessionToken:    stored.SessionToken,
+			Source:          fmt.Sprintf("crossaccount:%s", customerID),
+			CanExpire:       true,
+			Expires:         stored.Expiration,
+		}, nil
+	}
+
+	// During an external ID rotation the new ID is tried first
+	creds, sessionName, ok := c.assumeDuringRotation(ctx, integration, options)
+	if !ok {
+		creds, sessionName, err = c.assumeCustomerRole(ctx, integration, options)
+	}
+	c.telemetry.Count(ctx, telemetry.SessionRefreshes, 1, telemetry.String("source", "sts"), telemetry.String("outcome", telemetry.Outcome(err)))
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+	if options != nil {
+		// The store holds one unscoped session per customer
+		return creds, nil
+	}
+
+	err = c.storage.Store(ctx, customerID, &StoredCredentials{
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.SessionToken,
+		Expiration:      creds.Expires,
+		RoleARN:         integration.RoleARN,
+		ExternalID:      integration.ExternalID,
+		SessionName:     sessionName,
+	})
+	c.audit(ctx, AuditEvent{Action: AuditStoreSession, CustomerID: customerID, RoleARN: integration.RoleARN, SessionName: sessionName}, err)
+	if err != nil {
+		// The session still works; it just won't be reused after a restart
+		c.logger.WarnContext(ctx, "failed to cache session", "customer_id", customerID, "error", err)
+	}
+
+	return creds, nil
+}
+
+// assumeCustomerRole calls sts:AssumeRole for the customer's role, scoped by
+// options if set, and returns the credentials and session name
+func (c *Client) assumeCustomerRole(ctx context.Context, integration *CustomerIntegration, options *AssumeRoleOptions) (aws.Credentials, string, error) {
+	customerID := integration.CustomerID
+
+	stsClient, err := c.sts(ctx)
+	if err != nil {
+		return aws.Credentials{}, "", err
+	}
+
+	now := c.now()
+	sessionName := fmt.Sprintf("%s-%s-%d", c.config.ServiceName, customerID, now.Unix())
+	input := &sts.AssumeRoleInput{
+		RoleArn:         aws.String(integration.RoleARN),
+		RoleSessionName: aws.String(sessionName),
+		ExternalId:      aws.String(integration.ExternalID),
+		DurationSeconds: aws.Int32(int32(c.config.SessionDuration.Seconds())),
+	}
+	if err := options.apply(input); err != nil {
+		return aws.Credentials{}, "", err
+	}
+
+	result, err := c.stsAssumeRole(ctx, stsClient, customerID, "", input)
+	if err != nil {
+		c.logger.WarnContext(ctx, "assume role failed", "customer_id", customerID, "role_arn", integration.RoleARN, "error", err)
+		return aws.Credentials{}, "", fmt.Errorf("failed to assume role: %w", err)
+	}
+
+	expires := now.Add(c.config.SessionDuration)
+	if result.Credentials.Expiration != nil {
+		expires = *result.Credentials.Expiration
+	}
+
+	c.logger.DebugContext(ctx, "assumed customer role", "customer_id", customerID, "role_arn", integration.RoleARN, "expires", expires)
+
+	return aws.Credentials{
+		AccessKeyID:     aws.ToString(result.Credentials.AccessKeyId),
+		SecretAccessKey: aws.ToString(result.Credentials.SecretAccessKey),
+		SessionToken:    aws.ToString(result.Credentials.SessionToken),
+		Source:          fmt.Sprintf("crossaccount:%s", customerID),
+		CanExpire:       true,
+		Expires:         expires,
+	}, sessionName, nil
+}
+
+// stsAssumeRole calls sts:AssumeRole on a customer role. Every call is
+// traced, timed and audited as an issue_session event
+func (c *Client) stsAssumeRole(ctx context.Context, stsClient STSAPI, customerID, purpose string, input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	ctx, span := c.telemetry.StartSpan(ctx, "sts.AssumeRole",
+		telemetry.String("customer_id", customerID),
+		telemetry.String("purpose", purpose))
+	start := time.Now()
+	result, err := stsClient.AssumeRole(ctx, input)
+	span.End(err)
+
+	customer := telemetry.String("customer_id", customerID)
+	c.telemetry.Duration(ctx, telemetry.AssumeRoleDuration, time.Since(start), customer, telemetry.String("outcome", telemetry.Outcome(err)))
+	if err != nil {
+		c.telemetry.Count(ctx, telemetry.AssumeRoleErrors, 1, customer, telemetry.String("error_class", string(classifyHealthFailure(err))))
+	}
+
+	event := AuditEvent{
+		Action:      AuditIssueSession,
+		CustomerID:  customerID,
+		Caller:      aws.ToString(input.SourceIdentity),
+		Purpose:     purpose,
+		RoleARN:     aws.ToString(input.RoleArn),
+		SessionName: aws.ToString(input.RoleSessionName),
+	}
+	if result != nil {
+		event.RequestID, _ = awsmiddleware.GetRequestIDMetadata(result.ResultMetadata)
+	}
+	if len(input.Tags) > 0 || input.Policy != nil || len(input.PolicyArns) > 0 {
+		event.Details = map[string]string{"scoped": "true"}
+	}
+	c.audit(ctx, event, err)
+
+	return result, err
+}
+
+// clearSession drops the customer's cached sessions, scoped ones included
+func (c *Client) clearSession(ctx context.Context, customerID string) {
+	c.sessionMu.Lock()
+	c.clears[customerID]++
+	for key := range c.sessions {
+		if key == customerID || strings.HasPrefix(key, customerID+"#") {
+			delete(c.sessions, key)
+		}
+	}
+	// Later callers start a fresh refresh instead of joining one from before
+	for key := range c.inflight {
+		if key == customerID || strings.HasPrefix(key, customerID+"#") {
+			delete(c.inflight, key)
+		}
+	}
+	c.sessionMu.Unlock()
+
+	err := c.storage.Delete(ctx, customerID)
+	c.audit(ctx, AuditEvent{Action: AuditDeleteSession, CustomerID: customerID}, err)
+	if err != nil {
+		c.logger.WarnContext(ctx, "failed to delete cached session", "customer_id", customerID, "error", err)
+	}
+}
+
+// sourceIdentityPattern is what STS accepts as a source identity
+var sourceIdentityPattern = regexp.MustCompile(`^[\w+=,.@-]{2,64}$`)
+
+// validate checks the options against STS limits, so mistakes fail before
+// any call to the customer's account
+func (o *AssumeRoleOptions) validate() error {
+	if len(o.SessionTags) > 50 {
+		return errors.New("at most 50 session tags are allowed")
+	}
+	for key, value := range o.SessionTags {
+		if key == "" || len(key) > 128 {
+			return fmt.Errorf("session tag key %q must be 1 to 128 characters", key)
+		}
+		if len(value) > 256 {
+			return fmt.Errorf("session tag %s value can't exceed 256 characters", key)
+		}
+	}
+	for _, key := range o.TransitiveTagKeys {
+		if _, ok := o.SessionTags[key]; !ok {
+			return fmt.Errorf("transitive tag key %s isn't a session tag", key)
+		}
+	}
+	if o.SourceIdentity != "" && !sourceIdentityPattern.MatchString(o.SourceIdentity) {
+		return errors.New("source identity must be 2 to 64 letters, digits or +=,.@_- characters")
+	}
+	if strings.HasPrefix(strings.ToLower(o.SourceIdentity), "aws:") {
+		return errors.New(`source identity can't start with "aws:"`)
+	}
+	if len(o.PolicyARNs) > 10 {
+		return errors.New("at most 10 session policy ARNs are allowed")
+	}
+	for _, arn := range o.PolicyARNs {
+		if !strings.HasPrefix(arn, "arn:") || !strings.Contains(arn, ":policy/") {
+			return fmt.Errorf("%s is not a managed policy ARN", arn)
+		}
+	}
+	return nil
+}
+
+// apply adds the options to an AssumeRole request. A nil receiver leaves the
+// request unscoped
+func (o *AssumeRoleOptions) apply(input *sts.AssumeRoleInput) error {
+	if o == nil {
+		return nil
+	}
+
+	keys := make([]string, 0, len(o.SessionTags))
+	for key := range o.SessionTags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		input.Tags = append(input.Tags, ststypes.Tag{Key: aws.String(key), Value: aws.String(o.SessionTags[key])})
+	}
+	input.TransitiveTagKeys = o.TransitiveTagKeys
+	if o.SourceIdentity != "" {
+		input.SourceIdentity = aws.String(o.SourceIdentity)
+	}
+	if len(o.Policy) > 0 {
+		policy, err := policyDocumentJSON(o.Policy)
+		if err != nil {
+			return fmt.Errorf("failed to render session policy: %w", err)
+		}
+		input.Policy = aws.String(policy)
+	}
+	for _, arn := range o.PolicyARNs {
+		input.PolicyArns = append(input.PolicyArns, ststypes.PolicyDescriptorType{Arn: aws.String(arn)})
+	}
+	return nil
+}
+
+// sessionKey is where a session is cached: the customer ID for unscoped
+// sessions, or the customer ID and a hash of the options
+func sessionKey(customerID string, options *AssumeRoleOptions) string {
+	if options == nil {
+		return customerID
+	}
+
+	// Map keys marshal sorted; sort the lists so their order doesn't matter
+	normalized := *options
+	normalized.TransitiveTagKeys = sortedCopy(options.TransitiveTagKeys)
+	normalized.PolicyARNs = sortedCopy(options.PolicyARNs)
+	data, _ := json.Marshal(normalized)
+	sum := sha256.Sum256(data)
+	return customerID + "#" + hex.EncodeToString(sum[:8])
+}
+
+// sortedCopy returns a sorted copy of values
+func sortedCopy(values []string) []string {
+	out := append([]string(nil), values...)
+	sort.Strings(out)
+	return out
+}
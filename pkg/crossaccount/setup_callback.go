@@ -0,0 +1,453 @@
+package crossaccount
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// setupCallbackAttempts bounds CompleteSetup retries while a new role
+	// propagates through IAM
+	setupCallbackAttempts = 6
+
+	// defaultSetupCallbackRetryDelay is the delay between those retries
+	defaultSetupCallbackRetryDelay = 10 * time.Second
+
+	// setupCallbackTimeout bounds processing of one callback, well inside
+	// the hour CloudFormation waits for a custom resource
+	setupCallbackTimeout = 10 * time.Minute
+)
+
+// snsCertHost matches the hosts SNS serves signing certificates from
+var snsCertHost = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+// SNSCertificateFetcher returns the certificate at an SNS SigningCertURL.
+// The URL has already been checked to be an SNS host
+type SNSCertificateFetcher func(ctx context.Context, certURL string) (*x509.Certificate, error)
+
+// SetupCallbackOption customizes a SetupCallbackHandler
+type SetupCallbackOption func(*SetupCallbackHandler)
+
+// WithSNSCertificateFetcher sets how SNS signing certificates are fetched
+// (default: HTTPS GET, cached per URL)
+func WithSNSCertificateFetcher(fetch SNSCertificateFetcher) SetupCallbackOption {
+	return func(h *SetupCallbackHandler) { h.fetchCert = fetch }
+}
+
+// WithCallbackHTTPClient sets the HTTP client used to confirm the topic
+// subscription, fetch certificates and answer CloudFormation
+func WithCallbackHTTPClient(client *http.Client) SetupCallbackOption {
+	return func(h *SetupCallbackHandler) { h.httpClient = client }
+}
+
+// SetupCallbackHandler completes setup from the notifications customer stacks
+// send through Config.SetupCallbackTopicARN. Subscribe it to the topic over
+// HTTPS; it confirms the subscription itself.
+//
+// Every message must carry a valid SNS signature from that topic. Customer
+// accounts have to be allowed to publish to the topic, so the message content
+// is only trusted as far as CompleteSetup accepts its setup token. The stack's
+// custom resource always succeeds: if setup can't be completed the role stays
+// in place and the customer can still finish setup manually
+type SetupCallbackHandler struct {
+	client     *Client
+	topicARN   string
+	httpClient *http.Client
+	fetchCert  SNSCertificateFetcher
+	retryDelay time.Duration
+
+	certMu sync.Mutex
+	certs  map[string]*x509.Certificate
+
+	wg sync.WaitGroup // In-flight callbacks
+}
+
+// snsMessage is an SNS HTTP(S) delivery
+type snsMessage struct {
+	Type             string `json:"Type"`
+	MessageID        string `json:"MessageId"`
+	Token            string `json:"Token"`
+	TopicARN         string `json:"TopicArn"`
+	Subject          string `json:"Subject"`
+	Message          string `json:"Message"`
+	SubscribeURL     string `json:"SubscribeURL"`
+	Timestamp        string `json:"Timestamp"`
+	SignatureVersion string `json:"SignatureVersion"`
+	Signature        string `json:"Signature"`
+	SigningCertURL   string `json:"SigningCertURL"`
+}
+
+// customResourceRequest is the request CloudFormation publishes for a
+// custom resource
+type customResourceRequest struct {
+	RequestType        string `json:"RequestType"`
+	ResponseURL        string `json:"ResponseURL"`
+	StackID            string `json:"StackId"`
+	RequestID          string `json:"RequestId"`
+	LogicalResourceID  string `json:"LogicalResourceId"`
+	PhysicalResourceID string `json:"PhysicalResourceId"`
+	ResourceProperties struct {
+		RoleARN    string `json:"RoleArn"`
+		AccountID  string `json:"AccountId"`
+		ExternalID string `json:"ExternalId"`
+		SetupToken string `json:"SetupToken"`
+	} `json:"ResourceProperties"`
+}
+
+// customResourceResponse is uploaded to a custom resource's ResponseURL
+type customResourceResponse struct {
+	Status             string            `json:"Status"`
+	Reason             string            `json:"Reason,omitempty"`
+	PhysicalResourceID string            `json:"PhysicalResourceId"`
+	StackID            string            `json:"StackId"`
+	RequestID          string            `json:"RequestId"`
+	LogicalResourceID  string            `json:"LogicalResourceId"`
+	Data               map[string]string `json:"Data,omitempty"`
+}
+
+// NewSetupCallbackHandler returns the handler for Config.SetupCallbackTopicARN
+func (c *Client) NewSetupCallbackHandler(opts ...SetupCallbackOption) (*SetupCallbackHandler, error) {
+	if c.config.SetupCallbackTopicARN == "" {
+		return nil, fmt.Errorf("setup callback topic ARN is not configured")
+	}
+
+	h := &SetupCallbackHandler{
+		client:     c,
+		topicARN:   c.config.SetupCallbackTopicARN,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		retryDelay: defaultSetupCallbackRetryDelay,
+		certs:      make(map[string]*x509.Certificate),
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	if h.fetchCert == nil {
+		h.fetchCert = h.fetchCertificate
+	}
+	return h, nil
+}
+
+// ServeHTTP implements http.Handler for SNS HTTP(S) deliveries
+func (h *SetupCallbackHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var msg snsMessage
+	if err := json.NewDecoder(io.LimitReader(r.Body, 256<<10)).Decode(&msg); err != nil {
+		http.Error(w, "invalid SNS message", http.StatusBadRequest)
+		return
+	}
+	if msg.TopicARN != h.topicARN {
+		http.Error(w, "unexpected topic", http.StatusForbidden)
+		return
+	}
+	if err := h.verify(r.Context(), &msg); err != nil {
+		h.client.logger.WarnContext(r.Context(), "rejected setup callback", "message_id", msg.MessageID, "error", err)
+		http.Error(w, "invalid SNS signature", http.StatusForbidden)
+		return
+	}
+
+	switch msg.Type {
+	case "SubscriptionConfirmation":
+		if err := h.confirmSubscription(r.Context(), msg.SubscribeURL); err != nil {
+			h.client.logger.WarnContext(r.Context(), "setup callback subscription failed", "topic_arn", msg.TopicARN, "error", err)
+			http.Error(w, "subscription confirmation failed", http.StatusBadGateway)
+			return
+		}
+		h.client.logger.InfoContext(r.Context(), "setup callback subscription confirmed", "topic_arn", msg.TopicARN)
+	case "Notification":
+		var req customResourceRequest
+		if err := json.Unmarshal([]byte(msg.Message), &req); err != nil {
+			http.Error(w, "invalid custom resource request", http.StatusBadRequest)
+			return
+		}
+		if err := checkResponseURL(req.ResponseURL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// SNS expects a quick answer, while completing setup may wait for
+		// the new role to propagate
+		h.wg.Add(1)
+		go func() {
+			defer h.wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), setupCallbackTimeout)
+			defer cancel()
+			h.handleCustomResource(ctx, &req)
+		}()
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Wait blocks until callbacks being processed in the background are done
+func (h *SetupCallbackHandler) Wait() {
+	h.wg.Wait()
+}
+
+// handleCustomResource completes setup for a stack's callback and answers
+// CloudFormation
+func (h *SetupCallbackHandler) handleCustomResource(ctx context.Context, req *customResourceRequest) {
+	logger := h.client.logger
+	resp := &customResourceResponse{
+		Status:             "SUCCESS",
+		PhysicalResourceID: req.PhysicalResourceID,
+		StackID:            req.StackID,
+		RequestID:          req.RequestID,
+		LogicalResourceID:  req.LogicalResourceID,
+	}
+	if resp.PhysicalResourceID == "" {
+		resp.PhysicalResourceID = h.client.config.ServiceName + "-setup-callback"
+	}
+
+	if req.RequestType == "Create" {
+		customerID, err := h.completeSetup(ctx, req)
+		if err != nil {
+			logger.WarnContext(ctx, "setup callback did not complete setup", "customer_id", customerID, "stack_id", req.StackID, "error", err)
+		}
+		resp.Data = map[string]string{"SetupComplete": fmt.Sprint(err == nil)}
+	}
+
+	if err := h.respond(ctx, req.ResponseURL, resp); err != nil {
+		logger.WarnContext(ctx, "failed to answer CloudFormation", "stack_id", req.StackID, "request_type", req.RequestType, "error", err)
+	}
+}
+
+// completeSetup calls CompleteSetup with the callback's role, retrying while
+// the role may not be assumable yet
+func (h *SetupCallbackHandler) completeSetup(ctx context.Context, req *customResourceRequest) (string, error) {
+	props := req.ResourceProperties
+	claims, err := h.client.parseSetupToken(props.SetupToken)
+	if err != nil {
+		return "", err
+	}
+
+	// The stack, role and reported account must agree
+	account, _, err := parseRoleARN(props.RoleARN)
+	if err != nil {
+		return claims.CustomerID, err
+	}
+	stackARN := strings.Split(req.StackID, ":")
+	if account != props.AccountID || len(stackARN) != 6 || stackARN[4] != account {
+		return claims.CustomerID, fmt.Errorf("%w: role, stack and account don't match", ErrSetupSessionMismatch)
+	}
+	// The stack resource is stack/<name>/<id>
+	stack := strings.Split(stackARN[5], "/")
+	if len(stack) != 3 || stack[0] != "stack" || stack[1] == "" {
+		return claims.CustomerID, fmt.Errorf("%w: invalid stack ID %s", ErrSetupSessionMismatch, req.StackID)
+	}
+
+	setupReq := &SetupCompleteRequest{
+		CustomerID: claims.CustomerID,
+		RoleARN:    props.RoleARN,
+		ExternalID: props.ExternalID,
+		SetupToken: props.SetupToken,
+		StackName:  stack[1],
+	}
+	for attempt := 1; ; attempt++ {
+		err = h.client.CompleteSetup(ctx, setupReq)
+		switch {
+		case err == nil:
+			return claims.CustomerID, nil
+		case errors.Is(err, ErrSetupSessionUsed):
+			// SNS delivered the notification more than once
+			return claims.CustomerID, nil
+		case errors.Is(err, ErrInvalidSetupToken), errors.Is(err, ErrSetupSessionExpired),
+			errors.Is(err, ErrSetupSessionMismatch), errors.Is(err, ErrRoleTrustTooBroad),
+			attempt == setupCallbackAttempts:
+			return claims.CustomerID, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return claims.CustomerID, err
+		case <-time.After(h.retryDelay):
+		}
+	}
+}
+
+// respond uploads the custom resource response to its presigned URL
+func (h *SetupCallbackHandler) respond(ctx context.Context, responseURL string, resp *customResourceResponse) error {
+	body, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, responseURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	// The URL is presigned without a content type
+	req.Header.Set("Content-Type", "")
+
+	res, err := h.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("response upload returned %s", res.Status)
+	}
+	return nil
+}
+
+// confirmSubscription visits the SubscribeURL of a subscription confirmation
+func (h *SetupCallbackHandler) confirmSubscription(ctx context.Context, subscribeURL string) error {
+	u, err := url.Parse(subscribeURL)
+	if err != nil || u.Scheme != "https" || !snsCertHost.MatchString(u.Hostname()) {
+		return fmt.Errorf("unexpected subscribe URL: %s", subscribeURL)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, subscribeURL, nil)
+	if err != nil {
+		return err
+	}
+	res, err := h.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("subscribe URL returned %s", res.Status)
+	}
+	return nil
+}
+
+// verify checks an SNS message's signature against its signing certificate
+func (h *SetupCallbackHandler) verify(ctx context.Context, msg *snsMessage) error {
+	var hash crypto.Hash
+	switch msg.SignatureVersion {
+	case "1":
+		hash = crypto.SHA1
+	case "2":
+		hash = crypto.SHA256
+	default:
+		return fmt.Errorf("unsupported signature version %q", msg.SignatureVersion)
+	}
+
+	certURL, err := url.Parse(msg.SigningCertURL)
+	if err != nil || certURL.Scheme != "https" || !snsCertHost.MatchString(certURL.Hostname()) || !strings.HasSuffix(certURL.Path, ".pem") {
+		return fmt.Errorf("unexpected signing certificate URL: %s", msg.SigningCertURL)
+	}
+
+	cert, err := h.fetchCert(ctx, msg.SigningCertURL)
+	if err != nil {
+		return fmt.Errorf("failed to fetch signing certificate: %w", err)
+	}
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("signing certificate has a %T key", cert.PublicKey)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(msg.Signature)
+	if err != nil {
+		return fmt.Errorf("malformed signature: %w", err)
+	}
+
+	var digest []byte
+	if hash == crypto.SHA1 {
+		sum := sha1.Sum(snsStringToSign(msg))
+		digest = sum[:]
+	} else {
+		sum := sha256.Sum256(snsStringToSign(msg))
+		digest = sum[:]
+	}
+	return rsa.VerifyPKCS1v15(key, hash, digest, signature)
+}
+
+// snsStringToSign builds the canonical form SNS signs for a message type
+func snsStringToSign(msg *snsMessage) []byte {
+	fields := [][2]string{{"Message", msg.Message}, {"MessageId", msg.MessageID}}
+	if msg.Type == "Notification" {
+		if msg.Subject != "" {
+			fields = append(fields, [2]string{"Subject", msg.Subject})
+		}
+	} else {
+		fields = append(fields, [2]string{"SubscribeURL", msg.SubscribeURL})
+	}
+	fields = append(fields, [2]string{"Timestamp", msg.Timestamp})
+	if msg.Type != "Notification" {
+		fields = append(fields, [2]string{"Token", msg.Token})
+	}
+	fields = append(fields, [2]string{"TopicArn", msg.TopicARN}, [2]string{"Type", msg.Type})
+
+	var buf bytes.Buffer
+	for _, f := range fields {
+		buf.WriteString(f[0] + "\n" + f[1] + "\n")
+	}
+	return buf.Bytes()
+}
+
+// fetchCertificate downloads and caches an SNS signing certificate
+func (h *SetupCallbackHandler) fetchCertificate(ctx context.Context, certURL string) (*x509.Certificate, error) {
+	h.certMu.Lock()
+	cert, ok := h.certs[certURL]
+	h.certMu.Unlock()
+	if ok {
+		return cert, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, certURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := h.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("certificate URL returned %s", res.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(body)
+	if block == nil {
+		return nil, fmt.Errorf("certificate is not PEM encoded")
+	}
+	if cert, err = x509.ParseCertificate(block.Bytes); err != nil {
+		return nil, err
+	}
+
+	h.certMu.Lock()
+	h.certs[certURL] = cert
+	h.certMu.Unlock()
+	return cert, nil
+}
+
+// checkResponseURL only allows CloudFormation's S3 response URLs, so a
+// published message can't make the service send requests elsewhere
+func checkResponseURL(responseURL string) error {
+	u, err := url.Parse(responseURL)
+	if err != nil || u.Scheme != "https" {
+		return fmt.Errorf("invalid response URL")
+	}
+	host := u.Hostname()
+	if !strings.HasSuffix(host, ".amazonaws.com") && !strings.HasSuffix(host, ".amazonaws.com.cn") {
+		return fmt.Errorf("response URL is not an AWS endpoint")
+	}
+	return nil
+}
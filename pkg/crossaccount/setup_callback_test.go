@@ -0,0 +1,301 @@
+package crossaccount
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const testCallbackTopicARN = "arn:aws:sns:us-east-1:123456789012:setup-callbacks"
+
+// callbackTestEnv routes every HTTPS request the handler makes to a local
+// server that records them, and signs SNS messages with a test certificate
+type callbackTestEnv struct {
+	client  *Client
+	handler *SetupCallbackHandler
+	key     *rsa.PrivateKey
+
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   []string
+}
+
+func newCallbackTestEnv(t *testing.T) *callbackTestEnv {
+	t.Helper()
+
+	env := &callbackTestEnv{}
+	cfg := SimpleConfig("test-service", "123456789012", "test-bucket")
+	cfg.SetupCallbackTopicARN = testCallbackTopicARN
+	env.client, _ = newTestClient(t, cfg, withMockSTS(&mockSTSClient{}))
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		env.mu.Lock()
+		env.requests = append(env.requests, r)
+		env.bodies = append(env.bodies, string(body))
+		env.mu.Unlock()
+	}))
+	t.Cleanup(server.Close)
+
+	httpClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+		},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	var err error
+	env.key, err = rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "sns.amazonaws.com"}, NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &env.key.PublicKey, env.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	env.handler, err = env.client.NewSetupCallbackHandler(
+		WithCallbackHTTPClient(httpClient),
+		WithSNSCertificateFetcher(func(ctx context.Context, certURL string) (*x509.Certificate, error) { return cert, nil }),
+	)
+	if err != nil {
+		t.Fatalf("NewSetupCallbackHandler() error = %v", err)
+	}
+	env.handler.retryDelay = time.Millisecond
+	return env
+}
+
+// deliver signs msg like SNS and posts it to the handler
+func (env *callbackTestEnv) deliver(t *testing.T, msg *snsMessage) int {
+	t.Helper()
+
+	if msg.TopicARN == "" {
+		msg.TopicARN = testCallbackTopicARN
+	}
+	msg.MessageID = "message-1"
+	msg.Timestamp = time.Now().UTC().Format(time.RFC3339)
+	msg.SignatureVersion = "2"
+	msg.SigningCertURL = "https://sns.us-east-1.amazonaws.com/SimpleNotificationService-test.pem"
+	if msg.Signature == "" {
+		sum := sha256.Sum256(snsStringToSign(msg))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, env.key, crypto.SHA256, sum[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.Signature = base64.StdEncoding.EncodeToString(sig)
+	}
+
+	body, _ := json.Marshal(msg)
+	rec := httptest.NewRecorder()
+	env.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/aws/setup-callback", strings.NewReader(string(body))))
+	env.handler.Wait()
+	return rec.Code
+}
+
+// createNotification is the SNS notification for a stack's SetupCallback
+func createNotification(resp *SetupResponse, responseURL string) *snsMessage {
+	request, _ := json.Marshal(map[string]interface{}{
+		"RequestType":       "Create",
+		"ResponseURL":       responseURL,
+		"StackId":           "arn:aws:cloudformation:us-east-1:999999999999:stack/" + resp.StackName + "/1234",
+		"RequestId":         "request-1",
+		"LogicalResourceId": "SetupCallback",
+		"ResourceProperties": map[string]string{
+			"RoleArn":    testSetupRoleARN,
+			"AccountId":  "999999999999",
+			"ExternalId": resp.ExternalID,
+			"SetupToken": resp.SetupToken,
+		},
+	})
+	return &snsMessage{Type: "Notification", Message: string(request)}
+}
+
+func TestSetupCallbackHandler_CompletesSetup(t *testing.T) {
+	ctx := context.Background()
+	env := newCallbackTestEnv(t)
+
+	resp, err := env.client.GenerateSetupLinkWithContext(ctx, "customer-123", "Test Customer")
+	if err != nil {
+		t.Fatalf("GenerateSetupLink() error = %v", err)
+	}
+	if !strings.Contains(resp.LaunchURL, "param_SetupToken=") {
+		t.Error("launch URL should pass the setup token to the stack")
+	}
+
+	responseURL := "https://cloudformation-custom-resource-response-useast1.s3.amazonaws.com/response?X-Amz-Signature=abc"
+	if code := env.deliver(t, createNotification(resp, responseURL)); code != http.StatusOK {
+		t.Fatalf("ServeHTTP() status = %d", code)
+	}
+
+	integration, err := env.client.GetIntegration(ctx, "customer-123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if integration.Status != IntegrationActive || integration.RoleARN != testSetupRoleARN {
+		t.Errorf("callback should complete setup: %+v", integration)
+	}
+
+	if len(env.requests) != 1 || env.requests[0].Method != http.MethodPut || env.requests[0].Host != "cloudformation-custom-resource-response-useast1.s3.amazonaws.com" {
+		t.Fatalf("expected one response upload, got %v", env.requests)
+	}
+	var answer customResourceResponse
+	if err := json.Unmarshal([]byte(env.bodies[0]), &answer); err != nil {
+		t.Fatal(err)
+	}
+	if answer.Status != "SUCCESS" || answer.RequestID != "request-1" || answer.Data["SetupComplete"] != "true" {
+		t.Errorf("unexpected response: %+v", answer)
+	}
+}
+
+func TestSetupCallbackHandler_InvalidTokenDoesNotFailStack(t *testing.T) {
+	ctx := context.Background()
+	env := newCallbackTestEnv(t)
+
+	resp, err := env.client.GenerateSetupLinkWithContext(ctx, "customer-123", "Test Customer")
+	if err != nil {
+		t.Fatalf("GenerateSetupLink() error = %v", err)
+	}
+	resp.SetupToken += "x"
+
+	if code := env.deliver(t, createNotification(resp, "https://bucket.s3.amazonaws.com/response")); code != http.StatusOK {
+		t.Fatalf("ServeHTTP() status = %d", code)
+	}
+
+	if integration, _ := env.client.GetIntegration(ctx, "customer-123"); integration.Status != IntegrationLinkGenerated {
+		t.Errorf("forged callback changed the integration to %s", integration.Status)
+	}
+	var answer customResourceResponse
+	if len(env.bodies) != 1 || json.Unmarshal([]byte(env.bodies[0]), &answer) != nil ||
+		answer.Status != "SUCCESS" || answer.Data["SetupComplete"] != "false" {
+		t.Errorf("unexpected response: %v", env.bodies)
+	}
+}
+
+func TestSetupCallbackHandler_RejectsOtherStack(t *testing.T) {
+	ctx := context.Background()
+	env := newCallbackTestEnv(t)
+
+	resp, err := env.client.GenerateSetupLinkWithContext(ctx, "customer-123", "Test Customer")
+	if err != nil {
+		t.Fatalf("GenerateSetupLink() error = %v", err)
+	}
+	// The token replayed from another stack in the customer's account
+	replayed := *resp
+	replayed.StackName = "some-other-stack"
+
+	if code := env.deliver(t, createNotification(&replayed, "https://bucket.s3.amazonaws.com/response")); code != http.StatusOK {
+		t.Fatalf("ServeHTTP() status = %d", code)
+	}
+
+	if integration, _ := env.client.GetIntegration(ctx, "customer-123"); integration.Status != IntegrationLinkGenerated {
+		t.Errorf("callback from another stack changed the integration to %s", integration.Status)
+	}
+	var answer customResourceResponse
+	if len(env.bodies) != 1 || json.Unmarshal([]byte(env.bodies[0]), &answer) != nil || answer.Data["SetupComplete"] != "false" {
+		t.Errorf("unexpected response: %v", env.bodies)
+	}
+}
+
+func TestSetupCallbackHandler_RejectsMessages(t *testing.T) {
+	env := newCallbackTestEnv(t)
+	resp := &SetupResponse{StackName: "stack", SetupToken: "token"}
+
+	tests := []struct {
+		name string
+		msg  *snsMessage
+		want int
+	}{
+		{
+			name: "bad signature",
+			msg:  &snsMessage{Type: "Notification", Message: createNotification(resp, "https://bucket.s3.amazonaws.com/r").Message, Signature: "c2lnbmF0dXJl"},
+			want: http.StatusForbidden,
+		},
+		{
+			name: "other topic",
+			msg:  &snsMessage{Type: "Notification", TopicARN: "arn:aws:sns:us-east-1:111111111111:other", Message: "{}"},
+			want: http.StatusForbidden,
+		},
+		{
+			name: "response URL outside AWS",
+			msg:  createNotification(resp, "https://attacker.example.com/"),
+			want: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := env.deliver(t, tt.msg); code != tt.want {
+				t.Errorf("ServeHTTP() status = %d, want %d", code, tt.want)
+			}
+		})
+	}
+	if len(env.requests) != 0 {
+		t.Errorf("rejected messages should not trigger requests, got %d", len(env.requests))
+	}
+}
+
+func TestSetupCallbackHandler_ConfirmsSubscription(t *testing.T) {
+	env := newCallbackTestEnv(t)
+
+	code := env.deliver(t, &snsMessage{
+		Type:         "SubscriptionConfirmation",
+		Token:        "token",
+		Message:      "You have chosen to subscribe to the topic",
+		SubscribeURL: "https://sns.us-east-1.amazonaws.com/?Action=ConfirmSubscription&Token=token",
+	})
+	if code != http.StatusOK {
+		t.Fatalf("ServeHTTP() status = %d", code)
+	}
+	if len(env.requests) != 1 || env.requests[0].URL.Query().Get("Action") != "ConfirmSubscription" {
+		t.Errorf("subscription was not confirmed: %v", env.requests)
+	}
+}
+
+func TestGenerateCloudFormationTemplate_SetupCallback(t *testing.T) {
+	cfg := QuickConfig("data-platform", "test-service", "123456789012", "test-bucket")
+	cfg.SetupCallbackTopicARN = testCallbackTopicARN
+	client, _ := newTestClient(t, cfg)
+
+	body, err := client.GenerateCloudFormationTemplate()
+	if err != nil {
+		t.Fatalf("GenerateCloudFormationTemplate() error = %v", err)
+	}
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal([]byte(body), &doc); err != nil {
+		t.Fatalf("template is not valid YAML: %v", err)
+	}
+	for _, want := range []string{"Type: Custom::SetupCallback", "ServiceToken: '" + testCallbackTopicARN + "'", "SendSetupCallback"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("template is missing %q", want)
+		}
+	}
+
+	if _, err := New(&Config{
+		ServiceName:           "test-service",
+		ServiceAccountID:      "123456789012",
+		TemplateS3Bucket:      "test-bucket",
+		SetupCallbackTopicARN: "arn:aws:sns:eu-west-1:123456789012:setup-callbacks",
+	}); err == nil {
+		t.Error("New() should reject a callback topic outside the default region")
+	}
+}
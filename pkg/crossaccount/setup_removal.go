@@ -0,0 +1,291 @@
+package crossaccount
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	cftypes "github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+
+	"github.com/scttfrdmn/aws-remote-access-patterns/pkg/telemetry"
+)
+
+const (
+	// defaultStackPollDelay is the minimum delay between stack status checks
+	defaultStackPollDelay = 5 * time.Second
+
+	// setupRemovalTimeout bounds how long to wait for the stack update
+	setupRemovalTimeout = 30 * time.Minute
+)
+
+// setupOnlyResources are the template resources that exist only while
+// SetupPhase is true
+var setupOnlyResources = []string{"SetupPolicy", "SetupRemovalPolicy"}
+
+// CloudFormationAPI is the subset of the CloudFormation client used to manage
+// a customer's integration stack
+type CloudFormationAPI interface {
+	DescribeStacks(ctx context.Context, params *cloudformation.DescribeStacksInput, optFns ...func(*cloudformation.Options)) (*cloudformation.DescribeStacksOutput, error)
+	DescribeStackResources(ctx context.Context, params *cloudformation.DescribeStackResourcesInput, optFns ...func(*cloudformation.Options)) (*cloudformation.DescribeStackResourcesOutput, error)
+	UpdateStack(ctx context.Context, params *cloudformation.UpdateStackInput, optFns ...func(*cloudformation.Options)) (*cloudformation.UpdateStackOutput, error)
+}
+
+// RemoveSetupPermissionsWithContext removes the customer's setup permissions
+// by updating their stack with SetupPhase=false, using the scoped
+// cloudformation:UpdateStack permission the setup policy grants. It waits for
+// the update, verifies the setup policy is gone and moves the integration to
+// active. If the update can't be automated, for example because the stack
+// predates that permission, the manual instructions are returned instead with
+// AutomationError explaining why
+func (c *Client) RemoveSetupPermissionsWithContext(ctx context.Context, customerID string) (*CleanupInstructions, error) {
+	if customerID == "" {
+		return nil, fmt.Errorf("customer ID is required")
+	}
+
+	ctx, span := c.telemetry.StartSpan(ctx, "crossaccount.RemoveSetupPermissions", telemetry.String("customer_id", customerID))
+	instructions, err := c.removeSetupPermissions(ctx, customerID)
+	auditErr := err
+	if err == nil && !instructions.Automated {
+		// Manual instructions aren't an error for the caller, but nothing was removed
+		auditErr = fmt.Errorf("fell back to manual instructions: %s", instructions.AutomationError)
+	}
+	span.End(auditErr)
+	if auditErr == nil {
+		c.funnel(ctx, funnelPermissionsRemoved)
+	}
+	c.audit(ctx, AuditEvent{Action: AuditRemoveSetupPermissions, CustomerID: customerID}, auditErr)
+	return instructions, err
+}
+
+// removeSetupPermissions is RemoveSetupPermissionsWithContext without auditing
+func (c *Client) removeSetupPermissions(ctx context.Context, customerID string) (*CleanupInstructions, error) {
+
+	integration, err := c.integrations.GetIntegration(ctx, customerID)
+	if err != nil {
+		return nil, fmt.Errorf("customer not found: %w", err)
+	}
+
+	if integration.organization() {
+		return nil, fmt.Errorf("customer %s has no setup permissions: organizations never deploy them", customerID)
+	}
+
+	if integration.terraform() {
+		// The role can't change the customer's Terraform configuration
+		return &CleanupInstructions{
+			CustomerID:      customerID,
+			AutomationError: "the customer manages the role with Terraform",
+			Instructions: []string{
+				fmt.Sprintf("1. In the %s module block of your Terraform configuration, set setup_phase = false", c.terraformModuleName()),
+				"2. Run terraform apply",
+			},
+		}, nil
+	}
+
+	stackName, region := integration.StackName, integration.StackRegion
+	if stackName == "" {
+		stackName = c.stackName(customerID)
+	}
+	if region == "" {
+		region = c.config.DefaultRegion
+	}
+
+	if err := c.removeSetupStackPermissions(ctx, integration, stackName, region); err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		c.logger.WarnContext(ctx, "automated setup permission removal failed", "customer_id", customerID, "stack_name", stackName, "error", err)
+
+		// Fall back to instructions for the customer
+		return &CleanupInstructions{
+			CustomerID:      customerID,
+			StackName:       stackName,
+			AutomationError: err.Error(),
+			Instructions: []string{
+				"1. Go to AWS CloudFormation console in " + region,
+				"2. Find your stack: " + stackName,
+				"3. Click 'Update'",
+				"4. Change 'SetupPhase' parameter from 'true' to 'false'",
+				"5. Click 'Update stack'",
+			},
+			AutomationScript: c.generateCleanupScript(stackName, region, c.stackParameterKeys(ctx, customerID, stackName, region)),
+		}, nil
+	}
+
+	return &CleanupInstructions{
+		CustomerID: customerID,
+		StackName:  stackName,
+		Automated:  true,
+	}, nil
+}
+
+// removeSetupStackPermissions updates the customer's stack and confirms the
+// role still works on its ongoing permissions
+func (c *Client) removeSetupStackPermissions(ctx context.Context, integration *CustomerIntegration, stackName, region string) error {
+	customerID := integration.CustomerID
+
+	switch {
+	case integration.Status == IntegrationSetupActive:
+		cfg, err := c.AssumeRole(ctx, customerID)
+		if err != nil {
+			return err
+		}
+		cfg.Region = region
+		cfn := c.newCloudFormation(cfg)
+
+		if err := c.updateSetupPhase(ctx, cfn, stackName); err != nil {
+			return err
+		}
+		if err := verifySetupResourcesRemoved(ctx, cfn, stackName); err != nil {
+			return err
+		}
+		if _, err := c.TransitionIntegration(ctx, customerID, IntegrationSetupRemoved, "stack updated with SetupPhase=false"); err != nil {
+			return err
+		}
+	case integration.Status == IntegrationSetupRemoved:
+		// The stack was updated earlier; only confirmation is outstanding
+	case integration.Status.Operational() && !integration.SetupPhase:
+		return nil
+	default:
+		return fmt.Errorf("integration is %s", integration.Status)
+	}
+
+	// The role's policies changed, so confirm with a fresh session
+	c.clearSession(ctx, customerID)
+	if _, err := c.customerCredentials(ctx, customerID, nil); err != nil {
+		reason := fmt.Sprintf("role not assumable after removing setup permissions: %v", err)
+		if _, terr := c.TransitionIntegration(ctx, customerID, IntegrationDegraded, reason); terr != nil {
+			c.logger.WarnContext(ctx, "failed to record degraded integration", "customer_id", customerID, "error", terr)
+		}
+		return fmt.Errorf("failed to verify access after removing setup permissions: %w", err)
+	}
+
+	_, err := c.TransitionIntegration(ctx, customerID, IntegrationActive, "ongoing access verified after removing setup permissions")
+	return err
+}
+
+// updateSetupPhase sets SetupPhase=false on the stack, keeping its template
+// and other parameters, and waits for the update to finish
+func (c *Client) updateSetupPhase(ctx context.Context, cfn CloudFormationAPI, stackName string) error {
+	stack, err := describeStack(ctx, cfn, stackName)
+	if err != nil {
+		return err
+	}
+
+	if stackParameter(stack, "SetupPhase") != "false" {
+		params := make([]cftypes.Parameter, 0, len(stack.Parameters))
+		for _, p := range stack.Parameters {
+			if aws.ToString(p.ParameterKey) == "SetupPhase" {
+				params = append(params, cftypes.Parameter{ParameterKey: p.ParameterKey, ParameterValue: aws.String("false")})
+				continue
+			}
+			params = append(params, cftypes.Parameter{ParameterKey: p.ParameterKey, UsePreviousValue: aws.Bool(true)})
+		}
+
+		if _, err := cfn.UpdateStack(ctx, &cloudformation.UpdateStackInput{
+			StackName:           aws.String(stackName),
+			UsePreviousTemplate: aws.Bool(true),
+			Parameters:          params,
+			Capabilities:        []cftypes.Capability{cftypes.CapabilityCapabilityNamedIam},
+		}); err != nil {
+			return fmt.Errorf("failed to update stack %s: %w", stackName, err)
+		}
+	}
+
+	waiter := cloudformation.NewStackUpdateCompleteWaiter(cfn, func(o *cloudformation.StackUpdateCompleteWaiterOptions) {
+		o.MinDelay = c.stackPollDelay
+		o.MaxDelay = 6 * c.stackPollDelay
+	})
+	if err := waiter.Wait(ctx, &cloudformation.DescribeStacksInput{StackName: aws.String(stackName)}, setupRemovalTimeout); err != nil {
+		// The waiter's error doesn't say why the update failed
+		if stack, derr := describeStack(ctx, cfn, stackName); derr == nil {
+			return fmt.Errorf("stack %s update did not complete: %s %s", stackName, stack.StackStatus, aws.ToString(stack.StackStatusReason))
+		}
+		return fmt.Errorf("stack %s update did not complete: %w", stackName, err)
+	}
+	return nil
+}
+
+// verifySetupResourcesRemoved checks that the updated stack no longer has the
+// setup-phase parameter value or resources
+func verifySetupResourcesRemoved(ctx context.Context, cfn CloudFormationAPI, stackName string) error {
+	stack, err := describeStack(ctx, cfn, stackName)
+	if err != nil {
+		return err
+	}
+	if value := stackParameter(stack, "SetupPhase"); value != "false" {
+		return fmt.Errorf("stack %s still has SetupPhase=%s", stackName, value)
+	}
+
+	resources, err := cfn.DescribeStackResources(ctx, &cloudformation.DescribeStackResourcesInput{
+		StackName: aws.String(stackName),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list stack resources: %w", err)
+	}
+	for _, r := range resources.StackResources {
+		for _, logicalID := range setupOnlyResources {
+			if aws.ToString(r.LogicalResourceId) == logicalID {
+				return fmt.Errorf("stack %s still has %s (%s)", stackName, logicalID, r.ResourceStatus)
+			}
+		}
+	}
+	return nil
+}
+
+// describeStack returns a single stack's description
+func describeStack(ctx context.Context, cfn CloudFormationAPI, stackName string) (*cftypes.Stack, error) {
+	out, err := cfn.DescribeStacks(ctx, &cloudformation.DescribeStacksInput{StackName: aws.String(stackName)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe stack %s: %w", stackName, err)
+	}
+	if len(out.Stacks) == 0 {
+		return nil, fmt.Errorf("stack %s not found", stackName)
+	}
+	return &out.Stacks[0], nil
+}
+
+// stackParameterKeys returns the parameters the customer's stack was
+// deployed with, so update-stack commands keep exactly those. Stacks that
+// can't be described fall back to the current template's parameters
+func (c *Client) stackParameterKeys(ctx context.Context, customerID, stackName, region string) []string {
+	keys, err := c.describeStackParameterKeys(ctx, customerID, stackName, region)
+	if err != nil {
+		c.logger.WarnContext(ctx, "using template parameters for stack update command", "customer_id", customerID, "stack_name", stackName, "error", err)
+		return c.templateParameterKeys()
+	}
+	return keys
+}
+
+// describeStackParameterKeys reads the stack's parameter keys with the
+// customer's role
+func (c *Client) describeStackParameterKeys(ctx context.Context, customerID, stackName, region string) ([]string, error) {
+	cfg, err := c.AssumeRole(ctx, customerID)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Region = region
+
+	stack, err := describeStack(ctx, c.newCloudFormation(cfg), stackName)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(stack.Parameters))
+	for _, p := range stack.Parameters {
+		keys = append(keys, aws.ToString(p.ParameterKey))
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// stackParameter returns a stack parameter's value, or "" if it isn't set
+func stackParameter(stack *cftypes.Stack, key string) string {
+	for _, p := range stack.Parameters {
+		if aws.ToString(p.ParameterKey) == key {
+			return aws.ToString(p.ParameterValue)
+		}
+	}
+	return ""
+}
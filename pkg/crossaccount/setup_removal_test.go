@@ -0,0 +1,352 @@
+package crossaccount
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	cftypes "github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+	"gopkg.in/yaml.v3"
+)
+
+// fakeCloudFormation is an in-memory integration stack. Updates complete
+// after one status check, removing setup resources when SetupPhase=false
+type fakeCloudFormation struct {
+	mu        sync.Mutex
+	stackName string
+	status    cftypes.StackStatus
+	reason    string
+	params    map[string]string
+	resources []string
+	updates   []*cloudformation.UpdateStackInput
+	regions   []string
+	updateErr error
+	failWith  cftypes.StackStatus
+}
+
+func newFakeCloudFormation(stackName string) *fakeCloudFormation {
+	return &fakeCloudFormation{
+		stackName: stackName,
+		status:    cftypes.StackStatusCreateComplete,
+		params:    map[string]string{"ExternalId": "****", "ServiceAccountId": "123456789012", "RoleName": "role", "SetupPhase": "true"},
+		resources: []string{"CrossAccountRole", "StackStatusPolicy", "OngoingPolicy", "SetupPolicy", "SetupRemovalPolicy"},
+	}
+}
+
+func (f *fakeCloudFormation) DescribeStacks(ctx context.Context, params *cloudformation.DescribeStacksInput, optFns ...func(*cloudformation.Options)) (*cloudformation.DescribeStacksOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if aws.ToString(params.StackName) != f.stackName {
+		return nil, errors.New("ValidationError: stack does not exist")
+	}
+
+	stack := cftypes.Stack{StackName: aws.String(f.stackName), StackStatus: f.status, StackStatusReason: aws.String(f.reason)}
+	for k, v := range f.params {
+		stack.Parameters = append(stack.Parameters, cftypes.Parameter{ParameterKey: aws.String(k), ParameterValue: aws.String(v)})
+	}
+
+	// Finish an in-progress update on the next check
+	switch f.status {
+	case cftypes.StackStatusUpdateInProgress:
+		if f.failWith != "" {
+			f.status, f.reason = f.failWith, "Resource handler returned message: AccessDenied"
+			break
+		}
+		f.status = cftypes.StackStatusUpdateComplete
+		if f.params["SetupPhase"] == "false" {
+			f.resources = f.resources[:3]
+		}
+	}
+	return &cloudformation.DescribeStacksOutput{Stacks: []cftypes.Stack{stack}}, nil
+}
+
+func (f *fakeCloudFormation) DescribeStackResources(ctx context.Context, params *cloudformation.DescribeStackResourcesInput, optFns ...func(*cloudformation.Options)) (*cloudformation.DescribeStackResourcesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	out := &cloudformation.DescribeStackResourcesOutput{}
+	for _, r := range f.resources {
+		out.StackResources = append(out.StackResources, cftypes.StackResource{
+			LogicalResourceId: aws.String(r),
+			ResourceStatus:    cftypes.ResourceStatusCreateComplete,
+		})
+	}
+	return out, nil
+}
+
+func (f *fakeCloudFormation) UpdateStack(ctx context.Context, params *cloudformation.UpdateStackInput, optFns ...func(*cloudformation.Options)) (*cloudformation.UpdateStackOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.updates = append(f.updates, params)
+	if f.updateErr != nil {
+		return nil, f.updateErr
+	}
+	for _, p := range params.Parameters {
+		if !aws.ToBool(p.UsePreviousValue) {
+			f.params[aws.ToString(p.ParameterKey)] = aws.ToString(p.ParameterValue)
+		}
+	}
+	f.status = cftypes.StackStatusUpdateInProgress
+	return &cloudformation.UpdateStackOutput{}, nil
+}
+
+func TestRemoveSetupPermissions_Automated(t *testing.T) {
+	ctx := context.Background()
+	ti := newIntegratedTestClient(t, QuickConfig("data-platform", "test-service", "123456789012", "test-bucket"), withCloudFormation())
+	client, cfn := ti.client, ti.cfn
+
+	result, err := client.RemoveSetupPermissionsWithContext(ctx, "customer-123")
+	if err != nil {
+		t.Fatalf("RemoveSetupPermissions() error = %v", err)
+	}
+	if !result.Automated || result.AutomationError != "" || len(result.Instructions) != 0 {
+		t.Fatalf("expected automated removal, got %+v", result)
+	}
+
+	if len(cfn.updates) != 1 {
+		t.Fatalf("expected 1 stack update, got %d", len(cfn.updates))
+	}
+	update := cfn.updates[0]
+	if !aws.ToBool(update.UsePreviousTemplate) || len(update.Capabilities) != 1 || update.Capabilities[0] != cftypes.CapabilityCapabilityNamedIam {
+		t.Errorf("unexpected update input: %+v", update)
+	}
+	for _, p := range update.Parameters {
+		key := aws.ToString(p.ParameterKey)
+		if key == "SetupPhase" && aws.ToString(p.ParameterValue) != "false" {
+			t.Errorf("SetupPhase = %s, want false", aws.ToString(p.ParameterValue))
+		}
+		if key != "SetupPhase" && !aws.ToBool(p.UsePreviousValue) {
+			t.Errorf("parameter %s should keep its previous value", key)
+		}
+	}
+	if cfn.regions[0] != "us-east-1" {
+		t.Errorf("stack client region = %s, want us-east-1", cfn.regions[0])
+	}
+
+	integration, err := client.GetIntegration(ctx, "customer-123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if integration.Status != IntegrationActive || integration.SetupPhase {
+		t.Errorf("integration should be active without setup permissions: %+v", integration)
+	}
+	history, _ := client.IntegrationHistory(ctx, "customer-123")
+	if n := len(history); n < 2 || history[n-2].To != IntegrationSetupRemoved {
+		t.Errorf("history should record setup removal: %+v", history)
+	}
+
+	// Nothing is left to remove
+	again, err := client.RemoveSetupPermissionsWithContext(ctx, "customer-123")
+	if err != nil || !again.Automated || len(cfn.updates) != 1 {
+		t.Errorf("second removal = %+v, %v with %d updates", again, err, len(cfn.updates))
+	}
+}
+
+func TestRemoveSetupPermissions_FallsBackToInstructions(t *testing.T) {
+	ctx := context.Background()
+	ti := newIntegratedTestClient(t, QuickConfig("data-platform", "test-service", "123456789012", "test-bucket"), withCloudFormation())
+	client, cfn := ti.client, ti.cfn
+	cfn.updateErr = errors.New("AccessDenied: not authorized to perform cloudformation:UpdateStack")
+
+	result, err := client.RemoveSetupPermissionsWithContext(ctx, "customer-123")
+	if err != nil {
+		t.Fatalf("RemoveSetupPermissions() error = %v", err)
+	}
+	if result.Automated || !strings.Contains(result.AutomationError, "AccessDenied") {
+		t.Errorf("expected manual fallback, got %+v", result)
+	}
+
+	// The manual steps target the stack the setup link created
+	if result.StackName != cfn.stackName || !strings.Contains(result.AutomationScript, `--stack-name "`+cfn.stackName+`"`) {
+		t.Errorf("instructions target the wrong stack: %+v", result)
+	}
+	for _, want := range []string{"CAPABILITY_NAMED_IAM", "ParameterKey=ExternalId,UsePreviousValue=true"} {
+		if !strings.Contains(result.AutomationScript, want) {
+			t.Errorf("script is missing %s:\n%s", want, result.AutomationScript)
+		}
+	}
+
+	if integration, _ := client.GetIntegration(ctx, "customer-123"); integration.Status != IntegrationSetupActive {
+		t.Errorf("failed removal should leave the integration in setup_active, got %s", integration.Status)
+	}
+}
+
+func TestRemoveSetupPermissions_UpdateRollsBack(t *testing.T) {
+	ti := newIntegratedTestClient(t, QuickConfig("data-platform", "test-service", "123456789012", "test-bucket"), withCloudFormation())
+	client, cfn := ti.client, ti.cfn
+	cfn.failWith = cftypes.StackStatusUpdateRollbackComplete
+
+	result, err := client.RemoveSetupPermissionsWithContext(context.Background(), "customer-123")
+	if err != nil {
+		t.Fatalf("RemoveSetupPermissions() error = %v", err)
+	}
+	if result.Automated || !strings.Contains(result.AutomationError, "UPDATE_ROLLBACK_COMPLETE") {
+		t.Errorf("expected rollback to be reported, got %+v", result)
+	}
+}
+
+func TestStackName(t *testing.T) {
+	client, _ := newTestClient(t, SimpleConfig("test-service", "123456789012", "test-bucket"))
+
+	if got := client.stackName("acme_corp.prod"); got != "test-service-Integration-acme-corp-prod" {
+		t.Errorf("stackName() = %s", got)
+	}
+	if got := client.stackName(strings.Repeat("a", 200)); len(got) != 128 {
+		t.Errorf("stackName() length = %d, want 128", len(got))
+	}
+}
+
+func TestGenerateCloudFormationTemplate_SetupRemoval(t *testing.T) {
+	client, _ := newTestClient(t, QuickConfig("data-platform", "test-service", "123456789012", "test-bucket"))
+
+	body, err := client.GenerateCloudFormationTemplate()
+	if err != nil {
+		t.Fatalf("GenerateCloudFormationTemplate() error = %v", err)
+	}
+
+	var doc struct {
+		Resources map[string]struct {
+			Condition string      `yaml:"Condition"`
+			DependsOn interface{} `yaml:"DependsOn"`
+		} `yaml:"Resources"`
+	}
+	if err := yaml.Unmarshal([]byte(body), &doc); err != nil {
+		t.Fatalf("template is not valid YAML: %v", err)
+	}
+
+	removal, ok := doc.Resources["SetupRemovalPolicy"]
+	if !ok || removal.Condition != "IncludeSetupPermissions" {
+		t.Errorf("setup removal policy should exist only during setup: %+v", removal)
+	}
+	// CloudFormation deletes dependents first, so the setup policy goes
+	// while the permissions to delete it are still attached
+	if doc.Resources["SetupPolicy"].DependsOn != "SetupRemovalPolicy" {
+		t.Errorf("SetupPolicy DependsOn = %v", doc.Resources["SetupPolicy"].DependsOn)
+	}
+	if status, ok := doc.Resources["StackStatusPolicy"]; !ok || status.Condition != "" {
+		t.Error("stack status policy should always be present")
+	}
+}
+
+// setupPhaseChanges are the IAM actions CloudFormation needs to make each kind
+// of change when SetupPhase flips, and the resource it needs them on
+var setupPhaseChanges = map[string][]struct{ action, resource string }{
+	// Resources that only exist during setup are deleted
+	"AWS::IAM::ManagedPolicy": {
+		{"iam:DetachRolePolicy", "CrossAccountRole.Arn"},
+		{"iam:ListPolicyVersions", "${RoleName}-setup"},
+		{"iam:DeletePolicy", "${RoleName}-setup"},
+	},
+	"AWS::IAM::Policy": {{"iam:DeleteRolePolicy", "CrossAccountRole.Arn"}},
+	// Properties of resources that stay are updated
+	"AWS::IAM::Role.Tags": {
+		{"iam:TagRole", "CrossAccountRole.Arn"},
+		{"iam:UntagRole", "CrossAccountRole.Arn"},
+	},
+}
+
+func TestSetupRemovalPolicy_CoversSetupPhaseChanges(t *testing.T) {
+	client, _ := newTestClient(t, QuickConfig("data-platform", "test-service", "123456789012", "test-bucket"))
+	body, err := client.GenerateCloudFormationTemplate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(body), &doc); err != nil {
+		t.Fatal(err)
+	}
+	root := doc.Content[0]
+	field := func(n *yaml.Node, key string) *yaml.Node {
+		if v := mappingValue(n, key); v != nil {
+			return v
+		}
+		return &yaml.Node{}
+	}
+
+	// Conditions and properties that reference SetupPhase change with it
+	setupConditions := make(map[string]bool)
+	conditions := field(root, "Conditions")
+	for i := 0; i < len(conditions.Content); i += 2 {
+		if refersToSetupPhase(conditions.Content[i+1], nil) {
+			setupConditions[conditions.Content[i].Value] = true
+		}
+	}
+	var changes []string
+	resources := field(root, "Resources")
+	for i := 0; i < len(resources.Content); i += 2 {
+		resource := resources.Content[i+1]
+		kind := field(resource, "Type").Value
+		if setupConditions[field(resource, "Condition").Value] {
+			changes = append(changes, kind)
+			continue
+		}
+		properties := field(resource, "Properties")
+		for j := 0; j < len(properties.Content); j += 2 {
+			if refersToSetupPhase(properties.Content[j+1], setupConditions) {
+				changes = append(changes, kind+"."+properties.Content[j].Value)
+			}
+		}
+	}
+	if len(changes) == 0 {
+		t.Fatal("no resource changes with SetupPhase")
+	}
+
+	// What the removal policy grants, by action
+	granted := make(map[string][]string)
+	statements := field(field(field(field(resources, "SetupRemovalPolicy"), "Properties"), "PolicyDocument"), "Statement")
+	for _, statement := range statements.Content {
+		var targets []string
+		if resource := field(statement, "Resource"); resource.Kind == yaml.SequenceNode {
+			for _, r := range resource.Content {
+				targets = append(targets, r.Value)
+			}
+		} else {
+			targets = append(targets, resource.Value)
+		}
+		for _, action := range field(statement, "Action").Content {
+			granted[action.Value] = append(granted[action.Value], targets...)
+		}
+	}
+
+	for _, change := range changes {
+		needed, ok := setupPhaseChanges[change]
+		if !ok {
+			t.Errorf("%s changes with SetupPhase; add the IAM actions it needs to setupPhaseChanges and SetupRemovalPolicy", change)
+			continue
+		}
+		for _, n := range needed {
+			covered := false
+			for _, target := range granted[n.action] {
+				covered = covered || strings.Contains(target, n.resource)
+			}
+			if !covered {
+				t.Errorf("SetupRemovalPolicy doesn't grant %s on %s, needed to change %s", n.action, n.resource, change)
+			}
+		}
+	}
+}
+
+// refersToSetupPhase reports whether n uses the SetupPhase parameter, directly
+// or through one of conditions
+func refersToSetupPhase(n *yaml.Node, conditions map[string]bool) bool {
+	switch {
+	case n.Tag == "!Ref" && n.Value == "SetupPhase":
+		return true
+	case n.Tag == "!If" && len(n.Content) > 0 && conditions[n.Content[0].Value]:
+		return true
+	case n.Tag == "!Sub" && strings.Contains(n.Value, "${SetupPhase}"):
+		return true
+	}
+	for _, child := range n.Content {
+		if refersToSetupPhase(child, conditions) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,186 @@
+package crossaccount
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Setup session errors returned by CompleteSetup
+var (
+	ErrInvalidSetupToken    = errors.New("invalid setup token")
+	ErrSetupSessionExpired  = errors.New("setup session expired")
+	ErrSetupSessionUsed     = errors.New("setup session already used")
+	ErrSetupSessionMismatch = errors.New("setup request does not match setup session")
+)
+
+// setupTokenVersion prefixes tokens so the format can change later
+const setupTokenVersion = "v1"
+
+// minSetupSigningKeyLength is the shortest HMAC key WithSetupSigningKey accepts
+const minSetupSigningKeyLength = 32
+
+// SetupSession is what a setup link was issued for. CompleteSetup only
+// accepts a role that matches it, once, before it expires
+type SetupSession struct {
+	ID                string    `json:"id"`
+	ExternalID        string    `json:"external_id"`
+	StackName         string    `json:"stack_name"`
+	RoleName          string    `json:"role_name"`
+	CustomerAccountID string    `json:"customer_account_id,omitempty"`
+	IssuedAt          time.Time `json:"issued_at"`
+	ExpiresAt         time.Time `json:"expires_at"`
+	UsedAt            time.Time `json:"used_at"` // Zero until CompleteSetup succeeds
+}
+
+// setupTokenClaims is the signed part of a setup token
+type setupTokenClaims struct {
+	SessionID  string `json:"sid"`
+	CustomerID string `json:"cid"`
+	ExpiresAt  int64  `json:"exp"`
+}
+
+// WithSetupSigningKey sets the HMAC key that signs setup tokens. Use the same
+// key on every instance of your service so tokens survive restarts and
+// work behind a load balancer. By default a random per-process key is used
+func WithSetupSigningKey(key []byte) Option {
+	return func(c *Client) { c.setupKey = key }
+}
+
+// newSetupSession creates a session for a setup link
+func (c *Client) newSetupSession(externalID, stackName, roleName string, opts SetupLinkOptions) (*SetupSession, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to generate setup session ID: %w", err)
+	}
+
+	now := c.now()
+	return &SetupSession{
+		ID:                hex.EncodeToString(id),
+		ExternalID:        externalID,
+		StackName:         stackName,
+		RoleName:          roleName,
+		CustomerAccountID: opts.CustomerAccountID,
+		IssuedAt:          now,
+		ExpiresAt:         now.Add(c.config.SetupLinkExpiration),
+	}, nil
+}
+
+// signSetupToken returns the token for a customer's setup session
+func (c *Client) signSetupToken(customerID string, session *SetupSession) (string, error) {
+	payload, err := json.Marshal(setupTokenClaims{
+		SessionID:  session.ID,
+		CustomerID: customerID,
+		ExpiresAt:  session.ExpiresAt.Unix(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal setup token: %w", err)
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return setupTokenVersion + "." + encoded + "." + c.setupTokenMAC(encoded), nil
+}
+
+// parseSetupToken verifies a token's signature and expiry and returns its claims
+func (c *Client) parseSetupToken(token string) (*setupTokenClaims, error) {
+	version, rest, _ := strings.Cut(token, ".")
+	encoded, mac, ok := strings.Cut(rest, ".")
+	if version != setupTokenVersion || !ok {
+		return nil, fmt.Errorf("%w: malformed token", ErrInvalidSetupToken)
+	}
+	if !hmac.Equal([]byte(mac), []byte(c.setupTokenMAC(encoded))) {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidSetupToken)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed payload", ErrInvalidSetupToken)
+	}
+	var claims setupTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("%w: malformed payload", ErrInvalidSetupToken)
+	}
+
+	if !c.now().Before(time.Unix(claims.ExpiresAt, 0)) {
+		return nil, ErrSetupSessionExpired
+	}
+	return &claims, nil
+}
+
+// setupTokenMAC signs an encoded token payload
+func (c *Client) setupTokenMAC(encoded string) string {
+	mac := hmac.New(sha256.New, c.setupKey)
+	mac.Write([]byte(setupTokenVersion + "." + encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkSetupSession verifies a CompleteSetup request against the session
+// its token was issued for
+func (c *Client) checkSetupSession(session *SetupSession, claims *setupTokenClaims, req *SetupCompleteRequest) error {
+	if session == nil || session.ID != claims.SessionID {
+		return fmt.Errorf("%w: session was replaced by a newer setup link", ErrInvalidSetupToken)
+	}
+	if !session.UsedAt.IsZero() {
+		return ErrSetupSessionUsed
+	}
+	if !c.now().Before(session.ExpiresAt) {
+		return ErrSetupSessionExpired
+	}
+
+	if subtle.ConstantTimeCompare([]byte(req.ExternalID), []byte(session.ExternalID)) != 1 {
+		return fmt.Errorf("%w: external ID", ErrSetupSessionMismatch)
+	}
+
+	account, roleName, err := parseRoleARN(req.RoleARN)
+	if err != nil {
+		return err
+	}
+	if roleName != session.RoleName {
+		return fmt.Errorf("%w: expected role %s, got %s", ErrSetupSessionMismatch, session.RoleName, roleName)
+	}
+	if req.StackName != "" && req.StackName != session.StackName {
+		return fmt.Errorf("%w: expected stack %s, got %s", ErrSetupSessionMismatch, session.StackName, req.StackName)
+	}
+	if session.CustomerAccountID != "" && account != session.CustomerAccountID {
+		return fmt.Errorf("%w: expected account %s, got %s", ErrSetupSessionMismatch, session.CustomerAccountID, account)
+	}
+	return nil
+}
+
+// parseRoleARN returns the account ID and role name from an IAM role ARN
+// Role paths are ignored: arn:aws:iam::123456789012:role/path/name yields name
+func parseRoleARN(roleARN string) (account, roleName string, err error) {
+	parts := strings.SplitN(roleARN, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "iam" || !strings.HasPrefix(parts[5], "role/") {
+		return "", "", fmt.Errorf("invalid role ARN: %s", roleARN)
+	}
+
+	account = parts[4]
+	if !isAccountID(account) {
+		return "", "", fmt.Errorf("invalid account ID in role ARN: %s", roleARN)
+	}
+
+	resource := parts[5]
+	return account, resource[strings.LastIndex(resource, "/")+1:], nil
+}
+
+// isAccountID reports whether s is a 12-digit AWS account ID
+func isAccountID(s string) bool {
+	if len(s) != 12 {
+		return false
+	}
+	for _, ch := range s {
+		if ch < '0' || ch > '9' {
+			return false
+		}
+	}
+	return true
+}
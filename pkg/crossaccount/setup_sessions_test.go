@@ -0,0 +1,176 @@
+package crossaccount
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompleteSetup_SetupSession(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    SetupLinkOptions
+		modify  func(req *SetupCompleteRequest, now *time.Time)
+		wantErr error
+	}{
+		{
+			name:   "valid",
+			modify: func(req *SetupCompleteRequest, now *time.Time) {},
+		},
+		{
+			name: "tampered token",
+			modify: func(req *SetupCompleteRequest, now *time.Time) {
+				req.SetupToken += "x"
+			},
+			wantErr: ErrInvalidSetupToken,
+		},
+		{
+			name: "expired",
+			modify: func(req *SetupCompleteRequest, now *time.Time) {
+				*now = now.Add(73 * time.Hour)
+			},
+			wantErr: ErrSetupSessionExpired,
+		},
+		{
+			name: "wrong external ID",
+			modify: func(req *SetupCompleteRequest, now *time.Time) {
+				req.ExternalID = "guessed"
+			},
+			wantErr: ErrSetupSessionMismatch,
+		},
+		{
+			name: "wrong role name",
+			modify: func(req *SetupCompleteRequest, now *time.Time) {
+				req.RoleARN = "arn:aws:iam::999999999999:role/admin"
+			},
+			wantErr: ErrSetupSessionMismatch,
+		},
+		{
+			name:    "wrong account",
+			opts:    SetupLinkOptions{CustomerAccountID: "111111111111"},
+			modify:  func(req *SetupCompleteRequest, now *time.Time) {},
+			wantErr: ErrSetupSessionMismatch,
+		},
+		{
+			name: "wrong customer",
+			modify: func(req *SetupCompleteRequest, now *time.Time) {
+				req.CustomerID = "customer-456"
+			},
+			wantErr: ErrInvalidSetupToken,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+			ti := newIntegratedTestClient(t, SimpleConfig("test-service", "123456789012", "test-bucket"),
+				withSetupLinkOptions(tt.opts), withTestClock(&now), withSetupLinkOnly())
+			client, resp := ti.client, ti.setup
+
+			req := &SetupCompleteRequest{
+				CustomerID: "customer-123",
+				RoleARN:    testSetupRoleARN,
+				ExternalID: resp.ExternalID,
+				SetupToken: resp.SetupToken,
+			}
+			tt.modify(req, &now)
+
+			err := client.CompleteSetup(context.Background(), req)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("CompleteSetup() error = %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("CompleteSetup() error = %v, want %v", err, tt.wantErr)
+			}
+			if integration, _ := client.GetIntegration(context.Background(), "customer-123"); integration.Status != IntegrationLinkGenerated {
+				t.Errorf("rejected setup changed the integration to %s", integration.Status)
+			}
+		})
+	}
+}
+
+func TestCompleteSetup_SetupSessionSingleUse(t *testing.T) {
+	ctx := context.Background()
+	ti := newIntegratedTestClient(t, SimpleConfig("test-service", "123456789012", "test-bucket"), withSetupLinkOnly())
+	client, resp := ti.client, ti.setup
+
+	req := &SetupCompleteRequest{
+		CustomerID: "customer-123",
+		RoleARN:    testSetupRoleARN,
+		ExternalID: resp.ExternalID,
+		SetupToken: resp.SetupToken,
+	}
+	if err := client.CompleteSetup(ctx, req); err != nil {
+		t.Fatalf("CompleteSetup() error = %v", err)
+	}
+	if err := client.CompleteSetup(ctx, req); !errors.Is(err, ErrSetupSessionUsed) {
+		t.Errorf("replayed CompleteSetup() error = %v, want ErrSetupSessionUsed", err)
+	}
+}
+
+func TestCompleteSetup_ReplacedSetupSession(t *testing.T) {
+	ctx := context.Background()
+	ti := newIntegratedTestClient(t, SimpleConfig("test-service", "123456789012", "test-bucket"), withSetupLinkOnly())
+	client, first := ti.client, ti.setup
+
+	second, err := client.GenerateSetupLinkWithContext(ctx, "customer-123", "Test Customer")
+	if err != nil {
+		t.Fatalf("GenerateSetupLink() error = %v", err)
+	}
+
+	err = client.CompleteSetup(ctx, &SetupCompleteRequest{
+		CustomerID: "customer-123",
+		RoleARN:    testSetupRoleARN,
+		ExternalID: first.ExternalID,
+		SetupToken: first.SetupToken,
+	})
+	if !errors.Is(err, ErrInvalidSetupToken) {
+		t.Errorf("CompleteSetup() with a replaced link error = %v, want ErrInvalidSetupToken", err)
+	}
+
+	if err := client.CompleteSetup(ctx, &SetupCompleteRequest{
+		CustomerID: "customer-123",
+		RoleARN:    testSetupRoleARN,
+		ExternalID: second.ExternalID,
+		SetupToken: second.SetupToken,
+	}); err != nil {
+		t.Errorf("CompleteSetup() with the newest link error = %v", err)
+	}
+}
+
+func TestParseRoleARN(t *testing.T) {
+	tests := []struct {
+		arn, account, roleName string
+		wantErr                bool
+	}{
+		{arn: "arn:aws:iam::123456789012:role/my-role", account: "123456789012", roleName: "my-role"},
+		{arn: "arn:aws:iam::123456789012:role/path/to/my-role", account: "123456789012", roleName: "my-role"},
+		{arn: "arn:aws-us-gov:iam::123456789012:role/my-role", account: "123456789012", roleName: "my-role"},
+		{arn: "arn:aws:iam::123456789012:user/my-user", wantErr: true},
+		{arn: "arn:aws:iam::12345:role/my-role", wantErr: true},
+		{arn: "not-an-arn", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		account, roleName, err := parseRoleARN(tt.arn)
+		if (err != nil) != tt.wantErr || account != tt.account || roleName != tt.roleName {
+			t.Errorf("parseRoleARN(%q) = %q, %q, %v", tt.arn, account, roleName, err)
+		}
+	}
+}
+
+func TestNew_SetupSigningKey(t *testing.T) {
+	cfg := SimpleConfig("test-service", "123456789012", "test-bucket")
+
+	if _, err := New(cfg, WithSetupSigningKey([]byte("short"))); err == nil {
+		t.Error("New() should reject short setup signing keys")
+	}
+	if _, err := New(cfg, WithSetupSigningKey([]byte(strings.Repeat("k", minSetupSigningKeyLength)))); err != nil {
+		t.Errorf("New() error = %v", err)
+	}
+}
@@ -14,6 +14,8 @@ import (
 )
 
 // CredentialStorage defines the interface for storing and retrieving credentials
+// It caches short-lived customer sessions; durable customer records live in
+// IntegrationStorage
 type CredentialStorage interface {
 	// Store saves credentials with the given key
 	Store(ctx context.Context, key string, credentials *StoredCredentials) error
@@ -32,6 +34,8 @@ type CredentialStorage interface {
 }
 
 // StoredCredentials represents credentials stored in the cache
+// Expiration is when the session expires, after which the entry can be
+// discarded
 type StoredCredentials struct {
 	AccessKeyID     string    `json:"access_key_id"`
 	SecretAccessKey string    `json:"secret_access_key"`
@@ -72,7 +76,7 @@ type FileStorage struct {
 // NewFileStorage creates a new file-based credential storage
 func NewFileStorage(baseDir, password string) (*FileStorage, error) {
 	// Create base directory if it doesn't exist
-	if err := os.MkdirAll(baseDir, 0700); err != nil {
+	if err := os.MkdirAll(filepath.Join(baseDir, "integrations"), 0700); err != nil {
 		return nil, fmt.Errorf("failed to create storage directory: %w", err)
 	}
 	
@@ -90,10 +94,17 @@ func NewFileStorage(baseDir, password string) (*FileStorage, error) {
 		}
 	}
 	
-	return &FileStorage{
+	fs := &FileStorage{
 		baseDir:   baseDir,
 		encryptor: encryptor,
-	}, nil
+	}
+
+	// Convert customer records written by earlier versions
+	if _, err := fs.MigrateLegacyRecords(context.Background()); err != nil {
+		return nil, fmt.Errorf("failed to migrate legacy customer records: %w", err)
+	}
+
+	return fs, nil
 }
 
 // Store saves encrypted credentials to a file
@@ -229,14 +240,16 @@ func (fs *FileStorage) getFilePath(key string) string {
 
 // MemoryStorage implements in-memory credential storage (for testing)
 type MemoryStorage struct {
-	credentials map[string]*StoredCredentials
-	mu          sync.RWMutex
+	credentials  map[string]*StoredCredentials
+	integrations map[string]*CustomerIntegration
+	mu           sync.RWMutex
 }
 
 // NewMemoryStorage creates a new in-memory credential storage
 func NewMemoryStorage() *MemoryStorage {
 	return &MemoryStorage{
-		credentials: make(map[string]*StoredCredentials),
+		credentials:  make(map[string]*StoredCredentials),
+		integrations: make(map[string]*CustomerIntegration),
 	}
 }
 
@@ -318,6 +331,7 @@ func (ms *MemoryStorage) Close() error {
 	
 	// Clear all credentials
 	ms.credentials = make(map[string]*StoredCredentials)
+	ms.integrations = make(map[string]*CustomerIntegration)
 	return nil
 }
 
@@ -374,6 +388,7 @@ func removeCredentialExtension(filename string) string {
 }
 
 // CleanupExpiredCredentials removes expired credentials from storage
+// Only cached sessions are removed; customer integrations are unaffected
 func CleanupExpiredCredentials(ctx context.Context, storage CredentialStorage) error {
 	keys, err := storage.List(ctx)
 	if err != nil {
@@ -0,0 +1,109 @@
+package crossaccount
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/scttfrdmn/aws-remote-access-patterns/pkg/telemetry"
+)
+
+// Setup funnel stages
+const (
+	funnelLinkGenerated      = "link_generated"
+	funnelSetupCompleted     = "setup_completed"
+	funnelSetupRejected      = "setup_rejected"
+	funnelPermissionsRemoved = "setup_permissions_removed"
+)
+
+// WithTelemetry records metrics and spans with recorder: AssumeRole latency
+// and errors per customer, session cache hits and refreshes, storage latency
+// and the setup funnel. See the telemetry package for adapters
+func WithTelemetry(recorder telemetry.Recorder) Option {
+	return func(c *Client) { c.telemetry = recorder }
+}
+
+// funnel counts a customer reaching a setup stage
+func (c *Client) funnel(ctx context.Context, stage string) {
+	c.telemetry.Count(ctx, telemetry.SetupFunnel, 1, telemetry.String("stage", stage))
+}
+
+// observeStorage records the latency of one storage operation
+func observeStorage(ctx context.Context, recorder telemetry.Recorder, store, operation string, start time.Time, err error) {
+	outcome := telemetry.Outcome(err)
+	if errors.Is(err, ErrIntegrationNotFound) {
+		outcome = "not_found"
+	}
+	recorder.Duration(ctx, telemetry.StorageDuration, time.Since(start),
+		telemetry.String("store", store),
+		telemetry.String("operation", operation),
+		telemetry.String("outcome", outcome))
+}
+
+// instrumentedCredentialStorage times a session store's operations
+type instrumentedCredentialStorage struct {
+	CredentialStorage
+	recorder telemetry.Recorder
+}
+
+func (s *instrumentedCredentialStorage) Store(ctx context.Context, key string, credentials *StoredCredentials) error {
+	start := time.Now()
+	err := s.CredentialStorage.Store(ctx, key, credentials)
+	observeStorage(ctx, s.recorder, "sessions", "store", start, err)
+	return err
+}
+
+func (s *instrumentedCredentialStorage) Retrieve(ctx context.Context, key string) (*StoredCredentials, error) {
+	start := time.Now()
+	credentials, err := s.CredentialStorage.Retrieve(ctx, key)
+	observeStorage(ctx, s.recorder, "sessions", "retrieve", start, err)
+	return credentials, err
+}
+
+func (s *instrumentedCredentialStorage) Delete(ctx context.Context, key string) error {
+	start := time.Now()
+	err := s.CredentialStorage.Delete(ctx, key)
+	observeStorage(ctx, s.recorder, "sessions", "delete", start, err)
+	return err
+}
+
+func (s *instrumentedCredentialStorage) List(ctx context.Context) ([]string, error) {
+	start := time.Now()
+	keys, err := s.CredentialStorage.List(ctx)
+	observeStorage(ctx, s.recorder, "sessions", "list", start, err)
+	return keys, err
+}
+
+// instrumentedIntegrationStorage times an integration store's operations
+type instrumentedIntegrationStorage struct {
+	IntegrationStorage
+	recorder telemetry.Recorder
+}
+
+func (s *instrumentedIntegrationStorage) SaveIntegration(ctx context.Context, integration *CustomerIntegration) error {
+	start := time.Now()
+	err := s.IntegrationStorage.SaveIntegration(ctx, integration)
+	observeStorage(ctx, s.recorder, "integrations", "save", start, err)
+	return err
+}
+
+func (s *instrumentedIntegrationStorage) GetIntegration(ctx context.Context, customerID string) (*CustomerIntegration, error) {
+	start := time.Now()
+	integration, err := s.IntegrationStorage.GetIntegration(ctx, customerID)
+	observeStorage(ctx, s.recorder, "integrations", "get", start, err)
+	return integration, err
+}
+
+func (s *instrumentedIntegrationStorage) DeleteIntegration(ctx context.Context, customerID string) error {
+	start := time.Now()
+	err := s.IntegrationStorage.DeleteIntegration(ctx, customerID)
+	observeStorage(ctx, s.recorder, "integrations", "delete", start, err)
+	return err
+}
+
+func (s *instrumentedIntegrationStorage) ListIntegrations(ctx context.Context) ([]*CustomerIntegration, error) {
+	start := time.Now()
+	integrations, err := s.IntegrationStorage.ListIntegrations(ctx)
+	observeStorage(ctx, s.recorder, "integrations", "list", start, err)
+	return integrations, err
+}
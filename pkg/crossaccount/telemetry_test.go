@@ -0,0 +1,186 @@
+package crossaccount
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
+
+	"github.com/scttfrdmn/aws-remote-access-patterns/pkg/telemetry"
+)
+
+// recordingTelemetry keeps measurements in memory
+type recordingTelemetry struct {
+	mu       sync.Mutex
+	counts   []recordedMeasurement
+	timings  []recordedMeasurement
+	spans    []string
+	spanErrs map[string]error
+}
+
+type recordedMeasurement struct {
+	name  string
+	n     int64
+	attrs map[string]string
+}
+
+func (r *recordingTelemetry) Count(ctx context.Context, name string, n int64, attrs ...telemetry.Attribute) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counts = append(r.counts, recordedMeasurement{name: name, n: n, attrs: attributeMap(attrs)})
+}
+
+func (r *recordingTelemetry) Duration(ctx context.Context, name string, d time.Duration, attrs ...telemetry.Attribute) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.timings = append(r.timings, recordedMeasurement{name: name, n: int64(d), attrs: attributeMap(attrs)})
+}
+
+func (r *recordingTelemetry) StartSpan(ctx context.Context, name string, attrs ...telemetry.Attribute) (context.Context, telemetry.Span) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, name)
+	return ctx, recordedSpan{r, name}
+}
+
+type recordedSpan struct {
+	r    *recordingTelemetry
+	name string
+}
+
+func (s recordedSpan) End(err error) {
+	s.r.mu.Lock()
+	defer s.r.mu.Unlock()
+	if s.r.spanErrs == nil {
+		s.r.spanErrs = make(map[string]error)
+	}
+	s.r.spanErrs[s.name] = err
+}
+
+// total sums the counts of name whose attributes include attrs
+func (r *recordingTelemetry) total(name string, attrs map[string]string) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var n int64
+	for _, c := range r.counts {
+		if c.name == name && matches(c.attrs, attrs) {
+			n += c.n
+		}
+	}
+	return n
+}
+
+// observed counts the durations recorded for name whose attributes include attrs
+func (r *recordingTelemetry) observed(name string, attrs map[string]string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var n int
+	for _, t := range r.timings {
+		if t.name == name && matches(t.attrs, attrs) {
+			n++
+		}
+	}
+	return n
+}
+
+func attributeMap(attrs []telemetry.Attribute) map[string]string {
+	m := make(map[string]string, len(attrs))
+	for _, a := range attrs {
+		m[a.Key] = a.Value
+	}
+	return m
+}
+
+func matches(got, want map[string]string) bool {
+	for k, v := range want {
+		if got[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func TestTelemetry_SetupFunnelAndSessions(t *testing.T) {
+	ctx := context.Background()
+	recorder := &recordingTelemetry{}
+	client, _ := newTestClient(t, SimpleConfig("test-service", "123456789012", "test-bucket"), withMockSTS(&mockSTSClient{}), WithTelemetry(recorder))
+
+	resp, err := client.GenerateSetupLinkWithContext(ctx, "customer-123", "Test Customer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CompleteSetup(ctx, &SetupCompleteRequest{CustomerID: "customer-123", RoleARN: testSetupRoleARN, ExternalID: "wrong", SetupToken: resp.SetupToken}); err == nil {
+		t.Fatal("CompleteSetup() with the wrong external ID should fail")
+	}
+	if err := client.CompleteSetup(ctx, &SetupCompleteRequest{CustomerID: "customer-123", RoleARN: testSetupRoleARN, ExternalID: resp.ExternalID, SetupToken: resp.SetupToken}); err != nil {
+		t.Fatalf("CompleteSetup() error = %v", err)
+	}
+
+	for stage, want := range map[string]int64{funnelLinkGenerated: 1, funnelSetupRejected: 1, funnelSetupCompleted: 1} {
+		if got := recorder.total(telemetry.SetupFunnel, map[string]string{"stage": stage}); got != want {
+			t.Errorf("funnel %s = %d, want %d", stage, got, want)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := client.AssumeRole(ctx, "customer-123"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := recorder.total(telemetry.SessionCacheRequests, map[string]string{"result": "miss"}); got != 1 {
+		t.Errorf("cache misses = %d, want 1", got)
+	}
+	if got := recorder.total(telemetry.SessionCacheRequests, map[string]string{"result": "hit"}); got != 2 {
+		t.Errorf("cache hits = %d, want 2", got)
+	}
+	if got := recorder.total(telemetry.SessionRefreshes, map[string]string{"source": "sts", "outcome": telemetry.OutcomeSuccess}); got != 1 {
+		t.Errorf("sts refreshes = %d, want 1", got)
+	}
+	// Setup validation plus the session above
+	if got := recorder.observed(telemetry.AssumeRoleDuration, map[string]string{"customer_id": "customer-123", "outcome": telemetry.OutcomeSuccess}); got != 2 {
+		t.Errorf("AssumeRole durations = %d, want 2", got)
+	}
+	if got := recorder.observed(telemetry.StorageDuration, map[string]string{"store": "sessions", "operation": "store", "outcome": telemetry.OutcomeSuccess}); got != 1 {
+		t.Errorf("session store durations = %d, want 1", got)
+	}
+	if got := recorder.observed(telemetry.StorageDuration, map[string]string{"store": "integrations", "operation": "get"}); got == 0 {
+		t.Error("integration lookups should be timed")
+	}
+	if got := recorder.observed(telemetry.StorageDuration, map[string]string{"store": "integrations", "operation": "get", "outcome": "not_found"}); got == 0 {
+		t.Error("a missing integration should be timed as not_found")
+	}
+}
+
+func TestTelemetry_AssumeRoleErrors(t *testing.T) {
+	ctx := context.Background()
+	recorder := &recordingTelemetry{}
+	mock := &mockSTSClient{}
+	client := newSessionTestClient(t, &testClock{now: time.Now()}, mock)
+	client.telemetry = recorder
+
+	mock.assumeRoleFunc = func(ctx context.Context, params *sts.AssumeRoleInput, optFns ...func(*sts.Options)) (*sts.AssumeRoleOutput, error) {
+		return nil, &smithy.GenericAPIError{Code: "AccessDenied", Message: "not authorized"}
+	}
+	if _, err := client.AssumeRole(ctx, "customer-123"); err == nil {
+		t.Fatal("AssumeRole() should fail")
+	}
+
+	if got := recorder.total(telemetry.AssumeRoleErrors, map[string]string{"customer_id": "customer-123", "error_class": string(FailureAccessDenied)}); got != 1 {
+		t.Errorf("access denied errors = %d, want 1", got)
+	}
+	if got := recorder.observed(telemetry.AssumeRoleDuration, map[string]string{"outcome": telemetry.OutcomeError}); got != 1 {
+		t.Errorf("failed AssumeRole durations = %d, want 1", got)
+	}
+	if got := recorder.total(telemetry.SessionRefreshes, map[string]string{"outcome": telemetry.OutcomeError}); got != 1 {
+		t.Errorf("failed refreshes = %d, want 1", got)
+	}
+	if recorder.spanErrs["crossaccount.AssumeRole"] == nil || recorder.spanErrs["sts.AssumeRole"] == nil {
+		t.Errorf("spans should end with the error: %v", recorder.spanErrs)
+	}
+}
@@ -0,0 +1,778 @@
+package crossaccount
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Template diagnostic codes
+const (
+	LintSyntax            = "syntax"
+	LintDuplicateKey      = "duplicate-key"
+	LintUnknownSection    = "unknown-section"
+	LintFormatVersion     = "format-version"
+	LintMissingResources  = "missing-resources"
+	LintInvalidResource   = "invalid-resource"
+	LintInvalidParameter  = "invalid-parameter"
+	LintUnusedParameter   = "unused-parameter"
+	LintUnknownIntrinsic  = "unknown-intrinsic"
+	LintInvalidIntrinsic  = "invalid-intrinsic"
+	LintUnresolvedRef     = "unresolved-ref"
+	LintUnknownCondition  = "unknown-condition"
+	LintPolicyVersion     = "policy-version"
+	LintPolicyStatement   = "policy-statement"
+	LintInvalidEffect     = "invalid-effect"
+	LintInvalidAction     = "invalid-action"
+	LintUnknownService    = "unknown-service"
+	LintWildcardResource  = "wildcard-resource"
+	LintMissingExternalID = "missing-external-id"
+)
+
+// TemplateDiagnostic is one problem found in a CloudFormation template
+type TemplateDiagnostic struct {
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	Severity string `json:"severity"` // SeverityError or SeverityWarning
+	Code     string `json:"code"`
+	Path     string `json:"path,omitempty"` // e.g. Resources.Role.Properties.Policies[0]
+	Message  string `json:"message"`
+}
+
+func (d TemplateDiagnostic) String() string {
+	return fmt.Sprintf("%d:%d: %s: %s (%s)", d.Line, d.Column, d.Severity, d.Message, d.Code)
+}
+
+// TemplateValidationError is returned by ValidateTemplate when a template
+// has error diagnostics
+type TemplateValidationError struct {
+	Diagnostics []TemplateDiagnostic
+}
+
+func (e *TemplateValidationError) Error() string {
+	var errs []string
+	for _, d := range e.Diagnostics {
+		if d.Severity == SeverityError {
+			errs = append(errs, d.String())
+		}
+	}
+	return "invalid template: " + strings.Join(errs, "; ")
+}
+
+// LintOptions tunes LintTemplate
+type LintOptions struct {
+	// AllowWildcardResource lists write actions, e.g. "s3:CreateBucket" or
+	// "ec2:Create*", that may be granted on Resource "*" without a warning
+	AllowWildcardResource []string
+}
+
+// LintTemplate parses a YAML or JSON CloudFormation template and checks it:
+// top-level sections, that Ref, Fn::Sub, Fn::GetAtt and conditions refer to
+// parameters, resources and conditions that exist, and the IAM policy
+// documents of IAM resources. Policies must use a valid Effect and well-formed
+// actions of known services, should not grant write actions on Resource "*"
+// or through NotResource unless allowlisted, must not Allow NotAction on
+// every resource, and cross-account trust policies must require an
+// external ID. Diagnostics are ordered by position
+func LintTemplate(templateContent string, opts LintOptions) []TemplateDiagnostic {
+	l := &templateLinter{
+		opts:       opts,
+		parameters: make(map[string]*yaml.Node),
+		resources:  make(map[string]string),
+		conditions: make(map[string]bool),
+		mappings:   make(map[string]bool),
+		used:       make(map[string]bool),
+	}
+	l.lint(templateContent)
+
+	sort.SliceStable(l.diagnostics, func(i, j int) bool {
+		a, b := l.diagnostics[i], l.diagnostics[j]
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+	return l.diagnostics
+}
+
+// templateSections are the top-level sections CloudFormation accepts
+var templateSections = map[string]bool{
+	"AWSTemplateFormatVersion": true,
+	"Description":              true,
+	"Metadata":                 true,
+	"Parameters":               true,
+	"Rules":                    true,
+	"Mappings":                 true,
+	"Conditions":               true,
+	"Transform":                true,
+	"Resources":                true,
+	"Outputs":                  true,
+}
+
+// pseudoParameters can be referenced without being declared
+var pseudoParameters = map[string]bool{
+	"AWS::AccountId":        true,
+	"AWS::NotificationARNs": true,
+	"AWS::NoValue":          true,
+	"AWS::Partition":        true,
+	"AWS::Region":           true,
+	"AWS::StackId":          true,
+	"AWS::StackName":        true,
+	"AWS::URLSuffix":        true,
+}
+
+// intrinsicFunctions are the functions that take arbitrary arguments and
+// are checked by walking them
+var intrinsicFunctions = map[string]bool{
+	"Fn::And":          true,
+	"Fn::Base64":       true,
+	"Fn::Cidr":         true,
+	"Fn::Equals":       true,
+	"Fn::FindInMap":    true,
+	"Fn::GetAZs":       true,
+	"Fn::ImportValue":  true,
+	"Fn::Join":         true,
+	"Fn::Length":       true,
+	"Fn::Not":          true,
+	"Fn::Or":           true,
+	"Fn::Select":       true,
+	"Fn::Split":        true,
+	"Fn::ToJsonString": true,
+	"Fn::Transform":    true,
+}
+
+// subVariablePattern matches ${Name} in Fn::Sub strings; ${!Literal} is
+// escaped
+var subVariablePattern = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+// yamlErrorLine extracts the line from a YAML syntax error
+var yamlErrorLine = regexp.MustCompile(`line (\d+)`)
+
+// templateLinter collects diagnostics for one template
+type templateLinter struct {
+	opts        LintOptions
+	parameters  map[string]*yaml.Node // Key nodes by name
+	resources   map[string]string     // Types by logical ID
+	conditions  map[string]bool
+	mappings    map[string]bool
+	used        map[string]bool // Referenced parameters
+	diagnostics []TemplateDiagnostic
+}
+
+func (l *templateLinter) report(n *yaml.Node, severity, code, where, format string, args ...interface{}) {
+	d := TemplateDiagnostic{Severity: severity, Code: code, Path: where, Message: fmt.Sprintf(format, args...)}
+	if n != nil {
+		d.Line, d.Column = n.Line, n.Column
+	}
+	l.diagnostics = append(l.diagnostics, d)
+}
+
+func (l *templateLinter) lint(content string) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(content), &doc); err != nil {
+		d := TemplateDiagnostic{Line: 1, Column: 1, Severity: SeverityError, Code: LintSyntax, Message: err.Error()}
+		if m := yamlErrorLine.FindStringSubmatch(err.Error()); m != nil {
+			d.Line, _ = strconv.Atoi(m[1])
+		}
+		l.diagnostics = append(l.diagnostics, d)
+		return
+	}
+	if len(doc.Content) == 0 {
+		l.report(nil, SeverityError, LintSyntax, "", "template is empty")
+		return
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		l.report(root, SeverityError, LintSyntax, "", "template must be a mapping of sections")
+		return
+	}
+
+	sections := make(map[string]*yaml.Node)
+	for _, entry := range l.entries(root, "") {
+		if !templateSections[entry.key.Value] {
+			l.report(entry.key, SeverityError, LintUnknownSection, entry.key.Value, "unknown template section %s", entry.key.Value)
+			continue
+		}
+		sections[entry.key.Value] = entry.value
+	}
+
+	if version := sections["AWSTemplateFormatVersion"]; version != nil && version.Value != "2010-09-09" {
+		l.report(version, SeverityError, LintFormatVersion, "AWSTemplateFormatVersion", "AWSTemplateFormatVersion must be 2010-09-09, not %q", version.Value)
+	}
+	resources := sections["Resources"]
+	if resources == nil || resources.Kind != yaml.MappingNode || len(resources.Content) == 0 {
+		at := resources
+		if at == nil {
+			at = root
+		}
+		l.report(at, SeverityError, LintMissingResources, "Resources", "template must declare at least one resource")
+	}
+
+	// Collect names first; sections can refer to each other in any order
+	parameterEntries := l.entries(sections["Parameters"], "Parameters")
+	for _, entry := range parameterEntries {
+		l.parameters[entry.key.Value] = entry.key
+	}
+	conditionEntries := l.entries(sections["Conditions"], "Conditions")
+	for _, entry := range conditionEntries {
+		l.conditions[entry.key.Value] = true
+	}
+	for _, entry := range l.entries(sections["Mappings"], "Mappings") {
+		l.mappings[entry.key.Value] = true
+	}
+	resourceEntries := l.entries(resources, "Resources")
+	for _, entry := range resourceEntries {
+		l.resources[entry.key.Value] = ""
+		if entry.value.Kind == yaml.MappingNode {
+			if t := mappingValue(entry.value, "Type"); t != nil {
+				l.resources[entry.key.Value] = t.Value
+			}
+		}
+	}
+
+	for _, entry := range parameterEntries {
+		where := "Parameters." + entry.key.Value
+		if entry.value.Kind != yaml.MappingNode || mappingValue(entry.value, "Type") == nil {
+			l.report(entry.key, SeverityError, LintInvalidParameter, where, "parameter %s must declare a Type", entry.key.Value)
+		}
+	}
+	for _, entry := range conditionEntries {
+		l.walk(entry.value, "Conditions."+entry.key.Value, nil)
+	}
+	for _, entry := range resourceEntries {
+		l.lintResource(entry.key, entry.value)
+	}
+	for _, entry := range l.entries(sections["Outputs"], "Outputs") {
+		where := "Outputs." + entry.key.Value
+		if entry.value.Kind != yaml.MappingNode || mappingValue(entry.value, "Value") == nil {
+			l.report(entry.key, SeverityError, LintInvalidResource, where, "output %s must have a Value", entry.key.Value)
+			continue
+		}
+		l.checkConditionName(mappingValue(entry.value, "Condition"), where)
+		l.walk(entry.value, where, nil)
+	}
+
+	for name, key := range l.parameters {
+		if !l.used[name] {
+			l.report(key, SeverityWarning, LintUnusedParameter, "Parameters."+name, "parameter %s is never referenced", name)
+		}
+	}
+}
+
+// lintResource checks a resource's attributes, references and policies
+func (l *templateLinter) lintResource(key, resource *yaml.Node) {
+	where := "Resources." + key.Value
+	if resource.Kind != yaml.MappingNode {
+		l.report(key, SeverityError, LintInvalidResource, where, "resource %s must be a mapping", key.Value)
+		return
+	}
+	resourceType := mappingValue(resource, "Type")
+	if resourceType == nil || resourceType.Value == "" {
+		l.report(key, SeverityError, LintInvalidResource, where, "resource %s must declare a Type", key.Value)
+	}
+
+	l.checkConditionName(mappingValue(resource, "Condition"), where)
+	if dependsOn := mappingValue(resource, "DependsOn"); dependsOn != nil {
+		targets := []*yaml.Node{dependsOn}
+		if dependsOn.Kind == yaml.SequenceNode {
+			targets = dependsOn.Content
+		}
+		for _, target := range targets {
+			if _, ok := l.resources[target.Value]; !ok {
+				l.report(target, SeverityError, LintUnresolvedRef, where+".DependsOn", "DependsOn refers to unknown resource %s", target.Value)
+			}
+		}
+	}
+
+	properties := mappingValue(resource, "Properties")
+	if properties != nil {
+		l.walk(properties, where+".Properties", nil)
+	}
+	if properties == nil || properties.Kind != yaml.MappingNode || resourceType == nil {
+		return
+	}
+
+	where += ".Properties"
+	switch resourceType.Value {
+	case "AWS::IAM::Role":
+		if trust := mappingValue(properties, "AssumeRolePolicyDocument"); trust != nil {
+			l.lintPolicy(trust, where+".AssumeRolePolicyDocument", true)
+		}
+		l.lintInlinePolicies(properties, where)
+	case "AWS::IAM::User", "AWS::IAM::Group":
+		l.lintInlinePolicies(properties, where)
+	case "AWS::IAM::Policy", "AWS::IAM::ManagedPolicy":
+		if document := mappingValue(properties, "PolicyDocument"); document != nil {
+			l.lintPolicy(document, where+".PolicyDocument", false)
+		}
+	}
+}
+
+// lintInlinePolicies checks the Policies property of a role, user or group
+func (l *templateLinter) lintInlinePolicies(properties *yaml.Node, where string) {
+	policies := mappingValue(properties, "Policies")
+	if policies == nil || policies.Kind != yaml.SequenceNode || isIntrinsic(policies) {
+		return
+	}
+	for i, policy := range policies.Content {
+		if policy.Kind != yaml.MappingNode {
+			continue
+		}
+		if document := mappingValue(policy, "PolicyDocument"); document != nil {
+			l.lintPolicy(document, fmt.Sprintf("%s.Policies[%d].PolicyDocument", where, i), false)
+		}
+	}
+}
+
+// walk checks the intrinsic functions in n. locals are the extra variables
+// of an enclosing Fn::Sub
+func (l *templateLinter) walk(n *yaml.Node, where string, locals map[string]bool) {
+	if n == nil {
+		return
+	}
+	if name, arg, ok := intrinsic(n); ok {
+		l.intrinsic(name, arg, n, where, locals)
+		return
+	}
+
+	switch n.Kind {
+	case yaml.MappingNode:
+		for _, entry := range l.entries(n, where) {
+			l.walk(entry.value, where+"."+entry.key.Value, locals)
+		}
+	case yaml.SequenceNode:
+		for i, child := range n.Content {
+			l.walk(child, fmt.Sprintf("%s[%d]", where, i), locals)
+		}
+	}
+}
+
+// intrinsic checks one intrinsic function call
+func (l *templateLinter) intrinsic(name string, arg, at *yaml.Node, where string, locals map[string]bool) {
+	where += "." + name
+	switch name {
+	case "Ref":
+		if arg.Kind != yaml.ScalarNode {
+			l.report(at, SeverityError, LintInvalidIntrinsic, where, "Ref takes a logical name")
+			return
+		}
+		l.checkRef(arg.Value, at, where, nil)
+
+	case "Condition":
+		l.checkConditionName(arg, where)
+
+	case "Fn::GetAtt":
+		var resource string
+		switch {
+		case arg.Kind == yaml.ScalarNode && strings.Contains(arg.Value, "."):
+			resource, _, _ = strings.Cut(arg.Value, ".")
+		case arg.Kind == yaml.SequenceNode && len(arg.Content) == 2 && arg.Content[0].Kind == yaml.ScalarNode:
+			resource = arg.Content[0].Value
+			l.walk(arg.Content[1], where, locals)
+		default:
+			l.report(at, SeverityError, LintInvalidIntrinsic, where, "Fn::GetAtt takes Resource.Attribute or [Resource, Attribute]")
+			return
+		}
+		if _, ok := l.resources[resource]; !ok {
+			l.report(at, SeverityError, LintUnresolvedRef, where, "Fn::GetAtt refers to unknown resource %s", resource)
+		}
+
+	case "Fn::Sub":
+		text := arg
+		vars := make(map[string]bool)
+		for name := range locals {
+			vars[name] = true
+		}
+		if arg.Kind == yaml.SequenceNode {
+			if len(arg.Content) != 2 || arg.Content[1].Kind != yaml.MappingNode {
+				l.report(at, SeverityError, LintInvalidIntrinsic, where, "Fn::Sub takes a string or [string, variables]")
+				return
+			}
+			text = arg.Content[0]
+			for _, entry := range l.entries(arg.Content[1], where) {
+				vars[entry.key.Value] = true
+				l.walk(entry.value, where+"."+entry.key.Value, locals)
+			}
+		}
+		if text.Kind != yaml.ScalarNode || isIntrinsic(text) {
+			l.report(at, SeverityError, LintInvalidIntrinsic, where, "Fn::Sub takes a string")
+			return
+		}
+		for _, m := range subVariablePattern.FindAllStringSubmatch(text.Value, -1) {
+			variable := strings.TrimSpace(m[1])
+			if strings.HasPrefix(variable, "!") {
+				continue // Escaped literal
+			}
+			if resource, _, ok := strings.Cut(variable, "."); ok && !vars[variable] {
+				if _, found := l.resources[resource]; !found {
+					l.report(at, SeverityError, LintUnresolvedRef, where, "Fn::Sub refers to unknown resource %s", resource)
+				}
+				continue
+			}
+			l.checkRef(variable, at, where, vars)
+		}
+
+	case "Fn::If":
+		if arg.Kind != yaml.SequenceNode || len(arg.Content) != 3 {
+			l.report(at, SeverityError, LintInvalidIntrinsic, where, "Fn::If takes [condition, value if true, value if false]")
+			return
+		}
+		l.checkConditionName(arg.Content[0], where)
+		l.walk(arg.Content[1], where+"[1]", locals)
+		l.walk(arg.Content[2], where+"[2]", locals)
+
+	case "Fn::FindInMap":
+		if arg.Kind == yaml.SequenceNode && len(arg.Content) > 0 {
+			if first := arg.Content[0]; !isIntrinsic(first) && first.Kind == yaml.ScalarNode && !l.mappings[first.Value] {
+				l.report(first, SeverityError, LintUnresolvedRef, where, "Fn::FindInMap refers to unknown mapping %s", first.Value)
+			}
+		}
+		l.walkArgs(arg, where, locals)
+
+	default:
+		if !intrinsicFunctions[name] {
+			l.report(at, SeverityError, LintUnknownIntrinsic, where, "unknown intrinsic function %s", name)
+			return
+		}
+		l.walkArgs(arg, where, locals)
+	}
+}
+
+// walkArgs checks the arguments of an intrinsic function
+func (l *templateLinter) walkArgs(arg *yaml.Node, where string, locals map[string]bool) {
+	if arg.Kind == yaml.SequenceNode {
+		for i, child := range arg.Content {
+			l.walk(child, fmt.Sprintf("%s[%d]", where, i), locals)
+		}
+		return
+	}
+	if arg.Kind == yaml.MappingNode {
+		l.walk(arg, where, locals)
+	}
+}
+
+// checkRef reports a reference to anything but a parameter, resource,
+// pseudo parameter or Fn::Sub variable
+func (l *templateLinter) checkRef(name string, at *yaml.Node, where string, vars map[string]bool) {
+	if _, ok := l.parameters[name]; ok {
+		l.used[name] = true
+		return
+	}
+	if _, ok := l.resources[name]; ok || pseudoParameters[name] || vars[name] {
+		return
+	}
+	l.report(at, SeverityError, LintUnresolvedRef, where, "%s is not a parameter, resource or pseudo parameter", name)
+}
+
+// checkConditionName reports a condition name that isn't declared
+func (l *templateLinter) checkConditionName(n *yaml.Node, where string) {
+	if n == nil {
+		return
+	}
+	if n.Kind != yaml.ScalarNode || isIntrinsic(n) {
+		l.report(n, SeverityError, LintInvalidIntrinsic, where, "condition must be a condition name")
+		return
+	}
+	if !l.conditions[n.Value] {
+		l.report(n, SeverityError, LintUnknownCondition, where, "unknown condition %s", n.Value)
+	}
+}
+
+// lintPolicy checks an IAM policy document. Trust policies must require an
+// external ID from AWS account principals
+func (l *templateLinter) lintPolicy(document *yaml.Node, where string, trust bool) {
+	if document.Kind != yaml.MappingNode || isIntrinsic(document) {
+		return // Built at deploy time
+	}
+	if version := mappingValue(document, "Version"); version != nil && !isIntrinsic(version) &&
+		version.Value != "2012-10-17" && version.Value != "2008-10-17" {
+		l.report(version, SeverityWarning, LintPolicyVersion, where+".Version", "policy version should be 2012-10-17, not %q", version.Value)
+	}
+
+	statements := mappingValue(document, "Statement")
+	if statements == nil {
+		l.report(document, SeverityError, LintPolicyStatement, where, "policy has no Statement")
+		return
+	}
+	if isIntrinsic(statements) {
+		return
+	}
+	if statements.Kind == yaml.MappingNode {
+		l.lintStatement(statements, where+".Statement", trust)
+		return
+	}
+	for i, statement := range statements.Content {
+		l.lintStatement(statement, fmt.Sprintf("%s.Statement[%d]", where, i), trust)
+	}
+}
+
+// lintStatement checks one policy statement
+func (l *templateLinter) lintStatement(statement *yaml.Node, where string, trust bool) {
+	if statement.Kind != yaml.MappingNode || isIntrinsic(statement) {
+		return
+	}
+
+	effect := mappingValue(statement, "Effect")
+	switch {
+	case effect == nil:
+		l.report(statement, SeverityError, LintPolicyStatement, where, "statement has no Effect")
+	case !isIntrinsic(effect) && effect.Value != "Allow" && effect.Value != "Deny":
+		l.report(effect, SeverityError, LintInvalidEffect, where+".Effect", "Effect must be Allow or Deny, not %q", effect.Value)
+	}
+
+	actionKey, actions := "Action", mappingValue(statement, "Action")
+	if actions == nil {
+		actionKey, actions = "NotAction", mappingValue(statement, "NotAction")
+	}
+	if actions == nil {
+		l.report(statement, SeverityError, LintPolicyStatement, where, "statement has no Action or NotAction")
+		return
+	}
+	var writes []*yaml.Node
+	for _, action := range scalars(actions) {
+		if action.Value == "*" {
+			writes = append(writes, action)
+			continue
+		}
+		service, name, ok := strings.Cut(action.Value, ":")
+		if !ok || !actionPattern.MatchString(action.Value) {
+			l.report(action, SeverityError, LintInvalidAction, where+"."+actionKey, "action %q must look like service:Action", action.Value)
+			continue
+		}
+		if !knownServicePrefixes[strings.ToLower(service)] {
+			l.report(action, SeverityWarning, LintUnknownService, where+"."+actionKey, "unknown service prefix %q in %s", service, action.Value)
+		}
+		if !readOnlyAction(name) {
+			writes = append(writes, action)
+		}
+	}
+
+	if trust {
+		l.lintTrustStatement(statement, effect, where)
+		return
+	}
+
+	resourceKey, resources := "Resource", mappingValue(statement, "Resource")
+	if resources == nil {
+		resourceKey, resources = "NotResource", mappingValue(statement, "NotResource")
+	}
+	if resources == nil {
+		l.report(statement, SeverityError, LintPolicyStatement, where, "statement has no Resource or NotResource")
+		return
+	}
+	if effect != nil && effect.Value == "Deny" {
+		return
+	}
+
+	// NotResource covers every resource it doesn't list, like "*"
+	var wildcard *yaml.Node
+	if resourceKey == "NotResource" {
+		wildcard = resources
+	}
+	for _, resource := range scalars(resources) {
+		if resourceKey == "Resource" && resource.Value == "*" {
+			wildcard = resource
+		}
+	}
+	if wildcard == nil {
+		return
+	}
+	if actionKey == "NotAction" {
+		// Every action it doesn't list, writes included
+		l.report(actions, SeverityError, LintWildcardResource, where+".NotAction", "NotAction allows every other action on every resource")
+		return
+	}
+	for _, action := range writes {
+		if !l.wildcardAllowed(action.Value) {
+			l.report(wildcard, SeverityWarning, LintWildcardResource, where+"."+resourceKey, "write action %s is granted on every resource", action.Value)
+		}
+	}
+}
+
+// lintTrustStatement reports statements that let AWS accounts assume the
+// role without an external ID
+func (l *templateLinter) lintTrustStatement(statement, effect *yaml.Node, where string) {
+	if effect == nil || effect.Value != "Allow" {
+		return
+	}
+	principal := mappingValue(statement, "Principal")
+	if principal == nil {
+		return
+	}
+	crossAccount := principal.Kind == yaml.ScalarNode && principal.Value == "*"
+	if principal.Kind == yaml.MappingNode && mappingValue(principal, "AWS") != nil {
+		crossAccount = true
+	}
+	if !crossAccount {
+		return // Service and federated principals don't use external IDs
+	}
+
+	if condition := mappingValue(statement, "Condition"); condition != nil && condition.Kind == yaml.MappingNode {
+		for i := 1; i < len(condition.Content); i += 2 {
+			operator := condition.Content[i]
+			if operator.Kind != yaml.MappingNode {
+				continue
+			}
+			for j := 0; j < len(operator.Content); j += 2 {
+				if strings.EqualFold(operator.Content[j].Value, "sts:ExternalId") {
+					return
+				}
+			}
+		}
+	}
+	l.report(statement, SeverityError, LintMissingExternalID, where, "trust policy lets AWS accounts assume the role without an sts:ExternalId condition")
+}
+
+// wildcardAllowed reports whether action is allowlisted for Resource "*"
+func (l *templateLinter) wildcardAllowed(action string) bool {
+	for _, pattern := range l.opts.AllowWildcardResource {
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(action)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// templateEntry is a key and value of a mapping
+type templateEntry struct {
+	key, value *yaml.Node
+}
+
+// entries returns the entries of a mapping, reporting duplicate keys
+func (l *templateLinter) entries(n *yaml.Node, where string) []templateEntry {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil
+	}
+	seen := make(map[string]bool)
+	entries := make([]templateEntry, 0, len(n.Content)/2)
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key := n.Content[i]
+		if seen[key.Value] {
+			l.report(key, SeverityError, LintDuplicateKey, where, "duplicate key %s", key.Value)
+			continue
+		}
+		seen[key.Value] = true
+		entries = append(entries, templateEntry{key: key, value: n.Content[i+1]})
+	}
+	return entries
+}
+
+// mappingValue returns the value of key in a mapping, or nil
+func mappingValue(n *yaml.Node, key string) *yaml.Node {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// intrinsic recognizes a short form (!Ref x) or long form ({Ref: x}) call
+// and returns the function's full name and argument
+func intrinsic(n *yaml.Node) (string, *yaml.Node, bool) {
+	if isIntrinsic(n) {
+		name := strings.TrimPrefix(n.Tag, "!")
+		if name != "Ref" && name != "Condition" {
+			name = "Fn::" + name
+		}
+		arg := *n
+		arg.Tag = ""
+		return name, &arg, true
+	}
+	if n.Kind == yaml.MappingNode && len(n.Content) == 2 {
+		key := n.Content[0].Value
+		if key == "Ref" || strings.HasPrefix(key, "Fn::") {
+			return key, n.Content[1], true
+		}
+	}
+	return "", nil, false
+}
+
+// isIntrinsic reports whether n has a short form function tag
+func isIntrinsic(n *yaml.Node) bool {
+	return strings.HasPrefix(n.Tag, "!") && !strings.HasPrefix(n.Tag, "!!")
+}
+
+// scalars returns the literal values of a string or list of strings.
+// Values computed by intrinsic functions are skipped
+func scalars(n *yaml.Node) []*yaml.Node {
+	if isIntrinsic(n) {
+		return nil
+	}
+	if n.Kind == yaml.ScalarNode {
+		return []*yaml.Node{n}
+	}
+	var values []*yaml.Node
+	if n.Kind == yaml.SequenceNode {
+		for _, child := range n.Content {
+			if child.Kind == yaml.ScalarNode && !isIntrinsic(child) {
+				values = append(values, child)
+			}
+		}
+	}
+	return values
+}
+
+// actionPattern is the shape of an IAM action, wildcards allowed
+var actionPattern = regexp.MustCompile(`^[a-zA-Z0-9-]+:[a-zA-Z0-9*?]+$`)
+
+// readOnlyPrefixes start the names of actions that don't change resources
+var readOnlyPrefixes = []string{"Get", "List", "Describe", "Head", "BatchGet", "Lookup", "Search", "Select", "Query", "Scan", "View", "Download"}
+
+// readOnlyAction reports whether an action name, which may have wildcards,
+// only matches read actions
+func readOnlyAction(name string) bool {
+	literal, _, _ := strings.Cut(name, "*")
+	literal, _, _ = strings.Cut(literal, "?")
+	for _, prefix := range readOnlyPrefixes {
+		if strings.HasPrefix(strings.ToLower(literal), strings.ToLower(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// knownServicePrefixes are the IAM service prefixes actions are checked
+// against. Actions of other services get a warning, not an error
+var knownServicePrefixes = map[string]bool{
+	"access-analyzer": true, "acm": true, "acm-pca": true, "airflow": true, "amplify": true,
+	"apigateway": true, "appconfig": true, "application-autoscaling": true, "appmesh": true,
+	"apprunner": true, "appsync": true, "athena": true, "autoscaling": true, "backup": true,
+	"batch": true, "bedrock": true, "budgets": true, "ce": true, "cloud9": true,
+	"cloudformation": true, "cloudfront": true, "cloudhsm": true, "cloudshell": true,
+	"cloudtrail": true, "cloudwatch": true, "codeartifact": true, "codebuild": true,
+	"codecommit": true, "codedeploy": true, "codepipeline": true, "codestar-connections": true,
+	"cognito-identity": true, "cognito-idp": true, "comprehend": true, "config": true,
+	"cur": true, "databrew": true, "datasync": true, "dax": true, "detective": true,
+	"directconnect": true, "dms": true, "ds": true, "dynamodb": true, "ebs": true, "ec2": true,
+	"ec2messages": true, "ecr": true, "ecs": true, "eks": true, "elasticache": true,
+	"elasticbeanstalk": true, "elasticfilesystem": true, "elasticloadbalancing": true,
+	"elasticmapreduce": true, "emr-containers": true, "emr-serverless": true, "es": true,
+	"events": true, "firehose": true, "fis": true, "fms": true, "fsx": true, "glacier": true,
+	"globalaccelerator": true, "glue": true, "grafana": true, "guardduty": true, "health": true,
+	"iam": true, "identitystore": true, "imagebuilder": true, "inspector2": true, "iot": true,
+	"kafka": true, "kendra": true, "kinesis": true, "kinesisanalytics": true, "kms": true,
+	"lakeformation": true, "lambda": true, "logs": true, "macie2": true, "mediaconvert": true,
+	"memorydb": true, "mq": true, "network-firewall": true, "networkmanager": true,
+	"organizations": true, "pi": true, "pricing": true, "quicksight": true, "ram": true,
+	"rds": true, "rds-data": true, "redshift": true, "redshift-data": true,
+	"redshift-serverless": true, "rekognition": true, "resource-explorer-2": true,
+	"resource-groups": true, "route53": true, "route53domains": true, "route53resolver": true,
+	"s3": true, "s3-object-lambda": true, "sagemaker": true, "savingsplans": true,
+	"scheduler": true, "secretsmanager": true, "securityhub": true, "servicecatalog": true,
+	"servicediscovery": true, "servicequotas": true, "ses": true, "shield": true,
+	"signer": true, "sns": true, "sqs": true, "ssm": true, "ssmmessages": true, "sso": true,
+	"states": true, "storagegateway": true, "sts": true, "support": true, "swf": true,
+	"synthetics": true, "tag": true, "textract": true, "timestream": true, "transcribe": true,
+	"transfer": true, "translate": true, "trustedadvisor": true, "waf": true,
+	"waf-regional": true, "wafv2": true, "wellarchitected": true, "workspaces": true,
+	"xray": true,
+}
@@ -0,0 +1,293 @@
+package crossaccount
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// lintBase is a valid template that tests append resources to
+const lintBase = `AWSTemplateFormatVersion: '2010-09-09'
+Parameters:
+  ExternalId:
+    Type: String
+    NoEcho: true
+Conditions:
+  HasExternalId: !Not [!Equals [!Ref ExternalId, '']]
+Resources:
+  Role:
+    Type: AWS::IAM::Role
+    Properties:
+      AssumeRolePolicyDocument:
+        Version: '2012-10-17'
+        Statement:
+          - Effect: Allow
+            Principal:
+              AWS: !Sub 'arn:${AWS::Partition}:iam::123456789012:root'
+            Action: 'sts:AssumeRole'
+            Condition:
+              StringEquals:
+                'sts:ExternalId': !If [HasExternalId, !Ref ExternalId, !Ref AWS::NoValue]
+`
+
+func TestLintTemplate(t *testing.T) {
+	if diagnostics := LintTemplate(lintBase, LintOptions{}); len(diagnostics) != 0 {
+		t.Fatalf("valid template has diagnostics: %v", diagnostics)
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		code     string
+		severity string
+		line     int
+	}{
+		{
+			name:     "syntax error",
+			template: "Resources:\n  Role: [\n",
+			code:     LintSyntax,
+			severity: SeverityError,
+			line:     2,
+		},
+		{
+			name:     "missing resources",
+			template: "AWSTemplateFormatVersion: '2010-09-09'\nOutputs: {}\n",
+			code:     LintMissingResources,
+			severity: SeverityError,
+			line:     1,
+		},
+		{
+			name:     "unknown section",
+			template: lintBase + "Output:\n  Arn:\n    Value: !GetAtt Role.Arn\n",
+			code:     LintUnknownSection,
+			severity: SeverityError,
+			line:     22,
+		},
+		{
+			name:     "unresolved ref",
+			template: lintBase + "Outputs:\n  Id:\n    Value: !Ref ExternalID\n",
+			code:     LintUnresolvedRef,
+			severity: SeverityError,
+			line:     24,
+		},
+		{
+			name:     "unresolved sub variable",
+			template: lintBase + "Outputs:\n  Arn:\n    Value: !Sub '${Rol.Arn}'\n",
+			code:     LintUnresolvedRef,
+			severity: SeverityError,
+			line:     24,
+		},
+		{
+			name:     "unknown getatt resource",
+			template: lintBase + "Outputs:\n  Arn:\n    Value:\n      Fn::GetAtt: [Missing, Arn]\n",
+			code:     LintUnresolvedRef,
+			severity: SeverityError,
+			line:     25,
+		},
+		{
+			name:     "unknown condition",
+			template: lintBase + "Outputs:\n  Arn:\n    Condition: HasRole\n    Value: !GetAtt Role.Arn\n",
+			code:     LintUnknownCondition,
+			severity: SeverityError,
+			line:     24,
+		},
+		{
+			name:     "unknown intrinsic",
+			template: lintBase + "Outputs:\n  Arn:\n    Value: !GetArn Role\n",
+			code:     LintUnknownIntrinsic,
+			severity: SeverityError,
+			line:     24,
+		},
+		{
+			name: "invalid effect",
+			template: lintBase + `  Policy:
+    Type: AWS::IAM::Policy
+    Properties:
+      PolicyName: test
+      Roles: [!Ref Role]
+      PolicyDocument:
+        Version: '2012-10-17'
+        Statement:
+          - Effect: allow
+            Action: 's3:GetObject'
+            Resource: '*'
+`,
+			code:     LintInvalidEffect,
+			severity: SeverityError,
+			line:     30,
+		},
+		{
+			name: "malformed action",
+			template: lintBase + `  Policy:
+    Type: AWS::IAM::ManagedPolicy
+    Properties:
+      PolicyDocument: {"Version": "2012-10-17", "Statement": [{"Effect": "Allow", "Action": ["s3 GetObject"], "Resource": "*"}]}
+`,
+			code:     LintInvalidAction,
+			severity: SeverityError,
+			line:     25,
+		},
+		{
+			name: "unknown service",
+			template: lintBase + `  Policy:
+    Type: AWS::IAM::ManagedPolicy
+    Properties:
+      PolicyDocument:
+        Statement:
+          Effect: Allow
+          Action: 'ec3:DescribeInstances'
+          Resource: '*'
+`,
+			code:     LintUnknownService,
+			severity: SeverityWarning,
+			line:     28,
+		},
+		{
+			name: "write action on every resource",
+			template: lintBase + `      Policies:
+        - PolicyName: setup
+          PolicyDocument:
+            Version: '2012-10-17'
+            Statement:
+              - Effect: Allow
+                Action: ['s3:GetObject', 's3:DeleteBucket']
+                Resource: '*'
+`,
+			code:     LintWildcardResource,
+			severity: SeverityWarning,
+			line:     29,
+		},
+		{
+			name: "not action on every resource",
+			template: lintBase + `      Policies:
+        - PolicyName: setup
+          PolicyDocument:
+            Version: '2012-10-17'
+            Statement:
+              - Effect: Allow
+                NotAction: ['s3:GetObject']
+                Resource: '*'
+`,
+			code:     LintWildcardResource,
+			severity: SeverityError,
+			line:     28,
+		},
+		{
+			name: "write action through not resource",
+			template: lintBase + `      Policies:
+        - PolicyName: setup
+          PolicyDocument:
+            Version: '2012-10-17'
+            Statement:
+              - Effect: Allow
+                Action: 's3:DeleteBucket'
+                NotResource: 'arn:aws:s3:::audit-logs'
+`,
+			code:     LintWildcardResource,
+			severity: SeverityWarning,
+			line:     29,
+		},
+		{
+			name: "trust policy without external ID",
+			template: strings.Replace(lintBase, `            Condition:
+              StringEquals:
+                'sts:ExternalId': !If [HasExternalId, !Ref ExternalId, !Ref AWS::NoValue]
+`, "", 1),
+			code:     LintMissingExternalID,
+			severity: SeverityError,
+			line:     15,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diagnostics := LintTemplate(tt.template, LintOptions{})
+			for _, d := range diagnostics {
+				if d.Code == tt.code {
+					if d.Severity != tt.severity || d.Line != tt.line {
+						t.Errorf("diagnostic = %v, want %s at line %d", d, tt.severity, tt.line)
+					}
+					return
+				}
+			}
+			t.Errorf("no %s diagnostic in %v", tt.code, diagnostics)
+		})
+	}
+}
+
+func TestLintTemplateOptions(t *testing.T) {
+	template := lintBase + `      Policies:
+        - PolicyName: setup
+          PolicyDocument:
+            Version: '2012-10-17'
+            Statement:
+              - Effect: Allow
+                Action: ['ec2:CreateVpc', 'ec2:Describe*']
+                Resource: '*'
+`
+	if diagnostics := LintTemplate(template, LintOptions{AllowWildcardResource: []string{"EC2:Create*"}}); len(diagnostics) != 0 {
+		t.Errorf("allowlisted action has diagnostics: %v", diagnostics)
+	}
+
+	// Unused parameters are only a warning
+	unused := strings.Replace(lintBase, "Conditions:", "  Region:\n    Type: String\nConditions:", 1)
+	diagnostics := LintTemplate(unused, LintOptions{})
+	if len(diagnostics) != 1 || diagnostics[0].Code != LintUnusedParameter || diagnostics[0].Severity != SeverityWarning {
+		t.Errorf("diagnostics = %v", diagnostics)
+	}
+	if err := ValidateTemplate(unused); err != nil {
+		t.Errorf("ValidateTemplate() should ignore warnings: %v", err)
+	}
+}
+
+func TestValidateTemplate(t *testing.T) {
+	// JSON templates use the long form of intrinsic functions
+	valid := `{
+  "Parameters": {"Bucket": {"Type": "String"}},
+  "Resources": {"Policy": {"Type": "AWS::IAM::ManagedPolicy", "Properties": {"PolicyDocument": {
+    "Version": "2012-10-17",
+    "Statement": [{"Effect": "Allow", "Action": "s3:GetObject", "Resource": {"Fn::Sub": "arn:${AWS::Partition}:s3:::${Bucket}/*"}}]
+  }}}}
+}`
+	if err := ValidateTemplate(valid); err != nil {
+		t.Errorf("ValidateTemplate() error = %v", err)
+	}
+
+	err := ValidateTemplate(strings.Replace(valid, "${Bucket}", "${BucketName}", 1))
+	var validationErr *TemplateValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("ValidateTemplate() error = %v, want TemplateValidationError", err)
+	}
+	last := validationErr.Diagnostics[len(validationErr.Diagnostics)-1]
+	if !strings.Contains(err.Error(), "BucketName") || last.Code != LintUnresolvedRef || last.Line != 5 {
+		t.Errorf("error = %v, diagnostics = %v", err, validationErr.Diagnostics)
+	}
+
+	if err := ValidateTemplate(""); err == nil {
+		t.Error("ValidateTemplate() should reject an empty template")
+	}
+}
+
+func TestGeneratedTemplatesValidate(t *testing.T) {
+	cfg := QuickConfig("compute-platform", "test-service", "123456789012", "test-bucket")
+	cfg.SetupCallbackTopicARN = testCallbackTopicARN
+	client, _ := newTestClient(t, cfg)
+
+	role, err := client.GenerateCloudFormationTemplate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	member, _, err := client.currentOrgMemberTemplate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	management, _, err := client.currentOrgManagementTemplate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, body := range map[string]string{"role": role, "org member": member, "org management": management, "iam user": getIAMUserTemplate()} {
+		if err := ValidateTemplate(body); err != nil {
+			t.Errorf("%s template: %v", name, err)
+		}
+	}
+}
@@ -3,9 +3,16 @@ package crossaccount
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"embed"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"strings"
 	"text/template"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
 // Embed the CloudFormation templates
@@ -14,31 +21,47 @@ var templateFiles embed.FS
 
 // GenerateCloudFormationTemplate creates a CloudFormation template for cross-account role
 func (c *Client) GenerateCloudFormationTemplate() (string, error) {
-	// For now, use the embedded template from the file we created
-	templateStr := getCrossAccountTemplate()
+	return c.renderCrossAccountTemplate(c.config.ServiceName, c.config.ServiceAccountID, c.config.OngoingPermissions, false)
+}
 
-	// Parse template
-	tmpl, err := template.New("crossaccount").Parse(templateStr)
+// GenerateCustomTemplate creates a customized CloudFormation template
+func (c *Client) GenerateCustomTemplate(serviceName, serviceAccountID string, permissions []Permission) (string, error) {
+	return c.renderCrossAccountTemplate(serviceName, serviceAccountID, permissions, false)
+}
+
+// renderCrossAccountTemplate renders the cross-account role template with
+// the given ongoing permissions and the configured setup permissions. The
+// orgMember variant is deployed by an organization's StackSet: it can derive
+// a per-account external ID and has no setup callback
+func (c *Client) renderCrossAccountTemplate(serviceName, serviceAccountID string, ongoing []Permission, orgMember bool) (string, error) {
+	tmpl, err := template.New("crossaccount").Funcs(template.FuncMap{
+		"policyJSON": policyDocumentJSON,
+	}).Parse(getCrossAccountTemplate())
 	if err != nil {
 		return "", fmt.Errorf("failed to parse template: %w", err)
 	}
 
-	// Prepare template data
 	data := struct {
-		ServiceName             string
-		ServiceAccountID        string
-		SessionDurationSeconds  int
-		OngoingPermissions      []Permission
-		SetupPermissions        []Permission
+		ServiceName            string
+		ServiceAccountID       string
+		SessionDurationSeconds int
+		OngoingPermissions     []Permission
+		SetupPermissions       []Permission
+		SetupCallbackTopicARN  string
+		OrgMember              bool
 	}{
-		ServiceName:             c.config.ServiceName,
-		ServiceAccountID:        c.config.ServiceAccountID,
-		SessionDurationSeconds:  int(c.config.SessionDuration.Seconds()),
-		OngoingPermissions:      c.config.OngoingPermissions,
-		SetupPermissions:        c.config.SetupPermissions,
+		ServiceName:            serviceName,
+		ServiceAccountID:       serviceAccountID,
+		SessionDurationSeconds: c.maxSessionSeconds(),
+		OngoingPermissions:     ongoing,
+		SetupPermissions:       c.config.SetupPermissions,
+		SetupCallbackTopicARN:  c.config.SetupCallbackTopicARN,
+		OrgMember:              orgMember,
+	}
+	if orgMember {
+		data.SetupCallbackTopicARN = ""
 	}
 
-	// Execute template
 	var buf bytes.Buffer
 	if err := tmpl.Execute(&buf, data); err != nil {
 		return "", fmt.Errorf("failed to execute template: %w", err)
@@ -47,59 +70,184 @@ func (c *Client) GenerateCloudFormationTemplate() (string, error) {
 	return buf.String(), nil
 }
 
-// GenerateCustomTemplate creates a customized CloudFormation template
-func (c *Client) GenerateCustomTemplate(serviceName, serviceAccountID string, permissions []Permission) (string, error) {
-	templateStr := getCrossAccountTemplate()
+// maxSessionSeconds is the role's maximum session duration. IAM only
+// accepts values between 1 and 12 hours
+func (c *Client) maxSessionSeconds() int {
+	sessionSeconds := int(c.config.SessionDuration.Seconds())
+	if sessionSeconds < 3600 {
+		sessionSeconds = 3600
+	}
+	if sessionSeconds > 43200 {
+		sessionSeconds = 43200
+	}
+	return sessionSeconds
+}
 
-	tmpl, err := template.New("custom").Parse(templateStr)
+// policyDocumentJSON renders permissions as an IAM policy document
+// JSON is valid YAML, so the result can be embedded in the template directly
+func policyDocumentJSON(permissions []Permission) (string, error) {
+	type statement struct {
+		Sid       string                 `json:"Sid,omitempty"`
+		Effect    string                 `json:"Effect"`
+		Action    []string               `json:"Action"`
+		Resource  []string               `json:"Resource"`
+		Condition map[string]interface{} `json:"Condition,omitempty"`
+	}
+
+	doc := struct {
+		Version   string      `json:"Version"`
+		Statement []statement `json:"Statement"`
+	}{Version: "2012-10-17"}
+
+	for _, p := range permissions {
+		effect := p.Effect
+		if effect == "" {
+			effect = "Allow"
+		}
+		resources := p.Resources
+		if len(resources) == 0 {
+			resources = []string{"*"}
+		}
+		doc.Statement = append(doc.Statement, statement{
+			Sid:       p.Sid,
+			Effect:    effect,
+			Action:    p.Actions,
+			Resource:  resources,
+			Condition: p.Condition,
+		})
+	}
+
+	data, err := json.Marshal(doc)
 	if err != nil {
-		return "", fmt.Errorf("failed to parse template: %w", err)
+		return "", fmt.Errorf("failed to encode policy document: %w", err)
 	}
+	return string(data), nil
+}
 
-	data := struct {
-		ServiceName             string
-		ServiceAccountID        string
-		SessionDurationSeconds  int
-		OngoingPermissions      []Permission
-		SetupPermissions        []Permission
-	}{
-		ServiceName:             serviceName,
-		ServiceAccountID:        serviceAccountID,
-		SessionDurationSeconds:  int(c.config.SessionDuration.Seconds()),
-		OngoingPermissions:      permissions,
-		SetupPermissions:        c.config.SetupPermissions,
+// uploadTemplate publishes the rendered CloudFormation template to S3 and
+// returns the URL to launch it from along with the template version. Objects
+// are keyed by a hash of their content, so links keep pointing at the exact
+// permissions they were generated with and identical templates are uploaded
+// only once
+func (c *Client) uploadTemplate(ctx context.Context) (string, string, error) {
+	body, version, err := c.currentTemplate()
+	if err != nil {
+		return "", "", err
 	}
 
-	var buf bytes.Buffer
-	if err := tmpl.Execute(&buf, data); err != nil {
-		return "", fmt.Errorf("failed to execute template: %w", err)
+	templateURL, err := c.publishTemplate(ctx, "cross-account-role", body, version)
+	return templateURL, version, err
+}
+
+// publishTemplate uploads a template body under a key made of name and
+// version, once per client, and returns the URL to launch it from
+func (c *Client) publishTemplate(ctx context.Context, name, body, version string) (string, error) {
+	key := fmt.Sprintf("%s%s-%s-%s.yaml",
+		c.config.TemplateKeyPrefix, c.config.ServiceName, name, version)
+
+	s3Client, err := c.templateS3Client(ctx)
+	if err != nil {
+		return "", err
 	}
 
-	return buf.String(), nil
+	c.templateMu.Lock()
+	published := c.publishedTemplate[key]
+	c.templateMu.Unlock()
+
+	if !published {
+		input := &s3.PutObjectInput{
+			Bucket:       aws.String(c.config.TemplateS3Bucket),
+			Key:          aws.String(key),
+			Body:         strings.NewReader(body),
+			ContentType:  aws.String("text/yaml"),
+			CacheControl: aws.String("public, max-age=31536000, immutable"),
+		}
+		if c.config.TemplateBucketOwner != "" {
+			input.ExpectedBucketOwner = aws.String(c.config.TemplateBucketOwner)
+		}
+
+		if _, err := s3Client.PutObject(ctx, input); err != nil {
+			c.logger.WarnContext(ctx, "template upload failed", "bucket", c.config.TemplateS3Bucket, "key", key, "error", err)
+			return "", fmt.Errorf("failed to upload template to s3://%s/%s: %w", c.config.TemplateS3Bucket, key, err)
+		}
+
+		c.templateMu.Lock()
+		c.publishedTemplate[key] = true
+		c.templateMu.Unlock()
+
+		c.logger.InfoContext(ctx, "published CloudFormation template", "bucket", c.config.TemplateS3Bucket, "key", key)
+	}
+
+	if c.config.PresignTemplateURLs {
+		input := &s3.GetObjectInput{
+			Bucket: aws.String(c.config.TemplateS3Bucket),
+			Key:    aws.String(key),
+		}
+		if c.config.TemplateBucketOwner != "" {
+			input.ExpectedBucketOwner = aws.String(c.config.TemplateBucketOwner)
+		}
+
+		req, err := s3.NewPresignClient(s3Client).PresignGetObject(ctx, input,
+			s3.WithPresignExpires(c.config.TemplateURLExpiration))
+		if err != nil {
+			return "", fmt.Errorf("failed to presign template URL: %w", err)
+		}
+		return req.URL, nil
+	}
+
+	return c.templateObjectURL(s3Client, key), nil
 }
 
-// uploadTemplate uploads CloudFormation template to S3
-func (c *Client) uploadTemplate(ctx context.Context, customerID string) (string, error) {
-	// Generate the template
-	_, err := c.GenerateCloudFormationTemplate()
+// currentTemplate renders the template for the current config and returns it
+// with its version, a hash of its content
+func (c *Client) currentTemplate() (string, string, error) {
+	body, err := c.GenerateCloudFormationTemplate()
 	if err != nil {
-		return "", fmt.Errorf("failed to generate template: %w", err)
+		return "", "", fmt.Errorf("failed to generate template: %w", err)
 	}
 
-	// In a real implementation, this would upload to S3
-	// For now, we'll return a mock S3 URL
-	templateURL := fmt.Sprintf("https://%s.s3.amazonaws.com/templates/cross-account-role.yaml", c.config.TemplateS3Bucket)
-	
-	// TODO: Implement actual S3 upload
-	// s3Client := s3.NewFromConfig(awsConfig)
-	// _, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
-	//     Bucket: aws.String(c.config.TemplateS3Bucket),
-	//     Key:    aws.String(fmt.Sprintf("templates/%s-cross-account-role.yaml", customerID)),
-	//     Body:   strings.NewReader(template),
-	//     ContentType: aws.String("text/yaml"),
-	// })
+	return body, contentVersion(body), nil
+}
 
-	return templateURL, nil
+// contentVersion identifies a template by a hash of its content
+func contentVersion(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:8])
+}
+
+// templateS3Client returns the configured S3 client, creating one from the
+// base AWS config on first use
+func (c *Client) templateS3Client(ctx context.Context) (*s3.Client, error) {
+	c.templateMu.Lock()
+	defer c.templateMu.Unlock()
+
+	if c.s3Client != nil {
+		return c.s3Client, nil
+	}
+
+	cfg, err := c.baseAWSConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.s3Client = s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.Region = c.config.TemplateS3Region
+	})
+	return c.s3Client, nil
+}
+
+// templateObjectURL returns the unsigned URL of a template object
+func (c *Client) templateObjectURL(s3Client *s3.Client, key string) string {
+	opts := s3Client.Options()
+	if opts.BaseEndpoint != nil {
+		return fmt.Sprintf("%s/%s/%s", strings.TrimRight(*opts.BaseEndpoint, "/"), c.config.TemplateS3Bucket, key)
+	}
+
+	region := opts.Region
+	if region == "" {
+		region = c.config.TemplateS3Region
+	}
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", c.config.TemplateS3Bucket, region, key)
 }
 
 // buildLaunchURL creates a CloudFormation console launch URL
@@ -139,20 +287,62 @@ Parameters:
     Type: String
     Description: 'Unique identifier for additional security'
     MinLength: 8
-    MaxLength: 64
+    MaxLength: 1224
+    AllowedPattern: '[\w+=,.@:/-]+'
     NoEcho: true
-    
+
   ServiceAccountId:
     Type: String
     Description: 'AWS Account ID for {{.ServiceName}}'
     Default: '{{.ServiceAccountID}}'
     AllowedPattern: '[0-9]{12}'
 
+  RoleName:
+    Type: String
+    Description: 'Name of the role {{.ServiceName}} will assume'
+    Default: '{{.ServiceName}}-CrossAccountRole'
+    AllowedPattern: '[\w+=,.@-]{1,64}'
+
+  SetupPhase:
+    Type: String
+    Description: 'Grant temporary setup permissions - update the stack with false once setup is complete'
+    Default: 'true'
+    AllowedValues:
+      - 'true'
+      - 'false'
+{{- if .OrgMember}}
+
+  ExternalIdMode:
+    Type: String
+    Description: 'shared: every account trusts ExternalId; per-account: each account trusts ExternalId-<account ID>'
+    Default: 'shared'
+    AllowedValues:
+      - 'shared'
+      - 'per-account'
+{{- end}}
+{{- if .SetupCallbackTopicARN}}
+
+  SetupToken:
+    Type: String
+    Description: 'Setup link token - lets {{.ServiceName}} finish setup when the stack is created'
+    Default: ''
+    NoEcho: true
+{{- end}}
+
+Conditions:
+  IncludeSetupPermissions: !Equals [!Ref SetupPhase, 'true']
+{{- if .OrgMember}}
+  PerAccountExternalId: !Equals [!Ref ExternalIdMode, 'per-account']
+{{- end}}
+{{- if .SetupCallbackTopicARN}}
+  SendSetupCallback: !Not [!Equals [!Ref SetupToken, '']]
+{{- end}}
+
 Resources:
   CrossAccountRole:
     Type: AWS::IAM::Role
     Properties:
-      RoleName: !Sub '{{.ServiceName}}-CrossAccountRole'
+      RoleName: !Ref RoleName
       Path: '/{{.ServiceName}}/'
       MaxSessionDuration: {{.SessionDurationSeconds}}
       AssumeRolePolicyDocument:
@@ -160,20 +350,158 @@ Resources:
         Statement:
           - Effect: Allow
             Principal:
-              AWS: !Sub 'arn:aws:iam::${ServiceAccountId}:root'
-            Action: 'sts:AssumeRole'
+              AWS: !Sub 'arn:${AWS::Partition}:iam::${ServiceAccountId}:root'
+            # Tags and source identity label sessions in your CloudTrail
+            Action:
+              - 'sts:AssumeRole'
+              - 'sts:TagSession'
+              - 'sts:SetSourceIdentity'
             Condition:
               StringEquals:
+{{- if .OrgMember}}
+                'sts:ExternalId': !If [PerAccountExternalId, !Sub '${ExternalId}-${AWS::AccountId}', !Ref ExternalId]
+{{- else}}
                 'sts:ExternalId': !Ref ExternalId
+{{- end}}
+      Tags:
+        - Key: ManagedBy
+          Value: '{{.ServiceName}}'
+        - Key: SetupPhase
+          Value: !Ref SetupPhase
+
+  # Lets {{.ServiceName}} follow the stack while it removes setup permissions,
+  # check that this trust policy hasn't been widened and compare the attached
+  # policies with the ones it expects
+  StackStatusPolicy:
+    Type: AWS::IAM::Policy
+    Properties:
+      PolicyName: stack-status
+      Roles:
+        - !Ref CrossAccountRole
+      PolicyDocument:
+        Version: '2012-10-17'
+        Statement:
+          - Effect: Allow
+            Action:
+              - 'cloudformation:DescribeStacks'
+              - 'cloudformation:DescribeStackResources'
+            Resource: !Ref AWS::StackId
+          - Effect: Allow
+            Action:
+              - 'iam:GetRole'
+              - 'iam:ListAttachedRolePolicies'
+            Resource: !GetAtt CrossAccountRole.Arn
+          - Effect: Allow
+            Action:
+              - 'iam:GetPolicy'
+              - 'iam:GetPolicyVersion'
+            Resource:
+{{- if .OngoingPermissions}}
+              - !Ref OngoingPolicy
+{{- end}}
+              - !Sub 'arn:${AWS::Partition}:iam::${AWS::AccountId}:policy/{{.ServiceName}}/${RoleName}-setup'
+              - !Sub 'arn:${AWS::Partition}:iam::aws:policy/*'
+{{- if .OngoingPermissions}}
+
+  OngoingPolicy:
+    Type: AWS::IAM::ManagedPolicy
+    Properties:
+      Description: 'Ongoing permissions for {{.ServiceName}}'
+      Roles:
+        - !Ref CrossAccountRole
+      PolicyDocument: {{policyJSON .OngoingPermissions}}
+{{- end}}
+{{- if .SetupPermissions}}
+
+  SetupPolicy:
+    Type: AWS::IAM::ManagedPolicy
+    Condition: IncludeSetupPermissions
+    # Deleted before SetupRemovalPolicy, which grants the permissions to delete it
+    DependsOn: SetupRemovalPolicy
+    Properties:
+      ManagedPolicyName: !Sub '${RoleName}-setup'
+      Path: '/{{.ServiceName}}/'
+      Description: 'Temporary setup permissions for {{.ServiceName}}'
+      Roles:
+        - !Ref CrossAccountRole
+      PolicyDocument: {{policyJSON .SetupPermissions}}
+
+  # Lets {{.ServiceName}} end the setup phase by updating this stack with
+  # SetupPhase=false. Removed along with the setup permissions
+  SetupRemovalPolicy:
+    Type: AWS::IAM::Policy
+    Condition: IncludeSetupPermissions
+    Properties:
+      PolicyName: setup-removal
+      Roles:
+        - !Ref CrossAccountRole
+      PolicyDocument:
+        Version: '2012-10-17'
+        Statement:
+          - Sid: UpdateOwnStack
+            Effect: Allow
+            Action:
+              - 'cloudformation:UpdateStack'
+            Resource: !Ref AWS::StackId
+          - Sid: DeleteSetupPolicy
+            Effect: Allow
+            Action:
+              - 'iam:GetPolicy'
+              - 'iam:ListPolicyVersions'
+              - 'iam:ListEntitiesForPolicy'
+              - 'iam:DeletePolicyVersion'
+              - 'iam:DeletePolicy'
+            Resource: !Sub 'arn:${AWS::Partition}:iam::${AWS::AccountId}:policy/{{.ServiceName}}/${RoleName}-setup'
+          - Sid: DetachSetupPolicy
+            Effect: Allow
+            Action:
+              - 'iam:DetachRolePolicy'
+              - 'iam:GetRolePolicy'
+              - 'iam:DeleteRolePolicy'
+            Resource: !GetAtt CrossAccountRole.Arn
+          # The role's SetupPhase tag changes in the same update
+          - Sid: TagRole
+            Effect: Allow
+            Action:
+              - 'iam:TagRole'
+              - 'iam:UntagRole'
+            Resource: !GetAtt CrossAccountRole.Arn
+{{- end}}
+{{- if .SetupCallbackTopicARN}}
+
+  # Tells {{.ServiceName}} the role is ready so setup finishes on its own
+  SetupCallback:
+    Type: Custom::SetupCallback
+    Condition: SendSetupCallback
+    DependsOn:
+      - StackStatusPolicy
+{{- if .OngoingPermissions}}
+      - OngoingPolicy
+{{- end}}
+    Properties:
+      ServiceToken: '{{.SetupCallbackTopicARN}}'
+      RoleArn: !GetAtt CrossAccountRole.Arn
+      AccountId: !Ref AWS::AccountId
+      ExternalId: !Ref ExternalId
+      SetupToken: !Ref SetupToken
+{{- end}}
 
 Outputs:
   RoleArn:
     Description: 'ARN of the cross-account role'
     Value: !GetAtt CrossAccountRole.Arn
-    
+
   ExternalId:
     Description: 'External ID for additional security'
-    Value: !Ref ExternalId`
+{{- if .OrgMember}}
+    Value: !If [PerAccountExternalId, !Sub '${ExternalId}-${AWS::AccountId}', !Ref ExternalId]
+{{- else}}
+    Value: !Ref ExternalId
+{{- end}}
+
+  SetupPhase:
+    Description: 'Whether setup permissions are attached'
+    Value: !Ref SetupPhase`
 }
 
 // getIAMUserTemplate returns the IAM user template
@@ -200,26 +528,16 @@ Outputs:
     Value: !GetAtt ExternalToolUser.Arn`
 }
 
-// ValidateTemplate performs basic validation on a CloudFormation template
+// ValidateTemplate parses a CloudFormation template and lints it with
+// LintTemplate. It returns a *TemplateValidationError if there are error
+// diagnostics; warnings are ignored
 func ValidateTemplate(templateContent string) error {
-	// Basic validation - check if it's valid YAML and has required sections
-	if templateContent == "" {
-		return fmt.Errorf("template is empty")
-	}
-	
-	// Check for required CloudFormation sections
-	requiredSections := []string{
-		"AWSTemplateFormatVersion",
-		"Resources",
-		"Outputs",
-	}
-	
-	for _, section := range requiredSections {
-		if !bytes.Contains([]byte(templateContent), []byte(section)) {
-			return fmt.Errorf("template is missing required section: %s", section)
+	diagnostics := LintTemplate(templateContent, LintOptions{})
+	for _, d := range diagnostics {
+		if d.Severity == SeverityError {
+			return &TemplateValidationError{Diagnostics: diagnostics}
 		}
 	}
-	
 	return nil
 }
 
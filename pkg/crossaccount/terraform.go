@@ -0,0 +1,443 @@
+package crossaccount
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// TerraformSetup is what a customer needs to create their role with
+// Terraform instead of a CloudFormation launch link
+type TerraformSetup struct {
+	CustomerID    string `json:"customer_id"`
+	ExternalID    string `json:"external_id"` // Security token for the role
+	RoleName      string `json:"role_name"`
+	ModuleSource  string `json:"module_source"`  // Where main.tf loads the module from
+	ModuleVersion string `json:"module_version"` // Hash of the module files
+	MainTF        string `json:"main_tf"`        // Root module for the customer, external ID filled in
+	SetupComplete bool   `json:"setup_complete"` // Whether setup is finished
+
+	// Signed token for this setup session; pass it back in SetupCompleteRequest
+	// Empty when setup is already complete
+	SetupToken string    `json:"setup_token,omitempty"`
+	ExpiresAt  time.Time `json:"expires_at"` // When the setup session stops being accepted
+}
+
+// GenerateTerraformModule renders a self-contained Terraform module that
+// creates the same role as the CloudFormation template: the trust policy with
+// the external ID, the ongoing policy and the setup policy, which exists while
+// the setup_phase variable is true. It returns the module's files by name;
+// publish them at Config.TerraformModuleSource
+func (c *Client) GenerateTerraformModule() (map[string]string, error) {
+	files, _, err := c.currentTerraformModule()
+	return files, err
+}
+
+// WriteTerraformModule writes the module from GenerateTerraformModule to dir
+func (c *Client) WriteTerraformModule(dir string) error {
+	files, err := c.GenerateTerraformModule()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create module directory: %w", err)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// GenerateTerraformSetup is GenerateSetupLinkWithOptions for customers who
+// deploy with Terraform. It records the pending integration the same way and
+// returns a main.tf that calls the module with the customer's external ID.
+// The customer sends back the role_arn output to complete setup
+func (c *Client) GenerateTerraformSetup(ctx context.Context, customerID, customerName string, opts SetupLinkOptions) (*TerraformSetup, error) {
+	if err := validateSetupRequest(customerID, customerName, opts); err != nil {
+		return nil, err
+	}
+
+	_, moduleVersion, err := c.currentTerraformModule()
+	if err != nil {
+		return nil, err
+	}
+
+	integration, token, err := c.startSetup(ctx, customerID, customerName, opts, func(i *CustomerIntegration) {
+		i.Deployment = DeploymentTerraform
+		i.TemplateVersion = moduleVersion
+	})
+	if err != nil {
+		return nil, err
+	}
+	var expiresAt time.Time
+	if token != "" {
+		expiresAt = integration.SetupSession.ExpiresAt
+	}
+
+	mainTF, err := c.renderTerraform(terraformCustomerMain, map[string]interface{}{
+		"ServiceName":      c.config.ServiceName,
+		"ServiceAccountID": c.config.ServiceAccountID,
+		"CustomerName":     integration.CustomerName,
+		"ModuleName":       c.terraformModuleName(),
+		"ModuleSource":     c.config.TerraformModuleSource,
+		"ModuleVersion":    moduleVersion,
+		"ExternalID":       integration.ExternalID,
+		"RoleName":         integration.RoleName,
+		"SetupPhase":       integration.SetupPhase,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &TerraformSetup{
+		CustomerID:    customerID,
+		ExternalID:    integration.ExternalID,
+		RoleName:      integration.RoleName,
+		ModuleSource:  c.config.TerraformModuleSource,
+		ModuleVersion: moduleVersion,
+		MainTF:        mainTF,
+		SetupComplete: integration.Status.Operational(),
+		SetupToken:    token,
+		ExpiresAt:     expiresAt,
+	}, nil
+}
+
+// currentTerraformModule renders the module for the current config and
+// returns it with its version, a hash of its files
+func (c *Client) currentTerraformModule() (map[string]string, string, error) {
+	ongoing, err := terraformPolicy(c.config.OngoingPermissions)
+	if err != nil {
+		return nil, "", err
+	}
+	setup, err := terraformPolicy(c.config.SetupPermissions)
+	if err != nil {
+		return nil, "", err
+	}
+
+	data := map[string]interface{}{
+		"ServiceName":            c.config.ServiceName,
+		"ServiceAccountID":       c.config.ServiceAccountID,
+		"SessionDurationSeconds": c.maxSessionSeconds(),
+		"OngoingPolicy":          ongoing,
+		"SetupPolicy":            setup,
+	}
+
+	files := make(map[string]string, len(terraformModuleFiles))
+	for name, text := range terraformModuleFiles {
+		if files[name], err = c.renderTerraform(text, data); err != nil {
+			return nil, "", fmt.Errorf("failed to render %s: %w", name, err)
+		}
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	hash := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(hash, "%s\x00%s\x00", name, files[name])
+	}
+	return files, hex.EncodeToString(hash.Sum(nil)[:8]), nil
+}
+
+// renderTerraform executes a Terraform template. The hcl function escapes a
+// value for a quoted HCL string
+func (c *Client) renderTerraform(text string, data interface{}) (string, error) {
+	tmpl, err := template.New("terraform").Funcs(template.FuncMap{
+		"hcl":     hclEscape,
+		"comment": func(s string) string { return strings.Join(strings.Fields(s), " ") },
+	}).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse template: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to execute template: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// terraformModuleName is the module block label in customers' main.tf
+func (c *Client) terraformModuleName() string {
+	name := []byte(strings.ToLower(c.config.ServiceName))
+	for i, ch := range name {
+		if !(ch >= 'a' && ch <= 'z' || ch >= '0' && ch <= '9') {
+			name[i] = '_'
+		}
+	}
+	if len(name) == 0 || name[0] >= '0' && name[0] <= '9' {
+		name = append([]byte("service_"), name...)
+	}
+	return string(name) + "_access"
+}
+
+// hclEscape escapes s for use inside a quoted HCL string, including
+// Terraform's ${ and %{ template sequences
+func hclEscape(s string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		`"`, `\"`,
+		"\n", `\n`,
+		"\r", `\r`,
+		"\t", `\t`,
+		"${", "$${",
+		"%{", "%%{",
+	).Replace(s)
+}
+
+// terraformPolicy renders permissions as an indented policy document for a
+// heredoc, or "" when there are none. IAM policy variables such as
+// ${aws:username} are escaped so Terraform passes them through
+func terraformPolicy(permissions []Permission) (string, error) {
+	if len(permissions) == 0 {
+		return "", nil
+	}
+
+	doc, err := policyDocumentJSON(permissions)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, []byte(doc), "    ", "  "); err != nil {
+		return "", fmt.Errorf("failed to format policy document: %w", err)
+	}
+	return "    " + strings.NewReplacer("${", "$${", "%{", "%%{").Replace(buf.String()), nil
+}
+
+// terraformModuleFiles are the templates of the module's files
+var terraformModuleFiles = map[string]string{
+	"versions.tf":  terraformVersions,
+	"variables.tf": terraformVariables,
+	"main.tf":      terraformMain,
+	"outputs.tf":   terraformOutputs,
+}
+
+const terraformVersions = `terraform {
+  required_version = ">= 1.0"
+
+  required_providers {
+    aws = {
+      source  = "hashicorp/aws"
+      version = ">= 4.0"
+    }
+  }
+}
+`
+
+const terraformVariables = `variable "external_id" {
+  description = "Unique identifier for additional security, provided by {{hcl .ServiceName}}"
+  type        = string
+  sensitive   = true
+
+  validation {
+    condition     = can(regex("^[\\w+=,.@:/-]{8,1224}$", var.external_id))
+    error_message = "The external ID must be 8 to 1224 letters, digits or +=,.@:/- characters."
+  }
+}
+
+variable "service_account_id" {
+  description = "AWS account ID for {{hcl .ServiceName}}"
+  type        = string
+  default     = "{{hcl .ServiceAccountID}}"
+
+  validation {
+    condition     = can(regex("^[0-9]{12}$", var.service_account_id))
+    error_message = "The service account ID must be a 12-digit AWS account ID."
+  }
+}
+
+variable "role_name" {
+  description = "Name of the role {{hcl .ServiceName}} will assume"
+  type        = string
+  default     = "{{hcl .ServiceName}}-CrossAccountRole"
+
+  validation {
+    condition     = can(regex("^[\\w+=,.@-]{1,64}$", var.role_name))
+    error_message = "The role name must be 1 to 64 letters, digits or +=,.@- characters."
+  }
+}
+
+variable "setup_phase" {
+  description = "Grant temporary setup permissions - set to false and apply again once setup is complete"
+  type        = bool
+  default     = true
+}
+
+variable "tags" {
+  description = "Additional tags for the role"
+  type        = map(string)
+  default     = {}
+}
+`
+
+const terraformMain = `# Cross-account IAM role for {{comment .ServiceName}}
+
+data "aws_partition" "current" {}
+
+data "aws_caller_identity" "current" {}
+
+locals {
+  partition        = data.aws_partition.current.partition
+  setup_policy_arn = "arn:${local.partition}:iam::${data.aws_caller_identity.current.account_id}:policy/{{hcl .ServiceName}}/${var.role_name}-setup"
+}
+
+resource "aws_iam_role" "cross_account" {
+  name                 = var.role_name
+  path                 = "/{{hcl .ServiceName}}/"
+  max_session_duration = {{.SessionDurationSeconds}}
+
+  assume_role_policy = jsonencode({
+    Version = "2012-10-17"
+    Statement = [
+      # Tags and source identity label sessions in your CloudTrail
+      {
+        Effect    = "Allow"
+        Principal = { AWS = "arn:${local.partition}:iam::${var.service_account_id}:root" }
+        Action    = ["sts:AssumeRole", "sts:TagSession", "sts:SetSourceIdentity"]
+        Condition = { StringEquals = { "sts:ExternalId" = var.external_id } }
+      },
+    ]
+  })
+
+  tags = merge(var.tags, {
+    ManagedBy  = "{{hcl .ServiceName}}"
+    SetupPhase = tostring(var.setup_phase)
+  })
+}
+
+# Lets {{comment .ServiceName}} check that this trust policy hasn't been widened and
+# compare the attached policies with the ones it expects
+resource "aws_iam_role_policy" "role_status" {
+  name = "role-status"
+  role = aws_iam_role.cross_account.id
+
+  policy = jsonencode({
+    Version = "2012-10-17"
+    Statement = [
+      {
+        Effect   = "Allow"
+        Action   = ["iam:GetRole", "iam:ListAttachedRolePolicies"]
+        Resource = aws_iam_role.cross_account.arn
+      },
+      {
+        Effect = "Allow"
+        Action = ["iam:GetPolicy", "iam:GetPolicyVersion"]
+        Resource = [
+{{- if .OngoingPolicy}}
+          aws_iam_policy.ongoing.arn,
+{{- end}}
+          local.setup_policy_arn,
+          "arn:${local.partition}:iam::aws:policy/*",
+        ]
+      },
+    ]
+  })
+}
+{{- if .OngoingPolicy}}
+
+resource "aws_iam_policy" "ongoing" {
+  name        = "${var.role_name}-OngoingOperations"
+  path        = "/{{hcl .ServiceName}}/"
+  description = "Ongoing permissions for {{hcl .ServiceName}}"
+  policy      = <<-EOT
+{{.OngoingPolicy}}
+  EOT
+}
+
+resource "aws_iam_role_policy_attachment" "ongoing" {
+  role       = aws_iam_role.cross_account.name
+  policy_arn = aws_iam_policy.ongoing.arn
+}
+{{- end}}
+{{- if .SetupPolicy}}
+
+# Removed when setup_phase is set to false
+resource "aws_iam_policy" "setup" {
+  count = var.setup_phase ? 1 : 0
+
+  name        = "${var.role_name}-setup"
+  path        = "/{{hcl .ServiceName}}/"
+  description = "Temporary setup permissions for {{hcl .ServiceName}}"
+  policy      = <<-EOT
+{{.SetupPolicy}}
+  EOT
+}
+
+resource "aws_iam_role_policy_attachment" "setup" {
+  count = var.setup_phase ? 1 : 0
+
+  role       = aws_iam_role.cross_account.name
+  policy_arn = aws_iam_policy.setup[0].arn
+}
+{{- end}}
+`
+
+const terraformOutputs = `output "role_arn" {
+  description = "ARN of the cross-account role - send it to {{hcl .ServiceName}} to finish setup"
+  value       = aws_iam_role.cross_account.arn
+
+  # The role is only usable once its policies are attached
+  depends_on = [
+    aws_iam_role_policy.role_status,
+{{- if .OngoingPolicy}}
+    aws_iam_role_policy_attachment.ongoing,
+{{- end}}
+{{- if .SetupPolicy}}
+    aws_iam_role_policy_attachment.setup,
+{{- end}}
+  ]
+}
+
+output "role_name" {
+  description = "Name of the cross-account role"
+  value       = aws_iam_role.cross_account.name
+}
+
+output "external_id" {
+  description = "External ID for additional security"
+  value       = var.external_id
+  sensitive   = true
+}
+
+output "setup_phase" {
+  description = "Whether setup permissions are attached"
+  value       = var.setup_phase
+}
+`
+
+const terraformCustomerMain = `# {{comment .ServiceName}} cross-account access for {{comment .CustomerName}}
+#
+# 1. Run terraform init and terraform apply
+# 2. Send {{comment .ServiceName}} the {{.ModuleName}}_role_arn output
+# 3. Once {{comment .ServiceName}} confirms setup, set setup_phase to false and run
+#    terraform apply again to remove the temporary setup permissions
+
+module "{{.ModuleName}}" {
+  # Module version {{.ModuleVersion}}
+  source = "{{hcl .ModuleSource}}"
+
+  external_id        = "{{hcl .ExternalID}}"
+  service_account_id = "{{hcl .ServiceAccountID}}"
+  role_name          = "{{hcl .RoleName}}"
+  setup_phase        = {{.SetupPhase}}
+}
+
+output "{{.ModuleName}}_role_arn" {
+  description = "Send this to {{hcl .ServiceName}}"
+  value       = module.{{.ModuleName}}.role_arn
+}
+`
@@ -0,0 +1,165 @@
+package crossaccount
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGenerateTerraformModule(t *testing.T) {
+	cfg := SimpleConfig("test-service", "123456789012", "test-bucket")
+	cfg.OngoingPermissions = []Permission{{Sid: "ReadOwnPrefix", Actions: []string{"s3:GetObject"}, Resources: []string{"arn:aws:s3:::data/${aws:username}/*"}}}
+	cfg.SetupPermissions = []Permission{{Sid: "CreateBuckets", Actions: []string{"s3:CreateBucket"}}}
+	client, _ := newTestClient(t, cfg)
+
+	files, err := client.GenerateTerraformModule()
+	if err != nil {
+		t.Fatalf("GenerateTerraformModule() error = %v", err)
+	}
+	for _, name := range []string{"versions.tf", "variables.tf", "main.tf", "outputs.tf"} {
+		if files[name] == "" {
+			t.Errorf("module is missing %s", name)
+		}
+	}
+
+	main := files["main.tf"]
+	for _, want := range []string{
+		`Condition = { StringEquals = { "sts:ExternalId" = var.external_id } }`,
+		`"arn:${local.partition}:iam::${var.service_account_id}:root"`,
+		`name        = "${var.role_name}-OngoingOperations"`, // Recognized by DetectDrift
+		`name        = "${var.role_name}-setup"`,
+		`count = var.setup_phase ? 1 : 0`,
+		`"arn:aws:s3:::data/$${aws:username}/*"`, // IAM variable, not Terraform interpolation
+		`"Sid": "CreateBuckets"`,
+		`path                 = "/test-service/"`,
+	} {
+		if !strings.Contains(main, want) {
+			t.Errorf("main.tf is missing %s", want)
+		}
+	}
+	if !strings.Contains(files["variables.tf"], `variable "setup_phase"`) || !strings.Contains(files["outputs.tf"], `output "role_arn"`) {
+		t.Error("module should declare setup_phase and output role_arn")
+	}
+
+	// Without setup permissions there is nothing to remove
+	cfg2 := SimpleConfig("test-service", "123456789012", "test-bucket")
+	cfg2.OngoingPermissions = cfg.OngoingPermissions
+	client2, _ := newTestClient(t, cfg2)
+	files2, err := client2.GenerateTerraformModule()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(files2["main.tf"], `resource "aws_iam_policy" "setup"`) || strings.Contains(files2["outputs.tf"], "attachment.setup") {
+		t.Error("module without setup permissions shouldn't create a setup policy")
+	}
+
+	_, v1, _ := client.currentTerraformModule()
+	_, v2, _ := client2.currentTerraformModule()
+	if v1 == "" || v1 == v2 {
+		t.Errorf("module versions should differ with permissions: %q, %q", v1, v2)
+	}
+
+	dir := filepath.Join(t.TempDir(), "module")
+	if err := client.WriteTerraformModule(dir); err != nil {
+		t.Fatalf("WriteTerraformModule() error = %v", err)
+	}
+	written, err := os.ReadFile(filepath.Join(dir, "main.tf"))
+	if err != nil || string(written) != main {
+		t.Errorf("written main.tf doesn't match: %v", err)
+	}
+}
+
+func TestGenerateTerraformSetup(t *testing.T) {
+	ctx := context.Background()
+	cfg := SimpleConfig("test-service", "123456789012", "test-bucket")
+	cfg.TerraformModuleSource = "git::https://example.com/test-service/terraform-role.git?ref=v1"
+	cfg.OngoingPermissions = []Permission{{Sid: "ReadEC2", Actions: []string{"ec2:DescribeInstances"}}}
+	cfg.SetupPermissions = []Permission{{Sid: "CreateBuckets", Actions: []string{"s3:CreateBucket"}}}
+	client, s3Server := newTestClient(t, cfg, withMockSTS(&mockSTSClient{}))
+
+	setup, err := client.GenerateTerraformSetup(ctx, "customer-123", `Acme "Corp"`, SetupLinkOptions{})
+	if err != nil {
+		t.Fatalf("GenerateTerraformSetup() error = %v", err)
+	}
+	if s3Server.puts != 0 {
+		t.Error("Terraform setup shouldn't publish the CloudFormation template")
+	}
+	for _, want := range []string{
+		`module "test_service_access" {`,
+		`source = "git::https://example.com/test-service/terraform-role.git?ref=v1"`,
+		`external_id        = "` + setup.ExternalID + `"`,
+		`role_name          = "test-service-CrossAccount-customer-123"`,
+		`setup_phase        = true`,
+		`# Module version ` + setup.ModuleVersion,
+		`value       = module.test_service_access.role_arn`,
+	} {
+		if !strings.Contains(setup.MainTF, want) {
+			t.Errorf("main.tf is missing %s:\n%s", want, setup.MainTF)
+		}
+	}
+
+	integration, err := client.GetIntegration(ctx, "customer-123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if integration.Deployment != DeploymentTerraform || integration.TemplateVersion != setup.ModuleVersion || integration.StackName != "" || integration.Status != IntegrationLinkGenerated {
+		t.Errorf("integration = %+v", integration)
+	}
+
+	if err := client.CompleteSetup(ctx, &SetupCompleteRequest{
+		CustomerID: "customer-123",
+		RoleARN:    testSetupRoleARN,
+		ExternalID: setup.ExternalID,
+		SetupToken: setup.SetupToken,
+	}); err != nil {
+		t.Fatalf("CompleteSetup() error = %v", err)
+	}
+
+	// The customer applies setup_phase = false themselves
+	cleanup, err := client.RemoveSetupPermissionsWithContext(ctx, "customer-123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cleanup.Automated || cleanup.StackName != "" || !strings.Contains(strings.Join(cleanup.Instructions, "\n"), "setup_phase = false") {
+		t.Errorf("cleanup = %+v", cleanup)
+	}
+
+	rotation, err := client.RotateExternalID(ctx, "customer-123", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotation.ConsoleURL != "" || !strings.Contains(strings.Join(rotation.Instructions, "\n"), `external_id = "`+rotation.NewExternalID+`"`) {
+		t.Errorf("rotation = %+v", rotation)
+	}
+
+	// Terraform customers are compared with the module, not the template
+	plan, err := client.PlanUpgrades(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.UpToDate) != 1 || plan.TerraformModuleVersion != setup.ModuleVersion {
+		t.Errorf("plan = %+v", plan)
+	}
+
+	client.config.OngoingPermissions = append(client.config.OngoingPermissions, Permission{Sid: "ReadS3", Actions: []string{"s3:GetObject"}})
+	upgrade, err := client.OfferUpgrade(ctx, "customer-123")
+	if err != nil {
+		t.Fatalf("OfferUpgrade() error = %v", err)
+	}
+	if upgrade.Deployment != DeploymentTerraform || upgrade.FromVersion != setup.ModuleVersion || upgrade.ToVersion == setup.ModuleVersion || upgrade.TemplateURL != "" || len(upgrade.Changes) != 1 {
+		t.Errorf("upgrade = %+v", upgrade)
+	}
+	if s3Server.puts != 0 {
+		t.Error("Terraform upgrades shouldn't publish the CloudFormation template")
+	}
+}
+
+func TestHCLEscape(t *testing.T) {
+	got := hclEscape("a\"b\\c\n${x}%{y}")
+	want := `a\"b\\c\n$${x}%%{y}`
+	if got != want {
+		t.Errorf("hclEscape() = %s, want %s", got, want)
+	}
+}
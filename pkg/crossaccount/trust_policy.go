@@ -0,0 +1,340 @@
+package crossaccount
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+)
+
+// Trust policy finding severities
+const (
+	SeverityWarning = "warning"
+	SeverityError   = "error"
+)
+
+// Trust policy finding codes
+const (
+	TrustWildcardPrincipal    = "wildcard-principal"
+	TrustUntrustedPrincipal   = "untrusted-principal"
+	TrustNotPrincipal         = "not-principal"
+	TrustMissingExternalID    = "missing-external-id"
+	TrustUnexpectedExternalID = "unexpected-external-id"
+	TrustPolicyUnreadable     = "trust-policy-unreadable"
+)
+
+// ErrRoleTrustTooBroad is wrapped by TrustPolicyError
+var ErrRoleTrustTooBroad = errors.New("role trust policy is broader than allowed")
+
+// IAMAPI is the subset of the IAM client used to inspect a customer's role
+type IAMAPI interface {
+	GetRole(ctx context.Context, params *iam.GetRoleInput, optFns ...func(*iam.Options)) (*iam.GetRoleOutput, error)
+	ListAttachedRolePolicies(ctx context.Context, params *iam.ListAttachedRolePoliciesInput, optFns ...func(*iam.Options)) (*iam.ListAttachedRolePoliciesOutput, error)
+	GetPolicy(ctx context.Context, params *iam.GetPolicyInput, optFns ...func(*iam.Options)) (*iam.GetPolicyOutput, error)
+	GetPolicyVersion(ctx context.Context, params *iam.GetPolicyVersionInput, optFns ...func(*iam.Options)) (*iam.GetPolicyVersionOutput, error)
+}
+
+// WithIAMClientFactory sets how IAM clients for customer accounts are created
+func WithIAMClientFactory(factory func(cfg aws.Config) IAMAPI) Option {
+	return func(c *Client) { c.newIAM = factory }
+}
+
+// TrustPolicyFinding is a single problem in a role's trust policy
+type TrustPolicyFinding struct {
+	Code      string `json:"code"`
+	Severity  string `json:"severity"`
+	Statement string `json:"statement,omitempty"` // Sid, or position when unnamed
+	Principal string `json:"principal,omitempty"`
+	Message   string `json:"message"`
+}
+
+// TrustPolicyReport is the result of checking a customer role's trust policy
+type TrustPolicyReport struct {
+	RoleARN   string               `json:"role_arn"`
+	CheckedAt time.Time            `json:"checked_at"`
+	Findings  []TrustPolicyFinding `json:"findings,omitempty"`
+}
+
+// Trusted reports whether the trust policy has no error findings
+func (r *TrustPolicyReport) Trusted() bool {
+	for _, f := range r.Findings {
+		if f.Severity == SeverityError {
+			return false
+		}
+	}
+	return true
+}
+
+// TrustPolicyError is returned when a role trusts more than the service
+type TrustPolicyError struct {
+	Report *TrustPolicyReport
+}
+
+func (e *TrustPolicyError) Error() string {
+	var problems []string
+	for _, f := range e.Report.Findings {
+		if f.Severity == SeverityError {
+			problems = append(problems, f.Message)
+		}
+	}
+	return fmt.Sprintf("%v: %s", ErrRoleTrustTooBroad, strings.Join(problems, "; "))
+}
+
+func (e *TrustPolicyError) Unwrap() error { return ErrRoleTrustTooBroad }
+
+// VerifyTrustPolicy re-checks an integrated customer's role trust policy and
+// records the report on the integration. Roles that trust more than this
+// service with the customer's external ID are flagged as degraded
+func (c *Client) VerifyTrustPolicy(ctx context.Context, customerID string) (*TrustPolicyReport, error) {
+	integration, err := c.integrations.GetIntegration(ctx, customerID)
+	if err != nil {
+		return nil, fmt.Errorf("customer not found: %w", err)
+	}
+
+	cfg, err := c.AssumeRole(ctx, customerID)
+	if err != nil {
+		return nil, err
+	}
+	report := c.checkTrustPolicy(ctx, cfg, integration.RoleARN, integration.ExternalID)
+
+	if _, err := c.updateIntegration(ctx, customerID, false, func(i *CustomerIntegration) error {
+		i.TrustPolicy = report
+		if !report.Trusted() && i.Status != IntegrationDegraded && i.Status.CanTransitionTo(IntegrationDegraded) {
+			return i.transition(IntegrationDegraded, (&TrustPolicyError{Report: report}).Error(), c.now())
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to record trust policy check: %w", err)
+	}
+
+	if !report.Trusted() {
+		c.logger.WarnContext(ctx, "customer role trust policy too broad", "customer_id", customerID, "role_arn", integration.RoleARN, "findings", len(report.Findings))
+	}
+	return report, nil
+}
+
+// checkTrustPolicy reads the role's trust policy with the role's own
+// credentials and analyzes it. A policy that can't be read is reported as a
+// warning, since stacks from older templates can't read it
+func (c *Client) checkTrustPolicy(ctx context.Context, cfg aws.Config, roleARN string, externalIDs ...string) *TrustPolicyReport {
+	report := &TrustPolicyReport{RoleARN: roleARN, CheckedAt: c.now()}
+
+	unreadable := func(err error) *TrustPolicyReport {
+		report.Findings = []TrustPolicyFinding{{
+			Code:     TrustPolicyUnreadable,
+			Severity: SeverityWarning,
+			Message:  fmt.Sprintf("could not read the role's trust policy: %v", err),
+		}}
+		return report
+	}
+
+	_, roleName, err := parseRoleARN(roleARN)
+	if err != nil {
+		return unreadable(err)
+	}
+	out, err := c.newIAM(cfg).GetRole(ctx, &iam.GetRoleInput{RoleName: aws.String(roleName)})
+	if err != nil {
+		return unreadable(err)
+	}
+	if out.Role == nil || out.Role.AssumeRolePolicyDocument == nil {
+		return unreadable(errors.New("role has no trust policy"))
+	}
+
+	// IAM returns policy documents URL-encoded
+	document, err := url.QueryUnescape(aws.ToString(out.Role.AssumeRolePolicyDocument))
+	if err != nil {
+		return unreadable(err)
+	}
+	if report.Findings, err = AnalyzeTrustPolicy(document, c.config.ServiceAccountID, externalIDs...); err != nil {
+		return unreadable(err)
+	}
+	return report
+}
+
+// credentialsConfig returns the service's AWS config with static credentials
+func (c *Client) credentialsConfig(ctx context.Context, creds aws.Credentials) (aws.Config, error) {
+	base, err := c.baseAWSConfig(ctx)
+	if err != nil {
+		return aws.Config{}, err
+	}
+	cfg := base.Copy()
+	cfg.Region = c.config.DefaultRegion
+	cfg.Credentials = credentials.StaticCredentialsProvider{Value: creds}
+	return cfg, nil
+}
+
+// AnalyzeTrustPolicy checks that a role trust policy only lets
+// serviceAccountID assume the role, and only with one of externalIDs.
+// Deny statements are ignored
+func AnalyzeTrustPolicy(document, serviceAccountID string, externalIDs ...string) ([]TrustPolicyFinding, error) {
+	var policy struct {
+		Statement json.RawMessage `json:"Statement"`
+	}
+	if err := json.Unmarshal([]byte(document), &policy); err != nil {
+		return nil, fmt.Errorf("invalid trust policy: %w", err)
+	}
+
+	// Statement may be a single object or a list
+	var statements []trustStatement
+	if err := json.Unmarshal(policy.Statement, &statements); err != nil {
+		var single trustStatement
+		if err := json.Unmarshal(policy.Statement, &single); err != nil {
+			return nil, fmt.Errorf("invalid trust policy statement: %w", err)
+		}
+		statements = []trustStatement{single}
+	}
+
+	var findings []TrustPolicyFinding
+	for i, s := range statements {
+		if s.Effect != "Allow" {
+			continue
+		}
+		name := s.Sid
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		add := func(code, principal, format string, args ...interface{}) {
+			findings = append(findings, TrustPolicyFinding{
+				Code:      code,
+				Severity:  SeverityError,
+				Statement: name,
+				Principal: principal,
+				Message:   fmt.Sprintf("statement %s ", name) + fmt.Sprintf(format, args...),
+			})
+		}
+
+		if len(s.NotPrincipal) > 0 {
+			add(TrustNotPrincipal, "", "allows everyone except the listed principals")
+		}
+		for _, p := range s.principals() {
+			switch {
+			case p.value == "*":
+				add(TrustWildcardPrincipal, p.String(), "trusts any principal")
+			case p.kind != "AWS":
+				add(TrustUntrustedPrincipal, p.String(), "trusts %s", p)
+			case principalAccount(p.value) != serviceAccountID:
+				add(TrustUntrustedPrincipal, p.String(), "trusts %s, outside account %s", p.value, serviceAccountID)
+			}
+		}
+
+		values, ok := s.externalIDs()
+		switch {
+		case !ok:
+			add(TrustMissingExternalID, "", "has no StringEquals sts:ExternalId condition")
+		case len(externalIDs) > 0:
+			for _, v := range values {
+				if !containsString(externalIDs, v) {
+					add(TrustUnexpectedExternalID, "", "accepts an external ID that isn't the customer's")
+					break
+				}
+			}
+		}
+	}
+	return findings, nil
+}
+
+// trustStatement is a trust policy statement
+type trustStatement struct {
+	Sid          string                                `json:"Sid"`
+	Effect       string                                `json:"Effect"`
+	Principal    json.RawMessage                       `json:"Principal"`
+	NotPrincipal json.RawMessage                       `json:"NotPrincipal"`
+	Condition    map[string]map[string]json.RawMessage `json:"Condition"`
+}
+
+// trustPrincipal is one principal of a statement, e.g. AWS 123456789012
+type trustPrincipal struct {
+	kind, value string
+}
+
+func (p trustPrincipal) String() string {
+	if p.kind == "" {
+		return p.value
+	}
+	return p.kind + " " + p.value
+}
+
+// principals flattens the statement's Principal element
+func (s *trustStatement) principals() []trustPrincipal {
+	var wildcard string
+	if json.Unmarshal(s.Principal, &wildcard) == nil {
+		return []trustPrincipal{{value: wildcard}}
+	}
+
+	var byKind map[string]json.RawMessage
+	if json.Unmarshal(s.Principal, &byKind) != nil {
+		return nil
+	}
+	kinds := make([]string, 0, len(byKind))
+	for kind := range byKind {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	var out []trustPrincipal
+	for _, kind := range kinds {
+		for _, v := range stringOrList(byKind[kind]) {
+			out = append(out, trustPrincipal{kind: kind, value: v})
+		}
+	}
+	return out
+}
+
+// externalIDs returns the external IDs a StringEquals condition requires
+func (s *trustStatement) externalIDs() ([]string, bool) {
+	for op, keys := range s.Condition {
+		if op != "StringEquals" {
+			continue
+		}
+		for key, raw := range keys {
+			// Condition keys are case-insensitive
+			if strings.EqualFold(key, "sts:ExternalId") {
+				values := stringOrList(raw)
+				return values, len(values) > 0
+			}
+		}
+	}
+	return nil, false
+}
+
+// principalAccount returns the account of an AWS principal, which is either
+// an account ID or an ARN
+func principalAccount(principal string) string {
+	if isAccountID(principal) {
+		return principal
+	}
+	parts := strings.SplitN(principal, ":", 6)
+	if len(parts) == 6 && parts[0] == "arn" {
+		return parts[4]
+	}
+	return ""
+}
+
+// stringOrList decodes a policy value that may be a string or a list
+func stringOrList(raw json.RawMessage) []string {
+	var one string
+	if json.Unmarshal(raw, &one) == nil {
+		return []string{one}
+	}
+	var many []string
+	json.Unmarshal(raw, &many)
+	return many
+}
+
+// containsString reports whether list contains s
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,195 @@
+package crossaccount
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+)
+
+func TestAnalyzeTrustPolicy(t *testing.T) {
+	const good = `{"Effect":"Allow","Principal":{"AWS":"arn:aws:iam::123456789012:root"},"Action":"sts:AssumeRole","Condition":{"StringEquals":{"sts:ExternalId":"ext-1"}}}`
+
+	tests := []struct {
+		name      string
+		statement string
+		want      []string
+	}{
+		{name: "template policy", statement: `[` + good + `]`},
+		{
+			name:      "single statement object",
+			statement: good,
+		},
+		{
+			name:      "account ID principal and list of external IDs",
+			statement: `{"Effect":"Allow","Principal":{"AWS":["123456789012"]},"Action":"sts:AssumeRole","Condition":{"StringEquals":{"sts:externalid":["ext-1","ext-2"]}}}`,
+		},
+		{
+			name:      "wildcard principal",
+			statement: `{"Effect":"Allow","Principal":"*","Action":"sts:AssumeRole","Condition":{"StringEquals":{"sts:ExternalId":"ext-1"}}}`,
+			want:      []string{TrustWildcardPrincipal},
+		},
+		{
+			name:      "wildcard AWS principal",
+			statement: `{"Effect":"Allow","Principal":{"AWS":"*"},"Action":"sts:AssumeRole","Condition":{"StringEquals":{"sts:ExternalId":"ext-1"}}}`,
+			want:      []string{TrustWildcardPrincipal},
+		},
+		{
+			name:      "extra account",
+			statement: `{"Effect":"Allow","Principal":{"AWS":["arn:aws:iam::123456789012:root","arn:aws:iam::111111111111:root"]},"Action":"sts:AssumeRole","Condition":{"StringEquals":{"sts:ExternalId":"ext-1"}}}`,
+			want:      []string{TrustUntrustedPrincipal},
+		},
+		{
+			name:      "service principal",
+			statement: `{"Effect":"Allow","Principal":{"Service":"ec2.amazonaws.com"},"Action":"sts:AssumeRole","Condition":{"StringEquals":{"sts:ExternalId":"ext-1"}}}`,
+			want:      []string{TrustUntrustedPrincipal},
+		},
+		{
+			name:      "no external ID",
+			statement: `{"Effect":"Allow","Principal":{"AWS":"arn:aws:iam::123456789012:root"},"Action":"sts:AssumeRole"}`,
+			want:      []string{TrustMissingExternalID},
+		},
+		{
+			name:      "wildcard external ID",
+			statement: `{"Effect":"Allow","Principal":{"AWS":"arn:aws:iam::123456789012:root"},"Action":"sts:AssumeRole","Condition":{"StringLike":{"sts:ExternalId":"*"}}}`,
+			want:      []string{TrustMissingExternalID},
+		},
+		{
+			name:      "other external ID",
+			statement: `{"Effect":"Allow","Principal":{"AWS":"arn:aws:iam::123456789012:root"},"Action":"sts:AssumeRole","Condition":{"StringEquals":{"sts:ExternalId":"guessable"}}}`,
+			want:      []string{TrustUnexpectedExternalID},
+		},
+		{
+			name:      "not principal",
+			statement: `{"Effect":"Allow","NotPrincipal":{"AWS":"arn:aws:iam::111111111111:root"},"Action":"sts:AssumeRole","Condition":{"StringEquals":{"sts:ExternalId":"ext-1"}}}`,
+			want:      []string{TrustNotPrincipal},
+		},
+		{
+			name:      "deny statements are ignored",
+			statement: `[` + good + `,{"Effect":"Deny","Principal":"*","Action":"sts:AssumeRole"}]`,
+		},
+		{
+			name:      "second statement without condition",
+			statement: `[` + good + `,{"Sid":"Extra","Effect":"Allow","Principal":{"AWS":"arn:aws:iam::123456789012:role/admin"},"Action":"sts:AssumeRole"}]`,
+			want:      []string{TrustMissingExternalID},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			findings, err := AnalyzeTrustPolicy(`{"Version":"2012-10-17","Statement":`+tt.statement+`}`, "123456789012", "ext-1", "ext-2")
+			if err != nil {
+				t.Fatalf("AnalyzeTrustPolicy() error = %v", err)
+			}
+			if len(findings) != len(tt.want) {
+				t.Fatalf("findings = %+v, want codes %v", findings, tt.want)
+			}
+			for i, f := range findings {
+				if f.Code != tt.want[i] || f.Severity != SeverityError || f.Message == "" {
+					t.Errorf("finding %d = %+v, want %s", i, f, tt.want[i])
+				}
+			}
+		})
+	}
+
+	if _, err := AnalyzeTrustPolicy("not json", "123456789012"); err == nil {
+		t.Error("AnalyzeTrustPolicy() should reject invalid documents")
+	}
+}
+
+func TestCompleteSetup_RefusesBroadTrustPolicy(t *testing.T) {
+	ctx := context.Background()
+	ti := newIntegratedTestClient(t, SimpleConfig("test-service", "123456789012", "test-bucket"), withSetupLinkOnly())
+	client, resp := ti.client, ti.setup
+	ti.iam.trustPolicy = `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Principal":{"AWS":"*"},"Action":"sts:AssumeRole"}]}`
+
+	err := client.CompleteSetup(ctx, &SetupCompleteRequest{
+		CustomerID: "customer-123",
+		RoleARN:    testSetupRoleARN,
+		ExternalID: resp.ExternalID,
+		SetupToken: resp.SetupToken,
+	})
+
+	var trustErr *TrustPolicyError
+	if !errors.Is(err, ErrRoleTrustTooBroad) || !errors.As(err, &trustErr) {
+		t.Fatalf("CompleteSetup() error = %v, want TrustPolicyError", err)
+	}
+	if len(trustErr.Report.Findings) != 2 || trustErr.Report.RoleARN != testSetupRoleARN {
+		t.Errorf("unexpected report: %+v", trustErr.Report)
+	}
+	if integration, _ := client.GetIntegration(ctx, "customer-123"); integration.Status != IntegrationLinkGenerated {
+		t.Errorf("refused setup changed the integration to %s", integration.Status)
+	}
+}
+
+func TestCompleteSetup_UnreadableTrustPolicy(t *testing.T) {
+	ctx := context.Background()
+	ti := newIntegratedTestClient(t, SimpleConfig("test-service", "123456789012", "test-bucket"), withSetupLinkOnly())
+	client, resp := ti.client, ti.setup
+	WithIAMClientFactory(func(aws.Config) IAMAPI { return deniedIAM{} })(client)
+
+	if err := client.CompleteSetup(ctx, &SetupCompleteRequest{
+		CustomerID: "customer-123",
+		RoleARN:    testSetupRoleARN,
+		ExternalID: resp.ExternalID,
+		SetupToken: resp.SetupToken,
+	}); err != nil {
+		t.Fatalf("CompleteSetup() error = %v", err)
+	}
+
+	integration, _ := client.GetIntegration(ctx, "customer-123")
+	if integration.TrustPolicy == nil || len(integration.TrustPolicy.Findings) != 1 ||
+		integration.TrustPolicy.Findings[0].Code != TrustPolicyUnreadable || integration.TrustPolicy.Findings[0].Severity != SeverityWarning {
+		t.Errorf("unreadable trust policy should be recorded as a warning: %+v", integration.TrustPolicy)
+	}
+}
+
+// deniedIAM refuses every request, like a role created from an old template
+type deniedIAM struct{}
+
+func (deniedIAM) GetRole(ctx context.Context, params *iam.GetRoleInput, optFns ...func(*iam.Options)) (*iam.GetRoleOutput, error) {
+	return nil, errors.New("AccessDenied: not authorized to perform iam:GetRole")
+}
+
+func (deniedIAM) ListAttachedRolePolicies(ctx context.Context, params *iam.ListAttachedRolePoliciesInput, optFns ...func(*iam.Options)) (*iam.ListAttachedRolePoliciesOutput, error) {
+	return nil, errors.New("AccessDenied: not authorized to perform iam:ListAttachedRolePolicies")
+}
+
+func (deniedIAM) GetPolicy(ctx context.Context, params *iam.GetPolicyInput, optFns ...func(*iam.Options)) (*iam.GetPolicyOutput, error) {
+	return nil, errors.New("AccessDenied: not authorized to perform iam:GetPolicy")
+}
+
+func (deniedIAM) GetPolicyVersion(ctx context.Context, params *iam.GetPolicyVersionInput, optFns ...func(*iam.Options)) (*iam.GetPolicyVersionOutput, error) {
+	return nil, errors.New("AccessDenied: not authorized to perform iam:GetPolicyVersion")
+}
+
+func TestClient_VerifyTrustPolicy(t *testing.T) {
+	ctx := context.Background()
+	ti := newIntegratedTestClient(t, SimpleConfig("test-service", "123456789012", "test-bucket"))
+	client, resp := ti.client, ti.setup
+
+	report, err := client.VerifyTrustPolicy(ctx, "customer-123")
+	if err != nil || !report.Trusted() {
+		t.Fatalf("VerifyTrustPolicy() = %+v, %v", report, err)
+	}
+
+	// The customer later trusts another account
+	ti.iam.mu.Lock()
+	ti.iam.trustPolicy = `{"Version":"2012-10-17","Statement":{"Effect":"Allow","Principal":{"AWS":["123456789012","111111111111"]},"Action":"sts:AssumeRole","Condition":{"StringEquals":{"sts:ExternalId":"` + resp.ExternalID + `"}}}}`
+	ti.iam.mu.Unlock()
+
+	report, err = client.VerifyTrustPolicy(ctx, "customer-123")
+	if err != nil {
+		t.Fatalf("VerifyTrustPolicy() error = %v", err)
+	}
+	if report.Trusted() || len(report.Findings) != 1 || report.Findings[0].Principal != "AWS 111111111111" {
+		t.Errorf("unexpected report: %+v", report)
+	}
+
+	integration, _ := client.GetIntegration(ctx, "customer-123")
+	if integration.Status != IntegrationDegraded || integration.TrustPolicy == nil || integration.TrustPolicy.Trusted() {
+		t.Errorf("widened trust policy should be flagged: %+v", integration)
+	}
+}
@@ -0,0 +1,510 @@
+package crossaccount
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UpgradeStatus tracks a customer's response to a template upgrade
+type UpgradeStatus string
+
+// Template upgrade statuses
+const (
+	UpgradeOffered   UpgradeStatus = "offered"
+	UpgradeAccepted  UpgradeStatus = "accepted" // The customer agreed; their stack isn't verified yet
+	UpgradeDeclined  UpgradeStatus = "declined"
+	UpgradeCompleted UpgradeStatus = "completed" // The role matches the new template
+)
+
+// Permission change kinds
+const (
+	PermissionAdded   = "added"
+	PermissionRemoved = "removed"
+	PermissionChanged = "changed"
+)
+
+// ErrNoUpgradeOffered is returned when a customer has no open upgrade offer
+var ErrNoUpgradeOffered = errors.New("no template upgrade offered")
+
+// PermissionChange is one human-readable difference between a customer's
+// deployed permissions and the current config
+type PermissionChange struct {
+	Kind        string `json:"kind"`
+	Statement   string `json:"statement"` // Sid, or actions when unnamed
+	Description string `json:"description"`
+}
+
+// TemplateUpgrade records an upgrade offered to a customer
+type TemplateUpgrade struct {
+	FromVersion string             `json:"from_version,omitempty"`
+	ToVersion   string             `json:"to_version"`
+	Status      UpgradeStatus      `json:"status"`
+	Changes     []PermissionChange `json:"changes,omitempty"`
+	OfferedAt   time.Time          `json:"offered_at"`
+	RespondedAt time.Time          `json:"responded_at,omitempty"`
+	CompletedAt time.Time          `json:"completed_at,omitempty"`
+}
+
+// CustomerUpgrade is what one customer needs to do to reach the current
+// template
+type CustomerUpgrade struct {
+	CustomerID   string             `json:"customer_id"`
+	CustomerName string             `json:"customer_name,omitempty"`
+	FromVersion  string             `json:"from_version,omitempty"`
+	ToVersion    string             `json:"to_version"`
+	Changes      []PermissionChange `json:"changes,omitempty"`
+	ChangesKnown bool               `json:"changes_known"` // False for integrations that predate recorded permissions
+	Deployment   DeploymentMethod   `json:"deployment"`
+	StackName    string             `json:"stack_name"`
+	TemplateURL  string             `json:"template_url"`
+	ConsoleURL   string             `json:"console_url"`
+	Instructions []string           `json:"instructions"`
+	CLICommand   string             `json:"cli_command"`
+	Upgrade      *TemplateUpgrade   `json:"upgrade,omitempty"` // The tracked offer, if any
+}
+
+// UpgradePlan lists the customers behind the current template
+type UpgradePlan struct {
+	TemplateVersion        string            `json:"template_version"`
+	TerraformModuleVersion string            `json:"terraform_module_version"`
+	OrgMemberVersion       string            `json:"org_member_version"` // Template organizations' StackSets deploy
+	GeneratedAt            time.Time         `json:"generated_at"`
+	Customers              []CustomerUpgrade `json:"customers,omitempty"`
+	UpToDate               []string          `json:"up_to_date,omitempty"` // Customer IDs
+}
+
+// PlanUpgrades compares every operational customer's deployed template
+// version with the template the current config generates, or the Terraform
+// module or organization member template for customers who use them. For
+// customers who are behind it describes the permission changes and how to
+// update their stack, module or StackSet. Organization management accounts
+// hold no permissions of their own and are left out. Nothing is sent or
+// recorded; use OfferUpgrade to roll out to a customer
+func (c *Client) PlanUpgrades(ctx context.Context) (*UpgradePlan, error) {
+	_, version, err := c.currentTemplate()
+	if err != nil {
+		return nil, err
+	}
+	_, moduleVersion, err := c.currentTerraformModule()
+	if err != nil {
+		return nil, err
+	}
+	memberBody, memberVersion, err := c.currentOrgMemberTemplate()
+	if err != nil {
+		return nil, err
+	}
+
+	integrations, err := c.ListIntegrationsByStatus(ctx,
+		IntegrationRoleVerified, IntegrationSetupActive, IntegrationSetupRemoved, IntegrationActive, IntegrationDegraded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list integrations: %w", err)
+	}
+
+	plan := &UpgradePlan{TemplateVersion: version, TerraformModuleVersion: moduleVersion, OrgMemberVersion: memberVersion, GeneratedAt: c.now()}
+	var templateURL, memberURL string
+	for _, integration := range integrations {
+		switch integration.Deployment {
+		case DeploymentOrganization:
+			continue
+		case DeploymentStackSet:
+			if integration.TemplateVersion == memberVersion {
+				plan.UpToDate = append(plan.UpToDate, integration.CustomerID)
+				continue
+			}
+			if memberURL == "" {
+				if memberURL, err = c.publishTemplate(ctx, "org-member-role", memberBody, memberVersion); err != nil {
+					return nil, fmt.Errorf("failed to publish CloudFormation template: %w", err)
+				}
+			}
+			plan.Customers = append(plan.Customers, *c.customerUpgrade(ctx, integration, memberVersion, memberURL))
+			continue
+		}
+
+		if integration.terraform() {
+			if integration.TemplateVersion == moduleVersion {
+				plan.UpToDate = append(plan.UpToDate, integration.CustomerID)
+			} else {
+				plan.Customers = append(plan.Customers, *c.customerUpgrade(ctx, integration, moduleVersion, ""))
+			}
+			continue
+		}
+
+		if integration.TemplateVersion == version {
+			plan.UpToDate = append(plan.UpToDate, integration.CustomerID)
+			continue
+		}
+		if templateURL == "" {
+			if templateURL, _, err = c.uploadTemplate(ctx); err != nil {
+				return nil, fmt.Errorf("failed to publish CloudFormation template: %w", err)
+			}
+		}
+		plan.Customers = append(plan.Customers, *c.customerUpgrade(ctx, integration, version, templateURL))
+	}
+	return plan, nil
+}
+
+// latestVersion returns the template version the customer should run, or
+// the Terraform module or organization member template version for customers
+// who use them, and the template URL to update CloudFormation stacks from
+func (c *Client) latestVersion(ctx context.Context, i *CustomerIntegration) (string, string, error) {
+	switch i.Deployment {
+	case DeploymentTerraform:
+		_, version, err := c.currentTerraformModule()
+		return version, "", err
+	case DeploymentOrganization:
+		return "", "", fmt.Errorf("customer %s is an organization; upgrade its member accounts instead", i.CustomerID)
+	case DeploymentStackSet:
+		body, version, err := c.currentOrgMemberTemplate()
+		if err != nil {
+			return "", "", err
+		}
+		templateURL, err := c.publishTemplate(ctx, "org-member-role", body, version)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to publish CloudFormation template: %w", err)
+		}
+		return version, templateURL, nil
+	}
+
+	templateURL, version, err := c.uploadTemplate(ctx)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to publish CloudFormation template: %w", err)
+	}
+	return version, templateURL, nil
+}
+
+// OfferUpgrade records that a customer was asked to update their stack or
+// module to the current version and returns what to send them. An open offer
+// is replaced
+func (c *Client) OfferUpgrade(ctx context.Context, customerID string) (*CustomerUpgrade, error) {
+	current, err := c.integrations.GetIntegration(ctx, customerID)
+	if err != nil {
+		return nil, fmt.Errorf("customer not found: %w", err)
+	}
+	version, templateURL, err := c.latestVersion(ctx, current)
+	if err != nil {
+		return nil, err
+	}
+
+	// Built before the update, since it may read the customer's stack
+	upgrade := c.customerUpgrade(ctx, current, version, templateURL)
+	_, err = c.updateIntegration(ctx, customerID, false, func(i *CustomerIntegration) error {
+		if i.Deployment != current.Deployment {
+			return fmt.Errorf("customer %s integration changed while offering the upgrade", customerID)
+		}
+		if !i.Status.Operational() {
+			return fmt.Errorf("customer %s integration is %s", customerID, i.Status)
+		}
+		if i.TemplateVersion == version {
+			return fmt.Errorf("customer %s already runs template %s", customerID, version)
+		}
+
+		i.Upgrade = &TemplateUpgrade{
+			FromVersion: i.TemplateVersion,
+			ToVersion:   version,
+			Status:      UpgradeOffered,
+			Changes:     upgrade.Changes,
+			OfferedAt:   c.now(),
+		}
+		upgrade.Upgrade = i.Upgrade
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.logger.InfoContext(ctx, "template upgrade offered", "customer_id", customerID, "from", upgrade.FromVersion, "to", version, "changes", len(upgrade.Changes))
+	return upgrade, nil
+}
+
+// RespondToUpgrade records whether the customer accepted the upgrade offered
+// to them
+func (c *Client) RespondToUpgrade(ctx context.Context, customerID string, accepted bool) (*TemplateUpgrade, error) {
+	integration, err := c.updateIntegration(ctx, customerID, false, func(i *CustomerIntegration) error {
+		if i.Upgrade == nil || i.Upgrade.Status == UpgradeCompleted {
+			return ErrNoUpgradeOffered
+		}
+		i.Upgrade.Status = UpgradeDeclined
+		if accepted {
+			i.Upgrade.Status = UpgradeAccepted
+		}
+		i.Upgrade.RespondedAt = c.now()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.logger.InfoContext(ctx, "template upgrade response", "customer_id", customerID, "status", integration.Upgrade.Status)
+	return integration.Upgrade, nil
+}
+
+// CompleteUpgrade checks with DetectDrift that the customer's ongoing policy
+// matches the current config, then records the current template or module as
+// deployed. It works whether or not an upgrade was offered
+func (c *Client) CompleteUpgrade(ctx context.Context, customerID string) (*TemplateUpgrade, error) {
+	_, version, err := c.currentTemplate()
+	if err != nil {
+		return nil, err
+	}
+	_, moduleVersion, err := c.currentTerraformModule()
+	if err != nil {
+		return nil, err
+	}
+	_, memberVersion, err := c.currentOrgMemberTemplate()
+	if err != nil {
+		return nil, err
+	}
+
+	report, err := c.DetectDrift(ctx, customerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check the customer's role: %w", err)
+	}
+	var differences int
+	for _, f := range report.Findings {
+		if f.Policy == DriftPolicyOngoing {
+			differences++
+		}
+	}
+	if differences > 0 {
+		return nil, fmt.Errorf("stack not updated yet: %d ongoing policy statements differ from the current template", differences)
+	}
+	for _, w := range report.Warnings {
+		if strings.HasPrefix(w, DriftPolicyOngoing+" policy") {
+			return nil, fmt.Errorf("can't verify the upgrade: %s", w)
+		}
+	}
+
+	integration, err := c.updateIntegration(ctx, customerID, false, func(i *CustomerIntegration) error {
+		now := c.now()
+		version := version
+		switch i.Deployment {
+		case DeploymentTerraform:
+			version = moduleVersion
+		case DeploymentStackSet:
+			version = memberVersion
+		}
+		if i.Upgrade == nil || i.Upgrade.Status == UpgradeCompleted {
+			i.Upgrade = &TemplateUpgrade{FromVersion: i.TemplateVersion, OfferedAt: now}
+		}
+		i.Upgrade.ToVersion = version
+		i.Upgrade.Status = UpgradeCompleted
+		i.Upgrade.CompletedAt = now
+		i.TemplateVersion = version
+		i.DeployedPermissions = copyPermissions(c.config.OngoingPermissions)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to record upgrade: %w", err)
+	}
+
+	c.logger.InfoContext(ctx, "template upgrade completed", "customer_id", customerID, "version", integration.TemplateVersion)
+	return integration.Upgrade, nil
+}
+
+// customerUpgrade describes how a customer gets from their deployed
+// template to version
+func (c *Client) customerUpgrade(ctx context.Context, i *CustomerIntegration, version, templateURL string) *CustomerUpgrade {
+	var upgrade *CustomerUpgrade
+	switch i.Deployment {
+	case DeploymentTerraform:
+		upgrade = c.moduleUpgrade(version)
+	case DeploymentStackSet:
+		upgrade = c.stackSetUpgrade(i, templateURL)
+	default:
+		upgrade = c.stackUpgrade(ctx, i, templateURL)
+	}
+
+	upgrade.CustomerID = i.CustomerID
+	upgrade.CustomerName = i.CustomerName
+	upgrade.FromVersion = i.TemplateVersion
+	upgrade.ToVersion = version
+	upgrade.ChangesKnown = i.DeployedPermissions != nil
+	if i.Upgrade != nil && i.Upgrade.ToVersion == version {
+		upgrade.Upgrade = i.Upgrade
+	}
+	if upgrade.ChangesKnown {
+		upgrade.Changes = permissionChanges(i.DeployedPermissions, c.config.OngoingPermissions)
+	}
+	return upgrade
+}
+
+// moduleUpgrade tells a Terraform customer how to update the module
+func (c *Client) moduleUpgrade(version string) *CustomerUpgrade {
+	return &CustomerUpgrade{
+		Deployment: DeploymentTerraform,
+		Instructions: []string{
+			fmt.Sprintf("1. Update the %s module from %s to version %s", c.terraformModuleName(), c.config.TerraformModuleSource, version),
+			"2. Run terraform init -upgrade",
+			"3. Run terraform apply and review the IAM policy changes",
+		},
+		CLICommand: "terraform init -upgrade && terraform apply",
+	}
+}
+
+// stackUpgrade tells a CloudFormation customer how to update their stack
+func (c *Client) stackUpgrade(ctx context.Context, i *CustomerIntegration, templateURL string) *CustomerUpgrade {
+	stackName, region := i.StackName, i.StackRegion
+	if stackName == "" {
+		stackName = c.stackName(i.CustomerID)
+	}
+	if region == "" {
+		region = c.config.DefaultRegion
+	}
+
+	return &CustomerUpgrade{
+		Deployment:  DeploymentCloudFormation,
+		StackName:   stackName,
+		TemplateURL: templateURL,
+		ConsoleURL: fmt.Sprintf("https://console.aws.amazon.com/cloudformation/home?region=%s#/stacks/stackinfo?stackId=%s",
+			region, stackName),
+		Instructions: []string{
+			"1. Go to AWS CloudFormation console in " + region,
+			"2. Find your stack: " + stackName,
+			"3. Click 'Update' and choose 'Replace existing template'",
+			"4. Enter this Amazon S3 URL: " + templateURL,
+			"5. Keep the current parameter values and click 'Update stack'",
+		},
+		CLICommand: fmt.Sprintf(`aws cloudformation update-stack \
+  --region "%s" \
+  --stack-name "%s" \
+  --template-url "%s" \
+  --parameters %s \
+  --capabilities CAPABILITY_NAMED_IAM`,
+			region, stackName, templateURL, c.upgradeParameters(ctx, i, stackName, region)),
+	}
+}
+
+// upgradeParameters renders the --parameters of a stack's update to the
+// current template. CloudFormation rejects UsePreviousValue for parameters
+// the stack doesn't have, so only its own are kept and new ones take their
+// defaults. SetupPhase, which defaults to true, keeps the integration's phase
+func (c *Client) upgradeParameters(ctx context.Context, i *CustomerIntegration, stackName, region string) string {
+	deployed := make(map[string]bool)
+	for _, key := range c.stackParameterKeys(ctx, i.CustomerID, stackName, region) {
+		deployed[key] = true
+	}
+
+	var keys []string
+	values := make(map[string]string)
+	for _, key := range c.templateParameterKeys() {
+		switch {
+		case deployed[key]:
+			keys = append(keys, key)
+		case key == "SetupPhase":
+			keys = append(keys, key)
+			values[key] = strconv.FormatBool(i.SetupPhase)
+		}
+	}
+	return stackUpdateParameters(keys, values)
+}
+
+// stackSetUpgrade tells an organization how to update the StackSet that
+// deploys a member account's role: its management stack passes the member
+// template URL to the StackSet, which updates every member account
+func (c *Client) stackSetUpgrade(i *CustomerIntegration, templateURL string) *CustomerUpgrade {
+	stackName, region := c.stackName(i.ParentCustomerID), i.StackRegion
+	if region == "" {
+		region = c.config.DefaultRegion
+	}
+
+	params := []string{fmt.Sprintf("ParameterKey=MemberTemplateURL,ParameterValue=%s", templateURL)}
+	for _, key := range []string{"ExternalId", "ServiceAccountId", "ManagementRoleName", "MemberRoleName", "OrganizationalUnitIds", "ExternalIdMode", "StackSetName"} {
+		params = append(params, fmt.Sprintf("ParameterKey=%s,UsePreviousValue=true", key))
+	}
+
+	return &CustomerUpgrade{
+		Deployment:  DeploymentStackSet,
+		StackName:   stackName,
+		TemplateURL: templateURL,
+		ConsoleURL: fmt.Sprintf("https://console.aws.amazon.com/cloudformation/home?region=%s#/stacks/stackinfo?stackId=%s",
+			region, stackName),
+		Instructions: []string{
+			"1. Sign in to your organization's management account",
+			"2. Go to AWS CloudFormation console in " + region,
+			"3. Find your stack: " + stackName,
+			"4. Click 'Update' and choose 'Use existing template'",
+			"5. Change the 'MemberTemplateURL' parameter to: " + templateURL,
+			"6. Keep the other parameters and click 'Update stack'; the StackSet " + i.StackName + " then updates every member account",
+		},
+		CLICommand: fmt.Sprintf(`aws cloudformation update-stack \
+  --region "%s" \
+  --stack-name "%s" \
+  --use-previous-template \
+  --parameters %s \
+  --capabilities CAPABILITY_NAMED_IAM`,
+			region, stackName, strings.Join(params, " \\\n    ")),
+	}
+}
+
+// permissionChanges describes how the current permissions differ from the
+// deployed ones
+func permissionChanges(deployed, current []Permission) []PermissionChange {
+	var changes []PermissionChange
+	for _, f := range diffStatements(DriftPolicyOngoing, normalizePermissions(current), normalizePermissions(deployed)) {
+		switch f.Kind {
+		case DriftMissing:
+			changes = append(changes, PermissionChange{
+				Kind:        PermissionAdded,
+				Statement:   f.Statement,
+				Description: "Adds " + describeStatement(*f.Expected),
+			})
+		case DriftExtra:
+			changes = append(changes, PermissionChange{
+				Kind:        PermissionRemoved,
+				Statement:   f.Statement,
+				Description: "Removes " + describeStatement(*f.Actual),
+			})
+		case DriftModified:
+			changes = append(changes, PermissionChange{
+				Kind:        PermissionChanged,
+				Statement:   f.Statement,
+				Description: fmt.Sprintf("Changes %s to %s", describeStatement(*f.Actual), describeStatement(*f.Expected)),
+			})
+		}
+	}
+	return changes
+}
+
+// describeStatement renders a statement for customers, e.g.
+// "Allow s3:getobject on arn:aws:s3:::data/* when StringEquals aws:SourceVpc is vpc-1"
+func describeStatement(s PolicyStatement) string {
+	var b strings.Builder
+	b.WriteString(s.Effect)
+	if len(s.Actions) > 0 {
+		b.WriteString(" " + strings.Join(s.Actions, ", "))
+	}
+	if len(s.NotActions) > 0 {
+		b.WriteString(" everything except " + strings.Join(s.NotActions, ", "))
+	}
+	if len(s.Resources) > 0 {
+		b.WriteString(" on " + strings.Join(s.Resources, ", "))
+	}
+	if len(s.NotResources) > 0 {
+		b.WriteString(" on everything except " + strings.Join(s.NotResources, ", "))
+	}
+
+	var conditions []string
+	for op, keys := range s.Condition {
+		for key, values := range keys {
+			conditions = append(conditions, fmt.Sprintf("%s %s is %s", op, key, strings.Join(values, " or ")))
+		}
+	}
+	sort.Strings(conditions)
+	if len(conditions) > 0 {
+		b.WriteString(" when " + strings.Join(conditions, " and "))
+	}
+	return b.String()
+}
+
+// copyPermissions copies permissions, keeping an empty list non-nil so it
+// reads as recorded
+func copyPermissions(permissions []Permission) []Permission {
+	out := make([]Permission, len(permissions))
+	copy(out, permissions)
+	return out
+}
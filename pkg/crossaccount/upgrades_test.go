@@ -0,0 +1,204 @@
+package crossaccount
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// changeOngoingPermissions moves the config on to a new template version
+func changeOngoingPermissions(client *Client) {
+	client.config.OngoingPermissions = []Permission{
+		{Sid: "ReadEC2", Actions: []string{"ec2:DescribeInstances", "ec2:DescribeVolumes", "ec2:DescribeSnapshots"}},
+		{Sid: "ReadCloudWatch", Actions: []string{"cloudwatch:GetMetricData"}},
+	}
+}
+
+func TestPlanUpgrades(t *testing.T) {
+	ctx := context.Background()
+	client := newIntegratedTestClient(t, driftTestConfig(), withDeployedPolicies(), withCloudFormation()).client
+
+	plan, err := client.PlanUpgrades(ctx)
+	if err != nil {
+		t.Fatalf("PlanUpgrades() error = %v", err)
+	}
+	if len(plan.Customers) != 0 || len(plan.UpToDate) != 1 {
+		t.Fatalf("customer should be up to date: %+v", plan)
+	}
+	deployed := plan.TemplateVersion
+
+	changeOngoingPermissions(client)
+	plan, err = client.PlanUpgrades(ctx)
+	if err != nil {
+		t.Fatalf("PlanUpgrades() error = %v", err)
+	}
+	if plan.TemplateVersion == deployed || len(plan.Customers) != 1 {
+		t.Fatalf("customer should be behind: %+v", plan)
+	}
+
+	upgrade := plan.Customers[0]
+	if upgrade.FromVersion != deployed || upgrade.ToVersion != plan.TemplateVersion || !upgrade.ChangesKnown {
+		t.Errorf("unexpected upgrade: %+v", upgrade)
+	}
+	var kinds []string
+	for _, change := range upgrade.Changes {
+		kinds = append(kinds, change.Kind+"/"+change.Statement)
+	}
+	want := "changed/ReadEC2; added/ReadCloudWatch; removed/Allow s3:getobject"
+	if got := strings.Join(kinds, "; "); got != want {
+		t.Errorf("changes = %s, want %s", got, want)
+	}
+	if d := upgrade.Changes[1].Description; d != "Adds Allow cloudwatch:getmetricdata on *" {
+		t.Errorf("description = %q", d)
+	}
+	if !strings.Contains(upgrade.Changes[2].Description, "when StringEquals s3:existingobjecttag/owner is test-service") {
+		t.Errorf("description should include conditions: %q", upgrade.Changes[2].Description)
+	}
+	for _, want := range []string{"update-stack", "--stack-name \"" + upgrade.StackName + "\"", "--template-url \"" + upgrade.TemplateURL + "\"", "CAPABILITY_NAMED_IAM"} {
+		if !strings.Contains(upgrade.CLICommand, want) {
+			t.Errorf("CLI command is missing %q:\n%s", want, upgrade.CLICommand)
+		}
+	}
+	if !strings.Contains(upgrade.TemplateURL, plan.TemplateVersion) {
+		t.Errorf("template URL should be the new version: %s", upgrade.TemplateURL)
+	}
+}
+
+func TestPlanUpgrades_UnrecordedPermissions(t *testing.T) {
+	ctx := context.Background()
+	client := newIntegratedTestClient(t, driftTestConfig(), withDeployedPolicies(), withCloudFormation()).client
+	if _, err := client.updateIntegration(ctx, "customer-123", false, func(i *CustomerIntegration) error {
+		i.DeployedPermissions = nil
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	changeOngoingPermissions(client)
+	plan, err := client.PlanUpgrades(ctx)
+	if err != nil {
+		t.Fatalf("PlanUpgrades() error = %v", err)
+	}
+	if len(plan.Customers) != 1 || plan.Customers[0].ChangesKnown || plan.Customers[0].Changes != nil {
+		t.Errorf("changes of older integrations are unknown: %+v", plan.Customers)
+	}
+}
+
+func TestPlanUpgrades_KeepsDeployedParameters(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		params  map[string]string // The deployed stack's parameters
+		want    []string
+		missing []string
+	}{
+		{
+			name:    "stack created before the setup callback",
+			params:  map[string]string{"ExternalId": "****", "ServiceAccountId": "123456789012", "RoleName": "role", "SetupPhase": "false"},
+			want:    []string{"ParameterKey=ExternalId,UsePreviousValue=true", "ParameterKey=RoleName,UsePreviousValue=true", "ParameterKey=SetupPhase,UsePreviousValue=true"},
+			missing: []string{"SetupToken"},
+		},
+		{
+			name:    "baseline template stack",
+			params:  map[string]string{"ExternalId": "****", "ServiceAccountId": "123456789012"},
+			want:    []string{"ParameterKey=ExternalId,UsePreviousValue=true", "ParameterKey=ServiceAccountId,UsePreviousValue=true", "ParameterKey=SetupPhase,ParameterValue=false"},
+			missing: []string{"RoleName", "SetupToken"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := driftTestConfig()
+			cfg.SetupCallbackTopicARN = testCallbackTopicARN
+			ti := newIntegratedTestClient(t, cfg, withDeployedPolicies(), withCloudFormation())
+			if _, err := ti.client.updateIntegration(ctx, "customer-123", false, func(i *CustomerIntegration) error {
+				i.SetupPhase = false
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			ti.cfn.mu.Lock()
+			ti.cfn.params = tt.params
+			ti.cfn.mu.Unlock()
+
+			changeOngoingPermissions(ti.client)
+			plan, err := ti.client.PlanUpgrades(ctx)
+			if err != nil || len(plan.Customers) != 1 {
+				t.Fatalf("PlanUpgrades() = %+v, %v", plan, err)
+			}
+			command := plan.Customers[0].CLICommand
+			for _, want := range tt.want {
+				if !strings.Contains(command, want) {
+					t.Errorf("CLI command is missing %q:\n%s", want, command)
+				}
+			}
+			for _, key := range tt.missing {
+				if strings.Contains(command, "ParameterKey="+key) {
+					t.Errorf("CLI command passes %s, which the stack doesn't have:\n%s", key, command)
+				}
+			}
+		})
+	}
+}
+
+func TestUpgradeRollout(t *testing.T) {
+	ctx := context.Background()
+	ti := newIntegratedTestClient(t, driftTestConfig(), withDeployedPolicies(), withCloudFormation())
+	client := ti.client
+
+	if _, err := client.OfferUpgrade(ctx, "customer-123"); err == nil {
+		t.Error("OfferUpgrade() should fail for customers on the current template")
+	}
+	if _, err := client.RespondToUpgrade(ctx, "customer-123", true); !errors.Is(err, ErrNoUpgradeOffered) {
+		t.Errorf("RespondToUpgrade() error = %v, want ErrNoUpgradeOffered", err)
+	}
+
+	changeOngoingPermissions(client)
+	offer, err := client.OfferUpgrade(ctx, "customer-123")
+	if err != nil {
+		t.Fatalf("OfferUpgrade() error = %v", err)
+	}
+	if offer.Upgrade == nil || offer.Upgrade.Status != UpgradeOffered || len(offer.Upgrade.Changes) != 3 {
+		t.Fatalf("offer should be tracked: %+v", offer.Upgrade)
+	}
+
+	upgrade, err := client.RespondToUpgrade(ctx, "customer-123", true)
+	if err != nil {
+		t.Fatalf("RespondToUpgrade() error = %v", err)
+	}
+	if upgrade.Status != UpgradeAccepted || upgrade.RespondedAt.IsZero() {
+		t.Errorf("unexpected response: %+v", upgrade)
+	}
+
+	// The customer hasn't updated their stack yet
+	if _, err := client.CompleteUpgrade(ctx, "customer-123"); err == nil {
+		t.Error("CompleteUpgrade() should fail while the role has the old policy")
+	}
+
+	ongoing, _ := policyDocumentJSON(client.config.OngoingPermissions)
+	ti.iam.mu.Lock()
+	ti.iam.managedPolicies[testOngoingPolicyARN] = ongoing
+	ti.iam.mu.Unlock()
+
+	upgrade, err = client.CompleteUpgrade(ctx, "customer-123")
+	if err != nil {
+		t.Fatalf("CompleteUpgrade() error = %v", err)
+	}
+	if upgrade.Status != UpgradeCompleted || upgrade.ToVersion != offer.ToVersion || upgrade.FromVersion != offer.FromVersion {
+		t.Errorf("unexpected upgrade: %+v", upgrade)
+	}
+
+	integration, _ := client.GetIntegration(ctx, "customer-123")
+	if integration.TemplateVersion != offer.ToVersion || len(integration.DeployedPermissions) != 2 {
+		t.Errorf("new template should be recorded: %+v", integration)
+	}
+	plan, err := client.PlanUpgrades(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Customers) != 0 {
+		t.Errorf("customer should be up to date: %+v", plan.Customers)
+	}
+}
@@ -0,0 +1,90 @@
+package telemetry
+
+// Kind is the type of a metric
+type Kind int
+
+// Metric kinds
+const (
+	KindCounter   Kind = iota
+	KindHistogram      // Durations, in seconds
+)
+
+// Metric describes one metric the packages record. Adapters that need
+// metrics declared up front, such as Prometheus, use Metrics
+type Metric struct {
+	Name   string
+	Kind   Kind
+	Help   string
+	Labels []string // Attribute keys; missing attributes are recorded as ""
+}
+
+// Metric names
+const (
+	AssumeRoleDuration    = "crossaccount_assume_role_duration_seconds"
+	AssumeRoleErrors      = "crossaccount_assume_role_errors_total"
+	SessionCacheRequests  = "crossaccount_session_cache_requests_total"
+	SessionRefreshes      = "crossaccount_session_refreshes_total"
+	StorageDuration       = "crossaccount_storage_operation_duration_seconds"
+	SetupFunnel           = "crossaccount_setup_funnel_total"
+	SSODeviceFlows        = "awsauth_sso_device_flows_total"
+	SSODeviceFlowDuration = "awsauth_sso_device_flow_duration_seconds"
+	CredentialCacheHits   = "awsauth_credential_cache_requests_total"
+)
+
+// Metrics lists every metric the crossaccount and awsauth packages record
+var Metrics = []Metric{
+	{
+		Name:   AssumeRoleDuration,
+		Kind:   KindHistogram,
+		Help:   "Latency of sts:AssumeRole calls on customer roles",
+		Labels: []string{"customer_id", "outcome"},
+	},
+	{
+		Name:   AssumeRoleErrors,
+		Kind:   KindCounter,
+		Help:   "Failed sts:AssumeRole calls on customer roles by error class",
+		Labels: []string{"customer_id", "error_class"},
+	},
+	{
+		Name:   SessionCacheRequests,
+		Kind:   KindCounter,
+		Help:   "Customer session lookups served from memory (hit) or refreshed (miss)",
+		Labels: []string{"result"},
+	},
+	{
+		Name:   SessionRefreshes,
+		Kind:   KindCounter,
+		Help:   "Customer session refreshes by where the session came from",
+		Labels: []string{"source", "outcome"},
+	},
+	{
+		Name:   StorageDuration,
+		Kind:   KindHistogram,
+		Help:   "Latency of session and integration storage operations",
+		Labels: []string{"store", "operation", "outcome"},
+	},
+	{
+		Name:   SetupFunnel,
+		Kind:   KindCounter,
+		Help:   "Customer setup progress: link_generated, setup_completed, setup_rejected, setup_permissions_removed",
+		Labels: []string{"stage"},
+	},
+	{
+		Name:   SSODeviceFlows,
+		Kind:   KindCounter,
+		Help:   "AWS SSO device authorizations by outcome: success, expired, cancelled, error",
+		Labels: []string{"outcome"},
+	},
+	{
+		Name:   SSODeviceFlowDuration,
+		Kind:   KindHistogram,
+		Help:   "Time from starting an AWS SSO device authorization to its outcome",
+		Labels: []string{"outcome"},
+	},
+	{
+		Name:   CredentialCacheHits,
+		Kind:   KindCounter,
+		Help:   "Credential lookups served from the awsauth cache (hit) or loaded (miss)",
+		Labels: []string{"result"},
+	},
+}
@@ -0,0 +1,118 @@
+// Package otel records crossaccount and awsauth metrics and traces with
+// OpenTelemetry
+package otel
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/scttfrdmn/aws-remote-access-patterns/pkg/telemetry"
+)
+
+// instrumentationName identifies the meter and tracer
+const instrumentationName = "github.com/scttfrdmn/aws-remote-access-patterns"
+
+// Recorder is a telemetry.Recorder backed by an OpenTelemetry meter and
+// tracer
+type Recorder struct {
+	tracer     trace.Tracer
+	counters   map[string]metric.Int64Counter
+	histograms map[string]metric.Float64Histogram
+}
+
+// Option customizes the recorder
+type Option func(*options)
+
+type options struct {
+	meterProvider  metric.MeterProvider
+	tracerProvider trace.TracerProvider
+}
+
+// WithMeterProvider sets the meter provider
+// The default is the global one
+func WithMeterProvider(provider metric.MeterProvider) Option {
+	return func(o *options) { o.meterProvider = provider }
+}
+
+// WithTracerProvider sets the tracer provider
+// The default is the global one
+func WithTracerProvider(provider trace.TracerProvider) Option {
+	return func(o *options) { o.tracerProvider = provider }
+}
+
+// New creates the instruments for telemetry.Metrics
+func New(opts ...Option) (*Recorder, error) {
+	o := &options{meterProvider: otel.GetMeterProvider(), tracerProvider: otel.GetTracerProvider()}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	meter := o.meterProvider.Meter(instrumentationName)
+	r := &Recorder{
+		tracer:     o.tracerProvider.Tracer(instrumentationName),
+		counters:   make(map[string]metric.Int64Counter),
+		histograms: make(map[string]metric.Float64Histogram),
+	}
+	for _, m := range telemetry.Metrics {
+		var err error
+		switch m.Kind {
+		case telemetry.KindCounter:
+			r.counters[m.Name], err = meter.Int64Counter(m.Name, metric.WithDescription(m.Help))
+		case telemetry.KindHistogram:
+			r.histograms[m.Name], err = meter.Float64Histogram(m.Name, metric.WithDescription(m.Help), metric.WithUnit("s"))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s: %w", m.Name, err)
+		}
+	}
+	return r, nil
+}
+
+// Count implements telemetry.Recorder
+func (r *Recorder) Count(ctx context.Context, name string, n int64, attrs ...telemetry.Attribute) {
+	if counter, ok := r.counters[name]; ok {
+		counter.Add(ctx, n, metric.WithAttributes(attributes(attrs)...))
+	}
+}
+
+// Duration implements telemetry.Recorder
+func (r *Recorder) Duration(ctx context.Context, name string, d time.Duration, attrs ...telemetry.Attribute) {
+	if histogram, ok := r.histograms[name]; ok {
+		histogram.Record(ctx, d.Seconds(), metric.WithAttributes(attributes(attrs)...))
+	}
+}
+
+// StartSpan implements telemetry.Recorder
+func (r *Recorder) StartSpan(ctx context.Context, name string, attrs ...telemetry.Attribute) (context.Context, telemetry.Span) {
+	ctx, span := r.tracer.Start(ctx, name, trace.WithAttributes(attributes(attrs)...))
+	return ctx, otelSpan{span}
+}
+
+// otelSpan ends an OpenTelemetry span with an error status on failure
+type otelSpan struct {
+	span trace.Span
+}
+
+func (s otelSpan) End(err error) {
+	if err != nil {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+	s.span.End()
+}
+
+// attributes converts telemetry attributes to OpenTelemetry ones
+func attributes(attrs []telemetry.Attribute) []attribute.KeyValue {
+	out := make([]attribute.KeyValue, len(attrs))
+	for i, a := range attrs {
+		out[i] = attribute.String(a.Key, a.Value)
+	}
+	return out
+}
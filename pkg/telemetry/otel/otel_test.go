@@ -0,0 +1,72 @@
+package otel
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/scttfrdmn/aws-remote-access-patterns/pkg/telemetry"
+)
+
+func TestRecorder(t *testing.T) {
+	ctx := context.Background()
+	reader := sdkmetric.NewManualReader()
+	spans := tracetest.NewSpanRecorder()
+	r, err := New(
+		WithMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))),
+		WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans))),
+	)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	ctx, parent := r.StartSpan(ctx, "crossaccount.AssumeRole", telemetry.String("customer_id", "customer-123"))
+	_, child := r.StartSpan(ctx, "sts.AssumeRole")
+	child.End(errors.New("access denied"))
+	parent.End(nil)
+
+	r.Count(ctx, telemetry.SessionCacheRequests, 3, telemetry.String("result", "hit"))
+	r.Count(ctx, "not_a_metric", 1)
+	r.Duration(ctx, telemetry.StorageDuration, 20*time.Millisecond, telemetry.String("store", "sessions"))
+
+	var data metricdata.ResourceMetrics
+	if err := reader.Collect(ctx, &data); err != nil {
+		t.Fatal(err)
+	}
+	metrics := make(map[string]metricdata.Metrics)
+	for _, scope := range data.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			metrics[m.Name] = m
+		}
+	}
+
+	sum, ok := metrics[telemetry.SessionCacheRequests].Data.(metricdata.Sum[int64])
+	if !ok || len(sum.DataPoints) != 1 || sum.DataPoints[0].Value != 3 {
+		t.Errorf("cache counter = %+v", metrics[telemetry.SessionCacheRequests].Data)
+	} else if v, _ := sum.DataPoints[0].Attributes.Value("result"); v != attribute.StringValue("hit") {
+		t.Errorf("cache counter attributes = %v", sum.DataPoints[0].Attributes)
+	}
+	histogram, ok := metrics[telemetry.StorageDuration].Data.(metricdata.Histogram[float64])
+	if !ok || len(histogram.DataPoints) != 1 || histogram.DataPoints[0].Sum != 0.02 || metrics[telemetry.StorageDuration].Unit != "s" {
+		t.Errorf("storage histogram = %+v", metrics[telemetry.StorageDuration])
+	}
+
+	ended := spans.Ended()
+	if len(ended) != 2 {
+		t.Fatalf("got %d spans, want 2", len(ended))
+	}
+	if ended[0].Name() != "sts.AssumeRole" || ended[0].Status().Code != codes.Error || ended[0].Parent().SpanID() != ended[1].SpanContext().SpanID() {
+		t.Errorf("child span = %s %+v", ended[0].Name(), ended[0].Status())
+	}
+	if ended[1].Status().Code == codes.Error {
+		t.Error("successful span should not be marked failed")
+	}
+}
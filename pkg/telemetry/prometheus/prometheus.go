@@ -0,0 +1,123 @@
+// Package prometheus records crossaccount and awsauth metrics with the
+// Prometheus client library. Prometheus has no traces, so spans are dropped
+package prometheus
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+
+	"github.com/scttfrdmn/aws-remote-access-patterns/pkg/telemetry"
+)
+
+// Recorder is a telemetry.Recorder backed by Prometheus collectors
+type Recorder struct {
+	counters   map[string]*prom.CounterVec
+	histograms map[string]*prom.HistogramVec
+	labels     map[string][]string
+}
+
+// Option customizes the recorder
+type Option func(*options)
+
+type options struct {
+	namespace string
+	buckets   []float64
+	omit      map[string]bool
+}
+
+// WithNamespace prefixes every metric name, e.g. "myservice"
+func WithNamespace(namespace string) Option {
+	return func(o *options) { o.namespace = namespace }
+}
+
+// WithBuckets sets the histogram buckets, in seconds
+// The default is prometheus.DefBuckets
+func WithBuckets(buckets []float64) Option {
+	return func(o *options) { o.buckets = buckets }
+}
+
+// WithoutLabels drops labels from every metric, e.g. "customer_id" when
+// there are too many customers for per-customer series
+func WithoutLabels(labels ...string) Option {
+	return func(o *options) {
+		for _, l := range labels {
+			o.omit[l] = true
+		}
+	}
+}
+
+// New creates the collectors for telemetry.Metrics and registers them with
+// reg, such as prometheus.DefaultRegisterer
+func New(reg prom.Registerer, opts ...Option) (*Recorder, error) {
+	o := &options{buckets: prom.DefBuckets, omit: make(map[string]bool)}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	r := &Recorder{
+		counters:   make(map[string]*prom.CounterVec),
+		histograms: make(map[string]*prom.HistogramVec),
+		labels:     make(map[string][]string),
+	}
+	for _, m := range telemetry.Metrics {
+		var labels []string
+		for _, l := range m.Labels {
+			if !o.omit[l] {
+				labels = append(labels, l)
+			}
+		}
+		r.labels[m.Name] = labels
+
+		var collector prom.Collector
+		switch m.Kind {
+		case telemetry.KindCounter:
+			vec := prom.NewCounterVec(prom.CounterOpts{Namespace: o.namespace, Name: m.Name, Help: m.Help}, labels)
+			r.counters[m.Name] = vec
+			collector = vec
+		case telemetry.KindHistogram:
+			vec := prom.NewHistogramVec(prom.HistogramOpts{Namespace: o.namespace, Name: m.Name, Help: m.Help, Buckets: o.buckets}, labels)
+			r.histograms[m.Name] = vec
+			collector = vec
+		}
+		if err := reg.Register(collector); err != nil {
+			return nil, fmt.Errorf("failed to register %s: %w", m.Name, err)
+		}
+	}
+	return r, nil
+}
+
+// Count implements telemetry.Recorder
+func (r *Recorder) Count(ctx context.Context, name string, n int64, attrs ...telemetry.Attribute) {
+	if vec, ok := r.counters[name]; ok {
+		vec.With(r.labelValues(name, attrs)).Add(float64(n))
+	}
+}
+
+// Duration implements telemetry.Recorder
+func (r *Recorder) Duration(ctx context.Context, name string, d time.Duration, attrs ...telemetry.Attribute) {
+	if vec, ok := r.histograms[name]; ok {
+		vec.With(r.labelValues(name, attrs)).Observe(d.Seconds())
+	}
+}
+
+// StartSpan implements telemetry.Recorder. Spans aren't recorded
+func (r *Recorder) StartSpan(ctx context.Context, name string, attrs ...telemetry.Attribute) (context.Context, telemetry.Span) {
+	return telemetry.Nop().StartSpan(ctx, name)
+}
+
+// labelValues maps attrs onto the metric's labels, ignoring extra attributes
+func (r *Recorder) labelValues(name string, attrs []telemetry.Attribute) prom.Labels {
+	labels := make(prom.Labels, len(r.labels[name]))
+	for _, l := range r.labels[name] {
+		labels[l] = ""
+	}
+	for _, a := range attrs {
+		if _, ok := labels[a.Key]; ok {
+			labels[a.Key] = a.Value
+		}
+	}
+	return labels
+}
@@ -0,0 +1,80 @@
+package prometheus
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/scttfrdmn/aws-remote-access-patterns/pkg/telemetry"
+)
+
+func TestRecorder(t *testing.T) {
+	ctx := context.Background()
+	reg := prom.NewPedanticRegistry()
+	r, err := New(reg, WithNamespace("svc"))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	r.Count(ctx, telemetry.AssumeRoleErrors, 2,
+		telemetry.String("customer_id", "customer-123"),
+		telemetry.String("error_class", "throttled"),
+		telemetry.String("unknown", "ignored"))
+	r.Count(ctx, telemetry.SetupFunnel, 1) // Missing labels are empty
+	r.Count(ctx, "not_a_metric", 1)
+	r.Duration(ctx, telemetry.AssumeRoleDuration, 250*time.Millisecond, telemetry.String("customer_id", "customer-123"), telemetry.String("outcome", "success"))
+
+	if got := testutil.ToFloat64(r.counters[telemetry.AssumeRoleErrors].WithLabelValues("customer-123", "throttled")); got != 2 {
+		t.Errorf("errors counter = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(r.counters[telemetry.SetupFunnel].WithLabelValues("")); got != 1 {
+		t.Errorf("funnel counter = %v, want 1", got)
+	}
+
+	want := `
+# HELP svc_crossaccount_assume_role_duration_seconds Latency of sts:AssumeRole calls on customer roles
+# TYPE svc_crossaccount_assume_role_duration_seconds histogram
+svc_crossaccount_assume_role_duration_seconds_bucket{customer_id="customer-123",outcome="success",le="0.1"} 0
+svc_crossaccount_assume_role_duration_seconds_bucket{customer_id="customer-123",outcome="success",le="0.5"} 1
+svc_crossaccount_assume_role_duration_seconds_bucket{customer_id="customer-123",outcome="success",le="+Inf"} 1
+svc_crossaccount_assume_role_duration_seconds_sum{customer_id="customer-123",outcome="success"} 0.25
+svc_crossaccount_assume_role_duration_seconds_count{customer_id="customer-123",outcome="success"} 1
+`
+	reg2 := prom.NewPedanticRegistry()
+	r2, err := New(reg2, WithNamespace("svc"), WithBuckets([]float64{0.1, 0.5}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2.Duration(ctx, telemetry.AssumeRoleDuration, 250*time.Millisecond, telemetry.String("customer_id", "customer-123"), telemetry.String("outcome", "success"))
+	if err := testutil.GatherAndCompare(reg2, strings.NewReader(want), "svc_crossaccount_assume_role_duration_seconds"); err != nil {
+		t.Error(err)
+	}
+
+	// Spans are dropped
+	_, span := r.StartSpan(ctx, "crossaccount.AssumeRole")
+	span.End(nil)
+
+	if _, err := New(reg, WithNamespace("svc")); err == nil {
+		t.Error("registering twice should fail")
+	}
+}
+
+func TestWithoutLabels(t *testing.T) {
+	ctx := context.Background()
+	reg := prom.NewPedanticRegistry()
+	r, err := New(reg, WithoutLabels("customer_id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Count(ctx, telemetry.AssumeRoleErrors, 1, telemetry.String("customer_id", "customer-1"), telemetry.String("error_class", "access_denied"))
+	r.Count(ctx, telemetry.AssumeRoleErrors, 1, telemetry.String("customer_id", "customer-2"), telemetry.String("error_class", "access_denied"))
+
+	if got := testutil.ToFloat64(r.counters[telemetry.AssumeRoleErrors].WithLabelValues("access_denied")); got != 2 {
+		t.Errorf("errors counter = %v, want 2 across customers", got)
+	}
+}
@@ -0,0 +1,71 @@
+// Package telemetry is the instrumentation interface of the crossaccount and
+// awsauth packages. It has no exporter dependencies: pass a Recorder from the
+// prometheus or otel subpackage, or your own, to their WithTelemetry options
+package telemetry
+
+import (
+	"context"
+	"time"
+)
+
+// Attribute is a metric label or span attribute
+type Attribute struct {
+	Key   string
+	Value string
+}
+
+// String returns an attribute
+func String(key, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Recorder receives measurements and trace spans. Implementations must be
+// safe for concurrent use and should ignore metric names they don't know
+type Recorder interface {
+	// Count adds n to the counter name
+	Count(ctx context.Context, name string, n int64, attrs ...Attribute)
+
+	// Duration records d in the histogram name
+	Duration(ctx context.Context, name string, d time.Duration, attrs ...Attribute)
+
+	// StartSpan starts a span as a child of any span in ctx. The returned
+	// Span must be ended exactly once
+	StartSpan(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+}
+
+// Span is an in-progress trace span
+type Span interface {
+	// End finishes the span, marking it failed if err is not nil
+	End(err error)
+}
+
+// Nop returns a Recorder that discards everything
+func Nop() Recorder {
+	return nopRecorder{}
+}
+
+type nopRecorder struct{}
+
+func (nopRecorder) Count(context.Context, string, int64, ...Attribute)            {}
+func (nopRecorder) Duration(context.Context, string, time.Duration, ...Attribute) {}
+func (nopRecorder) StartSpan(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+type nopSpan struct{}
+
+func (nopSpan) End(error) {}
+
+// Outcome returns the outcome attribute value for err
+func Outcome(err error) string {
+	if err != nil {
+		return OutcomeError
+	}
+	return OutcomeSuccess
+}
+
+// Common attribute values
+const (
+	OutcomeSuccess = "success"
+	OutcomeError   = "error"
+)